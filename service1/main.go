@@ -167,13 +167,8 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	message.Pipeline.Step1Complete = time.Now().Format(time.RFC3339Nano)
 	processingSpan.Finish()
 
-	// SLI Metrics for SLO tracking
+	// SLI Metrics for SLO tracking, each request is counted once
 	statsdClient.Incr("sli.requests.total", []string{"service:service1", "endpoint:/send-message"}, 1)
-	if !injectError {
-		statsdClient.Incr("sli.requests.success", []string{"service:service1", "endpoint:/send-message"}, 1)
-	} else {
-		statsdClient.Incr("sli.requests.error", []string{"service:service1", "endpoint:/send-message", "error_type:invalid_data"}, 1)
-	}
 	if step1Duration <= 50*time.Millisecond {
 		statsdClient.Incr("sli.latency.under_50ms", []string{"service:service1"}, 1)
 	}
@@ -207,7 +202,6 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		}).WithError(err).Error("Failed to send message to Service2")
 
 		// SLI Error Metrics
-		statsdClient.Incr("sli.requests.total", []string{"service:service1", "endpoint:/send-message"}, 1)
 		statsdClient.Incr("sli.requests.error", []string{"service:service1", "endpoint:/send-message", "error_type:sqs_send_failure"}, 1)
 
 		// Classify error type for metrics
@@ -221,6 +215,13 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Success is only known once the message is on the queue
+	if !injectError {
+		statsdClient.Incr("sli.requests.success", []string{"service:service1", "endpoint:/send-message"}, 1)
+	} else {
+		statsdClient.Incr("sli.requests.error", []string{"service:service1", "endpoint:/send-message", "error_type:invalid_data"}, 1)
+	}
+
 	log.WithFields(log.Fields{
 		"dd.trace_id":    pipelineSpan.Context().TraceIDLower(),
 		"correlation.id": correlationID,
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds, matching metricKind in internal/pipeline/metrics.go
+const (
+	kindCount  = "count"
+	kindTiming = "timing"
+	kindGauge  = "gauge"
+)
+
+// Tags every MetricDef submission carries (see pipeline.NewMetrics), plus host added by the agent
+var baseTagKeys = []string{"service", "shard", "version", "env", "host"}
+
+// metricInfo is what the generator knows about a metric name
+type metricInfo struct {
+	Name        string
+	Kind        string
+	Description string
+	// Tags are the declared tag keys; nil for metrics sent with literal names, whose tags are not checked
+	Tags []string
+	// Services that emit the metric
+	Services []string
+}
+
+type catalogue struct {
+	metrics map[string]*metricInfo
+	// shared are the MetricDef declarations of the shared package, which every service may reference
+	shared map[string]*metricInfo
+}
+
+// loadCatalogue parses the Go sources of the shared package, when there is one, and of each
+// service directory. Metrics come from two places: MetricDef literals (the metrics facade)
+// referenced outside their declaration, and string literals passed to statsdClient/telemetry
+// Incr, Timing, Gauge and friends. Metrics the shared package emits itself are listed under
+// its name, as it runs in every service that imports it.
+func loadCatalogue(shared string, dirs []string) (*catalogue, error) {
+	c := &catalogue{metrics: make(map[string]*metricInfo), shared: make(map[string]*metricInfo)}
+	if shared != "" {
+		fset, files, err := parseDir(shared)
+		if err != nil {
+			return nil, err
+		}
+		declared := make(map[*ast.Ident]bool)
+		c.shared = declaredMetrics(fset, files, declared)
+		c.addEmitted(filepath.Base(filepath.Clean(shared)), files, c.shared, declared)
+	}
+	for _, dir := range dirs {
+		if err := c.loadService(dir); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *catalogue) loadService(dir string) error {
+	fset, files, err := parseDir(dir)
+	if err != nil {
+		return err
+	}
+	declared := make(map[*ast.Ident]bool)
+	defs := declaredMetrics(fset, files, declared)
+	for name, info := range c.shared {
+		defs[name] = info
+	}
+	c.addEmitted(filepath.Base(filepath.Clean(dir)), files, defs, declared)
+	return nil
+}
+
+// parseDir parses the non-test Go files of dir
+func parseDir(dir string) (*token.FileSet, []*ast.File, error) {
+	fset := token.NewFileSet()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		files = append(files, f)
+	}
+	return fset, files, nil
+}
+
+// declaredMetrics collects the MetricDef declarations of files:
+// var MetricX = MetricDef{Name: ..., Kind: ..., Tags: ...}. The declaring identifiers are
+// added to declared, so they do not count as references.
+func declaredMetrics(fset *token.FileSet, files []*ast.File, declared map[*ast.Ident]bool) map[string]*metricInfo {
+	defs := make(map[string]*metricInfo)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			for i, name := range spec.Names {
+				if i >= len(spec.Values) {
+					break
+				}
+				lit, ok := spec.Values[i].(*ast.CompositeLit)
+				if !ok || !isIdent(lit.Type, "MetricDef") {
+					continue
+				}
+				info, err := parseMetricDef(lit)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "warning: %s: %s: %v\n", fset.Position(lit.Pos()), name.Name, err)
+					continue
+				}
+				defs[name.Name] = info
+				declared[name] = true
+			}
+			return true
+		})
+	}
+	return defs
+}
+
+// addEmitted records service as emitting the metrics of defs that files reference, and the
+// literal metric names they submit
+func (c *catalogue) addEmitted(service string, files []*ast.File, defs map[string]*metricInfo, declared map[*ast.Ident]bool) {
+	emitted := make(map[string]*metricInfo)
+	for _, f := range files {
+		// The catalogue slice only lists definitions, it does not emit them
+		catalogueList := make(map[ast.Node]bool)
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			for _, s := range gen.Specs {
+				if vs, ok := s.(*ast.ValueSpec); ok && len(vs.Names) == 1 && vs.Names[0].Name == "metricDefinitions" {
+					catalogueList[vs] = true
+				}
+			}
+		}
+
+		ast.Inspect(f, func(n ast.Node) bool {
+			if catalogueList[n] {
+				return false
+			}
+			switch node := n.(type) {
+			case *ast.Ident:
+				if info, ok := defs[node.Name]; ok && !declared[node] {
+					emitted[info.Name] = info
+				}
+			case *ast.CallExpr:
+				if info := literalMetric(node); info != nil {
+					if _, ok := emitted[info.Name]; !ok {
+						emitted[info.Name] = info
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	for name, info := range emitted {
+		existing, ok := c.metrics[name]
+		if !ok {
+			copied := *info
+			copied.Services = nil
+			existing = &copied
+			c.metrics[name] = existing
+		}
+		if existing.Tags == nil && info.Tags != nil {
+			existing.Tags = info.Tags
+			existing.Description = info.Description
+		}
+		existing.Services = append(existing.Services, service)
+	}
+}
+
+func parseMetricDef(lit *ast.CompositeLit) (*metricInfo, error) {
+	info := &metricInfo{Tags: []string{}}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			return nil, fmt.Errorf("MetricDef must use keyed fields")
+		}
+		key, _ := kv.Key.(*ast.Ident)
+		if key == nil {
+			continue
+		}
+		switch key.Name {
+		case "Name":
+			info.Name = stringLit(kv.Value)
+		case "Description":
+			info.Description = stringLit(kv.Value)
+		case "Kind":
+			if id, ok := kv.Value.(*ast.Ident); ok {
+				info.Kind = strings.ToLower(strings.TrimPrefix(id.Name, "metric"))
+			}
+		case "Tags":
+			if tags, ok := kv.Value.(*ast.CompositeLit); ok {
+				for _, t := range tags.Elts {
+					info.Tags = append(info.Tags, stringLit(t))
+				}
+			}
+		}
+	}
+	if info.Name == "" || info.Kind == "" {
+		return nil, fmt.Errorf("MetricDef needs a literal Name and Kind")
+	}
+	return info, nil
+}
+
+// literalMetric recognises statsdClient.Incr("name", ...) and similar calls with a literal name
+func literalMetric(call *ast.CallExpr) *metricInfo {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || len(call.Args) == 0 {
+		return nil
+	}
+	// statsdClient.Incr, or pipeline.Telemetry.Incr in a service
+	var recv string
+	switch x := sel.X.(type) {
+	case *ast.Ident:
+		recv = x.Name
+	case *ast.SelectorExpr:
+		recv = x.Sel.Name
+	}
+	if recv != "statsdClient" && recv != "Telemetry" {
+		return nil
+	}
+	name := stringLit(call.Args[0])
+	if name == "" {
+		return nil
+	}
+	var kind string
+	switch sel.Sel.Name {
+	case "Incr", "Decr", "Count":
+		kind = kindCount
+	case "Timing", "TimeInMilliseconds", "Histogram", "Distribution":
+		kind = kindTiming
+	case "Gauge":
+		kind = kindGauge
+	default:
+		return nil
+	}
+	return &metricInfo{Name: name, Kind: kind}
+}
+
+func stringLit(e ast.Expr) string {
+	lit, ok := e.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return ""
+	}
+	s, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+// timingSuffixes are the series DogStatsD derives from a timing
+var timingSuffixes = []string{"95percentile", "avg", "median", "max", "count"}
+
+// resolve finds the metric a query name refers to, accepting DogStatsD timing suffixes
+func (c *catalogue) resolve(name string) (*metricInfo, error) {
+	if info, ok := c.metrics[name]; ok {
+		if info.Kind == kindTiming {
+			return nil, fmt.Errorf("timing %s must be queried with a suffix such as .95percentile or .avg", name)
+		}
+		return info, nil
+	}
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, suffix := name[:i], name[i+1:]
+		for _, s := range timingSuffixes {
+			if suffix != s {
+				continue
+			}
+			if info, ok := c.metrics[base]; ok {
+				if info.Kind != kindTiming {
+					return nil, fmt.Errorf("%s is a %s, .%s only exists for timings", base, info.Kind, suffix)
+				}
+				return info, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no service emits %s", name)
+}
+
+func (c *catalogue) names() []string {
+	names := make([]string, 0, len(c.metrics))
+	for name := range c.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// servicesEmitting lists the services that emit name, sorted
+func (c *catalogue) servicesEmitting(name string) []string {
+	info, ok := c.metrics[name]
+	if !ok {
+		return nil
+	}
+	services := append([]string(nil), info.Services...)
+	sort.Strings(services)
+	return services
+}
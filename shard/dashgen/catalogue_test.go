@@ -0,0 +1,195 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const sharedSource = `package pipeline
+
+type MetricDef struct {
+	Name        string
+	Kind        metricKind
+	Description string
+	Tags        []string
+}
+
+var MetricRequests = MetricDef{Name: "sli.requests.total", Kind: metricCount, Description: "Requests", Tags: []string{"endpoint", "outcome"}}
+var MetricStep = MetricDef{Name: "step.duration", Kind: metricTiming, Description: "Step time"}
+var MetricUnused = MetricDef{Name: "unused.total", Kind: metricCount}
+var MetricBroken = MetricDef{Name: name(), Kind: metricCount}
+
+var metricDefinitions = []MetricDef{MetricRequests, MetricStep, MetricUnused}
+
+func emit() { Metrics.Timing(MetricStep, 0) }
+`
+
+const serviceSource = `package main
+
+import "pipeline-shard/internal/pipeline"
+
+func handle() {
+	pipeline.Metrics.Incr(pipeline.MetricRequests)
+	pipeline.Telemetry.Gauge("queue.depth", 1, nil)
+	statsdClient.Incr("legacy.total", nil, 1)
+	other.Incr("ignored.total", nil, 1)
+}
+`
+
+// writePackage writes one Go file, and a test file the catalogue must skip, into dir/name
+func writePackage(t *testing.T, dir, name, source string) string {
+	t.Helper()
+	pkg := filepath.Join(dir, name)
+	if err := os.MkdirAll(pkg, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkg, name+".go"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	test := "package main\n\nfunc init() { statsdClient.Incr(\"test.only\", nil, 1) }\n"
+	if err := os.WriteFile(filepath.Join(pkg, name+"_test.go"), []byte(test), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestLoadCatalogue(t *testing.T) {
+	dir := t.TempDir()
+	shared := writePackage(t, dir, "pipeline", sharedSource)
+	service := writePackage(t, dir, "service1", serviceSource)
+
+	cat, err := loadCatalogue(shared, []string{service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		kind     string
+		tags     []string
+		services []string
+	}{
+		{"sli.requests.total", kindCount, []string{"endpoint", "outcome"}, []string{"service1"}},
+		{"step.duration", kindTiming, []string{}, []string{"pipeline"}},
+		{"queue.depth", kindGauge, nil, []string{"service1"}},
+		{"legacy.total", kindCount, nil, []string{"service1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, ok := cat.metrics[tt.name]
+			if !ok {
+				t.Fatalf("%s is not in the catalogue", tt.name)
+			}
+			if info.Kind != tt.kind {
+				t.Errorf("kind = %s, want %s", info.Kind, tt.kind)
+			}
+			if !slices.Equal(info.Tags, tt.tags) || (info.Tags == nil) != (tt.tags == nil) {
+				t.Errorf("tags = %#v, want %#v", info.Tags, tt.tags)
+			}
+			if got := cat.servicesEmitting(tt.name); !slices.Equal(got, tt.services) {
+				t.Errorf("services = %v, want %v", got, tt.services)
+			}
+		})
+	}
+	// Declared but only listed in metricDefinitions, emitted by an unknown receiver, or only in tests
+	for _, name := range []string{"unused.total", "ignored.total", "test.only"} {
+		if _, ok := cat.metrics[name]; ok {
+			t.Errorf("%s is in the catalogue, want it left out", name)
+		}
+	}
+}
+
+func TestLoadCatalogueFailsWithoutGoFiles(t *testing.T) {
+	if _, err := loadCatalogue("", []string{t.TempDir()}); err == nil {
+		t.Error("loadCatalogue succeeded on an empty directory")
+	}
+}
+
+func TestParseMetricDef(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    *metricInfo
+		wantErr bool
+	}{
+		{
+			name: "all fields",
+			expr: `MetricDef{Name: "a.total", Kind: metricCount, Description: "A", Tags: []string{"x", "y"}}`,
+			want: &metricInfo{Name: "a.total", Kind: kindCount, Description: "A", Tags: []string{"x", "y"}},
+		},
+		{
+			name: "no tags",
+			expr: `MetricDef{Name: "b.duration", Kind: metricTiming}`,
+			want: &metricInfo{Name: "b.duration", Kind: kindTiming, Tags: []string{}},
+		},
+		{
+			name:    "unkeyed fields",
+			expr:    `MetricDef{"c.total", metricCount, "", nil}`,
+			wantErr: true,
+		},
+		{
+			name:    "computed name",
+			expr:    `MetricDef{Name: prefix + "d", Kind: metricGauge}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing kind",
+			expr:    `MetricDef{Name: "e.total"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMetricDef(parseExpr(t, tt.expr).(*ast.CompositeLit))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseMetricDef = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want.Name || got.Kind != tt.want.Kind || got.Description != tt.want.Description || !slices.Equal(got.Tags, tt.want.Tags) {
+				t.Errorf("parseMetricDef = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiteralMetric(t *testing.T) {
+	tests := []struct {
+		expr string
+		want *metricInfo
+	}{
+		{`statsdClient.Incr("a.total", nil, 1)`, &metricInfo{Name: "a.total", Kind: kindCount}},
+		{`statsdClient.Distribution("a.duration", 1, nil, 1)`, &metricInfo{Name: "a.duration", Kind: kindTiming}},
+		{`pipeline.Telemetry.Gauge("a.depth", 1, nil)`, &metricInfo{Name: "a.depth", Kind: kindGauge}},
+		{`Telemetry.Timing("a.time", 0, nil)`, &metricInfo{Name: "a.time", Kind: kindTiming}},
+		{`statsdClient.Incr(name, nil, 1)`, nil},
+		{`statsdClient.Flush()`, nil},
+		{`statsdClient.Event("a.event")`, nil},
+		{`client.Incr("a.total", nil, 1)`, nil},
+		{`Incr("a.total")`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := literalMetric(parseExpr(t, tt.expr).(*ast.CallExpr))
+			if (got == nil) != (tt.want == nil) || (got != nil && (got.Name != tt.want.Name || got.Kind != tt.want.Kind)) {
+				t.Errorf("literalMetric = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func parseExpr(t *testing.T, src string) ast.Expr {
+	t.Helper()
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr
+}
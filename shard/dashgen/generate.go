@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// sloDefinition mirrors the entries of slo.json read by the services' SLO engine
+type sloDefinition struct {
+	Name        string  `json:"name"`
+	Service     string  `json:"service"`
+	Type        string  `json:"type"`
+	Source      string  `json:"source"`
+	Scope       string  `json:"scope,omitempty"`
+	Objective   float64 `json:"objective"`
+	Threshold   string  `json:"threshold,omitempty"`
+	Window      string  `json:"window"`
+	Description string  `json:"description,omitempty"`
+}
+
+func loadSLOs(path string) ([]sloDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var cfg struct {
+		SLOs []sloDefinition `json:"slos"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return cfg.SLOs, nil
+}
+
+// sliSource describes the metrics behind an SLO source in the services' outcome middleware
+type sliSource struct {
+	total    string
+	latency  string
+	scopeTag string
+}
+
+var sliSources = map[string]sliSource{
+	"requests":   {total: "sli.requests.total", latency: "sli.requests.latency", scopeTag: "endpoint"},
+	"processing": {total: "sli.processing.total", latency: "sli.processing.latency", scopeTag: "operation"},
+}
+
+// latencyBucketLabels are the le values of the cumulative latency counters
+var latencyBucketLabels = map[time.Duration]string{
+	50 * time.Millisecond:  "50ms",
+	100 * time.Millisecond: "100ms",
+	300 * time.Millisecond: "300ms",
+	time.Second:            "1s",
+}
+
+// pipelineLatencyMetrics are the end-to-end threshold counters emitted by service3
+var pipelineLatencyMetrics = map[time.Duration]string{
+	300 * time.Millisecond: "sli.pipeline.under_300ms",
+	time.Second:            "sli.pipeline.under_1s",
+}
+
+// sloQueries returns the good and total event queries of a Datadog metric SLO
+func sloQueries(def sloDefinition) (numerator, denominator string, err error) {
+	filter := "service:" + def.Service
+
+	if def.Source == "pipeline" {
+		if def.Type != "latency" {
+			return "", "", fmt.Errorf("pipeline SLOs can only be latency objectives")
+		}
+		threshold, err := time.ParseDuration(def.Threshold)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid threshold %q", def.Threshold)
+		}
+		metric, ok := pipelineLatencyMetrics[threshold]
+		if !ok {
+			return "", "", fmt.Errorf("no end-to-end counter for threshold %s (have 300ms, 1s)", def.Threshold)
+		}
+		return fmt.Sprintf("sum:%s{%s}.as_count()", metric, filter),
+			fmt.Sprintf("sum:sli.pipeline.total{%s}.as_count()", filter), nil
+	}
+
+	source, ok := sliSources[def.Source]
+	if !ok {
+		return "", "", fmt.Errorf("unknown source %q", def.Source)
+	}
+	if def.Scope != "" {
+		filter += "," + source.scopeTag + ":" + def.Scope
+	}
+
+	switch def.Type {
+	case "availability":
+		// Client and business errors do not count, as in the in-process engine
+		return fmt.Sprintf("sum:%s{%s,outcome:success}.as_count()", source.total, filter),
+			fmt.Sprintf("sum:%s{%s,!outcome:client_error,!outcome:business_error}.as_count()", source.total, filter), nil
+	case "latency":
+		threshold, err := time.ParseDuration(def.Threshold)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid threshold %q", def.Threshold)
+		}
+		le, ok := latencyBucketLabels[threshold]
+		if !ok {
+			return "", "", fmt.Errorf("threshold %s is not a latency bucket (have 50ms, 100ms, 300ms, 1s)", def.Threshold)
+		}
+		return fmt.Sprintf("sum:%s{%s,le:%s}.as_count()", source.latency, filter, le),
+			fmt.Sprintf("sum:%s{%s,le:inf}.as_count()", source.latency, filter), nil
+	default:
+		return "", "", fmt.Errorf("unknown type %q", def.Type)
+	}
+}
+
+// sloObject is a Datadog metric SLO (POST /api/v1/slo). Datadog only supports
+// 7d/30d/90d timeframes, so the in-process window is not carried over.
+func sloObject(def sloDefinition) (map[string]interface{}, error) {
+	numerator, denominator, err := sloQueries(def)
+	if err != nil {
+		return nil, err
+	}
+	target := def.Objective * 100
+	return map[string]interface{}{
+		"name":        "Pipeline " + def.Name,
+		"type":        "metric",
+		"description": def.Description,
+		"query": map[string]string{
+			"numerator":   numerator,
+			"denominator": denominator,
+		},
+		"thresholds": []map[string]interface{}{
+			{"timeframe": "7d", "target": target},
+			{"timeframe": "30d", "target": target},
+		},
+		"tags": []string{"env:pipeline", "service:" + def.Service, "slo:" + def.Name, "managed-by:dashgen"},
+	}, nil
+}
+
+// burnRateMonitors alert on the slo.burn_rate gauges emitted by the services. The long
+// window must stay above the threshold for the length of the short window, which is the
+// multi-window condition the services use for their status. The thresholds are derived
+// from the SLO's window as the services do: 2% of its budget spent in 1h, 5% in 6h.
+func burnRateMonitors(def sloDefinition) ([]map[string]interface{}, error) {
+	window, err := time.ParseDuration(def.Window)
+	if err != nil || window < time.Minute {
+		return nil, fmt.Errorf("invalid window %q", def.Window)
+	}
+	alerts := []struct {
+		kind, long, short string
+		threshold         float64
+		priority          int
+	}{
+		{"fast", "1h", "5m", 0.02 * float64(window) / float64(time.Hour), 1},
+		{"slow", "6h", "30m", 0.05 * float64(window) / float64(6*time.Hour), 3},
+	}
+	var monitors []map[string]interface{}
+	for _, a := range alerts {
+		monitors = append(monitors, map[string]interface{}{
+			"name":  fmt.Sprintf("[pipeline] %s %s burn", def.Name, a.kind),
+			"type":  "query alert",
+			"query": fmt.Sprintf("min(last_%s):min:slo.burn_rate{slo:%s,window:%s} by {shard} > %g", a.short, def.Name, a.long, a.threshold),
+			"message": fmt.Sprintf("%s is burning its error budget at more than %gx over %s (sustained %s) on shard {{shard.name}}.\n"+
+				"Check `GET /slo` on %s.", def.Name, a.threshold, a.long, a.short, def.Service),
+			"tags":     []string{"env:pipeline", "service:" + def.Service, "slo:" + def.Name, "managed-by:dashgen"},
+			"priority": a.priority,
+			"options": map[string]interface{}{
+				"thresholds":          map[string]float64{"critical": a.threshold},
+				"notify_no_data":      false,
+				"require_full_window": false,
+				"include_tags":        true,
+			},
+		})
+	}
+	return monitors, nil
+}
+
+func metricsQuery(name, query string) map[string]interface{} {
+	return map[string]interface{}{"data_source": "metrics", "name": name, "query": query}
+}
+
+func timeseriesWidget(title string, queries ...string) map[string]interface{} {
+	var qs []interface{}
+	var formulas []interface{}
+	for i, q := range queries {
+		name := fmt.Sprintf("query%d", i+1)
+		qs = append(qs, metricsQuery(name, q))
+		formulas = append(formulas, map[string]string{"formula": name})
+	}
+	return map[string]interface{}{
+		"title":       title,
+		"type":        "timeseries",
+		"show_legend": true,
+		"requests": []interface{}{map[string]interface{}{
+			"queries":         qs,
+			"formulas":        formulas,
+			"response_format": "timeseries",
+			"display_type":    "line",
+		}},
+	}
+}
+
+func queryValueWidget(title, query string, precision int) map[string]interface{} {
+	return map[string]interface{}{
+		"title":     title,
+		"type":      "query_value",
+		"precision": precision,
+		"requests": []interface{}{map[string]interface{}{
+			"queries":         []interface{}{metricsQuery("query1", query)},
+			"formulas":        []interface{}{map[string]string{"formula": "query1"}},
+			"response_format": "scalar",
+		}},
+	}
+}
+
+type placedWidget struct {
+	definition map[string]interface{}
+	width      int
+	height     int
+}
+
+// groupWidget lays children out left to right on a 12 column grid
+func groupWidget(title string, children []placedWidget) map[string]interface{} {
+	var widgets []interface{}
+	x, y, rowHeight := 0, 0, 0
+	for _, child := range children {
+		if x+child.width > 12 {
+			x, y, rowHeight = 0, y+rowHeight, 0
+		}
+		widgets = append(widgets, map[string]interface{}{
+			"definition": child.definition,
+			"layout":     map[string]int{"x": x, "y": y, "width": child.width, "height": child.height},
+		})
+		x += child.width
+		if child.height > rowHeight {
+			rowHeight = child.height
+		}
+	}
+	return map[string]interface{}{
+		"title":       title,
+		"type":        "group",
+		"layout_type": "ordered",
+		"widgets":     widgets,
+		"height":      y + rowHeight,
+	}
+}
+
+// generatedGroups derives one group per service with SLOs (SLI outcome breakdown and
+// latency) and one group per SLO (in-process SLI, error budget and burn rates)
+func generatedGroups(slos []sloDefinition) []map[string]interface{} {
+	sources := make(map[string]map[string]bool)
+	var services []string
+	for _, def := range slos {
+		if _, ok := sources[def.Service]; !ok {
+			sources[def.Service] = make(map[string]bool)
+			services = append(services, def.Service)
+		}
+		sources[def.Service][def.Source] = true
+	}
+	sort.Strings(services)
+
+	var groups []map[string]interface{}
+	for _, service := range services {
+		var children []placedWidget
+		if sources[service]["requests"] {
+			children = append(children,
+				placedWidget{timeseriesWidget("Requests by outcome",
+					fmt.Sprintf("sum:sli.requests.total{service:%s} by {outcome}.as_count()", service)), 6, 3},
+				placedWidget{timeseriesWidget("Response time p95 by endpoint",
+					fmt.Sprintf("avg:sli.response_time.95percentile{service:%s} by {endpoint}", service)), 6, 3})
+		}
+		if sources[service]["processing"] {
+			children = append(children,
+				placedWidget{timeseriesWidget("Messages by outcome",
+					fmt.Sprintf("sum:sli.processing.total{service:%s} by {outcome}.as_count()", service)), 6, 3},
+				placedWidget{timeseriesWidget("Processing time p95",
+					fmt.Sprintf("avg:sli.processing_time.95percentile{service:%s} by {operation}", service)), 6, 3},
+				// Queue time comes from SQS timestamps, so a growing gap to processing time is backlog
+				placedWidget{timeseriesWidget("Queue time vs processing time p95",
+					fmt.Sprintf("avg:sqs.message.queue_time.95percentile{service:%s}", service),
+					fmt.Sprintf("avg:sqs.message.age.95percentile{service:%s}", service),
+					fmt.Sprintf("avg:sli.processing_time.95percentile{service:%s}", service)), 12, 3})
+		}
+		if sources[service]["pipeline"] {
+			children = append(children,
+				placedWidget{timeseriesWidget("End-to-end duration p95 by shard",
+					fmt.Sprintf("avg:sli.pipeline.duration.95percentile{service:%s,step:end_to_end} by {shard}", service)), 12, 3})
+		}
+		groups = append(groups, groupWidget(service+" SLIs", children))
+	}
+
+	for _, def := range slos {
+		groups = append(groups, groupWidget("SLO "+def.Name, []placedWidget{
+			{queryValueWidget("SLI", fmt.Sprintf("avg:slo.sli{slo:%s}", def.Name), 4), 3, 2},
+			{queryValueWidget("Error budget remaining", fmt.Sprintf("min:slo.error_budget.remaining{slo:%s}", def.Name), 2), 3, 2},
+			{timeseriesWidget("Burn rate by window", fmt.Sprintf("max:slo.burn_rate{slo:%s} by {window}", def.Name)), 6, 2},
+		}))
+	}
+	return groups
+}
+
+// buildDashboard appends the generated groups below the hand-written widgets of the spec
+func buildDashboard(spec map[string]interface{}, slos []sloDefinition) map[string]interface{} {
+	dashboard := make(map[string]interface{}, len(spec))
+	for k, v := range spec {
+		dashboard[k] = v
+	}
+	widgets, _ := spec["widgets"].([]interface{})
+	widgets = append([]interface{}(nil), widgets...)
+
+	bottom := 0
+	for _, w := range widgets {
+		if layout, ok := w.(map[string]interface{})["layout"].(map[string]interface{}); ok {
+			y, _ := layout["y"].(float64)
+			h, _ := layout["height"].(float64)
+			if end := int(y + h); end > bottom {
+				bottom = end
+			}
+		}
+	}
+
+	for _, group := range generatedGroups(slos) {
+		height := group["height"].(int) + 1
+		delete(group, "height")
+		widgets = append(widgets, map[string]interface{}{
+			"definition": group,
+			"layout":     map[string]int{"x": 0, "y": bottom, "width": 12, "height": height},
+		})
+		bottom += height
+	}
+	dashboard["widgets"] = widgets
+	return dashboard
+}
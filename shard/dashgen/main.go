@@ -0,0 +1,161 @@
+// dashgen builds the Datadog dashboard, SLOs and monitors of the shard pipeline from the
+// metric definitions in the services' Go code and from slo.json, and fails when a dashboard
+// references a metric that no service emits.
+//
+//	dashgen                       regenerate ../datadog-pipeline.json, ../datadog-slos.json, ../datadog-monitors.json
+//	dashgen -check FILE[,FILE]    only validate existing dashboard JSON files
+//	dashgen -list                 print the metrics the services emit
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	servicesFlag := flag.String("services", "../service1,../service2,../service3,../router,../registry", "comma separated service directories to scan for metrics")
+	sharedFlag := flag.String("shared", "../internal/pipeline", "package of metric definitions shared by the services, empty for none")
+	specPath := flag.String("spec", "dashboard-spec.json", "hand-written dashboard widgets, Datadog dashboard JSON")
+	sloPath := flag.String("slo", "../slo.json", "SLO definitions shared with the services")
+	dashboardOut := flag.String("dashboard", "../datadog-pipeline.json", "generated dashboard")
+	slosOut := flag.String("slos", "../datadog-slos.json", "generated SLO objects")
+	monitorsOut := flag.String("monitors", "../datadog-monitors.json", "generated monitors")
+	check := flag.String("check", "", "comma separated dashboard files to validate instead of generating")
+	list := flag.Bool("list", false, "print the metric catalogue and exit")
+	flag.Parse()
+
+	cat, err := loadCatalogue(*sharedFlag, splitList(*servicesFlag))
+	if err != nil {
+		fatal(err)
+	}
+
+	if *list {
+		for _, name := range cat.names() {
+			info := cat.metrics[name]
+			tags := "-"
+			if info.Tags != nil {
+				tags = strings.Join(info.Tags, ",")
+			}
+			fmt.Printf("%-48s %-7s %-30s %s\n", name, info.Kind, tags, strings.Join(cat.servicesEmitting(name), ","))
+		}
+		return
+	}
+
+	if *check != "" {
+		failed := false
+		for _, path := range splitList(*check) {
+			dashboard, err := readJSON(path)
+			if err != nil {
+				fatal(err)
+			}
+			problems := cat.validateDashboard(dashboard)
+			report(path, problems)
+			failed = failed || len(problems) > 0
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	spec, err := readJSON(*specPath)
+	if err != nil {
+		fatal(err)
+	}
+	slos, err := loadSLOs(*sloPath)
+	if err != nil {
+		fatal(err)
+	}
+
+	var problems []string
+	var sloObjects []map[string]interface{}
+	var monitors []map[string]interface{}
+	for _, def := range slos {
+		obj, err := sloObject(def)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("SLO %s: %v", def.Name, err))
+			continue
+		}
+		query := obj["query"].(map[string]string)
+		problems = append(problems, cat.validateQuery(query["numerator"])...)
+		problems = append(problems, cat.validateQuery(query["denominator"])...)
+		sloObjects = append(sloObjects, obj)
+
+		burnMonitors, err := burnRateMonitors(def)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("SLO %s: %v", def.Name, err))
+			continue
+		}
+		for _, m := range burnMonitors {
+			problems = append(problems, cat.validateQuery(m["query"].(string))...)
+			monitors = append(monitors, m)
+		}
+	}
+
+	dashboard := buildDashboard(spec, slos)
+	problems = append(problems, cat.validateDashboard(dashboard)...)
+	if len(problems) > 0 {
+		report(*specPath, problems)
+		os.Exit(1)
+	}
+
+	for path, v := range map[string]interface{}{*dashboardOut: dashboard, *slosOut: sloObjects, *monitorsOut: monitors} {
+		if err := writeJSON(path, v); err != nil {
+			fatal(err)
+		}
+		fmt.Println("wrote", path)
+	}
+}
+
+func report(path string, problems []string) {
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", path)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d invalid metric reference(s)\n", path, len(problems))
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "  %s\n", p)
+	}
+}
+
+func readJSON(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return v, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "dashgen:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// metricQuery matches "agg:metric.name{filter} by {group}" inside a Datadog query string
+var metricQuery = regexp.MustCompile(`\b(avg|sum|min|max|count):([A-Za-z0-9_.]+)(?:\{([^}]*)\})?(?:\s*by\s*\{([^}]*)\})?`)
+
+// queryRefs lists every query string in a dashboard widget tree
+func queryRefs(widgets []interface{}) []string {
+	var queries []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			for key, child := range node {
+				if s, ok := child.(string); ok && (key == "query" || key == "q" || key == "numerator" || key == "denominator") {
+					queries = append(queries, s)
+					continue
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(widgets)
+	return queries
+}
+
+// validateQuery checks that every metric in query is emitted by a service and that
+// facade metrics are only filtered or grouped by tags they carry
+func (c *catalogue) validateQuery(query string) []string {
+	var problems []string
+	for _, m := range metricQuery.FindAllStringSubmatch(query, -1) {
+		name, filter, groupBy := m[2], m[3], m[4]
+		info, err := c.resolve(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%q: %v", query, err))
+			continue
+		}
+		if info.Tags == nil {
+			continue
+		}
+		allowed := make(map[string]bool)
+		for _, k := range append(append([]string{}, baseTagKeys...), info.Tags...) {
+			allowed[k] = true
+		}
+		for _, key := range tagKeys(filter, groupBy) {
+			if !allowed[key] {
+				problems = append(problems, fmt.Sprintf("%q: %s has no tag %q (tags: %s)",
+					query, info.Name, key, strings.Join(info.Tags, ", ")))
+			}
+		}
+	}
+	return problems
+}
+
+func tagKeys(filter, groupBy string) []string {
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(filter, ",") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "!")
+		if key, _, found := strings.Cut(part, ":"); found && !strings.HasPrefix(key, "$") {
+			seen[key] = true
+		}
+	}
+	for _, part := range strings.Split(groupBy, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			seen[part] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateDashboard returns one problem per invalid metric reference
+func (c *catalogue) validateDashboard(dashboard map[string]interface{}) []string {
+	widgets, _ := dashboard["widgets"].([]interface{})
+	var problems []string
+	for _, q := range queryRefs(widgets) {
+		problems = append(problems, c.validateQuery(q)...)
+	}
+	return problems
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testCatalogue() *catalogue {
+	return &catalogue{metrics: map[string]*metricInfo{
+		"sli.requests.total": {Name: "sli.requests.total", Kind: kindCount, Tags: []string{"endpoint", "outcome"}},
+		"step.duration":      {Name: "step.duration", Kind: kindTiming, Tags: []string{}},
+		"queue.depth":        {Name: "queue.depth", Kind: kindGauge},
+	}}
+}
+
+func TestValidateQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// want are substrings of the expected problems, in order
+		want []string
+	}{
+		{"declared filter and group", "sum:sli.requests.total{outcome:success} by {endpoint}.as_count()", nil},
+		{"base tags and template variables", "sum:sli.requests.total{service:service1,$shard,!env:dev} by {host,shard}", nil},
+		{"timing with suffix", "avg:step.duration.95percentile{*}", nil},
+		{"literal metric tags are not checked", "max:queue.depth{queue:anything} by {whatever}", nil},
+		{"unknown metric", "sum:nobody.emits{*}", []string{"no service emits nobody.emits"}},
+		{"timing without suffix", "avg:step.duration{*}", []string{"must be queried with a suffix"}},
+		{"suffix on a count", "avg:sli.requests.total.avg{*}", []string{"only exists for timings"}},
+		{"undeclared filter tag", "sum:sli.requests.total{customer:1}", []string{`has no tag "customer"`}},
+		{"undeclared group tag", "sum:step.duration.count{*} by {queue}", []string{`has no tag "queue"`}},
+		{
+			name:  "every metric of a formula",
+			query: "sum:sli.requests.total{error_type:x} / sum:nobody.emits{*}",
+			want:  []string{`has no tag "error_type"`, "no service emits nobody.emits"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := testCatalogue().validateQuery(tt.query)
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDashboardWalksNestedWidgets(t *testing.T) {
+	dashboard := map[string]interface{}{
+		"widgets": []interface{}{
+			map[string]interface{}{"definition": map[string]interface{}{
+				"widgets": []interface{}{
+					map[string]interface{}{"definition": map[string]interface{}{
+						"requests": []interface{}{map[string]interface{}{"q": "sum:nobody.emits{*}"}},
+					}},
+				},
+			}},
+			map[string]interface{}{"definition": map[string]interface{}{
+				"queries": []interface{}{map[string]interface{}{"query": "sum:sli.requests.total{*}"}},
+			}},
+		},
+	}
+	problems := testCatalogue().validateDashboard(dashboard)
+	if len(problems) != 1 || !strings.Contains(problems[0], "nobody.emits") {
+		t.Errorf("problems = %q, want one for nobody.emits", problems)
+	}
+}
@@ -0,0 +1,358 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// BacklogMonitor polls the depth of the queue a consumer reads from and turns backlog,
+// consumption rate and per-message processing time into a recommended worker and replica
+// count for a scaler. Depth covers the whole queue, so the rate does too: with a registry,
+// the rates the other consumers of the queue report on /admin/scaling are added to this
+// instance's; without one, this instance is taken to be the only consumer.
+//
+//	BACKLOG_POLL_INTERVAL   how often the queue attributes are read (default 15s)
+//	SCALING_TARGET_DRAIN    time the recommendation should drain the backlog in (default 60s)
+//	SCALING_MIN_WORKERS     lower bound of the recommendation (default 1)
+//	SCALING_MAX_WORKERS     upper bound of the recommendation (default 20)
+type BacklogMonitor struct {
+	queue    string
+	queueURL string
+	interval time.Duration
+	target   time.Duration
+	min, max int
+
+	workers func() int // workers of this instance, the consumer's concurrency limit
+
+	// Where the other consumers of the queue are found, nil without a registry
+	registry ShardRegistry
+	self     ServiceInstance
+	client   *http.Client
+
+	mu        sync.Mutex
+	processed int
+	busy      time.Duration
+	oldestAge time.Duration // of the messages this instance received since the last poll
+	rate      float64       // messages per second of this instance, smoothed
+	capacity  float64       // messages per second one busy worker handles, smoothed
+	lastPoll  time.Time
+	status    scalingStatus
+}
+
+// peerDrain is what the other consumers of the queue reported on their latest poll
+type peerDrain struct {
+	consumers int
+	rate      float64
+}
+
+// scalingStatus is served on /admin/scaling
+type scalingStatus struct {
+	Queue               string    `json:"queue"`
+	Shard               string    `json:"shard"`
+	Depth               int64     `json:"depth"`
+	InFlight            int64     `json:"in_flight"`
+	Processing          int       `json:"processing"` // by this instance, at the time of the request
+	Paused              bool      `json:"paused"`     // see ConsumerPauseHandler
+	Receiving           bool      `json:"receiving"`
+	Delayed             int64     `json:"delayed"`
+	ConsumerOldestAge   float64   `json:"consumer_oldest_age_seconds"`
+	ProcessingRate      float64   `json:"processing_rate"` // of this instance
+	QueueRate           float64   `json:"queue_processing_rate"`
+	Consumers           int       `json:"consumers"`
+	WorkerCapacity      float64   `json:"worker_capacity"`
+	Workers             int       `json:"workers"`
+	WorkersPerReplica   int       `json:"workers_per_replica"`
+	RecommendedWorkers  int       `json:"recommended_workers"`
+	RecommendedReplicas int       `json:"recommended_replicas"`
+	TargetDrainSeconds  float64   `json:"target_drain_seconds"`
+	Reason              string    `json:"reason"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	Error               string    `json:"error,omitempty"`
+}
+
+// Backlog is the monitor of the consumer's input queue, nil until main starts it
+var Backlog *BacklogMonitor
+
+// NewBacklogMonitor monitors queueURL for the consumer self. registry, when not nil, is
+// where the other consumers of the queue, instances of the same role, are found.
+func NewBacklogMonitor(queueURL string, workers func() int, registry ShardRegistry, self ServiceInstance) *BacklogMonitor {
+	m := &BacklogMonitor{
+		queue:    path.Base(queueURL),
+		queueURL: queueURL,
+		interval: EnvDuration("BACKLOG_POLL_INTERVAL", 15*time.Second),
+		target:   EnvDuration("SCALING_TARGET_DRAIN", time.Minute),
+		min:      EnvInt("SCALING_MIN_WORKERS", 1),
+		max:      EnvInt("SCALING_MAX_WORKERS", 20),
+		workers:  workers,
+		registry: registry,
+		self:     self,
+		client:   &http.Client{Timeout: 2 * time.Second},
+		lastPoll: time.Now(),
+	}
+	if m.target <= 0 {
+		m.target = time.Minute
+	}
+	m.status = scalingStatus{Queue: m.queue, Shard: ShardID, Consumers: 1, Workers: workers(), WorkersPerReplica: workers(), Reason: "no poll yet"}
+	return m
+}
+
+// messageProcessed counts a consumed message and the time a worker spent on it
+func (m *BacklogMonitor) messageProcessed(elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.processed++
+	m.busy += elapsed
+	m.mu.Unlock()
+}
+
+// observeAge records the age of a received message. SQS only publishes the age of the
+// oldest message in the queue to CloudWatch, so this is what the consumer saw: the oldest
+// message it received since the previous poll. It is not the queue's oldest age, and drops
+// to 0 when the consumer receives nothing, stuck or idle.
+func (m *BacklogMonitor) observeAge(age time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if age > m.oldestAge {
+		m.oldestAge = age
+	}
+	m.mu.Unlock()
+}
+
+func (m *BacklogMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *BacklogMonitor) poll(ctx context.Context) {
+	callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := SQSClient.GetQueueAttributes(callCtx, &sqs.GetQueueAttributesInput{
+		QueueUrl: &m.queueURL,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			types.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		},
+	})
+	if err != nil {
+		Logger.WarnContext(ctx, "Failed to read queue attributes",
+			"operation", "sqs_get_queue_attributes",
+			"queue.url", m.queueURL,
+			"error", err)
+		m.mu.Lock()
+		m.status.Error = err.Error()
+		m.mu.Unlock()
+		return
+	}
+	attr := func(name types.QueueAttributeName) int64 {
+		n, _ := strconv.ParseInt(out.Attributes[string(name)], 10, 64)
+		return n
+	}
+	peers, err := m.peerDrain(ctx)
+	if err != nil {
+		Logger.WarnContext(ctx, "Failed to read the rate of the queue's other consumers",
+			"operation", "backlog_peer_rate",
+			"queue", m.queue,
+			"error", err)
+	}
+	status := m.update(
+		attr(types.QueueAttributeNameApproximateNumberOfMessages),
+		attr(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+		attr(types.QueueAttributeNameApproximateNumberOfMessagesDelayed),
+		peers,
+		time.Now(),
+	)
+
+	queue := Tag("queue", m.queue)
+	Metrics.Gauge(MetricQueueDepth, float64(status.Depth), queue)
+	Metrics.Gauge(MetricQueueInFlight, float64(status.InFlight), queue)
+	Metrics.Gauge(MetricQueueDelayed, float64(status.Delayed), queue)
+	Metrics.Gauge(MetricConsumerOldestAge, status.ConsumerOldestAge, queue)
+	Metrics.Gauge(MetricConsumerRate, status.ProcessingRate, queue)
+	Metrics.Gauge(MetricRecommendedWorkers, float64(status.RecommendedWorkers), queue)
+	Metrics.Gauge(MetricRecommendedReplicas, float64(status.RecommendedReplicas), queue)
+}
+
+// peerDrain sums the processing rates of the other consumers of the queue. A consumer that
+// cannot be read counts as draining nothing; the error says which.
+func (m *BacklogMonitor) peerDrain(ctx context.Context) (peerDrain, error) {
+	if m.registry == nil {
+		return peerDrain{}, nil
+	}
+	instances, err := QueueConsumers(ctx, m.registry, m.self.Role, m.queueURL)
+	if err != nil {
+		return peerDrain{}, err
+	}
+	var drain peerDrain
+	var failed []error
+	for _, instance := range instances {
+		if instance.ID == m.self.ID {
+			continue
+		}
+		rate, err := ConsumerRate(ctx, m.client, instance.Address)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", instance.Address, err))
+			continue
+		}
+		drain.consumers++
+		drain.rate += rate
+	}
+	return drain, errors.Join(failed...)
+}
+
+// QueueConsumers lists the live instances of role that consume queueURL
+func QueueConsumers(ctx context.Context, registry ShardRegistry, role, queueURL string) ([]ServiceInstance, error) {
+	instances, err := registry.List(ctx, "", role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consumers: %w", err)
+	}
+	var consumers []ServiceInstance
+	for _, instance := range instances {
+		if instance.Queues["input"] == queueURL {
+			consumers = append(consumers, instance)
+		}
+	}
+	return consumers, nil
+}
+
+// ConsumerRate reads the processing rate a consumer reported on its latest poll
+func ConsumerRate(ctx context.Context, client *http.Client, address string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/admin/scaling", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("scaling status returned %s", resp.Status)
+	}
+	var status struct {
+		ProcessingRate float64 `json:"processing_rate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	return status.ProcessingRate, nil
+}
+
+// update folds a poll into the rates and recomputes the recommendation
+func (m *BacklogMonitor) update(depth, inFlight, delayed int64, peers peerDrain, now time.Time) scalingStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Smoothed so a single unusual interval does not swing the recommendation
+	first := m.status.UpdatedAt.IsZero()
+	if elapsed := now.Sub(m.lastPoll).Seconds(); elapsed > 0 {
+		m.rate = smooth(m.rate, float64(m.processed)/elapsed, first)
+	}
+	if m.processed > 0 && m.busy > 0 {
+		m.capacity = smooth(m.capacity, float64(m.processed)/m.busy.Seconds(), first || m.capacity == 0)
+	}
+	oldest := m.oldestAge
+	m.processed, m.busy, m.oldestAge, m.lastPoll = 0, 0, 0, now
+
+	workers := m.workers()
+	if workers < 1 {
+		workers = 1
+	}
+	queueRate := m.rate + peers.rate
+	recommended, reason := m.recommend(depth+inFlight, queueRate, workers)
+
+	m.status = scalingStatus{
+		Queue:               m.queue,
+		Shard:               ShardID,
+		Depth:               depth,
+		InFlight:            inFlight,
+		Delayed:             delayed,
+		ConsumerOldestAge:   oldest.Seconds(),
+		ProcessingRate:      m.rate,
+		QueueRate:           queueRate,
+		Consumers:           1 + peers.consumers,
+		WorkerCapacity:      m.capacity,
+		Workers:             workers,
+		WorkersPerReplica:   workers,
+		RecommendedWorkers:  recommended,
+		RecommendedReplicas: int(math.Ceil(float64(recommended) / float64(workers))),
+		TargetDrainSeconds:  m.target.Seconds(),
+		Reason:              reason,
+		UpdatedAt:           now,
+	}
+	return m.status
+}
+
+func smooth(previous, observed float64, first bool) float64 {
+	if first {
+		return observed
+	}
+	return 0.3*observed + 0.7*previous
+}
+
+// recommend sizes the queue's consumers to keep up with the current rate and drain the
+// backlog within the target: (rate + backlog / target) / capacity of one worker. The
+// consumption rate of all consumers stands in for the arrival rate, which SQS does not report.
+func (m *BacklogMonitor) recommend(pending int64, rate float64, workers int) (int, string) {
+	var n int
+	var reason string
+	switch {
+	case m.capacity == 0 && pending == 0:
+		n, reason = m.min, "idle"
+	case m.capacity == 0:
+		// No processing time observed yet, so nothing to size from: add one worker at a time
+		n, reason = workers+1, "backlog but no processing time observed yet"
+	default:
+		needed := rate + float64(pending)/m.target.Seconds()
+		n = int(math.Ceil(needed / m.capacity))
+		reason = fmt.Sprintf("%.2f msg/s plus %d messages to drain in %s, %.2f msg/s per worker",
+			rate, pending, m.target, m.capacity)
+	}
+	if n < m.min {
+		n = m.min
+	}
+	if m.max > 0 && n > m.max {
+		n, reason = m.max, reason+", capped at SCALING_MAX_WORKERS"
+	}
+	return n, reason
+}
+
+// handler serves GET /admin/scaling
+func (m *BacklogMonitor) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mu.Lock()
+	status := m.status
+	m.mu.Unlock()
+	if Limiter != nil {
+		status.Processing = Limiter.active()
+	}
+	status.Paused, status.Receiving = consumer.state()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testQueueURL = "https://sqs.us-east-1.amazonaws.com/123/shard-1-step1"
+
+func testBacklogMonitor(workers int) *BacklogMonitor {
+	return &BacklogMonitor{
+		queue:    "shard-1-step1",
+		queueURL: testQueueURL,
+		target:   time.Minute,
+		min:      1,
+		max:      20,
+		workers:  func() int { return workers },
+		lastPoll: time.Now(),
+	}
+}
+
+func TestBacklogRecommend(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacity   float64
+		pending    int64
+		rate       float64
+		workers    int
+		want       int
+		wantReason string
+	}{
+		{"idle", 0, 0, 0, 4, 1, "idle"},
+		{"backlog before any processing time", 0, 50, 0, 3, 4, "no processing time"},
+		{"keeps up with the rate", 10, 0, 25, 1, 3, "25.00 msg/s"},
+		{"drains the backlog within the target", 10, 1200, 0, 1, 2, "1200 messages"},
+		{"rate and backlog", 5, 600, 10, 1, 4, "10.00 msg/s plus 600"},
+		{"at least the min", 100, 10, 1, 1, 1, ""},
+		{"capped at the max", 1, 6000, 10, 1, 20, "capped at SCALING_MAX_WORKERS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testBacklogMonitor(tt.workers)
+			m.capacity = tt.capacity
+			n, reason := m.recommend(tt.pending, tt.rate, tt.workers)
+			if n != tt.want || !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("recommend = %d, %q, want %d, containing %q", n, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestBacklogUpdate(t *testing.T) {
+	m := testBacklogMonitor(2)
+	start := m.lastPoll
+	for range 10 {
+		m.messageProcessed(100 * time.Millisecond)
+	}
+	m.observeAge(3 * time.Second)
+	m.observeAge(time.Second)
+
+	// 10 messages in 10s at 100ms each: 1 msg/s, 10 msg/s per busy worker
+	status := m.update(600, 20, 5, peerDrain{}, start.Add(10*time.Second))
+	if status.ProcessingRate != 1 || status.QueueRate != 1 || status.WorkerCapacity != 10 {
+		t.Errorf("rates = %v, %v, capacity %v, want 1, 1, 10", status.ProcessingRate, status.QueueRate, status.WorkerCapacity)
+	}
+	if status.ConsumerOldestAge != 3 {
+		t.Errorf("consumer oldest age = %v, want 3", status.ConsumerOldestAge)
+	}
+	// (1 msg/s + 620 / 60s) / 10 msg/s per worker
+	if status.RecommendedWorkers != 2 || status.RecommendedReplicas != 1 || status.Consumers != 1 {
+		t.Errorf("recommended %d workers, %d replicas, %d consumers, want 2, 1, 1", status.RecommendedWorkers, status.RecommendedReplicas, status.Consumers)
+	}
+
+	// Nothing received since: the age is what this consumer saw, so it drops to 0,
+	// and the rates are smoothed towards the idle interval
+	status = m.update(600, 0, 0, peerDrain{}, start.Add(20*time.Second))
+	if status.ConsumerOldestAge != 0 {
+		t.Errorf("consumer oldest age = %v, want 0 after an interval without messages", status.ConsumerOldestAge)
+	}
+	if status.ProcessingRate != 0.7 || status.WorkerCapacity != 10 {
+		t.Errorf("rate %v, capacity %v, want 0.7 and the capacity kept", status.ProcessingRate, status.WorkerCapacity)
+	}
+}
+
+func TestBacklogUpdateSizesForTheWholeQueue(t *testing.T) {
+	m := testBacklogMonitor(2)
+	start := m.lastPoll
+	for range 20 {
+		m.messageProcessed(100 * time.Millisecond)
+	}
+
+	// This instance drains 2 msg/s, three others 28 msg/s: the queue needs 3 workers to keep up,
+	// not the 1 this instance's rate alone asks for
+	status := m.update(0, 0, 0, peerDrain{consumers: 3, rate: 28}, start.Add(10*time.Second))
+	if status.ProcessingRate != 2 || status.QueueRate != 30 || status.Consumers != 4 {
+		t.Errorf("rate %v, queue rate %v, consumers %d, want 2, 30, 4", status.ProcessingRate, status.QueueRate, status.Consumers)
+	}
+	if status.RecommendedWorkers != 3 || status.RecommendedReplicas != 2 {
+		t.Errorf("recommended %d workers, %d replicas, want 3 and 2 at 2 workers per replica", status.RecommendedWorkers, status.RecommendedReplicas)
+	}
+}
+
+func TestBacklogPeerDrain(t *testing.T) {
+	peer := func(rate float64) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"processing_rate":%g}`, rate)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(down.Close)
+
+	self := ServiceInstance{ID: "shard-1-service2-8081", Shard: "shard-1", Role: "service2", Address: peer(1000), Queues: map[string]string{"input": testQueueURL}}
+	instances := []ServiceInstance{
+		self,
+		{ID: "shard-1-service2-8091", Shard: "shard-1", Role: "service2", Address: peer(4), Queues: map[string]string{"input": testQueueURL}},
+		{ID: "shard-2-service2-8081", Shard: "shard-2", Role: "service2", Address: peer(1.5), Queues: map[string]string{"input": testQueueURL}},
+		{ID: "shard-1-service2-8101", Shard: "shard-1", Role: "service2", Address: down.URL, Queues: map[string]string{"input": testQueueURL}},
+		{ID: "shard-3-service2-8081", Shard: "shard-3", Role: "service2", Address: peer(100), Queues: map[string]string{"input": "https://sqs/shard-3-step1"}},
+		{ID: "shard-1-service3-8082", Shard: "shard-1", Role: "service3", Address: peer(100), Queues: map[string]string{"input": testQueueURL}},
+	}
+	data, err := json.Marshal(map[string]interface{}{"instances": instances})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &fileRegistry{path: filepath.Join(t.TempDir(), "registry.json")}
+	if err := os.WriteFile(registry.path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := testBacklogMonitor(1)
+	m.registry, m.self, m.client = registry, self, http.DefaultClient
+	drain, err := m.peerDrain(context.Background())
+	if err == nil || !strings.Contains(err.Error(), down.URL) {
+		t.Errorf("err = %v, want the consumer that could not be read", err)
+	}
+	if drain.consumers != 2 || drain.rate != 5.5 {
+		t.Errorf("peers = %d at %v msg/s, want the 2 other readable consumers of the queue at 5.5", drain.consumers, drain.rate)
+	}
+
+	m.registry = nil
+	if drain, err := m.peerDrain(context.Background()); err != nil || drain.consumers != 0 {
+		t.Errorf("without a registry: %+v, %v, want no peers", drain, err)
+	}
+}
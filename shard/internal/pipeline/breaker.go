@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the dependency while its circuit is open
+var ErrCircuitOpen = errors.New("circuit open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// breakerStateValue is the pipeline.circuit.state gauge value of each state
+var breakerStateValue = map[BreakerState]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}
+
+// CircuitBreaker fails calls to a dependency fast once it keeps failing, instead of every
+// caller paying the full timeout. Consecutive failures open the circuit; after the open
+// timeout one trial call is let through (half-open), which closes it on success or opens
+// it again on failure. Only retryable errors count as failures: a rejected request says
+// nothing about the dependency's health.
+//
+//	BREAKER_FAILURE_THRESHOLD  consecutive failures that open the circuit (default 5)
+//	BREAKER_OPEN_TIMEOUT       time open before a trial call (default 30s)
+type CircuitBreaker struct {
+	dependency  string
+	threshold   int
+	openTimeout time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerStatus is reported by the health endpoint
+type BreakerStatus struct {
+	State             BreakerState `json:"state"`
+	Failures          int          `json:"consecutive_failures"`
+	OpenedAt          *time.Time   `json:"opened_at,omitempty"`
+	RetryAfterSeconds int          `json:"retry_after_seconds,omitempty"`
+}
+
+// SQSSendBreaker guards SendMessage to the next step's queue
+var SQSSendBreaker = newCircuitBreaker("sqs_send")
+
+func newCircuitBreaker(dependency string) *CircuitBreaker {
+	b := &CircuitBreaker{
+		dependency:  dependency,
+		threshold:   EnvInt("BREAKER_FAILURE_THRESHOLD", 5),
+		openTimeout: EnvDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second),
+		state:       BreakerClosed,
+	}
+	if b.threshold < 1 {
+		b.threshold = 1
+	}
+	return b
+}
+
+// do calls op unless the circuit is open, and records its result
+func (b *CircuitBreaker) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	if !b.allow(time.Now()) {
+		Metrics.Incr(MetricCircuitRejected, Tag("dependency", b.dependency))
+		return ErrCircuitOpen
+	}
+	err := op(ctx)
+	state := b.record(ctx, err, time.Now())
+	Metrics.Gauge(MetricCircuitState, breakerStateValue[state], Tag("dependency", b.dependency))
+	return err
+}
+
+func (b *CircuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.transition(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		// A single trial call at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record applies the result of a call and returns the resulting state
+func (b *CircuitBreaker) record(ctx context.Context, err error, now time.Time) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+	switch {
+	case err == nil:
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+	case ctx.Err() != nil || !retryable(err):
+		// The caller gave up or the request was rejected: nothing learned about the dependency
+	default:
+		b.failures++
+		if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+			b.openedAt = now
+			b.transition(BreakerOpen)
+		}
+	}
+	return b.state
+}
+
+// transition changes the state, called with b.mu held
+func (b *CircuitBreaker) transition(to BreakerState) {
+	from := b.state
+	b.state = to
+	dependency := Tag("dependency", b.dependency)
+	Metrics.Gauge(MetricCircuitState, breakerStateValue[to], dependency)
+	Metrics.Incr(MetricCircuitTransitions, dependency, Tag("state", string(to)))
+	log := Logger.Info
+	if to == BreakerOpen {
+		log = Logger.Warn
+	}
+	log("Circuit breaker state changed",
+		"dependency", b.dependency,
+		"from", string(from),
+		"to", string(to),
+		"consecutive_failures", b.failures)
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+		s.RetryAfterSeconds = int(math.Ceil((b.openTimeout - time.Since(b.openedAt)).Seconds()))
+		// Half-open: worth retrying as soon as the trial call is done
+		if s.RetryAfterSeconds < 1 {
+			s.RetryAfterSeconds = 1
+		}
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// breakerCall is a call at an offset from the start of a test: whether the breaker lets it
+// through, and the state after its result err is recorded
+type breakerCall struct {
+	at          time.Duration
+	err         error
+	wantAllowed bool
+	wantState   BreakerState
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	errRejected := errors.New("rejected")
+	tests := []struct {
+		name  string
+		calls []breakerCall
+	}{
+		{
+			name: "failures below the threshold keep it closed",
+			calls: []breakerCall{
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+			},
+		},
+		{
+			name: "consecutive failures open it",
+			calls: []breakerCall{
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerOpen},
+				{time.Second, nil, false, BreakerOpen},
+			},
+		},
+		{
+			name: "a success resets the count",
+			calls: []breakerCall{
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+				{0, nil, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+			},
+		},
+		{
+			name: "errors that are not retryable are not failures",
+			calls: []breakerCall{
+				{0, errRejected, true, BreakerClosed},
+				{0, errRejected, true, BreakerClosed},
+				{0, errRejected, true, BreakerClosed},
+				{0, errRejected, true, BreakerClosed},
+			},
+		},
+		{
+			name: "successful trial call closes it",
+			calls: []breakerCall{
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerOpen},
+				{10 * time.Second, nil, true, BreakerClosed},
+				{10 * time.Second, ErrTransient, true, BreakerClosed},
+			},
+		},
+		{
+			name: "failed trial call opens it again",
+			calls: []breakerCall{
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerClosed},
+				{0, ErrTransient, true, BreakerOpen},
+				{10 * time.Second, ErrTransient, true, BreakerOpen},
+				// The open timeout restarts from the failed trial
+				{15 * time.Second, nil, false, BreakerOpen},
+				{20 * time.Second, nil, true, BreakerClosed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestTelemetry(t)
+			b := &CircuitBreaker{dependency: "test", threshold: 3, openTimeout: 10 * time.Second, state: BreakerClosed}
+			start := time.Unix(0, 0)
+			for i, call := range tt.calls {
+				now := start.Add(call.at)
+				allowed := b.allow(now)
+				if allowed != call.wantAllowed {
+					t.Fatalf("call %d: allowed = %v, want %v", i, allowed, call.wantAllowed)
+				}
+				state := b.state
+				if allowed {
+					state = b.record(context.Background(), call.err, now)
+				}
+				if state != call.wantState {
+					t.Fatalf("call %d: state = %s, want %s", i, state, call.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSingleTrialCall(t *testing.T) {
+	useTestTelemetry(t)
+	b := &CircuitBreaker{dependency: "test", threshold: 1, openTimeout: time.Second, state: BreakerClosed}
+	start := time.Unix(0, 0)
+	b.record(context.Background(), ErrTransient, start)
+
+	later := start.Add(time.Second)
+	if !b.allow(later) {
+		t.Fatal("trial call not allowed after the open timeout")
+	}
+	if b.state != BreakerHalfOpen {
+		t.Fatalf("state = %s, want %s", b.state, BreakerHalfOpen)
+	}
+	if b.allow(later) {
+		t.Error("second call allowed while the trial call is in flight")
+	}
+}
+
+func TestCircuitBreakerCanceledCallIsNotAFailure(t *testing.T) {
+	useTestTelemetry(t)
+	b := &CircuitBreaker{dependency: "test", threshold: 1, openTimeout: time.Second, state: BreakerClosed}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if state := b.record(ctx, context.DeadlineExceeded, time.Unix(0, 0)); state != BreakerClosed {
+		t.Errorf("state = %s, want %s", state, BreakerClosed)
+	}
+}
+
+func TestCircuitBreakerDo(t *testing.T) {
+	tel := useTestTelemetry(t)
+	b := &CircuitBreaker{dependency: "test", threshold: 1, openTimeout: time.Hour, state: BreakerClosed}
+	fail := func(context.Context) error { return ErrTransient }
+
+	if err := b.Do(context.Background(), fail); !errors.Is(err, ErrTransient) {
+		t.Fatalf("first call: err = %v, want the dependency's error", err)
+	}
+	called := false
+	err := b.Do(context.Background(), func(context.Context) error { called = true; return nil })
+	if !errors.Is(err, ErrCircuitOpen) || called {
+		t.Errorf("open circuit: err = %v, called = %v, want ErrCircuitOpen without a call", err, called)
+	}
+	if n := tel.count(MetricCircuitTransitions); n != 1 {
+		t.Errorf("%s = %d, want 1", MetricCircuitTransitions.Name, n)
+	}
+	if n := tel.count(MetricCircuitRejected); n != 1 {
+		t.Errorf("%s = %d, want 1", MetricCircuitRejected.Name, n)
+	}
+}
@@ -0,0 +1,286 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Pipeline event delivery shared by service2 and service3
+
+// callbackRetry covers a receiver that is down, overloaded or answers 5xx or 429
+var callbackRetry = NewRetryPolicy("callback", 5, time.Second, 30*time.Second)
+
+// callbackNetworks are the private networks callbacks may reach anyway
+// (CALLBACK_ALLOWED_NETWORKS, comma-separated CIDRs), set by ConfigureCallbacks
+var callbackNetworks []netip.Prefix
+
+// callbackClient delivers to the callers' callback URLs. Each attempt is bounded by
+// CALLBACK_TIMEOUT (default 5s), and every address it connects to is checked, so a host
+// that resolves to an internal address after the URL was accepted is still refused. It
+// never uses a proxy, which would hide the address.
+var callbackClient = &http.Client{
+	Timeout: EnvDuration("CALLBACK_TIMEOUT", 5*time.Second),
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: callbackDialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// eventClient delivers to the status and events URLs of service1, which are internal
+var eventClient = &http.Client{Timeout: EnvDuration("CALLBACK_TIMEOUT", 5*time.Second)}
+
+// ConfigureCallbacks checks CALLBACK_SECRET and loads CALLBACK_ALLOWED_NETWORKS. Services
+// refuse to start when it fails: pipeline events are always signed and verified.
+func ConfigureCallbacks() error {
+	if len(CallbackSecret) == 0 {
+		return errors.New("CALLBACK_SECRET is required to sign and verify pipeline events")
+	}
+	if len(CallbackSecret) < minCallbackSecretLength {
+		return fmt.Errorf("CALLBACK_SECRET must be at least %d bytes", minCallbackSecretLength)
+	}
+	networks, err := parseNetworks(os.Getenv("CALLBACK_ALLOWED_NETWORKS"))
+	if err != nil {
+		return fmt.Errorf("invalid CALLBACK_ALLOWED_NETWORKS: %w", err)
+	}
+	callbackNetworks = networks
+	return nil
+}
+
+func parseNetworks(list string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
+
+// CheckCallbackAddress refuses the addresses a caller must not make the pipeline call:
+// loopback, private, link-local (including cloud metadata endpoints), shared (CGNAT),
+// multicast and unspecified ones, unless they are in CALLBACK_ALLOWED_NETWORKS
+func CheckCallbackAddress(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, network := range callbackNetworks {
+		if network.Contains(addr) {
+			return nil
+		}
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+		return fmt.Errorf("%w: %s is not public", errAddressNotAllowed, addr)
+	}
+	return nil
+}
+
+// errAddressNotAllowed is final: a retry resolves to the same address
+var errAddressNotAllowed = errors.New("callback address not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, internal like the private ones
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// CheckCallbackHost resolves host and checks every address it has, see CheckCallbackAddress
+func CheckCallbackHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return CheckCallbackAddress(addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if err := CheckCallbackAddress(addr); err != nil {
+			return fmt.Errorf("host %s resolves to an address that is not allowed: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// callbackDialControl checks the address of each connection of callbackClient after DNS
+// resolution and before connecting
+func callbackDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("callback address %q: %w", address, err)
+	}
+	return CheckCallbackAddress(addrPort.Addr())
+}
+
+// NotifyEvent delivers event to the status URL and the callback URL carried by
+// message, in the background so a slow receiver never holds up the consumer. Deliveries
+// are retried, and given up on when the process stops.
+func NotifyEvent(ctx context.Context, message PipelineMessage, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		Logger.ErrorContext(ctx, "Failed to marshal pipeline event", "operation", "json_marshal", "error", err)
+		return
+	}
+	// The deliveries outlive the message's processing
+	ctx = context.WithoutCancel(ctx)
+	if message.StatusURL != "" {
+		go deliverPipelineEvent(ctx, eventClient, "status", message.StatusURL, event.Status, body)
+	}
+	if message.CallbackURL != "" {
+		go deliverPipelineEvent(ctx, callbackClient, "callback", message.CallbackURL, event.Status, body)
+	}
+}
+
+func deliverPipelineEvent(ctx context.Context, client *http.Client, target, endpoint, status string, body []byte) {
+	err := callbackRetry.Do(ctx, func(ctx context.Context) error {
+		return postPipelineEvent(ctx, client, endpoint, body)
+	})
+	if err == nil {
+		Metrics.Incr(MetricCallbackDelivered, Tag("target", target), Tag("status", status))
+		return
+	}
+	Metrics.Incr(MetricCallbackFailed, Tag("target", target), Tag("status", status), Tag("error_code", ErrorCode(err)))
+	// Only the host is logged: callback URLs may carry the caller's tokens
+	host := ""
+	if u, err := url.Parse(endpoint); err == nil {
+		host = u.Host
+	}
+	Logger.WarnContext(ctx, "Failed to deliver pipeline event",
+		"operation", "pipeline_event_delivery",
+		"callback.target", target,
+		"callback.host", host,
+		"error", err)
+}
+
+// postPipelineEvent makes one signed delivery attempt. Network errors, 5xx and 429 are
+// transient; any other refusal is final.
+func postPipelineEvent(ctx context.Context, client *http.Client, endpoint string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signPayload(CallbackSecret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errAddressNotAllowed) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrTransient, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%w: receiver answered %d", ErrTransient, resp.StatusCode)
+	}
+	return fmt.Errorf("receiver answered %d", resp.StatusCode)
+}
+
+// ProgressPublisher sends the step transitions of pipelines to the events URL of the
+// service1 instance that accepted them, for its event streams. They are best effort: queued
+// without blocking, dropped when the queue is full, and sent in batches without retries.
+//
+//	PROGRESS_EVENTS          false stops sending step transitions (default true)
+//	PROGRESS_FLUSH_INTERVAL  how long transitions are batched (default 200ms)
+type ProgressPublisher struct {
+	enabled  bool
+	interval time.Duration
+	queue    chan progressEvent
+}
+
+type progressEvent struct {
+	endpoint string
+	event    Event
+}
+
+// progressBatchSize bounds the events of one POST
+const progressBatchSize = 100
+
+var Progress = newProgressPublisher()
+
+func newProgressPublisher() *ProgressPublisher {
+	p := &ProgressPublisher{
+		enabled:  os.Getenv("PROGRESS_EVENTS") != "false",
+		interval: EnvDuration("PROGRESS_FLUSH_INTERVAL", 200*time.Millisecond),
+		queue:    make(chan progressEvent, 1000),
+	}
+	if p.interval <= 0 {
+		p.interval = 200 * time.Millisecond
+	}
+	return p
+}
+
+// publish queues a step transition of message's pipeline
+func (p *ProgressPublisher) Publish(message PipelineMessage, event Event) {
+	if !p.enabled || message.EventsURL == "" {
+		return
+	}
+	select {
+	case p.queue <- progressEvent{endpoint: message.EventsURL, event: event}:
+	default:
+		Metrics.Incr(MetricEventsDropped, Tag("reason", "queue_full"))
+	}
+}
+
+// run sends the queued transitions every interval until ctx is done
+func (p *ProgressPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	batches := make(map[string][]Event)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-p.queue:
+			batches[e.endpoint] = append(batches[e.endpoint], e.event)
+			if len(batches[e.endpoint]) >= progressBatchSize {
+				p.send(ctx, e.endpoint, batches[e.endpoint])
+				delete(batches, e.endpoint)
+			}
+		case <-ticker.C:
+			for endpoint, batch := range batches {
+				p.send(ctx, endpoint, batch)
+			}
+			clear(batches)
+		}
+	}
+}
+
+func (p *ProgressPublisher) send(ctx context.Context, endpoint string, batch []Event) {
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = postPipelineEvent(ctx, eventClient, endpoint, body)
+	}
+	if err != nil {
+		for range batch {
+			Metrics.Incr(MetricEventsDropped, Tag("reason", "send_failed"))
+		}
+		Logger.DebugContext(ctx, "Failed to send progress events",
+			"operation", "progress_events",
+			"events", len(batch),
+			"error", err)
+		return
+	}
+	for range batch {
+		Metrics.Incr(MetricEventsSent)
+	}
+}
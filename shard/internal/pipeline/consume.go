@@ -0,0 +1,268 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQS consumer helpers shared by service2 and service3
+
+// Retry policies of the consumers, see RetryPolicy
+var (
+	// Receive never gives up on a retryable error: the consumer has nothing else to do
+	SQSReceiveRetry = NewRetryPolicy("sqs_receive", 0, 500*time.Millisecond, 20*time.Second)
+	sqsDeleteRetry  = NewRetryPolicy("sqs_delete", 3, 100*time.Millisecond, 2*time.Second)
+)
+
+// sqsBatchSize is how many messages a consumer receives per ReceiveMessage call
+// (SQS_BATCH_SIZE, 1 to 10, default 1)
+func sqsBatchSize() int32 {
+	n, err := strconv.Atoi(os.Getenv("SQS_BATCH_SIZE"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	if n > 10 {
+		return 10
+	}
+	return int32(n)
+}
+
+// consumerSystemAttributes are the SQS system attributes the consumers request
+var consumerSystemAttributes = []types.MessageSystemAttributeName{
+	types.MessageSystemAttributeNameSentTimestamp,
+	types.MessageSystemAttributeNameApproximateReceiveCount,
+	types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp,
+}
+
+// messageCarrier returns the message attributes, which carry the producer's trace context
+func messageCarrier(msg types.Message) map[string]string {
+	carrier := make(map[string]string)
+	for key, attr := range msg.MessageAttributes {
+		if attr.StringValue != nil {
+			carrier[key] = *attr.StringValue
+		}
+	}
+	return carrier
+}
+
+// receiveCount is the message's ApproximateReceiveCount, 0 when it was not requested
+func receiveCount(msg types.Message) int {
+	n, _ := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	return n
+}
+
+// systemTimestamp reads an epoch-milliseconds system attribute such as SentTimestamp
+func systemTimestamp(msg types.Message, name types.MessageSystemAttributeName) (time.Time, bool) {
+	ms, err := strconv.ParseInt(msg.Attributes[string(name)], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// consumerGate pauses the consumer of a service, for a shard drain: while paused it receives
+// nothing, so once the messages it holds are processed it is idle even when the queue, shared
+// with other shards, is not empty. The pause lives in memory, a restarted service consumes again.
+type consumerGate struct {
+	mu        sync.Mutex
+	resumed   *sync.Cond
+	paused    bool
+	receiving bool
+}
+
+var consumer = newConsumerGate()
+
+func newConsumerGate() *consumerGate {
+	g := &consumerGate{}
+	g.resumed = sync.NewCond(&g.mu)
+	return g
+}
+
+// enter waits until the consumer is not paused and marks a receive as running
+func (g *consumerGate) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.resumed.Wait()
+	}
+	g.receiving = true
+}
+
+func (g *consumerGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.receiving = false
+}
+
+func (g *consumerGate) setPaused(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = paused
+	g.resumed.Broadcast()
+}
+
+// state reports whether the consumer is paused and whether a receive is still running:
+// a pause that arrives during a long poll takes effect on the next receive
+func (g *consumerGate) state() (paused, receiving bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.receiving
+}
+
+// ConsumerPauseHandler serves /admin/consumer: POST pauses receiving, DELETE resumes it and
+// GET reports {"paused", "receiving"}. Messages already received are still processed.
+func ConsumerPauseHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		paused := r.Method == http.MethodPost
+		consumer.setPaused(paused)
+		Logger.WarnContext(r.Context(), "Consumer pause changed", "paused", paused)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paused, receiving := consumer.state()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"paused": paused, "receiving": receiving})
+}
+
+// ReceiveMessages long-polls queueURL for the next batch, retrying throttling and
+// transient failures. It blocks while the consumer is paused, see ConsumerPauseHandler.
+func ReceiveMessages(queueURL string) ([]types.Message, error) {
+	consumer.enter()
+	defer consumer.leave()
+	var messages []types.Message
+	err := SQSReceiveRetry.Do(context.Background(), func(ctx context.Context) error {
+		attemptCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		result, err := SQSClient.ReceiveMessage(attemptCtx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    &queueURL,
+			MaxNumberOfMessages:         sqsBatchSize(),
+			WaitTimeSeconds:             20,
+			MessageAttributeNames:       []string{"All"},
+			MessageSystemAttributeNames: consumerSystemAttributes,
+		})
+		if err != nil {
+			return err
+		}
+		messages = result.Messages
+		return nil
+	})
+	return messages, err
+}
+
+// DeleteMessage removes a handled message from queueURL
+func DeleteMessage(ctx context.Context, queueURL string, msg types.Message) error {
+	return sqsDeleteRetry.Do(ctx, func(ctx context.Context) error {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		_, err := SQSClient.DeleteMessage(attemptCtx, &sqs.DeleteMessageInput{
+			QueueUrl:      &queueURL,
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+		return err
+	})
+}
+
+// recordQueueTiming tags span with the SQS timestamps and receive count of msg and emits its
+// queue time and age. Queue time is measured between two SQS timestamps, so unlike the
+// stepN_to_stepM durations it does not depend on the producer's and consumer's clocks.
+func recordQueueTiming(span Span, queue string, msg types.Message) {
+	span.SetTag("messaging.receive_count", receiveCount(msg))
+
+	sent, ok := systemTimestamp(msg, types.MessageSystemAttributeNameSentTimestamp)
+	if !ok {
+		return
+	}
+	span.SetTag("messaging.sqs.sent_timestamp", sent.UnixMilli())
+	age := time.Since(sent)
+	span.SetTag("messaging.sqs.age_ms", age.Milliseconds())
+	Metrics.Timing(MetricSQSMessageAge, age, Tag("queue", queue))
+	Backlog.observeAge(age)
+
+	if firstReceive, ok := systemTimestamp(msg, types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp); ok {
+		queueTime := firstReceive.Sub(sent)
+		span.SetTag("messaging.sqs.first_receive_timestamp", firstReceive.UnixMilli())
+		span.SetTag("messaging.sqs.queue_time_ms", queueTime.Milliseconds())
+		Metrics.Timing(MetricSQSQueueTime, queueTime, Tag("queue", queue))
+	}
+}
+
+// StartMessageSpan starts the consumer span of msg, received from queue. A first delivery
+// continues the producer's trace. A redelivery (visibility timeout expired, or the message was
+// redriven from the DLQ) starts a new trace with a span link to the producer instead, since the
+// original trace has usually finished by then. A message without trace context is tagged
+// messaging.orphaned and counted, and orphaned is true. The span also carries the SQS timing
+// of the message, see recordQueueTiming.
+func StartMessageSpan(operationName, queue string, msg types.Message) (span Span, ctx context.Context, orphaned bool) {
+	carrier := messageCarrier(msg)
+	if count := receiveCount(msg); count > 1 {
+		var missing int
+		span, ctx, missing = Telemetry.StartLinkedSpan(operationName, []map[string]string{carrier}, "redrive")
+		span.SetTag("messaging.redelivered", true)
+		Metrics.Incr(MetricMessagesRedelivered, Tag("queue", queue))
+		orphaned = missing > 0
+	} else {
+		var err error
+		span, ctx, err = Telemetry.StartSpanFromCarrier(operationName, carrier)
+		orphaned = err != nil
+	}
+
+	if orphaned {
+		span.SetTag("messaging.orphaned", true)
+		Metrics.Incr(MetricMessagesOrphaned)
+	}
+	recordQueueTiming(span, queue, msg)
+	return span, ctx, orphaned
+}
+
+// StartBatchSpan starts the span of a received batch, linked to the producer of every
+// message in it, so each producer trace leads to the batch that consumed it
+func StartBatchSpan(operationName string, msgs []types.Message) Span {
+	carriers := make([]map[string]string, 0, len(msgs))
+	for _, msg := range msgs {
+		carriers = append(carriers, messageCarrier(msg))
+	}
+	span, _, orphaned := Telemetry.StartLinkedSpan(operationName, carriers, "batch")
+	span.SetTag("span.kind", "consumer")
+	span.SetTag("messaging.system", "sqs")
+	span.SetTag("messaging.operation", "receive")
+	span.SetTag("messaging.batch.message_count", len(msgs))
+	span.SetTag("messaging.batch.orphaned_count", orphaned)
+	span.SetTag("shard", ShardID)
+	return span
+}
+
+// DispatchBatch processes msgs concurrently, each starting once the limiter allows it, and
+// finishes batchSpan, if any, when all of them are done. It returns when the last message
+// has started, so the consumer only receives more messages while it has room for them.
+func DispatchBatch(msgs []types.Message, batchSpan Span, process func(msg types.Message) Outcome) {
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		started := Limiter.acquire()
+		wg.Add(1)
+		go func(msg types.Message) {
+			defer wg.Done()
+			// A step is run once: its SQS and store calls retry on their own, and a message
+			// that still failed is left on the queue to be redelivered
+			result := process(msg)
+			Backlog.messageProcessed(time.Since(started))
+			Limiter.release(started, result)
+		}(msg)
+	}
+	if batchSpan != nil {
+		go func() {
+			wg.Wait()
+			batchSpan.Finish()
+		}()
+	}
+}
@@ -0,0 +1,167 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestConsumerPauseHandler(t *testing.T) {
+	previous := consumer
+	consumer = newConsumerGate()
+	t.Cleanup(func() { consumer = previous })
+
+	call := func(method string) map[string]bool {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ConsumerPauseHandler(w, httptest.NewRequest(method, "/admin/consumer", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s /admin/consumer = %d", method, w.Code)
+		}
+		var state map[string]bool
+		if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	consumer.enter()
+	if state := call(http.MethodPost); !state["paused"] || !state["receiving"] {
+		t.Errorf("paused during a receive: %v, want paused and still receiving", state)
+	}
+	consumer.leave()
+
+	received := make(chan struct{})
+	go func() {
+		consumer.enter()
+		close(received)
+	}()
+	select {
+	case <-received:
+		t.Fatal("paused consumer started a receive")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if state := call(http.MethodGet); !state["paused"] || state["receiving"] {
+		t.Errorf("paused and idle: %v", state)
+	}
+
+	call(http.MethodDelete)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resume did not let the consumer receive")
+	}
+	consumer.leave()
+
+	w := httptest.NewRecorder()
+	ConsumerPauseHandler(w, httptest.NewRequest(http.MethodPut, "/admin/consumer", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT /admin/consumer = %d, want 405", w.Code)
+	}
+}
+
+// testMessage is an SQS message carrying carrier as string attributes and received count times
+func testMessage(carrier map[string]string, count int) types.Message {
+	msg := types.Message{
+		MessageAttributes: make(map[string]types.MessageAttributeValue),
+		Attributes:        map[string]string{string(types.MessageSystemAttributeNameApproximateReceiveCount): strconv.Itoa(count)},
+	}
+	for key, value := range carrier {
+		msg.MessageAttributes[key] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	return msg
+}
+
+func TestStartMessageSpan(t *testing.T) {
+	tests := []struct {
+		name          string
+		traced        bool
+		receiveCount  int
+		wantOrphaned  bool
+		wantChild     bool
+		wantLink      bool
+		wantRedeliver bool
+	}{
+		{name: "first delivery continues the trace", traced: true, receiveCount: 1, wantChild: true},
+		{name: "first delivery without context", receiveCount: 1, wantOrphaned: true},
+		{name: "redelivery links the producer", traced: true, receiveCount: 3, wantLink: true, wantRedeliver: true},
+		{name: "redelivery without context", receiveCount: 2, wantOrphaned: true, wantRedeliver: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tel := useTracingTelemetry(t)
+			carrier := map[string]string{}
+			var producer trace.SpanContext
+			if tt.traced {
+				carrier, producer = tel.producerCarrier(t)
+			}
+
+			span, _, orphaned := StartMessageSpan("step2.process", "queue2", testMessage(carrier, tt.receiveCount))
+			span.Finish()
+			if orphaned != tt.wantOrphaned {
+				t.Errorf("orphaned = %v, want %v", orphaned, tt.wantOrphaned)
+			}
+			if got, want := tel.counter.count(MetricMessagesOrphaned), boolCount(tt.wantOrphaned); got != want {
+				t.Errorf("%s = %d, want %d", MetricMessagesOrphaned.Name, got, want)
+			}
+			if got, want := tel.counter.count(MetricMessagesRedelivered), boolCount(tt.wantRedeliver); got != want {
+				t.Errorf("%s = %d, want %d", MetricMessagesRedelivered.Name, got, want)
+			}
+
+			recorded := tel.ended(t, "step2.process")
+			if got := recorded.Parent().IsValid() && recorded.Parent().SpanID() == producer.SpanID(); got != tt.wantChild {
+				t.Errorf("child of the producer = %v, want %v", got, tt.wantChild)
+			}
+			if got := len(recorded.Links()) == 1 && recorded.Links()[0].SpanContext.SpanID() == producer.SpanID(); got != tt.wantLink {
+				t.Errorf("linked to the producer = %v, want %v", got, tt.wantLink)
+			}
+			if got := hasAttribute(recorded.Attributes(), attribute.Bool("messaging.orphaned", true)); got != tt.wantOrphaned {
+				t.Errorf("messaging.orphaned tag = %v, want %v", got, tt.wantOrphaned)
+			}
+			if !hasAttribute(recorded.Attributes(), attribute.Int("messaging.receive_count", tt.receiveCount)) {
+				t.Errorf("attributes = %v, want messaging.receive_count %d", recorded.Attributes(), tt.receiveCount)
+			}
+		})
+	}
+}
+
+func TestStartBatchSpanCountsOrphans(t *testing.T) {
+	tel := useTracingTelemetry(t)
+	first, _ := tel.producerCarrier(t)
+	second, _ := tel.producerCarrier(t)
+	msgs := []types.Message{testMessage(first, 1), testMessage(nil, 1), testMessage(second, 2)}
+
+	StartBatchSpan("step2.receive", msgs).Finish()
+
+	recorded := tel.ended(t, "step2.receive")
+	if got := len(recorded.Links()); got != 2 {
+		t.Errorf("links = %d, want one per traced message", got)
+	}
+	for _, want := range []attribute.KeyValue{
+		attribute.Int("messaging.batch.message_count", 3),
+		attribute.Int("messaging.batch.orphaned_count", 1),
+	} {
+		if !hasAttribute(recorded.Attributes(), want) {
+			t.Errorf("attributes = %v, want %v", recorded.Attributes(), want)
+		}
+	}
+	// The batch span does not count orphans; each message's span does
+	if got := tel.counter.count(MetricMessagesOrphaned); got != 0 {
+		t.Errorf("%s = %d, want 0", MetricMessagesOrphaned.Name, got)
+	}
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"math"
+	"path"
+	"sync"
+	"time"
+)
+
+// limitBackoff is the factor the concurrency limit is multiplied by on overload
+const limitBackoff = 0.9
+
+// ConcurrencyLimiter adapts how many messages a consumer processes at once (AIMD). A message
+// that succeeds within the latency target while the limit is in use grows the limit by
+// 1/limit, about one per round of limit messages. A dependency or server error, or a message
+// slower than the target, multiplies it by limitBackoff. Only messages started after the
+// last decrease can decrease it again, so one slow round backs off once.
+//
+//	CONSUMER_MIN_CONCURRENCY  lower bound and starting limit (default 1)
+//	CONSUMER_MAX_CONCURRENCY  upper bound (default 10)
+//	CONSUMER_LATENCY_TARGET   processing time above which a message counts as overload (default 1s)
+type ConcurrencyLimiter struct {
+	queue    string
+	min, max int
+	target   time.Duration
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	limit        float64
+	inFlight     int
+	lastDecrease time.Time
+}
+
+// Limiter bounds the consumer's in-flight messages, nil until main creates it
+var Limiter *ConcurrencyLimiter
+
+func NewConcurrencyLimiter(queueURL string) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		queue:  path.Base(queueURL),
+		min:    EnvInt("CONSUMER_MIN_CONCURRENCY", 1),
+		max:    EnvInt("CONSUMER_MAX_CONCURRENCY", 10),
+		target: EnvDuration("CONSUMER_LATENCY_TARGET", time.Second),
+	}
+	if l.min < 1 {
+		l.min = 1
+	}
+	if l.max < l.min {
+		l.max = l.min
+	}
+	if l.target <= 0 {
+		l.target = time.Second
+	}
+	l.limit = float64(l.min)
+	l.cond = sync.NewCond(&l.mu)
+	Metrics.Gauge(MetricConcurrencyLimit, l.limit, Tag("queue", l.queue))
+	return l
+}
+
+// acquire blocks until a message may start and returns its start time for release
+func (l *ConcurrencyLimiter) acquire() time.Time {
+	l.mu.Lock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	inFlight := l.inFlight
+	l.mu.Unlock()
+
+	Metrics.Gauge(MetricConsumerInFlight, float64(inFlight), Tag("queue", l.queue))
+	return time.Now()
+}
+
+// release ends a message started at started and adjusts the limit from its outcome
+func (l *ConcurrencyLimiter) release(started time.Time, result Outcome) {
+	elapsed := time.Since(started)
+	l.mu.Lock()
+	previous := l.limit
+	reason := l.adjust(started, elapsed, result)
+	l.inFlight--
+	limit, inFlight := l.limit, l.inFlight
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	queue := Tag("queue", l.queue)
+	Metrics.Gauge(MetricConsumerInFlight, float64(inFlight), queue)
+	if limit != previous {
+		Metrics.Gauge(MetricConcurrencyLimit, limit, queue)
+	}
+	if reason != "" {
+		Metrics.Incr(MetricConcurrencyLimitDecreases, queue, Tag("reason", reason))
+		Logger.Debug("Consumer concurrency limit decreased",
+			"queue", l.queue,
+			"reason", reason,
+			"limit", int(limit),
+			"duration_ms", elapsed.Milliseconds())
+	}
+}
+
+// adjust applies one sample to the limit and returns why it decreased, if it did.
+// Client and business errors say nothing about downstream load and leave it unchanged.
+func (l *ConcurrencyLimiter) adjust(started time.Time, elapsed time.Duration, result Outcome) string {
+	var reason string
+	switch {
+	case result == OutcomeDependencyError || result == OutcomeServerError:
+		reason = "error"
+	case elapsed > l.target:
+		reason = "latency"
+	case result != OutcomeSuccess:
+		return ""
+	}
+
+	if reason == "" {
+		// Growing an unused limit would only allow a burst later
+		if float64(l.inFlight)*2 >= l.limit {
+			l.limit = math.Min(float64(l.max), l.limit+1/l.limit)
+		}
+		return ""
+	}
+	if started.Before(l.lastDecrease) || l.limit <= float64(l.min) {
+		return ""
+	}
+	l.limit = math.Max(float64(l.min), math.Floor(l.limit*limitBackoff))
+	l.lastDecrease = time.Now()
+	return reason
+}
+
+// current is the limit as a worker count
+func (l *ConcurrencyLimiter) Current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// active is how many messages are being processed
+func (l *ConcurrencyLimiter) active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLimiter(min, max int, limit float64) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{queue: "test", min: min, max: max, target: time.Second, limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func TestConcurrencyLimiterAdditiveIncrease(t *testing.T) {
+	l := testLimiter(1, 4, 1)
+	// Each full round of successes, with the limit in use, grows it by about one
+	var limits []int
+	for range 12 {
+		l.inFlight = int(l.limit)
+		if reason := l.adjust(time.Now(), 10*time.Millisecond, OutcomeSuccess); reason != "" {
+			t.Fatalf("success decreased the limit: %s", reason)
+		}
+		limits = append(limits, int(l.limit))
+	}
+	want := []int{2, 2, 2, 3, 3, 3, 4, 4, 4, 4, 4, 4}
+	for i := range want {
+		if limits[i] != want[i] {
+			t.Fatalf("limits = %v, want %v", limits, want)
+		}
+	}
+	if l.limit != 4 {
+		t.Errorf("limit = %v, want it capped at the max, 4", l.limit)
+	}
+}
+
+func TestConcurrencyLimiterUnusedLimitDoesNotGrow(t *testing.T) {
+	l := testLimiter(1, 20, 8)
+	l.inFlight = 3
+	l.adjust(time.Now(), 10*time.Millisecond, OutcomeSuccess)
+	if l.limit != 8 {
+		t.Errorf("limit = %v, want 8 while less than half of it is in use", l.limit)
+	}
+}
+
+func TestConcurrencyLimiterMultiplicativeDecrease(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      float64
+		elapsed    time.Duration
+		result     Outcome
+		wantLimit  float64
+		wantReason string
+	}{
+		{"dependency error", 10, 10 * time.Millisecond, OutcomeDependencyError, 9, "error"},
+		{"server error", 10, 10 * time.Millisecond, OutcomeServerError, 9, "error"},
+		{"slower than the target", 10, 2 * time.Second, OutcomeSuccess, 9, "latency"},
+		{"rounds down", 5.5, 10 * time.Millisecond, OutcomeServerError, 4, "error"},
+		{"stops at the min", 2.5, 10 * time.Millisecond, OutcomeServerError, 2, "error"},
+		{"at the min", 2, 10 * time.Millisecond, OutcomeServerError, 2, ""},
+		{"client error", 10, 10 * time.Millisecond, OutcomeClientError, 10, ""},
+		{"business error", 10, 10 * time.Millisecond, OutcomeBusinessError, 10, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testLimiter(2, 20, tt.limit)
+			l.inFlight = 1
+			reason := l.adjust(time.Now(), tt.elapsed, tt.result)
+			if l.limit != tt.wantLimit || reason != tt.wantReason {
+				t.Errorf("adjust = %v, %q, want %v, %q", l.limit, reason, tt.wantLimit, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterBacksOffOncePerRound(t *testing.T) {
+	l := testLimiter(1, 20, 10)
+	round := time.Now()
+	l.adjust(round, 10*time.Millisecond, OutcomeServerError)
+	// The rest of the round started before the decrease and leaves the limit alone
+	for range 5 {
+		if reason := l.adjust(round, 2*time.Second, OutcomeSuccess); reason != "" {
+			t.Fatalf("message started before the decrease decreased the limit again: %s", reason)
+		}
+	}
+	if l.limit != 9 {
+		t.Fatalf("limit = %v, want 9 after one backoff", l.limit)
+	}
+
+	next := l.lastDecrease.Add(time.Millisecond)
+	if reason := l.adjust(next, 10*time.Millisecond, OutcomeServerError); reason != "error" || l.limit != 8 {
+		t.Errorf("message started after the decrease: %v, %q, want 8, error", l.limit, reason)
+	}
+}
+
+func TestConcurrencyLimiterBlocksAtTheLimit(t *testing.T) {
+	useTestTelemetry(t)
+	l := testLimiter(1, 1, 1)
+	started := l.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		l.release(l.acquire(), OutcomeSuccess)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	l.release(started, OutcomeSuccess)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("release did not let the waiting message start")
+	}
+	if n := l.active(); n != 0 {
+		t.Errorf("active = %d, want 0", n)
+	}
+}
+
+func TestNewConcurrencyLimiterBounds(t *testing.T) {
+	useTestTelemetry(t)
+	tests := []struct {
+		min, max, latency string
+		wantMin, wantMax  int
+		wantTarget        time.Duration
+	}{
+		{"", "", "", 1, 10, time.Second},
+		{"3", "8", "250ms", 3, 8, 250 * time.Millisecond},
+		{"0", "5", "", 1, 5, time.Second},
+		{"6", "2", "", 6, 6, time.Second},
+		{"", "", "-1s", 1, 10, time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("CONSUMER_MIN_CONCURRENCY", tt.min)
+		t.Setenv("CONSUMER_MAX_CONCURRENCY", tt.max)
+		t.Setenv("CONSUMER_LATENCY_TARGET", tt.latency)
+		l := NewConcurrencyLimiter("https://sqs.us-east-1.amazonaws.com/123/step1-queue")
+		if l.min != tt.wantMin || l.max != tt.wantMax || l.target != tt.wantTarget || l.Current() != tt.wantMin {
+			t.Errorf("min %q, max %q, latency %q: got %d..%d, %s, starting at %d, want %d..%d, %s, starting at the min",
+				tt.min, tt.max, tt.latency, l.min, l.max, l.target, l.Current(), tt.wantMin, tt.wantMax, tt.wantTarget)
+		}
+		if l.queue != "step1-queue" {
+			t.Errorf("queue = %q, want step1-queue", l.queue)
+		}
+	}
+}
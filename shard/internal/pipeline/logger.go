@@ -0,0 +1,324 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is the service logger. Records logged with a context get the trace and span IDs
+// of the active span and the pipeline fields stored with WithLogContext, so log calls
+// never have to repeat them.
+var Logger = slog.Default()
+
+// logLevel can be changed at runtime through /admin/log-level
+var logLevel = new(slog.LevelVar)
+
+// logSampling drops repeated info and debug records, see NewLogger
+var logSampling *logSampler
+
+type logContextKey struct{}
+
+type logContext struct {
+	correlationID string
+	step          int
+}
+
+// WithLogContext attaches the correlation ID and pipeline step to ctx for logging
+func WithLogContext(ctx context.Context, correlationID string, step int) context.Context {
+	return context.WithValue(ctx, logContextKey{}, logContext{correlationID: correlationID, step: step})
+}
+
+// NewLogger builds the service logger from the environment:
+//
+//	LOG_OUTPUT             comma separated sinks: stdout, stderr, file, syslog (default file)
+//	LOG_FORMAT             json (default) or text
+//	LOG_LEVEL              debug, info (default), warn, error; changeable through /admin/log-level
+//	LOG_FILE               file sink path (default defaultFile)
+//	LOG_MAX_SIZE_MB        rotate the file when it reaches this size (default 100)
+//	LOG_ROTATE_INTERVAL    rotate the file this often, 0 to disable (default 24h)
+//	LOG_MAX_BACKUPS        rotated files to keep (default 7)
+//	LOG_MAX_AGE            delete rotated files older than this, 0 to keep them (default 168h)
+//	LOG_SYSLOG_ADDR        syslog address, e.g. udp://host:514 or unix:///dev/log (default: local syslog/journald)
+//	LOG_SAMPLE_FIRST       info and debug records kept per message and second, 0 disables sampling (default 100)
+//	LOG_SAMPLE_THEREAFTER  past LOG_SAMPLE_FIRST, keep one record in this many (default 100)
+//
+// Sinks that cannot be opened are reported through the returned logger; when none can be
+// opened it logs to stdout. The returned function closes the sinks.
+func NewLogger(service, defaultFile string) (*slog.Logger, func()) {
+	var problems []string
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid LOG_LEVEL %q, using %s", v, logLevel.Level()))
+		}
+	}
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		// Reads the global at emission time, so rules loaded after the logger still apply
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr { return Redaction.replaceAttr(groups, a) },
+	}
+
+	var handlers []slog.Handler
+	var closers []io.Closer
+	outputs := os.Getenv("LOG_OUTPUT")
+	if outputs == "" {
+		outputs = "file"
+	}
+	for _, output := range strings.Split(outputs, ",") {
+		switch output = strings.ToLower(strings.TrimSpace(output)); output {
+		case "stdout":
+			handlers = append(handlers, newFormatHandler(os.Stdout, opts))
+		case "stderr":
+			handlers = append(handlers, newFormatHandler(os.Stderr, opts))
+		case "file":
+			path := os.Getenv("LOG_FILE")
+			if path == "" {
+				path = defaultFile
+			}
+			f, err := openRotatingFile(path, rotationFromEnv())
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			handlers = append(handlers, newFormatHandler(f, opts))
+			closers = append(closers, f)
+		case "syslog":
+			h, w, err := newSyslogHandler(os.Getenv("LOG_SYSLOG_ADDR"), service, opts)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			handlers = append(handlers, h)
+			closers = append(closers, w)
+		default:
+			problems = append(problems, fmt.Sprintf("unknown LOG_OUTPUT %q", output))
+		}
+	}
+	if len(handlers) == 0 {
+		handlers = append(handlers, newFormatHandler(os.Stdout, opts))
+	}
+
+	var handler slog.Handler = fanoutHandler(handlers)
+	if len(handlers) == 1 {
+		handler = handlers[0]
+	}
+	logSampling = newLogSampler(EnvInt("LOG_SAMPLE_FIRST", 100), EnvInt("LOG_SAMPLE_THEREAFTER", 100))
+	attrs := []any{slog.String("service", service)}
+	// The router and the registry are not part of a shard
+	if ShardID != "" {
+		attrs = append(attrs, slog.String("shard", ShardID))
+	}
+	l := slog.New(contextHandler{samplingHandler{handler, logSampling}}).With(
+		append(attrs, slog.String("version", ServiceVersion), slog.String("env", "pipeline"))...,
+	)
+	for _, p := range problems {
+		l.Warn("Log configuration problem", "error", p)
+	}
+	return l, func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+}
+
+// newFormatHandler returns the LOG_FORMAT handler writing to w
+func newFormatHandler(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+func EnvInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func EnvDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// contextHandler adds the fields carried by the record's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if Telemetry != nil {
+		if span := Telemetry.SpanFromContext(ctx); span != nil {
+			r.AddAttrs(slog.String("dd.trace_id", span.TraceID()), slog.String("dd.span_id", span.SpanID()))
+		}
+	}
+	if lc, ok := ctx.Value(logContextKey{}).(logContext); ok {
+		if lc.correlationID != "" {
+			r.AddAttrs(slog.String("correlation.id", lc.correlationID))
+		}
+		if lc.step > 0 {
+			r.AddAttrs(slog.Int("pipeline.step", lc.step))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fanoutHandler sends each record to every sink
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, handler := range h {
+		if !handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// logSampler keeps the first records of each message every second, then one in
+// thereafter. Warnings and errors are never sampled.
+type logSampler struct {
+	first      int
+	thereafter int
+
+	mu      sync.Mutex
+	second  int64
+	counts  map[string]int
+	dropped int64
+}
+
+func newLogSampler(first, thereafter int) *logSampler {
+	return &logSampler{first: first, thereafter: thereafter, counts: make(map[string]int)}
+}
+
+func (s *logSampler) allow(r slog.Record) bool {
+	if s.first <= 0 || r.Level >= slog.LevelWarn {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec := r.Time.Unix(); sec != s.second {
+		s.second = sec
+		clear(s.counts)
+	}
+	s.counts[r.Message]++
+	n := s.counts[r.Message]
+	if n <= s.first || (s.thereafter > 0 && (n-s.first)%s.thereafter == 0) {
+		return true
+	}
+	s.dropped++
+	return false
+}
+
+func (s *logSampler) droppedCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+type samplingHandler struct {
+	slog.Handler
+	sampler *logSampler
+}
+
+func (h samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.sampler.allow(r) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return samplingHandler{h.Handler.WithAttrs(attrs), h.sampler}
+}
+
+func (h samplingHandler) WithGroup(name string) slog.Handler {
+	return samplingHandler{h.Handler.WithGroup(name), h.sampler}
+}
+
+// LogLevelHandler serves /admin/log-level: GET returns the level, PUT {"level": "debug"} changes it
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid log level request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+			http.Error(w, "Invalid log level: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		previous := logLevel.Level()
+		logLevel.Set(level)
+		// Logged at warn so the change is recorded whatever the new level
+		Logger.WarnContext(r.Context(), "Log level changed", "from", previous.String(), "to", level.String())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := map[string]interface{}{"level": strings.ToLower(logLevel.Level().String())}
+	if logSampling != nil {
+		response["sampled_out"] = logSampling.droppedCount()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LogFatal logs at error level and exits, like logrus' Fatal
+func LogFatal(msg string, args ...any) {
+	Logger.Error(msg, args...)
+	os.Exit(1)
+}
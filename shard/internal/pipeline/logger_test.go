@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// testSpan is a span with fixed IDs for log correlation
+type testSpan struct {
+	Span
+	traceID, spanID string
+}
+
+func (s testSpan) TraceID() string { return s.traceID }
+func (s testSpan) SpanID() string  { return s.spanID }
+
+// spanTelemetry returns the span stored in the context under spanKey
+type spanTelemetry struct {
+	testTelemetry
+}
+
+type spanKey struct{}
+
+func (tel *spanTelemetry) SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+func TestContextHandlerAddsContextFields(t *testing.T) {
+	withSpan := context.WithValue(context.Background(), spanKey{}, testSpan{traceID: "123", spanID: "456"})
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want map[string]interface{}
+		// absent are keys the record must not carry
+		absent []string
+	}{
+		{
+			name:   "no context fields",
+			ctx:    context.Background(),
+			absent: []string{"dd.trace_id", "dd.span_id", "correlation.id", "pipeline.step"},
+		},
+		{
+			name:   "active span",
+			ctx:    withSpan,
+			want:   map[string]interface{}{"dd.trace_id": "123", "dd.span_id": "456"},
+			absent: []string{"correlation.id", "pipeline.step"},
+		},
+		{
+			name:   "correlation ID and step",
+			ctx:    WithLogContext(context.Background(), "corr-1", 2),
+			want:   map[string]interface{}{"correlation.id": "corr-1", "pipeline.step": float64(2)},
+			absent: []string{"dd.trace_id"},
+		},
+		{
+			name:   "step 0 is left out",
+			ctx:    WithLogContext(context.Background(), "corr-1", 0),
+			want:   map[string]interface{}{"correlation.id": "corr-1"},
+			absent: []string{"pipeline.step"},
+		},
+		{
+			name: "span and log context",
+			ctx:  WithLogContext(withSpan, "corr-2", 3),
+			want: map[string]interface{}{"dd.trace_id": "123", "correlation.id": "corr-2", "pipeline.step": float64(3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := Telemetry
+			Telemetry = &spanTelemetry{}
+			t.Cleanup(func() { Telemetry = previous })
+
+			var buf bytes.Buffer
+			logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}).With("service", "service1")
+			logger.InfoContext(tt.ctx, "Message processed")
+
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			if record["service"] != "service1" {
+				t.Errorf("service = %v, want the logger's attributes kept", record["service"])
+			}
+			for key, want := range tt.want {
+				if record[key] != want {
+					t.Errorf("%s = %v, want %v", key, record[key], want)
+				}
+			}
+			for _, key := range tt.absent {
+				if v, ok := record[key]; ok {
+					t.Errorf("%s = %v, want it absent", key, v)
+				}
+			}
+		})
+	}
+}
+
+func TestContextHandlerWithoutTelemetry(t *testing.T) {
+	previous := Telemetry
+	Telemetry = nil
+	t.Cleanup(func() { Telemetry = previous })
+
+	var buf bytes.Buffer
+	slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}).InfoContext(WithLogContext(context.Background(), "corr-1", 1), "Started")
+	if !bytes.Contains(buf.Bytes(), []byte(`"correlation.id":"corr-1"`)) {
+		t.Errorf("record = %s, want the correlation ID", buf.Bytes())
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	second := time.Unix(1_700_000_000, 0)
+	record := func(at time.Time, level slog.Level, msg string) slog.Record {
+		return slog.NewRecord(at, level, msg, 0)
+	}
+	tests := []struct {
+		name        string
+		first       int
+		thereafter  int
+		records     []slog.Record
+		wantAllowed int
+	}{
+		{
+			name:        "disabled",
+			first:       0,
+			records:     repeatRecord(record(second, slog.LevelInfo, "a"), 10),
+			wantAllowed: 10,
+		},
+		{
+			name:        "first then one in thereafter",
+			first:       2,
+			thereafter:  3,
+			records:     repeatRecord(record(second, slog.LevelInfo, "a"), 11),
+			wantAllowed: 5, // 1, 2, 5, 8, 11
+		},
+		{
+			name:        "drop everything past first",
+			first:       2,
+			thereafter:  0,
+			records:     repeatRecord(record(second, slog.LevelDebug, "a"), 5),
+			wantAllowed: 2,
+		},
+		{
+			name:        "counted per message",
+			first:       1,
+			thereafter:  0,
+			records:     append(repeatRecord(record(second, slog.LevelInfo, "a"), 3), repeatRecord(record(second, slog.LevelInfo, "b"), 3)...),
+			wantAllowed: 2,
+		},
+		{
+			name:        "counts reset every second",
+			first:       1,
+			thereafter:  0,
+			records:     append(repeatRecord(record(second, slog.LevelInfo, "a"), 3), repeatRecord(record(second.Add(time.Second), slog.LevelInfo, "a"), 3)...),
+			wantAllowed: 2,
+		},
+		{
+			name:        "warnings are never sampled",
+			first:       1,
+			thereafter:  0,
+			records:     repeatRecord(record(second, slog.LevelWarn, "a"), 4),
+			wantAllowed: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLogSampler(tt.first, tt.thereafter)
+			allowed := 0
+			for _, r := range tt.records {
+				if s.allow(r) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed %d records, want %d", allowed, tt.wantAllowed)
+			}
+			if got, want := s.droppedCount(), int64(len(tt.records)-tt.wantAllowed); got != want {
+				t.Errorf("droppedCount = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func repeatRecord(r slog.Record, n int) []slog.Record {
+	records := make([]slog.Record, n)
+	for i := range records {
+		records[i] = r
+	}
+	return records
+}
@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotationConfig controls when the file sink rotates and how many old files it keeps
+type rotationConfig struct {
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+func rotationFromEnv() rotationConfig {
+	return rotationConfig{
+		MaxSize:    int64(EnvInt("LOG_MAX_SIZE_MB", 100)) << 20,
+		Interval:   EnvDuration("LOG_ROTATE_INTERVAL", 24*time.Hour),
+		MaxBackups: EnvInt("LOG_MAX_BACKUPS", 7),
+		MaxAge:     EnvDuration("LOG_MAX_AGE", 7*24*time.Hour),
+	}
+}
+
+// rotatingFile is a log file that is renamed to <name>-<timestamp><ext> when it grows
+// past MaxSize or gets older than Interval. Rotated files beyond MaxBackups or older than
+// MaxAge are deleted. The shard ID is added to the rotated names when the path lacks it, so
+// shards sharing a log directory never prune each other's files.
+type rotatingFile struct {
+	path   string
+	prefix string // of rotated files, up to the timestamp
+	cfg    rotationConfig
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, cfg rotationConfig) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, prefix: backupPrefix(path, ShardID), cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+// rotatedTimestamp is the timestamp of rotated files; rotatedGlob matches exactly it
+const (
+	rotatedTimestamp = "20060102T150405.000"
+	rotatedGlob      = "[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T[0-9][0-9][0-9][0-9][0-9][0-9].[0-9][0-9][0-9]"
+)
+
+func backupPrefix(path, shard string) string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if shard != "" && !strings.Contains(filepath.Base(base), shard) {
+		base += "-" + shard
+	}
+	return base + "-"
+}
+
+func (f *rotatingFile) open() error {
+	if dir := filepath.Dir(f.path); dir != "." {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("failed to create log directory %s: %w", dir, err)
+		}
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file %s: %w", f.path, err)
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.cfg.MaxSize
+	tooOld := f.cfg.Interval > 0 && time.Since(f.opened) >= f.cfg.Interval
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the current file rather than losing records
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	backup := f.prefix + time.Now().Format(rotatedTimestamp) + filepath.Ext(f.path)
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, backup); err != nil {
+		// Reopen the original so writes continue
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.prune()
+	return nil
+}
+
+// prune deletes rotated files past the retention limits
+func (f *rotatingFile) prune() {
+	// Only this file's timestamps, not the files of a shard whose ID extends this one's
+	backups, err := filepath.Glob(f.prefix + rotatedGlob + filepath.Ext(f.path))
+	if err != nil {
+		return
+	}
+	// Timestamps sort chronologically, newest last
+	sort.Strings(backups)
+	for i, path := range backups {
+		expired := f.cfg.MaxBackups > 0 && i < len(backups)-f.cfg.MaxBackups
+		if !expired && f.cfg.MaxAge > 0 {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > f.cfg.MaxAge {
+				expired = true
+			}
+		}
+		if expired {
+			os.Remove(path)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// syslogHandler formats records with the LOG_FORMAT handler and sends each one to syslog
+// with the priority matching its level, so journald and syslog filters work on severity
+type syslogHandler struct {
+	format slog.Handler
+	state  *syslogState
+}
+
+type syslogState struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writer *syslog.Writer
+}
+
+// newSyslogHandler connects to addr ("udp://host:514", "unix:///dev/log"), or to the local
+// syslog daemon when addr is empty
+func newSyslogHandler(addr, tag string, opts *slog.HandlerOptions) (slog.Handler, *syslog.Writer, error) {
+	var network, raddr string
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Scheme == "" {
+			return nil, nil, fmt.Errorf("invalid LOG_SYSLOG_ADDR %q, expected e.g. udp://host:514", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+		if network == "unix" || network == "unixgram" {
+			raddr = u.Path
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	state := &syslogState{writer: w}
+	return syslogHandler{format: newFormatHandler(&state.buf, opts), state: state}, w, nil
+}
+
+func (h syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.format.Enabled(ctx, level)
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	h.state.buf.Reset()
+	if err := h.format.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.state.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.state.writer.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.state.writer.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.state.writer.Info(msg)
+	default:
+		return h.state.writer.Debug(msg)
+	}
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{format: h.format.WithAttrs(attrs), state: h.state}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{format: h.format.WithGroup(name), state: h.state}
+}
@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBackupPrefix(t *testing.T) {
+	tests := []struct {
+		path, shard, want string
+	}{
+		{"logs/service1.log", "", "logs/service1-"},
+		{"logs/service1.log", "shard-1", "logs/service1-shard-1-"},
+		{"logs/service1-shard-1.log", "shard-1", "logs/service1-shard-1-"},
+		{"logs/shard-1/service1.log", "shard-1", "logs/shard-1/service1-shard-1-"},
+		{"service1", "shard-2", "service1-shard-2-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+"/"+tt.shard, func(t *testing.T) {
+			if got := backupPrefix(tt.path, tt.shard); got != tt.want {
+				t.Errorf("backupPrefix = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotationFromEnv(t *testing.T) {
+	t.Setenv("LOG_MAX_SIZE_MB", "5")
+	t.Setenv("LOG_ROTATE_INTERVAL", "1h")
+	t.Setenv("LOG_MAX_BACKUPS", "2")
+	t.Setenv("LOG_MAX_AGE", "invalid")
+
+	want := rotationConfig{MaxSize: 5 << 20, Interval: time.Hour, MaxBackups: 2, MaxAge: 7 * 24 * time.Hour}
+	if got := rotationFromEnv(); got != want {
+		t.Errorf("rotationFromEnv = %+v, want %+v", got, want)
+	}
+}
+
+func TestRotatingFileRotatesOnSize(t *testing.T) {
+	useShardID(t, "shard-1")
+	path := filepath.Join(t.TempDir(), "service1.log")
+	f, err := openRotatingFile(path, rotationConfig{MaxSize: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"12345\n", "6789\n", "abcdef\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "service1-shard-1-"+rotatedGlob+".log"))
+	if len(backups) != 1 {
+		t.Fatalf("backups = %v, want one", backups)
+	}
+	assertFileContent(t, backups[0], "12345\n6789\n")
+	assertFileContent(t, path, "abcdef\n")
+}
+
+func TestRotatingFilePrunesOnlyItsShardsBackups(t *testing.T) {
+	useShardID(t, "shard-1")
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		name    string
+		modTime time.Time
+	}{
+		{"service1-shard-1-20260101T000000.000.log", old},
+		{"service1-shard-1-20260102T000000.000.log", time.Now()},
+		{"service1-shard-1-20260103T000000.000.log", time.Now()},
+		{"service1-shard-1-20260104T000000.000.log", time.Now()},
+		// Another shard whose ID extends this one's, and a file that is not a backup
+		{"service1-shard-10-20260101T000000.000.log", old},
+		{"service1-shard-1-notes.log", old},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, nil, 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.modTime, file.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		cfg  rotationConfig
+		want []string
+	}{
+		{
+			name: "no limits",
+			cfg:  rotationConfig{},
+			want: []string{"20260101", "20260102", "20260103", "20260104"},
+		},
+		{
+			name: "max age",
+			cfg:  rotationConfig{MaxAge: 24 * time.Hour},
+			want: []string{"20260102", "20260103", "20260104"},
+		},
+		{
+			name: "max backups",
+			cfg:  rotationConfig{MaxBackups: 2},
+			want: []string{"20260103", "20260104"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openRotatingFile(filepath.Join(dir, "service1.log"), tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			var kept []string
+			backups, _ := filepath.Glob(filepath.Join(dir, "service1-shard-1-"+rotatedGlob+".log"))
+			for _, path := range backups {
+				kept = append(kept, filepath.Base(path)[len("service1-shard-1-"):][:8])
+			}
+			if !slices.Equal(kept, tt.want) {
+				t.Errorf("kept %v, want %v", kept, tt.want)
+			}
+			for _, other := range []string{"service1-shard-10-20260101T000000.000.log", "service1-shard-1-notes.log"} {
+				if _, err := os.Stat(filepath.Join(dir, other)); err != nil {
+					t.Errorf("%s was pruned: %v", other, err)
+				}
+			}
+		})
+	}
+}
+
+func useShardID(t *testing.T, shard string) {
+	t.Helper()
+	previous := ShardID
+	ShardID = shard
+	t.Cleanup(func() { ShardID = previous })
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s = %q, want %q", filepath.Base(path), got, want)
+	}
+}
@@ -0,0 +1,259 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// metricKind is how a metric is submitted to the telemetry backend
+type metricKind string
+
+const (
+	metricCount  metricKind = "count"
+	metricTiming metricKind = "timing"
+	metricGauge  metricKind = "gauge"
+)
+
+// MetricDef is a named pipeline metric. Every submission carries the base tags
+// (service, shard, version, env) plus exactly the keys listed in Tags; a declared
+// tag the call site does not set is sent as "none" so dashboards can always group by it.
+// Services that do not belong to a shard (router, registry) have no shard base tag and
+// declare shard as a tag of the metrics that are about one.
+type MetricDef struct {
+	Name        string
+	Kind        metricKind
+	Description string
+	Tags        []string
+}
+
+// Pipeline metric definitions, the one catalogue every service and the dashboard
+// tooling share.
+var (
+	// HTTP SLIs
+	MetricRequestsTotal   = MetricDef{Name: "sli.requests.total", Kind: metricCount, Description: "HTTP requests received, one per request", Tags: []string{"endpoint", "outcome"}}
+	MetricRequestsSuccess = MetricDef{Name: "sli.requests.success", Kind: metricCount, Description: "HTTP requests that succeeded", Tags: []string{"endpoint"}}
+	MetricRequestsError   = MetricDef{Name: "sli.requests.error", Kind: metricCount, Description: "HTTP requests that failed", Tags: []string{"endpoint", "outcome", "error_type"}}
+	MetricResponseTime    = MetricDef{Name: "sli.response_time", Kind: metricTiming, Description: "HTTP response time", Tags: []string{"endpoint"}}
+	MetricRequestsLatency = MetricDef{Name: "sli.requests.latency", Kind: metricCount, Description: "Cumulative latency buckets: requests answered within le", Tags: []string{"endpoint", "le"}}
+
+	// Message processing SLIs
+	MetricProcessingTotal   = MetricDef{Name: "sli.processing.total", Kind: metricCount, Description: "Messages processed, one per message", Tags: []string{"operation", "outcome"}}
+	MetricProcessingSuccess = MetricDef{Name: "sli.processing.success", Kind: metricCount, Description: "Messages processed successfully", Tags: []string{"operation"}}
+	MetricProcessingError   = MetricDef{Name: "sli.processing.error", Kind: metricCount, Description: "Messages that failed processing", Tags: []string{"operation", "outcome", "error_type"}}
+	MetricProcessingTime    = MetricDef{Name: "sli.processing_time", Kind: metricTiming, Description: "Message processing time", Tags: []string{"operation"}}
+	MetricProcessingLatency = MetricDef{Name: "sli.processing.latency", Kind: metricCount, Description: "Cumulative latency buckets: messages processed within le", Tags: []string{"operation", "le"}}
+
+	// End-to-end pipeline SLIs
+	MetricPipelineDuration   = MetricDef{Name: "sli.pipeline.duration", Kind: metricTiming, Description: "Duration of a pipeline step, or of the whole pipeline for step end_to_end", Tags: []string{"step"}}
+	MetricPipelineTotal      = MetricDef{Name: "sli.pipeline.total", Kind: metricCount, Description: "Pipelines that reached the last step", Tags: []string{"pipeline"}}
+	MetricPipelineSuccess    = MetricDef{Name: "sli.pipeline.success", Kind: metricCount, Description: "Pipelines completed successfully", Tags: []string{"pipeline"}}
+	MetricPipelineUnder300ms = MetricDef{Name: "sli.pipeline.under_300ms", Kind: metricCount, Description: "Pipelines completed end to end within 300ms", Tags: []string{"pipeline"}}
+	MetricPipelineUnder1s    = MetricDef{Name: "sli.pipeline.under_1s", Kind: metricCount, Description: "Pipelines completed end to end within 1s", Tags: []string{"pipeline"}}
+
+	// SLO engine
+	MetricSLOSLI         = MetricDef{Name: "slo.sli", Kind: metricGauge, Description: "SLI over the SLO window", Tags: []string{"slo"}}
+	MetricSLOErrorBudget = MetricDef{Name: "slo.error_budget.remaining", Kind: metricGauge, Description: "Fraction of the error budget left in the SLO window", Tags: []string{"slo"}}
+	MetricSLOBurnRate    = MetricDef{Name: "slo.burn_rate", Kind: metricGauge, Description: "Error budget burn rate over window (1 = on budget)", Tags: []string{"slo", "window"}}
+
+	// Business metrics
+	MetricStep1Duration           = MetricDef{Name: "business.pipeline.step1.duration", Kind: metricTiming, Description: "Step1 processing time in service1"}
+	MetricStep2Duration           = MetricDef{Name: "business.pipeline.step2.duration", Kind: metricTiming, Description: "Step2 processing time in service2"}
+	MetricStep3Duration           = MetricDef{Name: "business.pipeline.step3.duration", Kind: metricTiming, Description: "Step3 processing time in service3"}
+	MetricStep1CalculatedDuration = MetricDef{Name: "business.pipeline.step1.calculated_duration", Kind: metricTiming, Description: "Pipeline start to step1 completion, from message timestamps"}
+	MetricStep2CalculatedDuration = MetricDef{Name: "business.pipeline.step2.calculated_duration", Kind: metricTiming, Description: "Step1 completion to step2 completion, from message timestamps"}
+	MetricStep1ToStep2Duration    = MetricDef{Name: "business.pipeline.step1_to_step2.duration", Kind: metricTiming, Description: "Time between step1 completion and step2 start"}
+	MetricStep2ToStep3Duration    = MetricDef{Name: "business.pipeline.step2_to_step3.duration", Kind: metricTiming, Description: "Time between step2 completion and step3 start"}
+	MetricEndToEndDuration        = MetricDef{Name: "business.pipeline.end_to_end.duration", Kind: metricTiming, Description: "Pipeline start to step3 completion"}
+	MetricMessagesStep1           = MetricDef{Name: "business.pipeline.messages.step1", Kind: metricCount, Description: "Messages sent by step1"}
+	MetricMessagesStep2           = MetricDef{Name: "business.pipeline.messages.step2", Kind: metricCount, Description: "Messages processed by step2"}
+	MetricMessagesStep3           = MetricDef{Name: "business.pipeline.messages.step3", Kind: metricCount, Description: "Messages processed by step3"}
+	MetricPipelineCompleted       = MetricDef{Name: "business.pipeline.completed", Kind: metricCount, Description: "Pipelines completed"}
+	MetricFailedStep2             = MetricDef{Name: "business.pipeline.failed.step2", Kind: metricCount, Description: "Messages failed by step2"}
+	MetricErrorsStep1             = MetricDef{Name: "business.pipeline.errors.step1", Kind: metricCount, Description: "Errors injected in step1"}
+	MetricErrorsStep2             = MetricDef{Name: "business.pipeline.errors.step2", Kind: metricCount, Description: "Errors seen in step2", Tags: []string{"type"}}
+	MetricErrorsSQSReceive        = MetricDef{Name: "business.pipeline.errors.sqs.receive", Kind: metricCount, Description: "SQS ReceiveMessage failures"}
+	MetricErrorsSQSSend           = MetricDef{Name: "business.pipeline.errors.sqs.send", Kind: metricCount, Description: "SQS SendMessage failures"}
+	MetricErrorsJSONUnmarshal     = MetricDef{Name: "business.pipeline.errors.json.unmarshal", Kind: metricCount, Description: "Messages with a malformed body"}
+	MetricMessagesOrphaned        = MetricDef{Name: "business.pipeline.messages.orphaned", Kind: metricCount, Description: "Consumed messages without a trace context to continue"}
+	MetricMessagesRedelivered     = MetricDef{Name: "business.pipeline.messages.redelivered", Kind: metricCount, Description: "Consumed messages received more than once, traced with a span link", Tags: []string{"queue"}}
+	MetricBatchSize               = MetricDef{Name: "business.pipeline.batch.size", Kind: metricGauge, Description: "Messages per received SQS batch"}
+	MetricSQSQueueTime            = MetricDef{Name: "sqs.message.queue_time", Kind: metricTiming, Description: "Time from SentTimestamp to ApproximateFirstReceiveTimestamp, both SQS clocks", Tags: []string{"queue"}}
+	MetricSQSMessageAge           = MetricDef{Name: "sqs.message.age", Kind: metricTiming, Description: "Time from SentTimestamp to this receive", Tags: []string{"queue"}}
+	MetricQueueDepth              = MetricDef{Name: "sqs.queue.depth", Kind: metricGauge, Description: "ApproximateNumberOfMessages of the input queue", Tags: []string{"queue"}}
+	MetricQueueInFlight           = MetricDef{Name: "sqs.queue.in_flight", Kind: metricGauge, Description: "ApproximateNumberOfMessagesNotVisible of the input queue", Tags: []string{"queue"}}
+	MetricQueueDelayed            = MetricDef{Name: "sqs.queue.delayed", Kind: metricGauge, Description: "ApproximateNumberOfMessagesDelayed of the input queue", Tags: []string{"queue"}}
+	MetricConsumerOldestAge       = MetricDef{Name: "pipeline.consumer.oldest_received_age", Kind: metricGauge, Description: "Age in seconds of the oldest message this consumer received since the previous poll, 0 when it received none", Tags: []string{"queue"}}
+	MetricConsumerRate            = MetricDef{Name: "pipeline.consumer.rate", Kind: metricGauge, Description: "Messages consumed per second, smoothed", Tags: []string{"queue"}}
+	MetricRecommendedWorkers      = MetricDef{Name: "pipeline.scaling.recommended_workers", Kind: metricGauge, Description: "Workers needed to keep up and drain the backlog", Tags: []string{"queue"}}
+	MetricRecommendedReplicas     = MetricDef{Name: "pipeline.scaling.recommended_replicas", Kind: metricGauge, Description: "Replicas needed at the current workers per replica", Tags: []string{"queue"}}
+
+	// Adaptive consumer concurrency
+	MetricConcurrencyLimit          = MetricDef{Name: "pipeline.consumer.concurrency_limit", Kind: metricGauge, Description: "Adaptive limit of messages processed at once", Tags: []string{"queue"}}
+	MetricConsumerInFlight          = MetricDef{Name: "pipeline.consumer.in_flight", Kind: metricGauge, Description: "Messages being processed", Tags: []string{"queue"}}
+	MetricConcurrencyLimitDecreases = MetricDef{Name: "pipeline.consumer.concurrency_limit.decrease", Kind: metricCount, Description: "Concurrency limit decreases on overload", Tags: []string{"queue", "reason"}}
+
+	// Admission control
+	MetricAdmissionRejected         = MetricDef{Name: "pipeline.admission.rejected", Kind: metricCount, Description: "Submissions shed while the pipeline is saturated", Tags: []string{"queue", "reason", "status"}}
+	MetricAdmissionPending          = MetricDef{Name: "pipeline.admission.pending", Kind: metricGauge, Description: "Visible plus in-flight messages of the step1 queue", Tags: []string{"queue"}}
+	MetricAdmissionEstimatedLatency = MetricDef{Name: "pipeline.admission.estimated_latency", Kind: metricTiming, Description: "Time the consumers need to drain the messages ahead of a new one", Tags: []string{"queue"}}
+
+	// Per-client rate limits
+	MetricRateLimitAdmitted = MetricDef{Name: "pipeline.ratelimit.admitted", Kind: metricCount, Description: "Submissions within the client's rate limit and quota", Tags: []string{"client", "tier"}}
+	MetricRateLimited       = MetricDef{Name: "pipeline.ratelimit.rejected", Kind: metricCount, Description: "Submissions rejected by the client's rate limit or quota", Tags: []string{"client", "tier", "reason"}}
+
+	// Retries
+	MetricRetryAttempts  = MetricDef{Name: "pipeline.retry.attempts", Kind: metricCount, Description: "Retries of a failed operation", Tags: []string{"operation", "error_code"}}
+	MetricRetryRecovered = MetricDef{Name: "pipeline.retry.recovered", Kind: metricCount, Description: "Operations that succeeded after a retry", Tags: []string{"operation"}}
+	MetricRetryExhausted = MetricDef{Name: "pipeline.retry.exhausted", Kind: metricCount, Description: "Operations that failed on their last attempt", Tags: []string{"operation"}}
+
+	// Circuit breakers
+	MetricCircuitState       = MetricDef{Name: "pipeline.circuit.state", Kind: metricGauge, Description: "Circuit state: 0 closed, 1 half-open, 2 open", Tags: []string{"dependency"}}
+	MetricCircuitTransitions = MetricDef{Name: "pipeline.circuit.transitions", Kind: metricCount, Description: "Circuit state changes, tagged with the new state", Tags: []string{"dependency", "state"}}
+	MetricCircuitRejected    = MetricDef{Name: "pipeline.circuit.rejected", Kind: metricCount, Description: "Calls failed fast while the circuit was open", Tags: []string{"dependency"}}
+
+	// Outbox
+	MetricOutboxPending         = MetricDef{Name: "pipeline.outbox.pending", Kind: metricGauge, Description: "Accepted messages not yet published"}
+	MetricOutboxPublished       = MetricDef{Name: "pipeline.outbox.published", Kind: metricCount, Description: "Messages the relay published"}
+	MetricOutboxPublishFailures = MetricDef{Name: "pipeline.outbox.publish_failures", Kind: metricCount, Description: "Relay publish attempts that failed", Tags: []string{"error_code"}}
+	MetricOutboxDelay           = MetricDef{Name: "pipeline.outbox.delay", Kind: metricTiming, Description: "Time from acceptance to publishing"}
+
+	// Completion callbacks and status reports
+	MetricCallbackDelivered     = MetricDef{Name: "pipeline.callback.delivered", Kind: metricCount, Description: "Pipeline events delivered to a callback or status URL", Tags: []string{"target", "status"}}
+	MetricCallbackFailed        = MetricDef{Name: "pipeline.callback.failed", Kind: metricCount, Description: "Pipeline events given up on after retries", Tags: []string{"target", "status", "error_code"}}
+	MetricStatusReportsRejected = MetricDef{Name: "pipeline.status.reports_rejected", Kind: metricCount, Description: "Status reports refused by service1", Tags: []string{"reason"}}
+
+	// Pipeline progress events
+	MetricEventsSent        = MetricDef{Name: "pipeline.events.sent", Kind: metricCount, Description: "Progress events sent to service1"}
+	MetricEventsDropped     = MetricDef{Name: "pipeline.events.dropped", Kind: metricCount, Description: "Progress events lost on the way to a stream", Tags: []string{"reason"}}
+	MetricEventsSubscribers = MetricDef{Name: "pipeline.events.subscribers", Kind: metricGauge, Description: "Open event streams", Tags: []string{"stream"}}
+
+	// Results store
+	MetricResultsStored      = MetricDef{Name: "pipeline.results.stored", Kind: metricCount, Description: "Pipeline results saved by service3"}
+	MetricResultsStoreErrors = MetricDef{Name: "pipeline.results.store_errors", Kind: metricCount, Description: "Failed results store operations", Tags: []string{"operation"}}
+
+	// Shard router
+	MetricRouterRequests    = MetricDef{Name: "router.requests.total", Kind: metricCount, Description: "Requests forwarded to a shard", Tags: []string{"shard", "canary.arm"}}
+	MetricRouterErrors      = MetricDef{Name: "router.requests.error", Kind: metricCount, Description: "Requests the router could not forward", Tags: []string{"shard", "error_type"}}
+	MetricRouterDuration    = MetricDef{Name: "router.route.duration", Kind: metricTiming, Description: "Time to route and proxy a request", Tags: []string{"shard", "canary.arm"}}
+	MetricRouterRingChanges = MetricDef{Name: "router.ring.changes", Kind: metricCount, Description: "Shards added to, removed from, drained from or restored to the ring", Tags: []string{"shard", "action"}}
+	MetricCanaryErrorRate   = MetricDef{Name: "router.canary.error_rate", Kind: metricGauge, Description: "Error rate of a canary arm over the analysis window", Tags: []string{"arm", "baseline", "canary"}}
+	MetricCanaryLatencyP95  = MetricDef{Name: "router.canary.latency.p95", Kind: metricGauge, Description: "p95 latency in ms of a canary arm over the analysis window", Tags: []string{"arm", "baseline", "canary"}}
+	MetricCanaryRequests    = MetricDef{Name: "router.canary.requests", Kind: metricGauge, Description: "Requests of a canary arm in the analysis window", Tags: []string{"arm", "baseline", "canary"}}
+	MetricCanaryWeight      = MetricDef{Name: "router.canary.weight", Kind: metricGauge, Description: "Percentage of baseline keys sent to the canary", Tags: []string{"baseline", "canary"}}
+	MetricCanaryRollback    = MetricDef{Name: "router.canary.rollback", Kind: metricCount, Description: "Canary analyses that breached the thresholds", Tags: []string{"baseline", "canary", "auto"}}
+
+	// Shard registry
+	MetricRegistryRegistrations = MetricDef{Name: "registry.registrations", Kind: metricCount, Description: "Instances registered", Tags: []string{"shard", "role"}}
+	MetricRegistryExpirations   = MetricDef{Name: "registry.expirations", Kind: metricCount, Description: "Instances expired after missing their heartbeats", Tags: []string{"shard", "role"}}
+	MetricRegistryActive        = MetricDef{Name: "registry.instances.active", Kind: metricGauge, Description: "Live instances", Tags: []string{"shard", "role"}}
+)
+
+// metricDefinitions is the catalogue of every metric above
+var metricDefinitions = []MetricDef{
+	MetricRequestsTotal, MetricRequestsSuccess, MetricRequestsError, MetricResponseTime, MetricRequestsLatency,
+	MetricProcessingTotal, MetricProcessingSuccess, MetricProcessingError, MetricProcessingTime, MetricProcessingLatency,
+	MetricPipelineDuration, MetricPipelineTotal, MetricPipelineSuccess, MetricPipelineUnder300ms, MetricPipelineUnder1s,
+	MetricSLOSLI, MetricSLOErrorBudget, MetricSLOBurnRate,
+	MetricStep1Duration, MetricStep2Duration, MetricStep3Duration,
+	MetricStep1CalculatedDuration, MetricStep2CalculatedDuration,
+	MetricStep1ToStep2Duration, MetricStep2ToStep3Duration, MetricEndToEndDuration,
+	MetricMessagesStep1, MetricMessagesStep2, MetricMessagesStep3,
+	MetricPipelineCompleted, MetricFailedStep2,
+	MetricErrorsStep1, MetricErrorsStep2, MetricErrorsSQSReceive, MetricErrorsSQSSend, MetricErrorsJSONUnmarshal,
+	MetricMessagesOrphaned, MetricMessagesRedelivered, MetricBatchSize,
+	MetricSQSQueueTime, MetricSQSMessageAge,
+	MetricQueueDepth, MetricQueueInFlight, MetricQueueDelayed, MetricConsumerOldestAge,
+	MetricConsumerRate, MetricRecommendedWorkers, MetricRecommendedReplicas,
+	MetricConcurrencyLimit, MetricConsumerInFlight, MetricConcurrencyLimitDecreases,
+	MetricAdmissionRejected, MetricAdmissionPending, MetricAdmissionEstimatedLatency,
+	MetricRateLimitAdmitted, MetricRateLimited,
+	MetricRetryAttempts, MetricRetryRecovered, MetricRetryExhausted,
+	MetricCircuitState, MetricCircuitTransitions, MetricCircuitRejected,
+	MetricOutboxPending, MetricOutboxPublished, MetricOutboxPublishFailures, MetricOutboxDelay,
+	MetricCallbackDelivered, MetricCallbackFailed, MetricStatusReportsRejected,
+	MetricEventsSent, MetricEventsDropped, MetricEventsSubscribers,
+	MetricResultsStored, MetricResultsStoreErrors,
+	MetricRouterRequests, MetricRouterErrors, MetricRouterDuration, MetricRouterRingChanges,
+	MetricCanaryErrorRate, MetricCanaryLatencyP95, MetricCanaryRequests, MetricCanaryWeight, MetricCanaryRollback,
+	MetricRegistryRegistrations, MetricRegistryExpirations, MetricRegistryActive,
+}
+
+type MetricTag struct {
+	Key   string
+	Value string
+}
+
+func Tag(key, value string) MetricTag {
+	return MetricTag{Key: key, Value: value}
+}
+
+// MetricsClient submits metric definitions through the telemetry backend with the base tags applied
+type MetricsClient struct {
+	baseTags []string
+	warned   sync.Map
+}
+
+var Metrics *MetricsClient
+
+// NewMetrics returns a client with the base tags; an empty shard leaves out the shard tag
+func NewMetrics(service, shard, version, env string) *MetricsClient {
+	baseTags := []string{"service:" + service}
+	if shard != "" {
+		baseTags = append(baseTags, "shard:"+shard)
+	}
+	return &MetricsClient{baseTags: append(baseTags, "version:"+version, "env:"+env)}
+}
+
+func (m *MetricsClient) Incr(def MetricDef, tags ...MetricTag) {
+	Telemetry.Incr(def.Name, m.tags(def, metricCount, tags))
+}
+
+func (m *MetricsClient) Timing(def MetricDef, value time.Duration, tags ...MetricTag) {
+	Telemetry.Timing(def.Name, value, m.tags(def, metricTiming, tags))
+}
+
+func (m *MetricsClient) Gauge(def MetricDef, value float64, tags ...MetricTag) {
+	Telemetry.Gauge(def.Name, value, m.tags(def, metricGauge, tags))
+}
+
+// tags builds the full tag set for def. Undeclared tags are dropped so a metric's
+// tag keys never depend on the call site.
+func (m *MetricsClient) tags(def MetricDef, kind metricKind, extra []MetricTag) []string {
+	if def.Kind != kind {
+		m.warnOnce(def.Name+"/kind", "Metric submitted with a different kind than its definition",
+			"metric", def.Name, "kind", def.Kind, "submitted_as", kind)
+	}
+
+	result := make([]string, 0, len(m.baseTags)+len(def.Tags))
+	result = append(result, m.baseTags...)
+	for _, key := range def.Tags {
+		value := "none"
+		for _, t := range extra {
+			if t.Key == key {
+				value = t.Value
+			}
+		}
+		result = append(result, key+":"+value)
+	}
+
+	for _, t := range extra {
+		declared := false
+		for _, key := range def.Tags {
+			if t.Key == key {
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			m.warnOnce(def.Name+"/"+t.Key, "Dropping tag not declared in the metric definition",
+				"metric", def.Name, "tag", t.Key)
+		}
+	}
+	return result
+}
+
+func (m *MetricsClient) warnOnce(key, msg string, args ...any) {
+	if _, seen := m.warned.LoadOrStore(key, true); !seen {
+		Logger.Warn(msg, args...)
+	}
+}
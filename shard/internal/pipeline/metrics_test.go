@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMetricsClientTags(t *testing.T) {
+	base := []string{"service:service1", "shard:shard-1", "version:1.2.0", "env:pipeline"}
+	tests := []struct {
+		name  string
+		def   MetricDef
+		kind  metricKind
+		extra []MetricTag
+		want  []string
+	}{
+		{
+			name: "base tags only",
+			def:  MetricStep1Duration,
+			kind: metricTiming,
+			want: base,
+		},
+		{
+			name:  "declared tags in declaration order",
+			def:   MetricRequestsError,
+			kind:  metricCount,
+			extra: []MetricTag{Tag("error_type", "timeout"), Tag("endpoint", "/send-message"), Tag("outcome", "server_error")},
+			want:  append(slices.Clone(base), "endpoint:/send-message", "outcome:server_error", "error_type:timeout"),
+		},
+		{
+			name:  "missing declared tag is none",
+			def:   MetricRequestsError,
+			kind:  metricCount,
+			extra: []MetricTag{Tag("endpoint", "/")},
+			want:  append(slices.Clone(base), "endpoint:/", "outcome:none", "error_type:none"),
+		},
+		{
+			name:  "undeclared tag is dropped",
+			def:   MetricRequestsSuccess,
+			kind:  metricCount,
+			extra: []MetricTag{Tag("endpoint", "/"), Tag("customer", "42")},
+			want:  append(slices.Clone(base), "endpoint:/"),
+		},
+		{
+			name:  "last value of a repeated tag wins",
+			def:   MetricQueueDepth,
+			kind:  metricGauge,
+			extra: []MetricTag{Tag("queue", "a"), Tag("queue", "b")},
+			want:  append(slices.Clone(base), "queue:b"),
+		},
+		{
+			name:  "different kind is still sent",
+			def:   MetricQueueDepth,
+			kind:  metricCount,
+			extra: []MetricTag{Tag("queue", "a")},
+			want:  append(slices.Clone(base), "queue:a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics("service1", "shard-1", "1.2.0", "pipeline")
+			if got := m.tags(tt.def, tt.kind, tt.extra); !slices.Equal(got, tt.want) {
+				t.Errorf("tags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsClientWithoutShard(t *testing.T) {
+	m := NewMetrics("router", "", "1.2.0", "pipeline")
+	got := m.tags(MetricRouterRequests, metricCount, []MetricTag{Tag("shard", "shard-2")})
+	want := []string{"service:router", "version:1.2.0", "env:pipeline", "shard:shard-2", "canary.arm:none"}
+	if !slices.Equal(got, want) {
+		t.Errorf("tags = %v, want %v with shard only as the metric's own tag", got, want)
+	}
+}
+
+func TestMetricDefinitionsCatalogue(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, def := range metricDefinitions {
+		if seen[def.Name] {
+			t.Errorf("%s is declared twice", def.Name)
+		}
+		seen[def.Name] = true
+		if def.Kind != metricCount && def.Kind != metricTiming && def.Kind != metricGauge {
+			t.Errorf("%s has kind %q", def.Name, def.Kind)
+		}
+		if def.Description == "" {
+			t.Errorf("%s has no description", def.Name)
+		}
+		for _, key := range def.Tags {
+			if key == "service" || key == "version" || key == "env" {
+				t.Errorf("%s declares the base tag %s", def.Name, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Outcome classifies a request or message for the availability SLIs
+type Outcome string
+
+const (
+	OutcomeSuccess         Outcome = "success"
+	OutcomeClientError     Outcome = "client_error"     // bad input from the caller or producer
+	OutcomeDependencyError Outcome = "dependency_error" // SQS or another downstream failed
+	OutcomeBusinessError   Outcome = "business_error"   // handled, but the pipeline item is failed
+	OutcomeServerError     Outcome = "server_error"     // 5xx nobody classified
+)
+
+// latencyBuckets are the thresholds of the cumulative latency counters (tag le)
+var latencyBuckets = []struct {
+	le    string
+	limit time.Duration
+}{
+	{"50ms", 50 * time.Millisecond},
+	{"100ms", 100 * time.Millisecond},
+	{"300ms", 300 * time.Millisecond},
+	{"1s", time.Second},
+}
+
+// outcomeRecorder holds the classification of one request or message. Handlers
+// refine it with classify; the middleware records it exactly once when they return.
+type outcomeRecorder struct {
+	outcome   Outcome
+	errorType string
+}
+
+type outcomeKey struct{}
+
+// Classify sets the outcome of the request or message being handled with ctx.
+// The first non-success classification wins, so a later generic failure does not hide the cause.
+func Classify(ctx context.Context, o Outcome, errorType string) {
+	rec, ok := ctx.Value(outcomeKey{}).(*outcomeRecorder)
+	if !ok {
+		return
+	}
+	if rec.outcome != "" && rec.outcome != OutcomeSuccess {
+		return
+	}
+	rec.outcome = o
+	rec.errorType = errorType
+}
+
+// WithOutcome records sli.requests.* for an HTTP endpoint. Unclassified requests are
+// classified from the status code.
+func WithOutcome(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &outcomeRecorder{}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r.WithContext(context.WithValue(r.Context(), outcomeKey{}, rec)))
+
+		if rec.outcome == "" {
+			switch {
+			case sw.status >= 500:
+				rec.outcome, rec.errorType = OutcomeServerError, http.StatusText(sw.status)
+			case sw.status >= 400:
+				rec.outcome, rec.errorType = OutcomeClientError, http.StatusText(sw.status)
+			default:
+				rec.outcome = OutcomeSuccess
+			}
+		}
+		elapsed := time.Since(start)
+		SLOs.Observe(SLOSourceRequests, endpoint, rec.outcome, elapsed)
+		recordOutcome(MetricRequestsTotal, MetricRequestsSuccess, MetricRequestsError, MetricResponseTime, MetricRequestsLatency,
+			Tag("endpoint", endpoint), rec, elapsed)
+	}
+}
+
+// ProcessWithOutcome records sli.processing.* for one consumed message and returns its outcome
+func ProcessWithOutcome(operation string, process func(ctx context.Context)) Outcome {
+	start := time.Now()
+	rec := &outcomeRecorder{}
+	process(context.WithValue(context.Background(), outcomeKey{}, rec))
+
+	if rec.outcome == "" {
+		rec.outcome = OutcomeSuccess
+	}
+	elapsed := time.Since(start)
+	SLOs.Observe(SLOSourceProcessing, operation, rec.outcome, elapsed)
+	recordOutcome(MetricProcessingTotal, MetricProcessingSuccess, MetricProcessingError, MetricProcessingTime, MetricProcessingLatency,
+		Tag("operation", operation), rec, elapsed)
+	return rec.outcome
+}
+
+func recordOutcome(total, success, failure, timing, latency MetricDef, scope MetricTag, rec *outcomeRecorder, elapsed time.Duration) {
+	Metrics.Incr(total, scope, Tag("outcome", string(rec.outcome)))
+	if rec.outcome == OutcomeSuccess {
+		Metrics.Incr(success, scope)
+	} else {
+		Metrics.Incr(failure, scope, Tag("outcome", string(rec.outcome)), Tag("error_type", rec.errorType))
+	}
+	Metrics.Timing(timing, elapsed, scope)
+	for _, bucket := range latencyBuckets {
+		if elapsed <= bucket.limit {
+			Metrics.Incr(latency, scope, Tag("le", bucket.le))
+		}
+	}
+	Metrics.Incr(latency, scope, Tag("le", "inf"))
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestWithOutcomeClassifiesRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		wantOutcome   Outcome
+		wantErrorType string
+	}{
+		{
+			name:        "implicit 200",
+			handler:     func(w http.ResponseWriter, r *http.Request) {},
+			wantOutcome: OutcomeSuccess,
+		},
+		{
+			name:        "202",
+			handler:     func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) },
+			wantOutcome: OutcomeSuccess,
+		},
+		{
+			name:          "unclassified 400",
+			handler:       func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadRequest) },
+			wantOutcome:   OutcomeClientError,
+			wantErrorType: "Bad Request",
+		},
+		{
+			name:          "unclassified 503",
+			handler:       func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			wantOutcome:   OutcomeServerError,
+			wantErrorType: "Service Unavailable",
+		},
+		{
+			name: "classified 500",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				Classify(r.Context(), OutcomeDependencyError, "sqs_send")
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantOutcome:   OutcomeDependencyError,
+			wantErrorType: "sqs_send",
+		},
+		{
+			name: "first failure wins",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				Classify(r.Context(), OutcomeClientError, "invalid_json")
+				Classify(r.Context(), OutcomeServerError, "write_failed")
+				w.WriteHeader(http.StatusBadRequest)
+			},
+			wantOutcome:   OutcomeClientError,
+			wantErrorType: "invalid_json",
+		},
+		{
+			name: "failure overrides success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				Classify(r.Context(), OutcomeSuccess, "")
+				Classify(r.Context(), OutcomeBusinessError, "step_failed")
+			},
+			wantOutcome:   OutcomeBusinessError,
+			wantErrorType: "step_failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tel := useTestTelemetry(t)
+			WithOutcome("/send-message", tt.handler)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/send-message", nil))
+
+			if got := tel.tags(MetricRequestsTotal); !slices.Contains(got, "outcome:"+string(tt.wantOutcome)) {
+				t.Errorf("%s tags = %v, want outcome %s", MetricRequestsTotal.Name, got, tt.wantOutcome)
+			}
+			if tt.wantOutcome == OutcomeSuccess {
+				if tel.count(MetricRequestsSuccess) != 1 || tel.count(MetricRequestsError) != 0 {
+					t.Errorf("success = %d, error = %d, want 1 and 0", tel.count(MetricRequestsSuccess), tel.count(MetricRequestsError))
+				}
+				return
+			}
+			if tel.count(MetricRequestsSuccess) != 0 || tel.count(MetricRequestsError) != 1 {
+				t.Fatalf("success = %d, error = %d, want 0 and 1", tel.count(MetricRequestsSuccess), tel.count(MetricRequestsError))
+			}
+			if got := tel.tags(MetricRequestsError); !slices.Contains(got, "error_type:"+tt.wantErrorType) {
+				t.Errorf("%s tags = %v, want error_type %s", MetricRequestsError.Name, got, tt.wantErrorType)
+			}
+		})
+	}
+}
+
+func TestWithOutcomeCountsLatencyBuckets(t *testing.T) {
+	tel := useTestTelemetry(t)
+	WithOutcome("/", func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// A handler that returns at once falls in every bucket plus inf
+	if got, want := tel.count(MetricRequestsLatency), len(latencyBuckets)+1; got != want {
+		t.Errorf("%s = %d, want %d", MetricRequestsLatency.Name, got, want)
+	}
+}
+
+func TestProcessWithOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		process func(ctx context.Context)
+		want    Outcome
+	}{
+		{"unclassified", func(ctx context.Context) {}, OutcomeSuccess},
+		{"dependency", func(ctx context.Context) { Classify(ctx, OutcomeDependencyError, "sqs_receive") }, OutcomeDependencyError},
+		{"business", func(ctx context.Context) { Classify(ctx, OutcomeBusinessError, "step_failed") }, OutcomeBusinessError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tel := useTestTelemetry(t)
+			if got := ProcessWithOutcome("step2", tt.process); got != tt.want {
+				t.Errorf("outcome = %s, want %s", got, tt.want)
+			}
+			if got := tel.tags(MetricProcessingTotal); !slices.Contains(got, "outcome:"+string(tt.want)) {
+				t.Errorf("%s tags = %v, want outcome %s", MetricProcessingTotal.Name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyWithoutRecorder(t *testing.T) {
+	// Outside WithOutcome and ProcessWithOutcome there is nothing to classify
+	Classify(context.Background(), OutcomeServerError, "ignored")
+}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States of a pipeline: accepted by service1, then completed or failed by the step that ends it
+const (
+	StatusAccepted  = "accepted"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Step transitions in between, only sent to the event streams
+const (
+	StatusStepStarted   = "step_started"
+	StatusStepCompleted = "step_completed"
+)
+
+// Event is sent when a pipeline ends, to the caller's callback URL and to the
+// status URL of the service1 instance that accepted it. A message may be processed more
+// than once, so receivers should treat the same correlation ID and status as one event.
+// Step transitions use the same format on the event streams.
+type Event struct {
+	CorrelationID string    `json:"correlation_id"`
+	Status        string    `json:"status"`
+	Step          int       `json:"step"`
+	Service       string    `json:"service,omitempty"`
+	ErrorType     string    `json:"error_type,omitempty"`
+	Shard         string    `json:"shard"`
+	StartTime     string    `json:"start_time,omitempty"`
+	DurationMs    int64     `json:"duration_ms,omitempty"`
+	EndToEndMs    int64     `json:"end_to_end_duration_ms,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// terminal reports whether the event ends its pipeline
+func (e Event) Terminal() bool {
+	return e.Status == StatusCompleted || e.Status == StatusFailed
+}
+
+// Pipeline events are signed with HMAC-SHA256 of "<timestamp>.<body>" under CALLBACK_SECRET,
+// so receivers can check they come from the pipeline and reject replays of old ones
+const (
+	signatureHeader = "X-Pipeline-Signature"
+	timestampHeader = "X-Pipeline-Timestamp"
+	// maxSignatureAge is how old a signed event may be when it is verified
+	maxSignatureAge = 5 * time.Minute
+)
+
+// CallbackSecret signs and verifies pipeline events. It is required: without it anyone could
+// report a pipeline's end to service1, see ConfigureCallbacks.
+var CallbackSecret = []byte(os.Getenv("CALLBACK_SECRET"))
+
+// minCallbackSecretLength is the shortest CALLBACK_SECRET accepted, in bytes
+const minCallbackSecretLength = 16
+
+var (
+	errNoSecret         = errors.New("no callback secret configured")
+	errSignatureMissing = errors.New("missing signature")
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature timestamp out of range")
+)
+
+// signPayload is the X-Pipeline-Signature of body sent at timestamp (Unix seconds)
+func signPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature headers of a pipeline event received at now. Without
+// a secret nothing verifies.
+func VerifySignature(secret []byte, header http.Header, body []byte, now time.Time) error {
+	if len(secret) == 0 {
+		return errNoSecret
+	}
+	timestamp, signature := header.Get(timestampHeader), header.Get(signatureHeader)
+	if timestamp == "" || signature == "" {
+		return errSignatureMissing
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return errSignatureExpired
+	}
+	if !hmac.Equal([]byte(signature), []byte(signPayload(secret, timestamp, body))) {
+		return errSignatureInvalid
+	}
+	return nil
+}
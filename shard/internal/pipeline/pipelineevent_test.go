@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef-test")
+
+func signedHeader(secret []byte, sentAt time.Time, body []byte) http.Header {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	header := http.Header{}
+	header.Set(timestampHeader, timestamp)
+	header.Set(signatureHeader, signPayload(secret, timestamp, body))
+	return header
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"correlation_id":"c-1","status":"completed"}`)
+	tests := []struct {
+		name    string
+		secret  []byte
+		header  http.Header
+		body    []byte
+		wantErr error
+	}{
+		{"valid", testSecret, signedHeader(testSecret, now, body), body, nil},
+		{"within the skew in the past", testSecret, signedHeader(testSecret, now.Add(-maxSignatureAge), body), body, nil},
+		{"within the skew in the future", testSecret, signedHeader(testSecret, now.Add(maxSignatureAge), body), body, nil},
+		{"too old", testSecret, signedHeader(testSecret, now.Add(-maxSignatureAge-time.Second), body), body, errSignatureExpired},
+		{"too far in the future", testSecret, signedHeader(testSecret, now.Add(maxSignatureAge+time.Second), body), body, errSignatureExpired},
+		{"tampered body", testSecret, signedHeader(testSecret, now, body), []byte(`{"correlation_id":"c-2"}`), errSignatureInvalid},
+		{"other secret", testSecret, signedHeader([]byte("another-secret-0123"), now, body), body, errSignatureInvalid},
+		{"unsigned", testSecret, http.Header{}, body, errSignatureMissing},
+		{"no secret configured", nil, signedHeader(nil, now, body), body, errNoSecret},
+		{
+			name:   "timestamp not a number",
+			secret: testSecret,
+			header: http.Header{
+				timestampHeader: {"yesterday"},
+				signatureHeader: {signPayload(testSecret, "yesterday", body)},
+			},
+			body:    body,
+			wantErr: errSignatureInvalid,
+		},
+		{
+			name:   "timestamp replaced",
+			secret: testSecret,
+			header: func() http.Header {
+				h := signedHeader(testSecret, now.Add(-time.Hour), body)
+				h.Set(timestampHeader, strconv.FormatInt(now.Unix(), 10))
+				return h
+			}(),
+			body:    body,
+			wantErr: errSignatureInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignature(tt.secret, tt.header, tt.body, now)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("VerifySignature = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigureCallbacks(t *testing.T) {
+	previousSecret, previousNetworks := CallbackSecret, callbackNetworks
+	t.Cleanup(func() { CallbackSecret, callbackNetworks = previousSecret, previousNetworks })
+
+	tests := []struct {
+		name     string
+		secret   string
+		networks string
+		wantErr  bool
+	}{
+		{"secret", string(testSecret), "", false},
+		{"no secret", "", "", true},
+		{"short secret", "short", "", true},
+		{"networks", string(testSecret), "127.0.0.0/8, 10.1.0.0/16", false},
+		{"invalid network", string(testSecret), "10.1.0.0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			CallbackSecret = []byte(tt.secret)
+			t.Setenv("CALLBACK_ALLOWED_NETWORKS", tt.networks)
+			if err := ConfigureCallbacks(); (err != nil) != tt.wantErr {
+				t.Errorf("ConfigureCallbacks = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCallbackAddress(t *testing.T) {
+	previous := callbackNetworks
+	t.Cleanup(func() { callbackNetworks = previous })
+	callbackNetworks = []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.5", false},
+		{"172.16.3.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"10.20.3.4", true}, // in CALLBACK_ALLOWED_NETWORKS
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := CheckCallbackAddress(netip.MustParseAddr(tt.addr))
+			if (err == nil) != tt.allowed {
+				t.Errorf("CheckCallbackAddress(%s) = %v, want allowed %v", tt.addr, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckCallbackHost(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "localhost", "169.254.169.254"} {
+		if err := CheckCallbackHost(context.Background(), host); err == nil {
+			t.Errorf("CheckCallbackHost(%s) allowed an internal host", host)
+		}
+	}
+}
+
+func TestCallbackClientRefusesInternalAddresses(t *testing.T) {
+	useTestTelemetry(t)
+	previousSecret, previousNetworks := CallbackSecret, callbackNetworks
+	t.Cleanup(func() { CallbackSecret, callbackNetworks = previousSecret, previousNetworks })
+	CallbackSecret = testSecret
+
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	callbackNetworks = nil
+	err := postPipelineEvent(context.Background(), callbackClient, server.URL, []byte(`{}`))
+	if !errors.Is(err, errAddressNotAllowed) {
+		t.Fatalf("delivery to a loopback receiver: err = %v, want errAddressNotAllowed", err)
+	}
+	if retryable(err) {
+		t.Error("refused address is retried")
+	}
+
+	callbackNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	if err := postPipelineEvent(context.Background(), callbackClient, server.URL, []byte(`{}`)); err != nil {
+		t.Fatalf("delivery to an allowed network: %v", err)
+	}
+	if err := VerifySignature(testSecret, received, []byte(`{}`), time.Now()); err != nil {
+		t.Errorf("delivered event does not verify: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package pipeline
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// promBuckets are the histogram buckets in seconds. They include the SLO thresholds
+// (50ms, 100ms, 300ms) so latency SLIs can be computed from the buckets directly.
+var promBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.3, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics mirrors the DogStatsD-style metrics as Prometheus series. Tags become
+// labels; since call sites do not always send the same tag keys for a metric, each family
+// uses the union of the keys seen so far and exports missing ones as empty labels.
+type PrometheusMetrics struct {
+	mu       sync.Mutex
+	families map[string]*promFamily
+	registry *prometheus.Registry
+}
+
+type promFamily struct {
+	name      string
+	kind      prometheus.ValueType // CounterValue, GaugeValue, or UntypedValue for histograms
+	labelKeys map[string]bool
+	series    map[string]*promSeries
+}
+
+type promSeries struct {
+	labels  map[string]string
+	value   float64
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	p := &PrometheusMetrics{
+		families: make(map[string]*promFamily),
+		registry: prometheus.NewRegistry(),
+	}
+	p.registry.MustRegister(p)
+	p.registry.MustRegister(prometheus.NewGoCollector())
+	p.registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return p
+}
+
+func (p *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+func (p *PrometheusMetrics) incr(name string, tags []string) {
+	p.observe(promName(name, "_total"), prometheus.CounterValue, tags, func(s *promSeries) {
+		s.value++
+	})
+}
+
+func (p *PrometheusMetrics) gauge(name string, value float64, tags []string) {
+	p.observe(promName(name, ""), prometheus.GaugeValue, tags, func(s *promSeries) {
+		s.value = value
+	})
+}
+
+func (p *PrometheusMetrics) timing(name string, value time.Duration, tags []string) {
+	seconds := value.Seconds()
+	p.observe(promName(name, "_seconds"), prometheus.UntypedValue, tags, func(s *promSeries) {
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(promBuckets))
+		}
+		s.count++
+		s.sum += seconds
+		for i, upper := range promBuckets {
+			if seconds <= upper {
+				s.buckets[i]++
+			}
+		}
+	})
+}
+
+func (p *PrometheusMetrics) observe(name string, kind prometheus.ValueType, tags []string, update func(*promSeries)) {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		labels[promLabel(k)] = v
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	family, ok := p.families[name]
+	if !ok {
+		family = &promFamily{name: name, kind: kind, labelKeys: make(map[string]bool), series: make(map[string]*promSeries)}
+		p.families[name] = family
+	}
+	for k := range labels {
+		family.labelKeys[k] = true
+	}
+	key := seriesKey(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &promSeries{labels: labels}
+		family.series[key] = series
+	}
+	update(series)
+}
+
+// Describe sends no descriptors: the families are only known once metrics are recorded,
+// which makes this an unchecked collector.
+func (p *PrometheusMetrics) Describe(chan<- *prometheus.Desc) {}
+
+func (p *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, family := range p.families {
+		keys := make([]string, 0, len(family.labelKeys))
+		for k := range family.labelKeys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		desc := prometheus.NewDesc(family.name, "Pipeline metric "+family.name, keys, nil)
+
+		for _, series := range family.series {
+			values := make([]string, len(keys))
+			for i, k := range keys {
+				values[i] = series.labels[k]
+			}
+			if family.kind == prometheus.UntypedValue {
+				buckets := make(map[float64]uint64, len(promBuckets))
+				for i, upper := range promBuckets {
+					buckets[upper] = series.buckets[i]
+				}
+				ch <- prometheus.MustNewConstHistogram(desc, series.count, series.sum, buckets, values...)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(desc, family.kind, series.value, values...)
+		}
+	}
+}
+
+// promName turns "sli.requests.total" into "sli_requests_total", adding suffix if missing
+func promName(name, suffix string) string {
+	n := promLabel(name)
+	if suffix != "" && !strings.HasSuffix(n, suffix) {
+		n += suffix
+	}
+	return n
+}
+
+func promLabel(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func seriesKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// promTelemetry sends metrics to the configured backend and to Prometheus
+type promTelemetry struct {
+	TelemetryProvider
+	prom *PrometheusMetrics
+}
+
+func WithPrometheus(provider TelemetryProvider, prom *PrometheusMetrics) TelemetryProvider {
+	return &promTelemetry{TelemetryProvider: provider, prom: prom}
+}
+
+func (t *promTelemetry) Incr(name string, tags []string) {
+	t.TelemetryProvider.Incr(name, tags)
+	t.prom.incr(name, tags)
+}
+
+func (t *promTelemetry) Timing(name string, value time.Duration, tags []string) {
+	t.TelemetryProvider.Timing(name, value, tags)
+	t.prom.timing(name, value, tags)
+}
+
+func (t *promTelemetry) Gauge(name string, value float64, tags []string) {
+	t.TelemetryProvider.Gauge(name, value, tags)
+	t.prom.gauge(name, value, tags)
+}
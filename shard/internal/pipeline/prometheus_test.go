@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromName(t *testing.T) {
+	tests := []struct {
+		name, suffix, want string
+	}{
+		{"sli.requests.total", "_total", "sli_requests_total"},
+		{"pipeline.outbox.published", "_total", "pipeline_outbox_published_total"},
+		{"sli.response_time", "_seconds", "sli_response_time_seconds"},
+		{"router.canary.latency.p95", "", "router_canary_latency_p95"},
+		{"sqs.message.queue-time", "_seconds", "sqs_message_queue_time_seconds"},
+	}
+	for _, tt := range tests {
+		if got := promName(tt.name, tt.suffix); got != tt.want {
+			t.Errorf("promName(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	prom := NewPrometheusMetrics()
+	prom.incr("sli.requests.total", []string{"service:service1", "endpoint:/send-message"})
+	prom.incr("sli.requests.total", []string{"service:service1", "endpoint:/send-message"})
+	// A call site that leaves out a key gets it as an empty label
+	prom.incr("sli.requests.total", []string{"service:service1"})
+	prom.gauge("slo.sli", 0.5, []string{"slo:availability"})
+	prom.gauge("slo.sli", 0.995, []string{"slo:availability"})
+	prom.timing("sli.response_time", 200*time.Millisecond, []string{"canary.arm:baseline"})
+	prom.timing("sli.response_time", 2*time.Second, []string{"canary.arm:baseline"})
+
+	w := httptest.NewRecorder()
+	prom.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	exposition := string(body)
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"counter", `sli_requests_total{endpoint="/send-message",service="service1"} 2`},
+		{"counter missing a label", `sli_requests_total{endpoint="",service="service1"} 1`},
+		{"gauge keeps the last value", `slo_sli{slo="availability"} 0.995`},
+		{"histogram bucket below both", `sli_response_time_seconds_bucket{canary_arm="baseline",le="0.1"} 0`},
+		{"histogram bucket at an SLO threshold", `sli_response_time_seconds_bucket{canary_arm="baseline",le="0.3"} 1`},
+		{"histogram bucket above both", `sli_response_time_seconds_bucket{canary_arm="baseline",le="2.5"} 2`},
+		{"histogram inf bucket", `sli_response_time_seconds_bucket{canary_arm="baseline",le="+Inf"} 2`},
+		{"histogram sum", `sli_response_time_seconds_sum{canary_arm="baseline"} 2.2`},
+		{"histogram count", `sli_response_time_seconds_count{canary_arm="baseline"} 2`},
+		{"go collector", `go_goroutines `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(exposition, tt.line) {
+				t.Errorf("exposition has no %s\n%s", tt.line, exposition)
+			}
+		})
+	}
+}
+
+func TestWithPrometheusForwardsToBothBackends(t *testing.T) {
+	backend := newTestTelemetry()
+	prom := NewPrometheusMetrics()
+	tel := WithPrometheus(backend, prom)
+	tel.Incr("pipeline.outbox.published", []string{"service:service1"})
+
+	if backend.counts["pipeline.outbox.published"] != 1 {
+		t.Error("the backend did not get the metric")
+	}
+	if series := prom.families["pipeline_outbox_published_total"]; series == nil || len(series.series) != 1 {
+		t.Error("Prometheus did not get the metric")
+	}
+}
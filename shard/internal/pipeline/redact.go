@@ -0,0 +1,160 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "[REDACTED]"
+
+// redactionConfig is the format of REDACT_CONFIG
+type redactionConfig struct {
+	// Mode is how denied fields are replaced: "mask" (default) or "hash"
+	Mode string `json:"mode"`
+	// Deny lists log field and span tag keys whose value is always replaced
+	Deny []string `json:"deny"`
+	// Allow lists keys that are never redacted, not even by patterns
+	Allow []string `json:"allow"`
+	// Patterns are masked inside the string values of every other field
+	Patterns []redactionPattern `json:"patterns"`
+}
+
+type redactionPattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// defaultRedaction is used when REDACT_CONFIG does not exist
+var defaultRedaction = redactionConfig{
+	Mode:  "mask",
+	Deny:  []string{"message.data", "data"},
+	Allow: []string{"correlation.id", "dd.trace_id", "dd.span_id", "service", "shard", "version", "env"},
+	Patterns: []redactionPattern{
+		{Name: "email", Regex: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+		{Name: "card", Regex: `\b(?:\d[ -]?){12,15}\d\b`},
+	},
+}
+
+// Redactor removes sensitive values from log fields and span tags before they leave the process
+type Redactor struct {
+	hash     bool
+	hashKey  []byte
+	deny     map[string]bool
+	allow    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// Redaction is applied by the logger and by SetTag of both telemetry backends.
+// A nil redactor leaves values unchanged.
+var Redaction *Redactor
+
+// NewRedactor loads the redaction rules from path, falling back to defaultRedaction when
+// the file does not exist. REDACT_HASH_KEY keys the hashes of "hash" mode, so they cannot
+// be reversed by hashing guesses without the key.
+func NewRedactor(path string) (*Redactor, error) {
+	cfg := defaultRedaction
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	default:
+		cfg = redactionConfig{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	return compileRedaction(cfg, []byte(os.Getenv("REDACT_HASH_KEY")))
+}
+
+func compileRedaction(cfg redactionConfig, hashKey []byte) (*Redactor, error) {
+	r := &Redactor{hashKey: hashKey, deny: make(map[string]bool), allow: make(map[string]bool)}
+	switch strings.ToLower(cfg.Mode) {
+	case "", "mask":
+	case "hash":
+		r.hash = true
+	default:
+		return nil, fmt.Errorf("unknown redaction mode %q, expected mask or hash", cfg.Mode)
+	}
+	for _, key := range cfg.Deny {
+		r.deny[strings.ToLower(key)] = true
+	}
+	for _, key := range cfg.Allow {
+		r.allow[strings.ToLower(key)] = true
+	}
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %w", p.Name, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// value returns what may be emitted for key. Denied keys are masked or hashed whatever
+// their type; other string values have pattern matches masked.
+func (r *Redactor) value(key string, v interface{}) interface{} {
+	if r == nil {
+		return v
+	}
+	key = strings.ToLower(key)
+	if r.allow[key] {
+		return v
+	}
+	if r.deny[key] {
+		if r.hash {
+			return r.hashOf(fmt.Sprint(v))
+		}
+		return redactedValue
+	}
+	switch s := v.(type) {
+	case string:
+		return r.scrub(s)
+	case error:
+		return r.scrub(s.Error())
+	}
+	return v
+}
+
+func (r *Redactor) scrub(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, redactedValue)
+	}
+	return s
+}
+
+// hashOf is stable for a given key, so redacted values can still be correlated
+func (r *Redactor) hashOf(s string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(s))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// replaceAttr is the slog.HandlerOptions.ReplaceAttr hook. Keys inside groups are matched
+// with their group prefix, e.g. "message.data".
+func (r *Redactor) replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if r == nil || a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+		return a
+	}
+	key := a.Key
+	if len(groups) > 0 {
+		key = strings.Join(groups, ".") + "." + a.Key
+	}
+	redacted := r.value(key, a.Value.Any())
+	if s, ok := redacted.(string); ok {
+		return slog.String(a.Key, s)
+	}
+	return a
+}
@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testPayload = "order 42 for jane.doe@example.com, card 4111 1111 1111 1111"
+
+func testRedactor(t *testing.T, mode string) *Redactor {
+	t.Helper()
+	cfg := defaultRedaction
+	cfg.Mode = mode
+	r, err := compileRedaction(cfg, []byte("test-key"))
+	if err != nil {
+		t.Fatalf("compileRedaction: %v", err)
+	}
+	return r
+}
+
+// logWith logs one record through the service's handler options with r as the redactor
+func logWith(t *testing.T, r *Redactor, msg string, args ...any) string {
+	t.Helper()
+	previous := Redaction
+	Redaction = r
+	t.Cleanup(func() { Redaction = previous })
+
+	var buf bytes.Buffer
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr { return Redaction.replaceAttr(groups, a) },
+	}
+	slog.New(slog.NewJSONHandler(&buf, opts)).Info(msg, args...)
+	return buf.String()
+}
+
+func TestRedactMessageDataInLogs(t *testing.T) {
+	out := logWith(t, testRedactor(t, "mask"), "Pipeline completed - Step3 finished",
+		"message.data", testPayload,
+		"correlation.id", "c-1")
+
+	if strings.Contains(out, "jane.doe") || strings.Contains(out, "order 42") {
+		t.Fatalf("message.data leaked into the log: %s", out)
+	}
+	if !strings.Contains(out, `"message.data":"[REDACTED]"`) {
+		t.Errorf("message.data not masked: %s", out)
+	}
+	if !strings.Contains(out, `"correlation.id":"c-1"`) {
+		t.Errorf("allowed field was changed: %s", out)
+	}
+}
+
+func TestRedactMessageDataInGroup(t *testing.T) {
+	out := logWith(t, testRedactor(t, "mask"), "Step2 completed",
+		slog.Group("message", slog.String("data", testPayload)))
+
+	if strings.Contains(out, "jane.doe") {
+		t.Fatalf("grouped message.data leaked into the log: %s", out)
+	}
+}
+
+func TestRedactHashMode(t *testing.T) {
+	r := testRedactor(t, "hash")
+	first := r.value("message.data", testPayload)
+	second := r.value("message.data", testPayload)
+	other := r.value("message.data", "another payload")
+
+	s, ok := first.(string)
+	if !ok || !strings.HasPrefix(s, "sha256:") {
+		t.Fatalf("expected a sha256 hash, got %v", first)
+	}
+	if strings.Contains(s, "jane.doe") {
+		t.Fatalf("hash contains the payload: %s", s)
+	}
+	if first != second {
+		t.Errorf("hash is not stable: %v != %v", first, second)
+	}
+	if first == other {
+		t.Errorf("different payloads hash to the same value %v", first)
+	}
+
+	unkeyed, err := compileRedaction(defaultRedaction, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unkeyed.hash = true
+	if unkeyed.value("message.data", testPayload) == first {
+		t.Errorf("hash does not depend on REDACT_HASH_KEY")
+	}
+}
+
+func TestRedactPatterns(t *testing.T) {
+	r := testRedactor(t, "mask")
+	tests := []struct {
+		name  string
+		key   string
+		value interface{}
+		want  interface{}
+	}{
+		{"email in free text", "error.msg", "rejected for jane.doe@example.com", "rejected for [REDACTED]"},
+		{"card number", "note", "paid with 4111-1111-1111-1111", "paid with [REDACTED]"},
+		{"error value", "error", errors.New("bad card 4111111111111111"), "bad card [REDACTED]"},
+		{"non-string untouched", "pipeline.step", 2, 2},
+		{"allowed key untouched", "dd.span_id", "4111111111111111", "4111111111111111"},
+		{"plain text untouched", "operation", "sqs_send", "sqs_send"},
+		{"deny is case insensitive", "Message.Data", testPayload, redactedValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.value(tt.key, tt.value); got != tt.want {
+				t.Errorf("value(%q, %v) = %v, want %v", tt.key, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSpanTags(t *testing.T) {
+	previous := Redaction
+	Redaction = testRedactor(t, "mask")
+	t.Cleanup(func() { Redaction = previous })
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := tp.Tracer("test")
+	ctx, s := tracer.Start(context.Background(), "pipeline.step3.process")
+	span := &otelSpan{span: s, ctx: ctx, tracer: tracer}
+	span.SetTag("message.data", testPayload)
+	span.SetTag("error.msg", "rejected for jane.doe@example.com")
+	span.SetTag("correlation.id", "c-1")
+	span.Finish()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(ended))
+	}
+	attrs := make(map[string]string)
+	for _, kv := range ended[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	want := map[string]string{
+		"message.data":   redactedValue,
+		"error.msg":      "rejected for [REDACTED]",
+		"correlation.id": "c-1",
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("span tag %s = %q, want %q", key, attrs[key], value)
+		}
+	}
+	if desc := ended[0].Status().Description; strings.Contains(desc, "jane.doe") {
+		t.Errorf("span status leaked the payload: %s", desc)
+	}
+}
+
+func TestNilRedactorIsNoop(t *testing.T) {
+	var r *Redactor
+	if got := r.value("message.data", testPayload); got != testPayload {
+		t.Errorf("nil redactor changed the value: %v", got)
+	}
+}
+
+func TestCompileRedactionErrors(t *testing.T) {
+	if _, err := compileRedaction(redactionConfig{Mode: "encrypt"}, nil); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	if _, err := compileRedaction(redactionConfig{Patterns: []redactionPattern{{Name: "bad", Regex: "("}}}, nil); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
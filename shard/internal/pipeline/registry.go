@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ServiceInstance is a running service as seen by the shard registry
+type ServiceInstance struct {
+	ID            string            `json:"id"`
+	Shard         string            `json:"shard"`
+	Role          string            `json:"role"`
+	Address       string            `json:"address"`
+	Version       string            `json:"version"`
+	Queues        map[string]string `json:"queues,omitempty"`
+	Status        string            `json:"status,omitempty"`
+	TTLSeconds    int               `json:"ttl_seconds,omitempty"`
+	LastHeartbeat time.Time         `json:"last_heartbeat,omitempty"`
+}
+
+// ShardRegistry is where services announce themselves and where routers and tooling
+// discover them. Implementations: httpRegistry (registry/ stand-in for etcd/Consul)
+// and fileRegistry (static JSON file).
+type ShardRegistry interface {
+	// Register creates or refreshes an instance; calling it again acts as a heartbeat
+	Register(ctx context.Context, instance ServiceInstance) error
+	Deregister(ctx context.Context, id string) error
+	// List returns live instances, optionally filtered by shard and role
+	List(ctx context.Context, shard, role string) ([]ServiceInstance, error)
+}
+
+// NewRegistryFromEnv picks the registry from REGISTRY_URL or REGISTRY_FILE; nil when neither is set
+func NewRegistryFromEnv() ShardRegistry {
+	if u := os.Getenv("REGISTRY_URL"); u != "" {
+		return NewHTTPRegistry(u)
+	}
+	if f := os.Getenv("REGISTRY_FILE"); f != "" {
+		return &fileRegistry{path: f}
+	}
+	return nil
+}
+
+// httpRegistry talks to the registry service over its /v1/instances API
+type httpRegistry struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRegistry returns the registry served at baseURL, for tools that take the address as a flag
+func NewHTTPRegistry(baseURL string) ShardRegistry {
+	return &httpRegistry{baseURL: baseURL, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (r *httpRegistry) Register(ctx context.Context, instance ServiceInstance) error {
+	body, err := json.Marshal(instance)
+	if err != nil {
+		return fmt.Errorf("failed to marshal instance %s: %w", instance.ID, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.baseURL+"/v1/instances", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return r.do(req, nil)
+}
+
+func (r *httpRegistry) Deregister(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
+		r.baseURL+"/v1/instances?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	return r.do(req, nil)
+}
+
+func (r *httpRegistry) List(ctx context.Context, shard, role string) ([]ServiceInstance, error) {
+	query := url.Values{}
+	if shard != "" {
+		query.Set("shard", shard)
+	}
+	if role != "" {
+		query.Set("role", role)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+"/v1/instances?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var instances []ServiceInstance
+	if err := r.do(req, &instances); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (r *httpRegistry) do(req *http.Request, out interface{}) error {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("registry request %s %s failed: %w", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("registry request %s %s returned %s", req.Method, req.URL.Path, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// fileRegistry reads a static {"instances": [...]} file. It is re-read on every list so
+// edits are picked up; Register and Deregister are no-ops.
+type fileRegistry struct {
+	path string
+}
+
+func (r *fileRegistry) Register(ctx context.Context, instance ServiceInstance) error {
+	return nil
+}
+
+func (r *fileRegistry) Deregister(ctx context.Context, id string) error {
+	return nil
+}
+
+func (r *fileRegistry) List(ctx context.Context, shard, role string) ([]ServiceInstance, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry file %s: %w", r.path, err)
+	}
+	var file struct {
+		Instances []ServiceInstance `json:"instances"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse registry file %s: %w", r.path, err)
+	}
+	var instances []ServiceInstance
+	for _, instance := range file.Instances {
+		if (shard == "" || instance.Shard == shard) && (role == "" || instance.Role == role) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// KeepRegistered registers instance and heartbeats every third of its TTL until ctx is done,
+// then deregisters it
+func KeepRegistered(ctx context.Context, registry ShardRegistry, instance ServiceInstance) {
+	interval := time.Duration(instance.TTLSeconds) * time.Second / 3
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	registered := false
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := registry.Register(callCtx, instance)
+		cancel()
+		if err != nil {
+			Logger.WarnContext(ctx, "Failed to heartbeat shard registry",
+				"instance.id", instance.ID,
+				"operation", "registry_heartbeat",
+				"error", err)
+		} else if !registered {
+			registered = true
+			Logger.InfoContext(ctx, "Registered in shard registry",
+				"instance.id", instance.ID,
+				"address", instance.Address)
+		}
+
+		select {
+		case <-ctx.Done():
+			deregCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := registry.Deregister(deregCtx, instance.ID); err != nil {
+				Logger.Warn("Failed to deregister from shard registry", "instance.id", instance.ID, "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// ErrTransient marks a failure that is not an AWS error but worth retrying, such as a
+// refused callback or a failed write to the result store
+var ErrTransient = errors.New("transient failure")
+
+// RetryPolicy retries an operation on retryable errors with exponential backoff and full
+// jitter: attempt n waits a random time up to min(maxDelay, baseDelay * 2^(n-1)). The SQS
+// client is built without SDK retries, so these policies are the only retries and their
+// metrics count all of them. Each policy can be tuned from the environment, e.g. for
+// operation sqs_send:
+//
+//	RETRY_SQS_SEND_MAX_ATTEMPTS  attempts including the first, 0 retries for as long as the error is retryable
+//	RETRY_SQS_SEND_BASE_DELAY    backoff of the first retry
+//	RETRY_SQS_SEND_MAX_DELAY     upper bound of any backoff
+type RetryPolicy struct {
+	operation   string
+	maxAttempts int
+	baseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// SQSSendRetry covers SendMessage of the producers
+var SQSSendRetry = NewRetryPolicy("sqs_send", 3, 100*time.Millisecond, 2*time.Second)
+
+func NewRetryPolicy(operation string, maxAttempts int, baseDelay, maxDelay time.Duration) RetryPolicy {
+	prefix := "RETRY_" + strings.ToUpper(operation) + "_"
+	p := RetryPolicy{
+		operation:   operation,
+		maxAttempts: EnvInt(prefix+"MAX_ATTEMPTS", maxAttempts),
+		baseDelay:   EnvDuration(prefix+"BASE_DELAY", baseDelay),
+		MaxDelay:    EnvDuration(prefix+"MAX_DELAY", maxDelay),
+	}
+	if p.MaxDelay < p.baseDelay {
+		p.MaxDelay = p.baseDelay
+	}
+	return p
+}
+
+// do runs op until it succeeds, fails with an error that is not retryable, runs out of
+// attempts or ctx is done, and returns the last error
+func (p RetryPolicy) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	operation := Tag("operation", p.operation)
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			if attempt > 1 {
+				Metrics.Incr(MetricRetryRecovered, operation)
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if p.maxAttempts > 0 && attempt >= p.maxAttempts {
+			Metrics.Incr(MetricRetryExhausted, operation)
+			return err
+		}
+
+		delay := p.Backoff(attempt)
+		Metrics.Incr(MetricRetryAttempts, operation, Tag("error_code", ErrorCode(err)))
+		Logger.WarnContext(ctx, "Retrying after error",
+			"operation", p.operation,
+			"attempt", attempt,
+			"retry.delay_ms", delay.Milliseconds(),
+			"error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff is the wait before the retry following attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := attempt - 1; shift < 32 && p.baseDelay<<shift < p.MaxDelay {
+		ceiling = p.baseDelay << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// awsRetryables is the AWS SDK's own classification: throttling and transient error codes,
+// 5xx and 429 responses, connection errors and timeouts
+var awsRetryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+// retryable reports whether err is worth another attempt. A timeout is: callers give each
+// attempt its own deadline, and do stops once its own context is done. An open circuit is
+// not: retrying it only waits out the breaker's cooldown inside the caller's request. Nor is
+// a callback address that is not allowed, though it fails like a connection error.
+func retryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, errAddressNotAllowed) {
+		return false
+	}
+	if errors.Is(err, ErrTransient) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return awsRetryables.IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// ErrorCode is the AWS error code of err, or a coarse kind for the retry metrics
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.ErrorCode()
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrTransient):
+		return "transient"
+	}
+	return "other"
+}
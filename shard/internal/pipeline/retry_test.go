@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoffJitter(t *testing.T) {
+	p := RetryPolicy{operation: "test", baseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{40, time.Second}, // past the shift width
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %d", tt.attempt), func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			var highest time.Duration
+			for range 1000 {
+				d := p.Backoff(tt.attempt)
+				if d < 0 || d > tt.ceiling {
+					t.Fatalf("backoff %s outside [0, %s]", d, tt.ceiling)
+				}
+				seen[d] = true
+				highest = max(highest, d)
+			}
+			// Full jitter spreads the waits over the whole range instead of a fixed delay
+			if len(seen) < 100 {
+				t.Errorf("only %d distinct backoffs in 1000 draws", len(seen))
+			}
+			if highest < tt.ceiling/2 {
+				t.Errorf("highest backoff %s never reached half of %s", highest, tt.ceiling)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffZeroDelay(t *testing.T) {
+	p := RetryPolicy{operation: "test"}
+	if d := p.Backoff(3); d != 0 {
+		t.Errorf("backoff = %s, want 0", d)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	errRejected := errors.New("rejected")
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error // returned by successive attempts, then nil
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "success",
+			maxAttempts:  3,
+			wantAttempts: 1,
+		},
+		{
+			name:         "recovers",
+			maxAttempts:  3,
+			errs:         []error{ErrTransient, context.DeadlineExceeded},
+			wantAttempts: 3,
+		},
+		{
+			name:         "exhausted",
+			maxAttempts:  2,
+			errs:         []error{ErrTransient, ErrTransient, ErrTransient},
+			wantAttempts: 2,
+			wantErr:      ErrTransient,
+		},
+		{
+			name:         "not retryable",
+			maxAttempts:  3,
+			errs:         []error{errRejected},
+			wantAttempts: 1,
+			wantErr:      errRejected,
+		},
+		{
+			name:         "open circuit is not retried",
+			maxAttempts:  3,
+			errs:         []error{fmt.Errorf("%w: %w", ErrTransient, ErrCircuitOpen)},
+			wantAttempts: 1,
+			wantErr:      ErrCircuitOpen,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestTelemetry(t)
+			p := RetryPolicy{operation: "test", maxAttempts: tt.maxAttempts, baseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+			attempts := 0
+			err := p.Do(context.Background(), func(context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import "github.com/aws/aws-sdk-go-v2/service/sqs"
+
+// Identity of the running service, set by main before anything else uses it
+var (
+	ShardID        string
+	ServiceVersion string
+)
+
+// SQSClient is the SQS client of the service, created by main
+var SQSClient *sqs.Client
+
+// PipelineMessage is the body of the messages passed between the steps of a pipeline
+type PipelineMessage struct {
+	CorrelationID string `json:"correlation_id"`
+	Data          string `json:"data"`
+	Pipeline      struct {
+		StartTime     string `json:"start_time"`
+		Step1Complete string `json:"step1_complete,omitempty"`
+		Step2Complete string `json:"step2_complete,omitempty"`
+		CurrentStep   int    `json:"current_step"`
+	} `json:"pipeline"`
+	ErrorType string `json:"error_type,omitempty"`
+	// FailedStep is set by the step that failed the pipeline. The message still goes on to
+	// service3, which only records the result.
+	FailedStep int `json:"failed_step,omitempty"`
+	// Where the end of the pipeline is reported: the caller's X-Callback-URL and the
+	// accepting service1 instance, which also takes the step transitions on EventsURL
+	CallbackURL string `json:"callback_url,omitempty"`
+	StatusURL   string `json:"status_url,omitempty"`
+	EventsURL   string `json:"events_url,omitempty"`
+}
@@ -0,0 +1,306 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+
+	// SLI sources fed by the outcome middleware and by service3's end-to-end timing
+	SLOSourceRequests   = "requests"
+	SLOSourceProcessing = "processing"
+	SLOSourcePipeline   = "pipeline"
+)
+
+// sloDefinition is one objective from slo.json. Availability counts dependency and
+// server errors as bad events; latency counts events slower than Threshold as bad.
+// Client and business errors never burn availability budget.
+type sloDefinition struct {
+	Name        string  `json:"name"`
+	Service     string  `json:"service"`
+	Type        string  `json:"type"`
+	Source      string  `json:"source"`
+	Scope       string  `json:"scope,omitempty"`
+	Objective   float64 `json:"objective"`
+	Threshold   string  `json:"threshold,omitempty"`
+	Window      string  `json:"window"`
+	Description string  `json:"description,omitempty"`
+}
+
+type sloConfig struct {
+	SLOs []sloDefinition `json:"slos"`
+}
+
+// burnWindows are the burn-rate windows reported and emitted; the pairs (1h, 5m) and
+// (6h, 30m) are the fast and slow multi-window alert conditions.
+var burnWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+const (
+	fastBurnBudget = 0.02 // of the window's error budget spent in 1h
+	slowBurnBudget = 0.05 // of the window's error budget spent in 6h
+)
+
+// burnThreshold is the burn rate that spends fraction of the error budget of window
+// within alertWindow. A 30-day window gives the usual 14.4 for 2% in 1h; a 24h window
+// alerts at 0.48.
+func burnThreshold(fraction float64, window, alertWindow time.Duration) float64 {
+	return fraction * float64(window) / float64(alertWindow)
+}
+
+type sloBucket struct {
+	minute int64
+	good   int64
+	total  int64
+}
+
+// sloTracker counts good and total events in one-minute buckets over the SLO window
+type sloTracker struct {
+	def       sloDefinition
+	window    time.Duration
+	threshold time.Duration
+	fastBurn  float64
+	slowBurn  float64
+	buckets   []sloBucket
+}
+
+type sloReport struct {
+	Name                 string             `json:"name"`
+	Type                 string             `json:"type"`
+	Objective            float64            `json:"objective"`
+	Threshold            string             `json:"threshold,omitempty"`
+	Window               string             `json:"window"`
+	Total                int64              `json:"total"`
+	Good                 int64              `json:"good"`
+	SLI                  float64            `json:"sli"`
+	ErrorBudgetRemaining float64            `json:"error_budget_remaining"`
+	BurnRates            map[string]float64 `json:"burn_rates"`
+	FastBurnThreshold    float64            `json:"fast_burn_threshold"`
+	SlowBurnThreshold    float64            `json:"slow_burn_threshold"`
+	Status               string             `json:"status"`
+}
+
+type SLOEngine struct {
+	service  string
+	mu       sync.Mutex
+	trackers []*sloTracker
+}
+
+var SLOs *SLOEngine
+
+// NewSLOEngine loads the objectives of service from path. A missing file leaves the
+// engine empty so the service still starts without SLOs.
+func NewSLOEngine(service, path string) (*SLOEngine, error) {
+	engine := &SLOEngine{service: service}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return engine, nil
+		}
+		return engine, fmt.Errorf("failed to read SLO config %s: %w", path, err)
+	}
+	var cfg sloConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return engine, fmt.Errorf("failed to parse SLO config %s: %w", path, err)
+	}
+
+	for _, def := range cfg.SLOs {
+		if def.Service != service {
+			continue
+		}
+		tracker, err := newSLOTracker(def)
+		if err != nil {
+			return engine, fmt.Errorf("invalid SLO %q: %w", def.Name, err)
+		}
+		engine.trackers = append(engine.trackers, tracker)
+	}
+	return engine, nil
+}
+
+func newSLOTracker(def sloDefinition) (*sloTracker, error) {
+	if def.Objective <= 0 || def.Objective >= 1 {
+		return nil, fmt.Errorf("objective must be between 0 and 1, got %v", def.Objective)
+	}
+	switch def.Source {
+	case SLOSourceRequests, SLOSourceProcessing, SLOSourcePipeline:
+	default:
+		return nil, fmt.Errorf("unknown source %q", def.Source)
+	}
+	window, err := time.ParseDuration(def.Window)
+	if err != nil || window < time.Minute {
+		return nil, fmt.Errorf("window must be a duration of at least 1m, got %q", def.Window)
+	}
+
+	tracker := &sloTracker{
+		def:      def,
+		window:   window,
+		fastBurn: burnThreshold(fastBurnBudget, window, time.Hour),
+		slowBurn: burnThreshold(slowBurnBudget, window, 6*time.Hour),
+	}
+	switch def.Type {
+	case sloAvailability:
+	case sloLatency:
+		tracker.threshold, err = time.ParseDuration(def.Threshold)
+		if err != nil || tracker.threshold <= 0 {
+			return nil, fmt.Errorf("latency SLO needs a threshold duration, got %q", def.Threshold)
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q", def.Type)
+	}
+	tracker.buckets = make([]sloBucket, int(window/time.Minute))
+	return tracker, nil
+}
+
+// observe feeds one request or message into every matching objective
+func (e *SLOEngine) Observe(source, scope string, o Outcome, elapsed time.Duration) {
+	if e == nil {
+		return
+	}
+	// Callers' mistakes do not count against the service
+	if o == OutcomeClientError || o == OutcomeBusinessError {
+		return
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, t := range e.trackers {
+		if t.def.Source != source || (t.def.Scope != "" && t.def.Scope != scope) {
+			continue
+		}
+		good := o == OutcomeSuccess
+		if t.def.Type == sloLatency {
+			good = elapsed <= t.threshold
+		}
+		t.add(now, good)
+	}
+}
+
+func (t *sloTracker) add(now time.Time, good bool) {
+	minute := now.Unix() / 60
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// counts sums the buckets that fall within the last d
+func (t *sloTracker) counts(now time.Time, d time.Duration) (good, total int64) {
+	current := now.Unix() / 60
+	oldest := current - int64(d/time.Minute) + 1
+	for _, b := range t.buckets {
+		if b.minute >= oldest && b.minute <= current {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+func (t *sloTracker) report(now time.Time) sloReport {
+	good, total := t.counts(now, t.window)
+	r := sloReport{
+		Name:                 t.def.Name,
+		Type:                 t.def.Type,
+		Objective:            t.def.Objective,
+		Threshold:            t.def.Threshold,
+		Window:               t.def.Window,
+		Total:                total,
+		Good:                 good,
+		SLI:                  1,
+		ErrorBudgetRemaining: 1,
+		BurnRates:            make(map[string]float64, len(burnWindows)),
+		FastBurnThreshold:    t.fastBurn,
+		SlowBurnThreshold:    t.slowBurn,
+		Status:               "ok",
+	}
+	budget := 1 - t.def.Objective
+	if total > 0 {
+		r.SLI = float64(good) / float64(total)
+		r.ErrorBudgetRemaining = 1 - (1-r.SLI)/budget
+	}
+
+	for _, w := range burnWindows {
+		g, n := t.counts(now, w.duration)
+		rate := 0.0
+		if n > 0 {
+			rate = (1 - float64(g)/float64(n)) / budget
+		}
+		r.BurnRates[w.name] = rate
+	}
+	switch {
+	case r.BurnRates["1h"] > t.fastBurn && r.BurnRates["5m"] > t.fastBurn:
+		r.Status = "fast_burn"
+	case r.BurnRates["6h"] > t.slowBurn && r.BurnRates["30m"] > t.slowBurn:
+		r.Status = "slow_burn"
+	case r.ErrorBudgetRemaining <= 0:
+		r.Status = "budget_exhausted"
+	}
+	return r
+}
+
+func (e *SLOEngine) reports() []sloReport {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reports := make([]sloReport, 0, len(e.trackers))
+	for _, t := range e.trackers {
+		reports = append(reports, t.report(now))
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// emitLoop publishes the SLI, error budget and burn rates as gauges
+func (e *SLOEngine) EmitLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, r := range e.reports() {
+			Metrics.Gauge(MetricSLOSLI, r.SLI, Tag("slo", r.Name))
+			Metrics.Gauge(MetricSLOErrorBudget, r.ErrorBudgetRemaining, Tag("slo", r.Name))
+			for window, rate := range r.BurnRates {
+				Metrics.Gauge(MetricSLOBurnRate, rate, Tag("slo", r.Name), Tag("window", window))
+			}
+			if r.Status == "fast_burn" || r.Status == "slow_burn" {
+				Logger.Warn("SLO error budget burning too fast",
+					"slo", r.Name,
+					"status", r.Status,
+					"burn_rates", r.BurnRates,
+					"budget", r.ErrorBudgetRemaining)
+			}
+		}
+	}
+}
+
+// handler serves GET /slo
+func (e *SLOEngine) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service": e.service,
+		"shard":   ShardID,
+		"slos":    e.reports(),
+	})
+}
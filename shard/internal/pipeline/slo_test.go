@@ -0,0 +1,225 @@
+package pipeline
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var sloEpoch = time.Date(2025, 1, 15, 10, 0, 30, 0, time.UTC)
+
+func testSLOTracker(t *testing.T, window string) *sloTracker {
+	t.Helper()
+	tracker, err := newSLOTracker(sloDefinition{Name: "test", Type: sloAvailability, Source: SLOSourceRequests, Objective: 0.99, Window: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+// addEvents records total events, bad of them bad, at now
+func addEvents(tr *sloTracker, now time.Time, total, bad int) {
+	for i := range total {
+		tr.add(now, i >= bad)
+	}
+}
+
+func TestSLOTrackerCountsMinuteBuckets(t *testing.T) {
+	tr := testSLOTracker(t, "10m")
+	addEvents(tr, sloEpoch, 4, 1)
+	addEvents(tr, sloEpoch.Add(20*time.Second), 2, 0)
+	addEvents(tr, sloEpoch.Add(time.Minute), 3, 3)
+	addEvents(tr, sloEpoch.Add(5*time.Minute), 5, 0)
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		d         time.Duration
+		wantGood  int64
+		wantTotal int64
+	}{
+		{"same minute", sloEpoch.Add(20 * time.Second), time.Minute, 5, 6},
+		{"last two minutes", sloEpoch.Add(time.Minute), 2 * time.Minute, 5, 9},
+		{"whole window", sloEpoch.Add(5 * time.Minute), 10 * time.Minute, 10, 14},
+		{"older minutes left the short window", sloEpoch.Add(5 * time.Minute), 3 * time.Minute, 5, 5},
+		{"first minute left the window", sloEpoch.Add(10 * time.Minute), 10 * time.Minute, 5, 8},
+		{"nothing recent", sloEpoch.Add(time.Hour), 10 * time.Minute, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			good, total := tr.counts(tt.now, tt.d)
+			if good != tt.wantGood || total != tt.wantTotal {
+				t.Errorf("counts = %d/%d, want %d/%d", good, total, tt.wantGood, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestSLOTrackerReusesBucketsAfterTheWindow(t *testing.T) {
+	tr := testSLOTracker(t, "10m")
+	addEvents(tr, sloEpoch, 10, 10)
+	// Ten minutes later the same bucket holds the new minute only
+	later := sloEpoch.Add(10 * time.Minute)
+	addEvents(tr, later, 2, 0)
+	if good, total := tr.counts(later, 10*time.Minute); good != 2 || total != 2 {
+		t.Errorf("counts = %d/%d, want 2/2 without the expired minute", good, total)
+	}
+}
+
+func TestBurnThresholdFollowsTheWindow(t *testing.T) {
+	tests := []struct {
+		window       string
+		wantFast     float64
+		wantSlow     float64
+		wantBuckets  int
+		wantFastText string
+	}{
+		{"24h", 0.48, 0.2, 24 * 60, "2% of a day in 1h"},
+		{"720h", 14.4, 6, 30 * 24 * 60, "2% of 30 days in 1h"},
+		{"168h", 3.36, 1.4, 7 * 24 * 60, "2% of a week in 1h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			tr := testSLOTracker(t, tt.window)
+			if math.Abs(tr.fastBurn-tt.wantFast) > 1e-9 || math.Abs(tr.slowBurn-tt.wantSlow) > 1e-9 {
+				t.Errorf("thresholds = %v, %v, want %v, %v (%s)", tr.fastBurn, tr.slowBurn, tt.wantFast, tt.wantSlow, tt.wantFastText)
+			}
+			if len(tr.buckets) != tt.wantBuckets {
+				t.Errorf("%d buckets, want one per minute, %d", len(tr.buckets), tt.wantBuckets)
+			}
+		})
+	}
+}
+
+func TestSLOReportClassifiesBurn(t *testing.T) {
+	// With a 1% budget over 24h, the fast threshold is 0.48 (0.48% errors) and the slow 0.2
+	tests := []struct {
+		name       string
+		events     func(tr *sloTracker)
+		wantStatus string
+	}{
+		{
+			name:       "no events",
+			events:     func(tr *sloTracker) {},
+			wantStatus: "ok",
+		},
+		{
+			name: "errors below the slow threshold",
+			events: func(tr *sloTracker) {
+				addEvents(tr, sloEpoch, 1000, 1)
+			},
+			wantStatus: "ok",
+		},
+		{
+			name: "fast burn in the last hour and 5 minutes",
+			events: func(tr *sloTracker) {
+				addEvents(tr, sloEpoch, 100, 1)
+			},
+			wantStatus: "fast_burn",
+		},
+		{
+			name: "old burst no longer burning fast",
+			events: func(tr *sloTracker) {
+				addEvents(tr, sloEpoch.Add(-20*time.Minute), 100, 1)
+				addEvents(tr, sloEpoch, 100, 0)
+			},
+			wantStatus: "slow_burn",
+		},
+		{
+			name: "slow burn over 6h and 30m",
+			events: func(tr *sloTracker) {
+				for h := range 6 {
+					addEvents(tr, sloEpoch.Add(-time.Duration(h)*time.Hour), 1000, 3)
+				}
+			},
+			wantStatus: "slow_burn",
+		},
+		{
+			name: "burn only in the long window",
+			events: func(tr *sloTracker) {
+				addEvents(tr, sloEpoch.Add(-3*time.Hour), 100, 10)
+				addEvents(tr, sloEpoch, 10000, 0)
+			},
+			wantStatus: "ok",
+		},
+		{
+			name: "budget spent long ago",
+			events: func(tr *sloTracker) {
+				addEvents(tr, sloEpoch.Add(-12*time.Hour), 100, 50)
+			},
+			wantStatus: "budget_exhausted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := testSLOTracker(t, "24h")
+			tt.events(tr)
+			r := tr.report(sloEpoch)
+			if r.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s (burn rates %v, budget %v)", r.Status, tt.wantStatus, r.BurnRates, r.ErrorBudgetRemaining)
+			}
+		})
+	}
+}
+
+func TestSLOReportBudget(t *testing.T) {
+	tr := testSLOTracker(t, "24h")
+	addEvents(tr, sloEpoch, 200, 1)
+	r := tr.report(sloEpoch)
+	if r.Total != 200 || r.Good != 199 {
+		t.Errorf("events = %d/%d, want 199/200", r.Good, r.Total)
+	}
+	if math.Abs(r.SLI-0.995) > 1e-9 || math.Abs(r.ErrorBudgetRemaining-0.5) > 1e-9 {
+		t.Errorf("sli %v, budget %v, want 0.995 and half the budget left", r.SLI, r.ErrorBudgetRemaining)
+	}
+	if math.Abs(r.BurnRates["5m"]-0.5) > 1e-9 {
+		t.Errorf("5m burn rate = %v, want 0.5", r.BurnRates["5m"])
+	}
+	if r.FastBurnThreshold != tr.fastBurn || r.SlowBurnThreshold != tr.slowBurn {
+		t.Errorf("reported thresholds %v, %v, want the tracker's", r.FastBurnThreshold, r.SlowBurnThreshold)
+	}
+}
+
+func TestSLOEngineObserve(t *testing.T) {
+	availability := testSLOTracker(t, "1h")
+	availability.def.Scope = "/send-message"
+	latency, err := newSLOTracker(sloDefinition{Name: "latency", Type: sloLatency, Source: SLOSourceRequests, Objective: 0.9, Threshold: "100ms", Window: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := &SLOEngine{trackers: []*sloTracker{availability, latency}}
+
+	engine.Observe(SLOSourceRequests, "/send-message", OutcomeSuccess, 50*time.Millisecond)
+	engine.Observe(SLOSourceRequests, "/send-message", OutcomeServerError, 50*time.Millisecond)
+	engine.Observe(SLOSourceRequests, "/send-message", OutcomeDependencyError, 200*time.Millisecond)
+	engine.Observe(SLOSourceRequests, "/send-message", OutcomeClientError, time.Second)
+	engine.Observe(SLOSourceRequests, "/send-message", OutcomeBusinessError, time.Second)
+	engine.Observe(SLOSourceRequests, "/health", OutcomeServerError, 10*time.Millisecond)
+	engine.Observe(SLOSourceProcessing, "/send-message", OutcomeServerError, time.Second)
+
+	now := time.Now()
+	if good, total := availability.counts(now, time.Hour); good != 1 || total != 3 {
+		t.Errorf("availability = %d/%d, want 1/3: client and business errors and other scopes do not count", good, total)
+	}
+	if good, total := latency.counts(now, time.Hour); good != 3 || total != 4 {
+		t.Errorf("latency = %d/%d, want 3/4: every scope, bad only when slower than 100ms", good, total)
+	}
+}
+
+func TestSLOHandlerRejectsOtherMethods(t *testing.T) {
+	engine := &SLOEngine{service: "service1"}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		engine.Handler(w, httptest.NewRequest(method, "/slo", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s /slo = %d, want 405", method, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	engine.Handler(w, httptest.NewRequest(http.MethodGet, "/slo", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /slo = %d, want 200", w.Code)
+	}
+}
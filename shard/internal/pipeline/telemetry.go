@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TelemetryProvider hides the tracing and metrics backend from the pipeline code.
+// TELEMETRY_BACKEND selects it: "datadog" (default, dd-trace-go + DogStatsD) or
+// "otel" (OpenTelemetry SDK exporting OTLP traces and metrics).
+type TelemetryProvider interface {
+	// StartSpan starts a span as a child of the span in ctx, if any
+	StartSpan(ctx context.Context, operationName string) (Span, context.Context)
+	// StartSpanFromCarrier continues the trace propagated in carrier. When no context can be
+	// extracted it starts a new root span and returns the extraction error.
+	StartSpanFromCarrier(operationName string, carrier map[string]string) (Span, context.Context, error)
+	// StartLinkedSpan starts a new root span with a span link to the trace of each carrier,
+	// for work that fans in several producers (a batch) or resumes a trace that has long
+	// finished (a redrive). kind is recorded on the links. It returns how many carriers
+	// held no trace context.
+	StartLinkedSpan(operationName string, carriers []map[string]string, kind string) (Span, context.Context, int)
+	// SpanFromContext returns the active span in ctx, including the server spans of
+	// InstrumentHandler, or nil
+	SpanFromContext(ctx context.Context) Span
+	// Inject writes the span context into carrier, e.g. for SQS message attributes
+	Inject(span Span, carrier map[string]string) error
+	// InstrumentHandler wraps an HTTP handler with server spans
+	InstrumentHandler(handler http.Handler) http.Handler
+
+	Incr(name string, tags []string)
+	Timing(name string, value time.Duration, tags []string)
+	Gauge(name string, value float64, tags []string)
+
+	// Shutdown flushes pending spans and metrics
+	Shutdown()
+}
+
+// Span is the subset of span operations the pipeline uses
+type Span interface {
+	SetTag(key string, value interface{})
+	StartChild(operationName string) Span
+	Finish()
+	// TraceID and SpanID are formatted for log correlation with the backend
+	TraceID() string
+	SpanID() string
+}
+
+type TelemetryConfig struct {
+	Service string
+	Env     string
+	Version string
+	// Tags are added to every span and metric (e.g. shard, port)
+	Tags map[string]string
+}
+
+var Telemetry TelemetryProvider
+
+func NewTelemetry(cfg TelemetryConfig) (TelemetryProvider, error) {
+	backend := strings.ToLower(os.Getenv("TELEMETRY_BACKEND"))
+	switch backend {
+	case "", "datadog":
+		return newDatadogTelemetry(cfg)
+	case "otel", "opentelemetry":
+		return newOtelTelemetry(cfg)
+	default:
+		return nil, fmt.Errorf("unknown TELEMETRY_BACKEND %q, expected datadog or otel", backend)
+	}
+}
+
+// splitTag turns a DogStatsD "key:value" tag into a key and value
+func splitTag(tag string) (string, string) {
+	key, value, found := strings.Cut(tag, ":")
+	if !found {
+		return tag, ""
+	}
+	return key, value
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	httptrace "github.com/DataDog/dd-trace-go/contrib/net/http/v2"
+	"github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
+)
+
+// datadogTelemetry sends traces to the Datadog agent and metrics to DogStatsD
+type datadogTelemetry struct {
+	service string
+	statsd  *statsd.Client
+}
+
+type datadogSpan struct {
+	span *tracer.Span
+}
+
+func newDatadogTelemetry(cfg TelemetryConfig) (*datadogTelemetry, error) {
+	opts := []tracer.StartOption{
+		tracer.WithService(cfg.Service),
+		tracer.WithEnv(cfg.Env),
+		tracer.WithServiceVersion(cfg.Version),
+	}
+	for k, v := range cfg.Tags {
+		opts = append(opts, tracer.WithGlobalTag(k, v))
+	}
+	if err := tracer.Start(opts...); err != nil {
+		return nil, fmt.Errorf("failed to start Datadog tracer: %w", err)
+	}
+
+	statsdAddr := os.Getenv("DOGSTATSD_ADDR")
+	if statsdAddr == "" {
+		statsdAddr = "127.0.0.1:8125"
+	}
+	client, err := statsd.New(statsdAddr)
+	if err != nil {
+		tracer.Stop()
+		return nil, fmt.Errorf("failed to initialize StatsD client: %w", err)
+	}
+	return &datadogTelemetry{service: cfg.Service, statsd: client}, nil
+}
+
+func (t *datadogTelemetry) StartSpan(ctx context.Context, operationName string) (Span, context.Context) {
+	span, ctx := tracer.StartSpanFromContext(ctx, operationName)
+	return &datadogSpan{span: span}, ctx
+}
+
+func (t *datadogTelemetry) StartLinkedSpan(operationName string, carriers []map[string]string, kind string) (Span, context.Context, int) {
+	var links []tracer.SpanLink
+	orphaned := 0
+	for _, carrier := range carriers {
+		spanCtx, err := tracer.Extract(tracer.TextMapCarrier(carrier))
+		if err != nil {
+			orphaned++
+			continue
+		}
+		links = append(links, tracer.SpanLink{
+			TraceID:     spanCtx.TraceIDLower(),
+			TraceIDHigh: spanCtx.TraceIDUpper(),
+			SpanID:      spanCtx.SpanID(),
+			Attributes:  map[string]string{"link.kind": kind},
+		})
+	}
+	span := tracer.StartSpan(operationName, tracer.WithSpanLinks(links))
+	return &datadogSpan{span: span}, tracer.ContextWithSpan(context.Background(), span), orphaned
+}
+
+func (t *datadogTelemetry) SpanFromContext(ctx context.Context) Span {
+	span, ok := tracer.SpanFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return &datadogSpan{span: span}
+}
+
+func (t *datadogTelemetry) StartSpanFromCarrier(operationName string, carrier map[string]string) (Span, context.Context, error) {
+	spanCtx, err := tracer.Extract(tracer.TextMapCarrier(carrier))
+	if err != nil {
+		span, ctx := tracer.StartSpanFromContext(context.Background(), operationName)
+		return &datadogSpan{span: span}, ctx, err
+	}
+	span := tracer.StartSpan(operationName, tracer.ChildOf(spanCtx))
+	return &datadogSpan{span: span}, tracer.ContextWithSpan(context.Background(), span), nil
+}
+
+func (t *datadogTelemetry) Inject(span Span, carrier map[string]string) error {
+	ddSpan, ok := span.(*datadogSpan)
+	if !ok {
+		return fmt.Errorf("span %T does not belong to the Datadog backend", span)
+	}
+	return tracer.Inject(ddSpan.span.Context(), tracer.TextMapCarrier(carrier))
+}
+
+func (t *datadogTelemetry) InstrumentHandler(handler http.Handler) http.Handler {
+	// Same "METHOD /path" resources as httptrace.NewServeMux
+	return httptrace.WrapHandler(handler, t.service, "", httptrace.WithResourceNamer(func(r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
+
+func (t *datadogTelemetry) Incr(name string, tags []string) {
+	t.statsd.Incr(name, tags, 1)
+}
+
+func (t *datadogTelemetry) Timing(name string, value time.Duration, tags []string) {
+	t.statsd.Timing(name, value, tags, 1)
+}
+
+func (t *datadogTelemetry) Gauge(name string, value float64, tags []string) {
+	t.statsd.Gauge(name, value, tags, 1)
+}
+
+func (t *datadogTelemetry) Shutdown() {
+	t.statsd.Close()
+	tracer.Stop()
+}
+
+func (s *datadogSpan) SetTag(key string, value interface{}) {
+	s.span.SetTag(key, Redaction.value(key, value))
+}
+
+func (s *datadogSpan) StartChild(operationName string) Span {
+	return &datadogSpan{span: s.span.StartChild(operationName)}
+}
+
+func (s *datadogSpan) Finish() {
+	s.span.Finish()
+}
+
+// TraceID is the lower 64 bits in decimal, the format Datadog log correlation expects
+func (s *datadogSpan) TraceID() string {
+	return strconv.FormatUint(s.span.Context().TraceIDLower(), 10)
+}
+
+func (s *datadogSpan) SpanID() string {
+	return strconv.FormatUint(s.span.Context().SpanID(), 10)
+}
@@ -0,0 +1,269 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelTelemetry exports traces and metrics over OTLP/HTTP, e.g. to a local OpenTelemetry
+// collector in front of Jaeger. The exporters read the standard OTEL_EXPORTER_OTLP_* variables
+// (default endpoint localhost:4318). Trace context is propagated as W3C traceparent/tracestate.
+type otelTelemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+	meter          metric.Meter
+	propagator     propagation.TextMapPropagator
+
+	mu         sync.Mutex
+	counters   map[string]metric.Int64Counter
+	histograms map[string]metric.Float64Histogram
+	gauges     map[string]metric.Float64Gauge
+}
+
+type otelSpan struct {
+	span   trace.Span
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func newOtelTelemetry(cfg TelemetryConfig) (*otelTelemetry, error) {
+	ctx := context.Background()
+
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", cfg.Service),
+		attribute.String("service.version", cfg.Version),
+		attribute.String("deployment.environment", cfg.Env),
+	}
+	for k, v := range cfg.Tags {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	res := resource.NewSchemaless(attrs...)
+
+	traceExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(10*time.Second))),
+		sdkmetric.WithResource(res),
+	)
+
+	return &otelTelemetry{
+		tracerProvider: tp,
+		meterProvider:  mp,
+		tracer:         tp.Tracer(cfg.Service),
+		meter:          mp.Meter(cfg.Service),
+		propagator:     propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		counters:       make(map[string]metric.Int64Counter),
+		histograms:     make(map[string]metric.Float64Histogram),
+		gauges:         make(map[string]metric.Float64Gauge),
+	}, nil
+}
+
+func (t *otelTelemetry) StartSpan(ctx context.Context, operationName string) (Span, context.Context) {
+	ctx, span := t.tracer.Start(ctx, operationName)
+	return &otelSpan{span: span, ctx: ctx, tracer: t.tracer}, ctx
+}
+
+func (t *otelTelemetry) StartLinkedSpan(operationName string, carriers []map[string]string, kind string) (Span, context.Context, int) {
+	var links []trace.Link
+	orphaned := 0
+	for _, carrier := range carriers {
+		spanCtx := trace.SpanContextFromContext(t.propagator.Extract(context.Background(), propagation.MapCarrier(carrier)))
+		if !spanCtx.IsValid() {
+			orphaned++
+			continue
+		}
+		links = append(links, trace.Link{SpanContext: spanCtx, Attributes: []attribute.KeyValue{attribute.String("link.kind", kind)}})
+	}
+	ctx, span := t.tracer.Start(context.Background(), operationName,
+		trace.WithNewRoot(), trace.WithLinks(links...), trace.WithSpanKind(trace.SpanKindConsumer))
+	return &otelSpan{span: span, ctx: ctx, tracer: t.tracer}, ctx, orphaned
+}
+
+func (t *otelTelemetry) SpanFromContext(ctx context.Context) Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return nil
+	}
+	return &otelSpan{span: span, ctx: ctx, tracer: t.tracer}
+}
+
+func (t *otelTelemetry) StartSpanFromCarrier(operationName string, carrier map[string]string) (Span, context.Context, error) {
+	parent := t.propagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+	var err error
+	if !trace.SpanContextFromContext(parent).IsValid() {
+		err = fmt.Errorf("no valid traceparent in carrier")
+	}
+	ctx, span := t.tracer.Start(parent, operationName, trace.WithSpanKind(trace.SpanKindConsumer))
+	return &otelSpan{span: span, ctx: ctx, tracer: t.tracer}, ctx, err
+}
+
+func (t *otelTelemetry) Inject(span Span, carrier map[string]string) error {
+	oSpan, ok := span.(*otelSpan)
+	if !ok {
+		return fmt.Errorf("span %T does not belong to the OpenTelemetry backend", span)
+	}
+	t.propagator.Inject(oSpan.ctx, propagation.MapCarrier(carrier))
+	return nil
+}
+
+// InstrumentHandler starts a server span per request, continuing a W3C traceparent header
+func (t *otelTelemetry) InstrumentHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		recorder := &otelStatusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+type otelStatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *otelStatusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *otelStatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (t *otelTelemetry) Incr(name string, tags []string) {
+	t.mu.Lock()
+	counter, ok := t.counters[name]
+	if !ok {
+		counter, _ = t.meter.Int64Counter(name)
+		t.counters[name] = counter
+	}
+	t.mu.Unlock()
+	if counter != nil {
+		counter.Add(context.Background(), 1, metric.WithAttributes(tagAttributes(tags)...))
+	}
+}
+
+func (t *otelTelemetry) Timing(name string, value time.Duration, tags []string) {
+	t.mu.Lock()
+	histogram, ok := t.histograms[name]
+	if !ok {
+		histogram, _ = t.meter.Float64Histogram(name, metric.WithUnit("ms"))
+		t.histograms[name] = histogram
+	}
+	t.mu.Unlock()
+	if histogram != nil {
+		histogram.Record(context.Background(), float64(value)/float64(time.Millisecond), metric.WithAttributes(tagAttributes(tags)...))
+	}
+}
+
+func (t *otelTelemetry) Gauge(name string, value float64, tags []string) {
+	t.mu.Lock()
+	gauge, ok := t.gauges[name]
+	if !ok {
+		gauge, _ = t.meter.Float64Gauge(name)
+		t.gauges[name] = gauge
+	}
+	t.mu.Unlock()
+	if gauge != nil {
+		gauge.Record(context.Background(), value, metric.WithAttributes(tagAttributes(tags)...))
+	}
+}
+
+func (t *otelTelemetry) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t.tracerProvider.Shutdown(ctx)
+	t.meterProvider.Shutdown(ctx)
+}
+
+func tagAttributes(tags []string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(tags))
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return attrs
+}
+
+// SetTag maps Datadog-style error tags onto the span status
+func (s *otelSpan) SetTag(key string, value interface{}) {
+	value = Redaction.value(key, value)
+	switch key {
+	case "error":
+		if failed, ok := value.(bool); ok && failed {
+			s.span.SetStatus(codes.Error, "")
+		}
+		return
+	case "error.msg":
+		s.span.SetStatus(codes.Error, fmt.Sprint(value))
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case float64:
+		s.span.SetAttributes(attribute.Float64(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s *otelSpan) StartChild(operationName string) Span {
+	ctx, span := s.tracer.Start(s.ctx, operationName)
+	return &otelSpan{span: span, ctx: ctx, tracer: s.tracer}
+}
+
+func (s *otelSpan) Finish() {
+	s.span.End()
+}
+
+func (s *otelSpan) TraceID() string {
+	return s.span.SpanContext().TraceID().String()
+}
+
+func (s *otelSpan) SpanID() string {
+	return s.span.SpanContext().SpanID().String()
+}
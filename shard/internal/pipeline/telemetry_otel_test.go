@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingTelemetry traces with the OpenTelemetry backend into an in-memory recorder and
+// counts metrics like testTelemetry
+type tracingTelemetry struct {
+	*otelTelemetry
+	counter  *testTelemetry
+	recorder *tracetest.SpanRecorder
+}
+
+// useTracingTelemetry makes Telemetry and Metrics a tracingTelemetry for the duration of the test
+func useTracingTelemetry(t *testing.T) *tracingTelemetry {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tel := &tracingTelemetry{
+		otelTelemetry: &otelTelemetry{
+			tracerProvider: tp,
+			tracer:         tp.Tracer("test"),
+			propagator:     propagation.TraceContext{},
+		},
+		counter:  newTestTelemetry(),
+		recorder: recorder,
+	}
+	previousTelemetry, previousMetrics := Telemetry, Metrics
+	Telemetry, Metrics = tel, NewMetrics("test", "shard-test", "test", "test")
+	t.Cleanup(func() { Telemetry, Metrics = previousTelemetry, previousMetrics })
+	return tel
+}
+
+func (tel *tracingTelemetry) Incr(name string, tags []string) { tel.counter.Incr(name, tags) }
+
+func (tel *tracingTelemetry) Timing(string, time.Duration, []string) {}
+
+func (tel *tracingTelemetry) Gauge(string, float64, []string) {}
+
+// producerCarrier starts and ends a producer span and returns its propagated context
+func (tel *tracingTelemetry) producerCarrier(t *testing.T) (map[string]string, trace.SpanContext) {
+	t.Helper()
+	span, _ := tel.StartSpan(context.Background(), "producer")
+	defer span.Finish()
+	carrier := make(map[string]string)
+	if err := tel.Inject(span, carrier); err != nil {
+		t.Fatal(err)
+	}
+	return carrier, span.(*otelSpan).span.SpanContext()
+}
+
+// ended returns the recorded span named name
+func (tel *tracingTelemetry) ended(t *testing.T, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	for _, span := range tel.recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no span %s was recorded", name)
+	return nil
+}
+
+func TestOtelStartLinkedSpan(t *testing.T) {
+	tel := useTracingTelemetry(t)
+	first, firstCtx := tel.producerCarrier(t)
+	second, secondCtx := tel.producerCarrier(t)
+
+	tests := []struct {
+		name         string
+		carriers     []map[string]string
+		wantLinks    []trace.SpanContext
+		wantOrphaned int
+	}{
+		{"no carriers", nil, nil, 0},
+		{"one producer", []map[string]string{first}, []trace.SpanContext{firstCtx}, 0},
+		{"two producers", []map[string]string{first, second}, []trace.SpanContext{firstCtx, secondCtx}, 0},
+		{"orphans", []map[string]string{{}, first, {"traceparent": "invalid"}}, []trace.SpanContext{firstCtx}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, ctx, orphaned := tel.StartLinkedSpan("linked."+tt.name, tt.carriers, "batch")
+			span.Finish()
+			if orphaned != tt.wantOrphaned {
+				t.Errorf("orphaned = %d, want %d", orphaned, tt.wantOrphaned)
+			}
+			if tel.SpanFromContext(ctx) == nil {
+				t.Error("the returned context holds no span")
+			}
+
+			recorded := tel.ended(t, "linked."+tt.name)
+			if recorded.Parent().IsValid() {
+				t.Errorf("parent = %v, want a new root", recorded.Parent())
+			}
+			links := recorded.Links()
+			if len(links) != len(tt.wantLinks) {
+				t.Fatalf("links = %d, want %d", len(links), len(tt.wantLinks))
+			}
+			for i, link := range links {
+				if link.SpanContext.TraceID() != tt.wantLinks[i].TraceID() || link.SpanContext.SpanID() != tt.wantLinks[i].SpanID() {
+					t.Errorf("link %d = %v, want %v", i, link.SpanContext, tt.wantLinks[i])
+				}
+				if !hasAttribute(link.Attributes, attribute.String("link.kind", "batch")) {
+					t.Errorf("link %d attributes = %v, want link.kind batch", i, link.Attributes)
+				}
+			}
+		})
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
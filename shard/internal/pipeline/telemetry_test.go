@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTelemetry counts the metrics submitted through Metrics. Tracing is left to the
+// embedded provider, nil unless a test sets one.
+type testTelemetry struct {
+	TelemetryProvider
+
+	mu       sync.Mutex
+	counts   map[string]int
+	lastTags map[string][]string
+}
+
+func newTestTelemetry() *testTelemetry {
+	return &testTelemetry{counts: make(map[string]int), lastTags: make(map[string][]string)}
+}
+
+// useTestTelemetry makes Metrics submit to a testTelemetry for the duration of the test
+func useTestTelemetry(t *testing.T) *testTelemetry {
+	t.Helper()
+	tel := newTestTelemetry()
+	previousTelemetry, previousMetrics := Telemetry, Metrics
+	Telemetry, Metrics = tel, NewMetrics("test", "shard-test", "test", "test")
+	t.Cleanup(func() { Telemetry, Metrics = previousTelemetry, previousMetrics })
+	return tel
+}
+
+func (tel *testTelemetry) Incr(name string, tags []string) {
+	tel.mu.Lock()
+	defer tel.mu.Unlock()
+	tel.counts[name]++
+	tel.lastTags[name] = tags
+}
+
+func (tel *testTelemetry) Timing(string, time.Duration, []string) {}
+
+func (tel *testTelemetry) Gauge(string, float64, []string) {}
+
+func (tel *testTelemetry) count(def MetricDef) int {
+	tel.mu.Lock()
+	defer tel.mu.Unlock()
+	return tel.counts[def.Name]
+}
+
+// tags returns the tags of the last Incr of def
+func (tel *testTelemetry) tags(def MetricDef) []string {
+	tel.mu.Lock()
+	defer tel.mu.Unlock()
+	return tel.lastTags[def.Name]
+}
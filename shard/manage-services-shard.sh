@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # Multi-Service Pipeline Shard Management Script
-# Usage: ./manage-services-shard.sh [start-shard|stop-shard|compare-shards|list-shards] [options]
+# Usage: ./manage-services-shard.sh [start-shard|stop-shard|compare-shards|list-shards|drain-shard|start-router|stop-router|ring|canary|canary-status|canary-stop|start-registry|stop-registry] [options]
 
 set -euo pipefail
 
@@ -9,6 +9,21 @@ SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 SERVICE1_DIR="$SCRIPT_DIR/service1"
 SERVICE2_DIR="$SCRIPT_DIR/service2"
 SERVICE3_DIR="$SCRIPT_DIR/service3"
+ROUTER_DIR="$SCRIPT_DIR/router"
+ROUTER_PORT="${ROUTER_PORT:-8070}"
+ROUTER_ADMIN_PORT="${ROUTER_ADMIN_PORT:-8071}"
+REGISTRY_DIR="$SCRIPT_DIR/registry"
+PIPECTL_DIR="$SCRIPT_DIR/pipectl"
+REGISTRY_PORT="${REGISTRY_PORT:-8500}"
+
+# Services refuse to start without CALLBACK_SECRET; local runs share one kept next to this script
+if [[ -z "${CALLBACK_SECRET:-}" ]]; then
+    if [[ ! -s "$SCRIPT_DIR/.callback-secret" ]]; then
+        (umask 077 && openssl rand -hex 32 > "$SCRIPT_DIR/.callback-secret")
+    fi
+    CALLBACK_SECRET="$(cat "$SCRIPT_DIR/.callback-secret")"
+fi
+export CALLBACK_SECRET
 
 # Colors for output
 RED='\033[0;31m'
@@ -60,7 +75,7 @@ build_service() {
     log "Building $service_name..."
     cd "$service_dir"
     
-    if go build -o main main.go; then
+    if go build -o main .; then
         success "$service_name built successfully"
         return 0
     else
@@ -86,8 +101,14 @@ start_service_with_env() {
         "service3") export SERVICE3_PORT="$port" ;;
     esac
     
+    # Registrar no registry de shards quando ele estiver rodando
+    local registry_url="${REGISTRY_URL:-}"
+    if [[ -z "$registry_url" ]] && lsof -ti:$REGISTRY_PORT > /dev/null 2>&1; then
+        registry_url="http://localhost:$REGISTRY_PORT"
+    fi
+
     # Iniciar serviço com variáveis de ambiente
-    nohup env SHARD_ID="$shard_id" ./main > "${service_name}-${shard_id}.log" 2>&1 &
+    nohup env SHARD_ID="$shard_id" REGISTRY_URL="$registry_url" SLO_CONFIG="${SLO_CONFIG:-$SCRIPT_DIR/slo.json}" REDACT_CONFIG="${REDACT_CONFIG:-$SCRIPT_DIR/redaction.json}" RATE_LIMIT_CONFIG="${RATE_LIMIT_CONFIG:-$SCRIPT_DIR/ratelimits.json}" ./main > "${service_name}-${shard_id}.log" 2>&1 &
     local pid=$!
     
     # Aguardar inicialização
@@ -207,24 +228,177 @@ stop_shard() {
     fi
 }
 
+# Função inversa de get_port_base
+get_shard_name() {
+    local port="$1"
+    case "$port" in
+        "8080") echo "shard-baseline" ;;
+        "8090") echo "shard-1" ;;
+        "8100") echo "shard-2" ;;
+        "8110") echo "shard-3" ;;
+        *) echo "shard-$((($port - 8080) / 10))" ;;
+    esac
+}
+
 # Função para listar shards ativos
 list_shards() {
-    log "Active shards:"
+    # Com o registry rodando, ele é a fonte de verdade
+    if lsof -ti:$REGISTRY_PORT > /dev/null 2>&1; then
+        log "Active shards (registry on :$REGISTRY_PORT):"
+        curl -s "http://localhost:$REGISTRY_PORT/v1/instances" | \
+            jq -r '.[] | "  • \(.shard): \(.role) \(.address) v\(.version) [\(.status)]"'
+        return
+    fi
+
+    log "Active shards (by port):"
     for port in $(seq 8080 10 8200); do
         if lsof -ti:$port > /dev/null 2>&1; then
-            local shard_name=""
-            case "$port" in
-                "8080") shard_name="shard-baseline" ;;
-                "8090") shard_name="shard-1" ;;
-                "8100") shard_name="shard-2" ;;
-                "8110") shard_name="shard-3" ;;
-                *) shard_name="shard-$((($port - 8080) / 10))" ;;
-            esac
+            local shard_name
+            shard_name=$(get_shard_name "$port")
             echo "  • $shard_name: ports $port-$((port + 2))"
         fi
     done
 }
 
+# Função para iniciar o router de shards (consistent hashing)
+start_router() {
+    local shards="${1:-}"
+
+    if lsof -ti:$ROUTER_PORT > /dev/null 2>&1; then
+        warn "Port $ROUTER_PORT is already in use, stopping existing router..."
+        lsof -ti:$ROUTER_PORT | xargs kill -TERM 2>/dev/null || true
+        sleep 2
+    fi
+
+    local registry_url=""
+    if lsof -ti:$REGISTRY_PORT > /dev/null 2>&1; then
+        registry_url="http://localhost:$REGISTRY_PORT"
+    fi
+
+    # Sem argumento e sem registry, monta a lista a partir dos shards ativos
+    if [[ -z "$shards" && -z "$registry_url" ]]; then
+        for port in $(seq 8080 10 8200); do
+            if lsof -ti:$port > /dev/null 2>&1; then
+                local shard_name
+                shard_name=$(get_shard_name "$port")
+                shards="${shards:+$shards,}$shard_name=http://localhost:$port"
+            fi
+        done
+    fi
+    if [[ -z "$shards" && -z "$registry_url" ]]; then
+        error "No active shards found, start a shard first or pass <shard-id>=<url>,..."
+        exit 1
+    fi
+
+    build_service "router" "$ROUTER_DIR"
+
+    log "Starting router on port $ROUTER_PORT with shards: ${shards:-discovered from $registry_url}"
+    cd "$ROUTER_DIR"
+    nohup env ROUTER_PORT="$ROUTER_PORT" ROUTER_ADMIN_ADDR="localhost:$ROUTER_ADMIN_PORT" ROUTER_SHARDS="$shards" REGISTRY_URL="$registry_url" ./main > "router-stdout.log" 2>&1 &
+    local pid=$!
+    sleep 2
+    if kill -0 "$pid" 2>/dev/null; then
+        success "Router started successfully (PID: $pid, Port: $ROUTER_PORT, Admin: localhost:$ROUTER_ADMIN_PORT)"
+    else
+        error "Router failed to start"
+        return 1
+    fi
+    cd - > /dev/null
+
+    echo ""
+    log "Test command:"
+    echo "  curl -X POST -H \"X-Customer-ID: customer-42\" http://localhost:$ROUTER_PORT/send-message"
+    echo "  curl http://localhost:$ROUTER_ADMIN_PORT/admin/ring?key=customer-42"
+}
+
+# Função para parar o router
+stop_router() {
+    local pids=$(lsof -ti:$ROUTER_PORT 2>/dev/null || true)
+    if [[ -n "$pids" ]]; then
+        echo "$pids" | xargs kill -TERM 2>/dev/null || true
+        success "Router stopped"
+    else
+        warn "Router is not running"
+    fi
+}
+
+# Função para mostrar o ring atual do router
+show_ring() {
+    curl -s "http://localhost:$ROUTER_ADMIN_PORT/admin/ring${1:+?key=$1}"
+    echo ""
+}
+
+# Função para dividir tráfego entre baseline e canary no router
+start_canary() {
+    local baseline="$1"
+    local canary="$2"
+    local weight="${3:-10}"
+
+    if [[ -z "$baseline" || -z "$canary" ]]; then
+        echo "Usage: $0 canary <baseline-shard> <canary-shard> [weight%]"
+        exit 1
+    fi
+
+    local canary_address="http://localhost:$(get_port_base "$canary")"
+    curl -s -X PUT "http://localhost:$ROUTER_ADMIN_PORT/admin/canary" \
+        -H "Content-Type: application/json" \
+        -d "{\"baseline\":\"$baseline\",\"canary\":\"$canary\",\"canary_address\":\"$canary_address\",\"weight\":$weight,\"header\":\"X-Canary\",\"auto_rollback\":true}"
+    echo ""
+    success "Sending $weight% of $baseline traffic to $canary"
+    echo "  Follow the analysis with: curl http://localhost:$ROUTER_ADMIN_PORT/admin/canary"
+}
+
+# Função para drenar um shard via pipectl (para de rotear e espera as filas esvaziarem)
+drain_shard() {
+    local shard_id="$1"
+    shift || true
+    if [[ -z "$shard_id" ]]; then
+        echo "Usage: $0 drain-shard <shard-id> [--move-to <shard-id>] [--timeout 10m]"
+        exit 1
+    fi
+
+    build_service "pipectl" "$PIPECTL_DIR" > /dev/null
+    cd - > /dev/null
+    "$PIPECTL_DIR/main" shard drain "$shard_id" \
+        --router "http://localhost:$ROUTER_ADMIN_PORT" \
+        --registry "http://localhost:$REGISTRY_PORT" "$@"
+}
+
+# Função para iniciar o registry de shards (stand-in local de etcd/Consul)
+start_registry() {
+    if lsof -ti:$REGISTRY_PORT > /dev/null 2>&1; then
+        warn "Registry already running on port $REGISTRY_PORT"
+        return 0
+    fi
+
+    build_service "registry" "$REGISTRY_DIR"
+
+    log "Starting registry on port $REGISTRY_PORT..."
+    cd "$REGISTRY_DIR"
+    nohup env REGISTRY_PORT="$REGISTRY_PORT" ./main > "registry-stdout.log" 2>&1 &
+    local pid=$!
+    sleep 2
+    if kill -0 "$pid" 2>/dev/null; then
+        success "Registry started successfully (PID: $pid, Port: $REGISTRY_PORT)"
+        echo "  Shards started from now on register themselves automatically"
+    else
+        error "Registry failed to start"
+        return 1
+    fi
+    cd - > /dev/null
+}
+
+# Função para parar o registry
+stop_registry() {
+    local pids=$(lsof -ti:$REGISTRY_PORT 2>/dev/null || true)
+    if [[ -n "$pids" ]]; then
+        echo "$pids" | xargs kill -TERM 2>/dev/null || true
+        success "Registry stopped"
+    else
+        warn "Registry is not running"
+    fi
+}
+
 # Main command handling
 case "${1:-}" in
     "start-shard")
@@ -239,6 +413,36 @@ case "${1:-}" in
     "list-shards")
         list_shards
         ;;
+    "start-router")
+        start_router "${2:-}"
+        ;;
+    "stop-router")
+        stop_router
+        ;;
+    "ring")
+        show_ring "${2:-}"
+        ;;
+    "canary")
+        start_canary "${2:-}" "${3:-}" "${4:-}"
+        ;;
+    "canary-status")
+        curl -s "http://localhost:$ROUTER_ADMIN_PORT/admin/canary"
+        echo ""
+        ;;
+    "canary-stop")
+        curl -s -X DELETE "http://localhost:$ROUTER_ADMIN_PORT/admin/canary"
+        success "Canary traffic split stopped"
+        ;;
+    "drain-shard")
+        shift
+        drain_shard "$@"
+        ;;
+    "start-registry")
+        start_registry
+        ;;
+    "stop-registry")
+        stop_registry
+        ;;
     "help"|"-h"|"--help"|"")
         echo "Multi-Service Pipeline Shard Management"
         echo ""
@@ -249,12 +453,26 @@ case "${1:-}" in
         echo "  stop-shard <shard-id>      Stop services for specific shard"
         echo "  compare-shards <s1> <s2>   Compare performance between shards"
         echo "  list-shards                List active shards"
+        echo "  drain-shard <id> [flags]   Stop routing to a shard and wait for its queues to empty"
+        echo ""
+        echo "Router Commands:"
+        echo "  start-router [id=url,...]  Start consistent-hash router (default: active shards)"
+        echo "  stop-router                Stop the router"
+        echo "  ring [key]                 Show the router ring (and the owner of key)"
+        echo "  canary <base> <can> [w%]   Send w% (default 10) of base traffic to canary"
+        echo "  canary-status              Show canary vs baseline analysis and rollback signal"
+        echo "  canary-stop                Stop the canary split"
+        echo ""
+        echo "Registry Commands:"
+        echo "  start-registry             Start the shard registry (services register on start)"
+        echo "  stop-registry              Stop the shard registry"
         echo ""
         echo "Examples:"
         echo "  $0 start-shard shard-baseline    # Start baseline shard (ports 8080-8082)"
         echo "  $0 start-shard shard-1           # Start optimized shard (ports 8090-8092)"
         echo "  $0 compare-shards shard-baseline shard-1"
         echo "  $0 stop-shard shard-1"
+        echo "  $0 start-router                  # Router on :$ROUTER_PORT in front of active shards"
         ;;
     *)
         error "Unknown command: $1"
@@ -11,6 +11,15 @@ SERVICE2_DIR="$SCRIPT_DIR/service2"
 SERVICE2_SLOW_DIR="$SCRIPT_DIR/service2-slow"
 SERVICE3_DIR="$SCRIPT_DIR/service3"
 
+# Services refuse to start without CALLBACK_SECRET; local runs share one kept next to this script
+if [[ -z "${CALLBACK_SECRET:-}" ]]; then
+    if [[ ! -s "$SCRIPT_DIR/.callback-secret" ]]; then
+        (umask 077 && openssl rand -hex 32 > "$SCRIPT_DIR/.callback-secret")
+    fi
+    CALLBACK_SECRET="$(cat "$SCRIPT_DIR/.callback-secret")"
+fi
+export CALLBACK_SECRET
+
 # PID files
 PID_DIR="$SCRIPT_DIR/.pids"
 mkdir -p "$PID_DIR"
@@ -404,9 +413,9 @@ case "${1:-}" in
                 
                 # 20% error injection
                 if (( RANDOM % 100 < 20 )); then
-                    curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:8080/send-message > /dev/null &
+                    curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:8080/send-message > /dev/null &
                 else
-                    curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:8080/send-message > /dev/null &
+                    curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:8080/send-message > /dev/null &
                 fi
             done
             
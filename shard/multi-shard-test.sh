@@ -43,10 +43,10 @@ send_shard_batch() {
         # 20% error injection
         RAND_NUM=$((RANDOM % 100))
         if (( RAND_NUM < 20 )); then
-            curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:$port/send-message > /dev/null &
+            curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:$port/send-message > /dev/null &
             ((error_count++))
         else
-            curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:$port/send-message > /dev/null &
+            curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:$port/send-message > /dev/null &
         fi
 
         # Health checks
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// pipectl is the operator CLI for the sharded pipeline.
+//
+//	pipectl shard list
+//	pipectl shard drain <id> [--move-to <id>] [--timeout 10m]
+//	pipectl shard undrain <id>
+
+var sqsClient *sqs.Client
+
+// Queues of a shard in pipeline order; draining step1 first means step2 stops refilling
+var drainSteps = []struct {
+	name string
+	role string
+}{
+	{name: "step1", role: "service2"},
+	{name: "step2", role: "service3"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: pipectl <command>
+
+Shard commands:
+  shard list                     List shards from the registry
+  shard drain <id> [flags]       Stop routing to a shard and wait for its work to finish
+  shard undrain <id>             Route traffic to a drained shard again and resume its consumers
+
+Drain flags:
+  --router URL      Router admin address (default $ROUTER_ADMIN_URL or http://localhost:8071)
+  --registry URL    Shard registry address (default $REGISTRY_URL or http://localhost:8500)
+  --move-to ID      Move the remaining messages to this shard's queues instead of waiting
+  --timeout D       Give up after D (default 10m)
+  --interval D      Progress report interval (default 5s)
+`)
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "shard" {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[2] {
+	case "list":
+		err = listShards(os.Args[3:])
+	case "drain":
+		err = drainShard(os.Args[3:])
+	case "undrain":
+		err = undrainShard(os.Args[3:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pipectl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type commonFlags struct {
+	router   string
+	registry string
+}
+
+func newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&common.router, "router", envOr("ROUTER_ADMIN_URL", "http://localhost:8071"), "router admin address")
+	fs.StringVar(&common.registry, "registry", envOr("REGISTRY_URL", "http://localhost:8500"), "shard registry address")
+	return fs
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// parseArgs accepts the shard ID before or after the flags
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	var id string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if id == "" && fs.NArg() > 0 {
+		id = fs.Arg(0)
+	}
+	if id == "" {
+		return "", fmt.Errorf("shard id is required")
+	}
+	return id, nil
+}
+
+func listShards(args []string) error {
+	var common commonFlags
+	fs := newFlagSet("list", &common)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	registry := pipeline.NewHTTPRegistry(common.registry)
+	instances, err := registry.List(context.Background(), "", "")
+	if err != nil {
+		return err
+	}
+	drained := drainedShards(common.router)
+	for _, instance := range instances {
+		status := instance.Status
+		if drained[instance.Shard] {
+			status = "draining"
+		}
+		fmt.Printf("%-16s %-9s %-24s v%-8s %s\n", instance.Shard, instance.Role, instance.Address, instance.Version, status)
+	}
+	return nil
+}
+
+func drainShard(args []string) error {
+	var common commonFlags
+	fs := newFlagSet("drain", &common)
+	moveTo := fs.String("move-to", "", "move remaining messages to this shard")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up after this long")
+	interval := fs.Duration("interval", 5*time.Second, "progress report interval")
+	id, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *moveTo == id {
+		return fmt.Errorf("cannot move messages of %s to itself", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	registry := pipeline.NewHTTPRegistry(common.registry)
+	queues, err := shardQueues(ctx, registry, id)
+	if err != nil {
+		return err
+	}
+	// A queue other shards also consume from never empties while they run; for those only
+	// this shard's own in-flight work is waited for
+	shared, err := sharedQueues(ctx, registry, id, queues)
+	if err != nil {
+		return err
+	}
+	var targetQueues map[string]string
+	var targetService1 string
+	if *moveTo != "" {
+		for _, step := range drainSteps {
+			if others, ok := shared[step.name]; ok {
+				return fmt.Errorf("%s shares the %s queue with %s, its messages are not %s's to move", id, step.name, others, id)
+			}
+		}
+		if targetQueues, err = shardQueues(ctx, registry, *moveTo); err != nil {
+			return err
+		}
+		for step, queue := range queues {
+			if targetQueues[step] == queue {
+				return fmt.Errorf("%s and %s share the %s queue, nothing to move", id, *moveTo, step)
+			}
+		}
+		// Moved pipelines report their status and progress to the target shard's service1,
+		// the drained one is about to stop
+		if targetService1, err = shardAddress(ctx, registry, *moveTo, "service1"); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion("us-east-1"),
+		config.WithSharedConfigProfile("controlplane-pcsilva"))
+	if err != nil {
+		return fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	sqsClient = sqs.NewFromConfig(cfg)
+
+	// 1. Stop routing new traffic to the shard
+	if err := routerCall(http.MethodPost, common.router, id); err != nil {
+		return fmt.Errorf("failed to drain %s in router: %w", id, err)
+	}
+	fmt.Printf("[%s] %s removed from router ring, no new traffic is routed to it\n", timestamp(), id)
+
+	// 2. Empty the step queues in pipeline order
+	for _, step := range drainSteps {
+		queue, ok := queues[step.name]
+		if !ok {
+			fmt.Printf("[%s] %s has no %s queue registered, skipping\n", timestamp(), id, step.name)
+			continue
+		}
+		if others, ok := shared[step.name]; ok {
+			fmt.Printf("[%s] %s: queue shared with %s, pausing %s's consumers and waiting for them to finish their messages\n",
+				timestamp(), step.name, others, id)
+			if err := waitForIdle(ctx, registry, id, step.name, step.role, *interval); err != nil {
+				return fmt.Errorf("%w; %s's consumers stay paused until pipectl shard undrain %s", err, id, id)
+			}
+			continue
+		}
+		if *moveTo != "" {
+			moved, err := moveMessages(ctx, queue, targetQueues[step.name], targetService1, *interval)
+			if err != nil {
+				return fmt.Errorf("failed to move %s messages: %w", step.name, err)
+			}
+			fmt.Printf("[%s] %s: moved %d messages to %s\n", timestamp(), step.name, moved, *moveTo)
+		}
+		if err := waitForEmpty(ctx, step.name, queue, *interval); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("[%s] %s drained: no work left in its step queues, the shard can be stopped\n", timestamp(), id)
+	return nil
+}
+
+func undrainShard(args []string) error {
+	var common commonFlags
+	fs := newFlagSet("undrain", &common)
+	id, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := routerCall(http.MethodDelete, common.router, id); err != nil {
+		return fmt.Errorf("failed to undrain %s in router: %w", id, err)
+	}
+	fmt.Printf("[%s] %s added back to router ring\n", timestamp(), id)
+
+	// A drain of a shared queue paused the shard's consumers
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	registry := pipeline.NewHTTPRegistry(common.registry)
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, step := range drainSteps {
+		instances, err := registry.List(ctx, id, step.role)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s consumers in registry: %w", step.name, err)
+		}
+		for _, instance := range instances {
+			if _, err := consumerPause(ctx, client, instance.Address, http.MethodDelete); err != nil {
+				return fmt.Errorf("failed to resume %s: %w", instance.ID, err)
+			}
+		}
+		if len(instances) > 0 {
+			fmt.Printf("[%s] %s: %d consumers of %s resumed\n", timestamp(), step.name, len(instances), id)
+		}
+	}
+	return nil
+}
+
+// shardAddress is the address of the shard's first instance of role, by ID
+func shardAddress(ctx context.Context, registry pipeline.ShardRegistry, shard, role string) (string, error) {
+	instances, err := registry.List(ctx, shard, role)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up %s of %s in registry: %w", role, shard, err)
+	}
+	if len(instances) == 0 {
+		return "", fmt.Errorf("shard %s has no %s in the registry", shard, role)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances[0].Address, nil
+}
+
+// shardQueues maps step name to queue URL, taken from the input queues of the shard's consumers
+func shardQueues(ctx context.Context, registry pipeline.ShardRegistry, shard string) (map[string]string, error) {
+	instances, err := registry.List(ctx, shard, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s in registry: %w", shard, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("shard %s is not in the registry", shard)
+	}
+	queues := make(map[string]string)
+	for _, step := range drainSteps {
+		for _, instance := range instances {
+			if instance.Role == step.role && instance.Queues["input"] != "" {
+				queues[step.name] = instance.Queues["input"]
+				break
+			}
+		}
+	}
+	return queues, nil
+}
+
+// sharedQueues maps the steps whose queue other shards' consumers also read to those shards
+func sharedQueues(ctx context.Context, registry pipeline.ShardRegistry, shard string, queues map[string]string) (map[string]string, error) {
+	shared := make(map[string]string)
+	for _, step := range drainSteps {
+		queue, ok := queues[step.name]
+		if !ok {
+			continue
+		}
+		instances, err := registry.List(ctx, "", step.role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s consumers in registry: %w", step.name, err)
+		}
+		var others []string
+		for _, instance := range instances {
+			if instance.Shard != shard && instance.Queues["input"] == queue && !slices.Contains(others, instance.Shard) {
+				others = append(others, instance.Shard)
+			}
+		}
+		if len(others) > 0 {
+			sort.Strings(others)
+			shared[step.name] = strings.Join(others, ",")
+		}
+	}
+	return shared, nil
+}
+
+func routerCall(method, routerURL, id string) error {
+	req, err := http.NewRequest(method, routerURL+"/admin/drain?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("router returned %s", resp.Status)
+	}
+	return nil
+}
+
+func drainedShards(routerURL string) map[string]bool {
+	drained := make(map[string]bool)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(routerURL + "/admin/drain")
+	if err != nil {
+		return drained
+	}
+	defer resp.Body.Close()
+	var shards []struct {
+		Target struct {
+			ID string `json:"id"`
+		} `json:"target"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&shards); err == nil {
+		for _, shard := range shards {
+			drained[shard.Target.ID] = true
+		}
+	}
+	return drained
+}
+
+type queueDepth struct {
+	visible  int
+	inFlight int
+	delayed  int
+}
+
+func (d queueDepth) total() int {
+	return d.visible + d.inFlight + d.delayed
+}
+
+func getQueueDepth(ctx context.Context, queue string) (queueDepth, error) {
+	out, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queue),
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			types.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		},
+	})
+	if err != nil {
+		return queueDepth{}, fmt.Errorf("failed to read attributes of %s: %w", queue, err)
+	}
+	atoi := func(name types.QueueAttributeName) int {
+		n, _ := strconv.Atoi(out.Attributes[string(name)])
+		return n
+	}
+	return queueDepth{
+		visible:  atoi(types.QueueAttributeNameApproximateNumberOfMessages),
+		inFlight: atoi(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+		delayed:  atoi(types.QueueAttributeNameApproximateNumberOfMessagesDelayed),
+	}, nil
+}
+
+// waitForEmpty polls the queue until it reports no visible, in-flight or delayed messages.
+// SQS counts are approximate, so the queue must read empty twice in a row.
+func waitForEmpty(ctx context.Context, step, queue string, interval time.Duration) error {
+	emptyReads := 0
+	for {
+		depth, err := getQueueDepth(ctx, queue)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[%s] %s: %d visible, %d in flight, %d delayed\n",
+			timestamp(), step, depth.visible, depth.inFlight, depth.delayed)
+		if depth.total() == 0 {
+			emptyReads++
+			if emptyReads >= 2 {
+				return nil
+			}
+		} else {
+			emptyReads = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s queue to empty (%d messages left)", step, depth.total())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// waitForIdle pauses the shard's consumers of step and polls their /admin/scaling until
+// none of them is receiving or processing a message. Without the pause they would keep
+// receiving from the shared queue, which other shards keep filling. The pause is sent on
+// every poll, so a consumer that restarted meanwhile is paused too; idle must still be read
+// twice in a row.
+func waitForIdle(ctx context.Context, registry pipeline.ShardRegistry, shard, step, role string, interval time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	idleReads := 0
+	for {
+		instances, err := registry.List(ctx, shard, role)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s consumers in registry: %w", step, err)
+		}
+		processing, receiving := 0, 0
+		for _, instance := range instances {
+			if _, err := consumerPause(ctx, client, instance.Address, http.MethodPost); err != nil {
+				return fmt.Errorf("failed to pause %s of %s: %w", instance.ID, step, err)
+			}
+			status, err := consumerStatus(ctx, client, instance.Address)
+			if err != nil {
+				return fmt.Errorf("failed to read %s of %s: %w", instance.ID, step, err)
+			}
+			processing += status.Processing
+			if status.Receiving || !status.Paused {
+				receiving++
+			}
+		}
+		fmt.Printf("[%s] %s: %d messages being processed by %d paused consumers, %d still receiving\n",
+			timestamp(), step, processing, len(instances), receiving)
+		if processing == 0 && receiving == 0 {
+			idleReads++
+			if idleReads >= 2 {
+				return nil
+			}
+		} else {
+			idleReads = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %s consumers to finish (%d messages being processed)", step, processing)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// consumerState is the part of a consumer's /admin/scaling the drain reads
+type consumerState struct {
+	Processing int  `json:"processing"`
+	Paused     bool `json:"paused"`
+	Receiving  bool `json:"receiving"`
+}
+
+func consumerStatus(ctx context.Context, client *http.Client, address string) (consumerState, error) {
+	var status consumerState
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/admin/scaling", nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("scaling status returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// consumerPause pauses (POST) or resumes (DELETE) a consumer through its /admin/consumer
+func consumerPause(ctx context.Context, client *http.Client, address, method string) (consumerState, error) {
+	var status consumerState
+	req, err := http.NewRequestWithContext(ctx, method, address+"/admin/consumer", nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("consumer pause returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// moveMessages receives messages from source and re-sends them, with their attributes, to
+// target. The status and events URLs in the body are pointed at targetService1. A message is
+// deleted from source only after it was sent to target.
+func moveMessages(ctx context.Context, source, target, targetService1 string, interval time.Duration) (int, error) {
+	moved := 0
+	lastReport := time.Now()
+	for {
+		out, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(source),
+			MaxNumberOfMessages:   10,
+			WaitTimeSeconds:       2,
+			MessageAttributeNames: []string{"All"},
+		})
+		if err != nil {
+			return moved, fmt.Errorf("failed to receive from %s: %w", source, err)
+		}
+		if len(out.Messages) == 0 {
+			depth, err := getQueueDepth(ctx, source)
+			if err != nil {
+				return moved, err
+			}
+			// In-flight messages belong to the shard's consumers; waitForEmpty covers them
+			if depth.visible == 0 {
+				return moved, nil
+			}
+			continue
+		}
+
+		for _, msg := range out.Messages {
+			body, err := rewriteReportURLs(aws.ToString(msg.Body), targetService1)
+			if err != nil {
+				return moved, fmt.Errorf("failed to rewrite message %s: %w", aws.ToString(msg.MessageId), err)
+			}
+			if _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+				QueueUrl:          aws.String(target),
+				MessageBody:       aws.String(body),
+				MessageAttributes: msg.MessageAttributes,
+			}); err != nil {
+				return moved, fmt.Errorf("failed to send message %s to %s: %w", aws.ToString(msg.MessageId), target, err)
+			}
+			if _, err := sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(source),
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil {
+				return moved, fmt.Errorf("message %s was copied but not deleted from %s: %w", aws.ToString(msg.MessageId), source, err)
+			}
+			moved++
+		}
+
+		if time.Since(lastReport) >= interval {
+			fmt.Printf("[%s] moved %d messages so far\n", timestamp(), moved)
+			lastReport = time.Now()
+		}
+	}
+}
+
+// rewriteReportURLs points the status_url and events_url of a pipeline message at the
+// service1 at address, keeping their paths. Bodies that are not JSON objects are returned
+// unchanged, the consumers drop them anyway.
+func rewriteReportURLs(body, address string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		return body, nil
+	}
+	base, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid service1 address %q: %w", address, err)
+	}
+	changed := false
+	for _, key := range []string{"status_url", "events_url"} {
+		var value string
+		if raw, ok := fields[key]; !ok || json.Unmarshal(raw, &value) != nil || value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %q: %w", key, value, err)
+		}
+		u.Scheme, u.Host = base.Scheme, base.Host
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+		u.RawPath = ""
+		if fields[key], err = json.Marshal(u.String()); err != nil {
+			return "", err
+		}
+		changed = true
+	}
+	if !changed {
+		return body, nil
+	}
+	rewritten, err := json.Marshal(fields)
+	return string(rewritten), err
+}
+
+func timestamp() string {
+	return time.Now().Format("15:04:05")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+func TestRewriteReportURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		address string
+		want    map[string]string
+	}{
+		{
+			name:    "status and events",
+			body:    `{"correlation_id":"abc","status_url":"http://localhost:8090/pipeline/abc/status","events_url":"http://localhost:8090/pipeline/events","pipeline":{"current_step":1}}`,
+			address: "http://localhost:8100",
+			want:    map[string]string{"status_url": "http://localhost:8100/pipeline/abc/status", "events_url": "http://localhost:8100/pipeline/events", "correlation_id": "abc"},
+		},
+		{
+			name:    "address with a path prefix",
+			body:    `{"status_url":"http://shard-1/pipeline/abc/status"}`,
+			address: "https://gateway/shard-2/",
+			want:    map[string]string{"status_url": "https://gateway/shard-2/pipeline/abc/status"},
+		},
+		{
+			name:    "callback url is the caller's",
+			body:    `{"callback_url":"http://caller/done","events_url":""}`,
+			address: "http://localhost:8100",
+			want:    map[string]string{"callback_url": "http://caller/done", "events_url": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteReportURLs(tt.body, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(got), &fields); err != nil {
+				t.Fatalf("rewritten body %s: %v", got, err)
+			}
+			for key, want := range tt.want {
+				if fields[key] != want {
+					t.Errorf("%s = %v, want %s", key, fields[key], want)
+				}
+			}
+		})
+	}
+
+	if got, err := rewriteReportURLs("not json", "http://localhost:8100"); err != nil || got != "not json" {
+		t.Errorf("non-JSON body = %q, %v, want it unchanged", got, err)
+	}
+}
+
+// testRegistry lists a fixed set of instances
+type testRegistry []pipeline.ServiceInstance
+
+func (r testRegistry) Register(context.Context, pipeline.ServiceInstance) error { return nil }
+func (r testRegistry) Deregister(context.Context, string) error                 { return nil }
+func (r testRegistry) List(ctx context.Context, shard, role string) ([]pipeline.ServiceInstance, error) {
+	var instances []pipeline.ServiceInstance
+	for _, instance := range r {
+		if (shard == "" || instance.Shard == shard) && (role == "" || instance.Role == role) {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// testConsumer serves /admin/consumer and /admin/scaling. It keeps receiving, and so
+// processing, until it is paused; the first polls after the pause find a receive still running.
+type testConsumer struct {
+	mu       sync.Mutex
+	paused   bool
+	draining int
+}
+
+func (c *testConsumer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.URL.Path {
+	case "/admin/consumer":
+		if r.Method == http.MethodPost && !c.paused {
+			c.paused, c.draining = true, 2
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"paused": c.paused, "receiving": c.draining > 0})
+	case "/admin/scaling":
+		status := consumerState{Paused: c.paused, Processing: 3, Receiving: true}
+		if c.paused {
+			status.Processing, status.Receiving = c.draining, c.draining > 0
+			if c.draining > 0 {
+				c.draining--
+			}
+		}
+		json.NewEncoder(w).Encode(status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWaitForIdlePausesTheShardsConsumers(t *testing.T) {
+	own := &testConsumer{}
+	other := &testConsumer{}
+	ownServer := httptest.NewServer(own)
+	defer ownServer.Close()
+	otherServer := httptest.NewServer(other)
+	defer otherServer.Close()
+	registry := testRegistry{
+		{ID: "shard-1-service2-8091", Shard: "shard-1", Role: "service2", Address: ownServer.URL},
+		{ID: "shard-2-service2-8101", Shard: "shard-2", Role: "service2", Address: otherServer.URL},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForIdle(ctx, registry, "shard-1", "step1", "service2", time.Millisecond); err != nil {
+		t.Fatalf("drain of a consumer that goes idle once paused: %v", err)
+	}
+	if !own.paused {
+		t.Error("the shard's consumer was not paused")
+	}
+	if other.paused {
+		t.Error("another shard's consumer of the shared queue was paused")
+	}
+}
+
+func TestWaitForIdleFailsOnAConsumerThatCannotPause(t *testing.T) {
+	// An older consumer without /admin/consumer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/scaling" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(consumerState{Processing: 1})
+	}))
+	defer server.Close()
+	registry := testRegistry{{ID: "shard-1-service2-8091", Shard: "shard-1", Role: "service2", Address: server.URL}}
+
+	err := waitForIdle(context.Background(), registry, "shard-1", "step1", "service2", time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "pause") {
+		t.Errorf("err = %v, want the failed pause", err)
+	}
+}
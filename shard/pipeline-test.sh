@@ -102,10 +102,10 @@ send_batch() {
     # Send message with random error injection (20% chance)
     RAND_NUM=$((RANDOM % 100))
     if (( RAND_NUM < 20 )); then
-      curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:8080/send-message > /dev/null &
+      curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" -H "X-Inject-Error: true" http://localhost:8080/send-message > /dev/null &
       ((error_count++))
     else
-      curl -sS -m 5 -X POST -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:8080/send-message > /dev/null &
+      curl -sS -m 5 -X POST -H "X-API-Key: load-test-key" -H "X-Correlation-ID: $CORRELATION_ID" http://localhost:8080/send-message > /dev/null &
     fi
 
     # Health checks for all services
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// Local stand-in for etcd/Consul: services PUT themselves with a TTL and keep heartbeating;
+// instances that miss their TTL are expired.
+
+var (
+	registryPort string
+	defaultTTL   = 15 * time.Second
+)
+
+type instanceStore struct {
+	mu        sync.RWMutex
+	instances map[string]pipeline.ServiceInstance
+}
+
+var store = &instanceStore{instances: make(map[string]pipeline.ServiceInstance)}
+
+func init() {
+	pipeline.ServiceVersion = os.Getenv("SERVICE_VERSION")
+	if pipeline.ServiceVersion == "" {
+		pipeline.ServiceVersion = "1.2.0"
+	}
+
+	registryPort = os.Getenv("REGISTRY_PORT")
+	if registryPort == "" {
+		registryPort = "8500"
+	}
+	if v := os.Getenv("REGISTRY_DEFAULT_TTL"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			defaultTTL = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+func main() {
+	var closeLogs func()
+	pipeline.Logger, closeLogs = pipeline.NewLogger("registry", "registry.log")
+	defer closeLogs()
+
+	var err error
+	pipeline.Telemetry, err = pipeline.NewTelemetry(pipeline.TelemetryConfig{
+		Service: "registry",
+		Env:     "pipeline",
+		Version: pipeline.ServiceVersion,
+		Tags:    map[string]string{"port": registryPort},
+	})
+	if err != nil {
+		pipeline.LogFatal("Failed to initialize telemetry", "error", err)
+	}
+	defer pipeline.Telemetry.Shutdown()
+	// Registrations are counted per shard, the registry itself belongs to none
+	pipeline.Metrics = pipeline.NewMetrics("registry", "", pipeline.ServiceVersion, "pipeline")
+
+	go expireLoop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/instances", instancesHandler)
+	mux.HandleFunc("/v1/shards", shardsHandler)
+
+	fmt.Printf("Registry running on :%s\n", registryPort)
+	pipeline.Logger.Info("Registry started", "port", registryPort)
+	if err := http.ListenAndServe(":"+registryPort, mux); err != nil {
+		pipeline.Logger.Error("HTTP server failed", "error", err)
+	}
+}
+
+// instancesHandler registers/heartbeats (PUT), deregisters (DELETE ?id=) and lists (GET ?shard=&role=)
+func instancesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		instances := store.list(r.URL.Query().Get("shard"), r.URL.Query().Get("role"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(instances)
+
+	case http.MethodPut:
+		var instance pipeline.ServiceInstance
+		if err := json.NewDecoder(r.Body).Decode(&instance); err != nil {
+			http.Error(w, "Invalid instance: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if instance.ID == "" || instance.Shard == "" || instance.Role == "" || instance.Address == "" {
+			http.Error(w, "Instance id, shard, role and address are required", http.StatusBadRequest)
+			return
+		}
+		if created := store.put(instance); created {
+			pipeline.Metrics.Incr(pipeline.MetricRegistryRegistrations,
+				pipeline.Tag("shard", instance.Shard), pipeline.Tag("role", instance.Role))
+			pipeline.Logger.InfoContext(r.Context(), "Instance registered",
+				"instance.id", instance.ID,
+				"shard", instance.Shard,
+				"role", instance.Role,
+				"address", instance.Address,
+				"instance.version", instance.Version)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Instance id is required", http.StatusBadRequest)
+			return
+		}
+		if !store.remove(id) {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		pipeline.Logger.InfoContext(r.Context(), "Instance deregistered", "instance.id", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shardsHandler groups live instances by shard, for status tooling and dashboards
+func shardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shards := make(map[string][]pipeline.ServiceInstance)
+	for _, instance := range store.list("", "") {
+		shards[instance.Shard] = append(shards[instance.Shard], instance)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shards)
+}
+
+// put stores or refreshes an instance and reports whether it is new
+func (s *instanceStore) put(instance pipeline.ServiceInstance) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if instance.TTLSeconds <= 0 {
+		instance.TTLSeconds = int(defaultTTL / time.Second)
+	}
+	if instance.Status == "" {
+		instance.Status = "up"
+	}
+	instance.LastHeartbeat = time.Now().UTC()
+	_, exists := s.instances[instance.ID]
+	s.instances[instance.ID] = instance
+	return !exists
+}
+
+func (s *instanceStore) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.instances[id]; !exists {
+		return false
+	}
+	delete(s.instances, id)
+	return true
+}
+
+func (s *instanceStore) list(shard, role string) []pipeline.ServiceInstance {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instances := make([]pipeline.ServiceInstance, 0, len(s.instances))
+	for _, instance := range s.instances {
+		if (shard == "" || instance.Shard == shard) && (role == "" || instance.Role == role) {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// expireLoop drops instances whose last heartbeat is older than their TTL and
+// reports the number of live instances per shard and role
+func expireLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		active := make(map[[2]string]int)
+
+		store.mu.Lock()
+		for id, instance := range store.instances {
+			ttl := time.Duration(instance.TTLSeconds) * time.Second
+			if now.Sub(instance.LastHeartbeat) > ttl {
+				delete(store.instances, id)
+				pipeline.Metrics.Incr(pipeline.MetricRegistryExpirations,
+					pipeline.Tag("shard", instance.Shard), pipeline.Tag("role", instance.Role))
+				pipeline.Logger.Warn("Instance expired after missing heartbeats",
+					"instance.id", id,
+					"shard", instance.Shard,
+					"role", instance.Role,
+					"last_heartbeat", instance.LastHeartbeat)
+				continue
+			}
+			active[[2]string{instance.Shard, instance.Role}]++
+		}
+		store.mu.Unlock()
+
+		for key, count := range active {
+			pipeline.Metrics.Gauge(pipeline.MetricRegistryActive, float64(count),
+				pipeline.Tag("shard", key[0]), pipeline.Tag("role", key[1]))
+		}
+	}
+}
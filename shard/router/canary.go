@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// canaryConfig splits traffic that the ring sends to Baseline between Baseline and Canary.
+// Weight is the percentage of baseline keys sent to the canary; the split is sticky per key.
+// Header, when set, lets a caller force an arm with "canary" or "baseline" as its value.
+type canaryConfig struct {
+	Baseline      string `json:"baseline"`
+	Canary        string `json:"canary"`
+	CanaryAddress string `json:"canary_address,omitempty"`
+	Weight        int    `json:"weight"`
+	Header        string `json:"header,omitempty"`
+
+	// Rollback thresholds, compared between the arms over WindowSeconds
+	MaxErrorRateDelta float64 `json:"max_error_rate_delta"`
+	MaxLatencyRatio   float64 `json:"max_latency_ratio"`
+	MinRequests       int     `json:"min_requests"`
+	WindowSeconds     int     `json:"window_seconds"`
+	AutoRollback      bool    `json:"auto_rollback"`
+}
+
+const (
+	armBaseline = "baseline"
+	armCanary   = "canary"
+
+	canaryRunning    = "running"
+	canaryRolledBack = "rolled_back"
+)
+
+type canarySample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// armSLIs are the SLIs compared between baseline and canary
+type armSLIs struct {
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP95Ms float64 `json:"latency_p95_ms"`
+}
+
+type canaryAnalysis struct {
+	Baseline armSLIs  `json:"baseline"`
+	Canary   armSLIs  `json:"canary"`
+	Verdict  string   `json:"verdict"`
+	Breaches []string `json:"breaches,omitempty"`
+}
+
+type canaryState struct {
+	Config       canaryConfig   `json:"config"`
+	Status       string         `json:"status"`
+	Rollback     bool           `json:"rollback"`
+	RollbackAt   *time.Time     `json:"rollback_at,omitempty"`
+	RollbackWhy  []string       `json:"rollback_reasons,omitempty"`
+	StartedAt    time.Time      `json:"started_at"`
+	LastAnalysis canaryAnalysis `json:"analysis"`
+}
+
+// canaryController holds the active split, if any, and the samples used to analyse it
+type canaryController struct {
+	mu      sync.Mutex
+	state   *canaryState
+	samples map[string][]canarySample
+}
+
+var canary = &canaryController{}
+
+func (c canaryConfig) withDefaults() canaryConfig {
+	if c.MaxErrorRateDelta <= 0 {
+		c.MaxErrorRateDelta = 0.02
+	}
+	if c.MaxLatencyRatio <= 0 {
+		c.MaxLatencyRatio = 1.5
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 50
+	}
+	if c.WindowSeconds <= 0 {
+		c.WindowSeconds = 300
+	}
+	return c
+}
+
+func (c canaryConfig) validate() error {
+	if c.Baseline == "" || c.Canary == "" {
+		return fmt.Errorf("baseline and canary are required")
+	}
+	if c.Baseline == c.Canary {
+		return fmt.Errorf("baseline and canary must be different shards")
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100, got %d", c.Weight)
+	}
+	return nil
+}
+
+func (cc *canaryController) start(cfg canaryConfig) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = &canaryState{Config: cfg.withDefaults(), Status: canaryRunning, StartedAt: time.Now().UTC()}
+	cc.samples = map[string][]canarySample{armBaseline: nil, armCanary: nil}
+}
+
+func (cc *canaryController) stop() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = nil
+	cc.samples = nil
+}
+
+// route decides whether a request the ring sent to target goes to the canary instead.
+// It returns the target to use and the arm ("" when the request is not part of the split).
+func (cc *canaryController) route(r *http.Request, key string, target shardTarget) (shardTarget, string) {
+	cc.mu.Lock()
+	if cc.state == nil || target.ID != cc.state.Config.Baseline {
+		cc.mu.Unlock()
+		return target, ""
+	}
+	cfg, status := cc.state.Config, cc.state.Status
+	cc.mu.Unlock()
+
+	useCanary := false
+	forced := false
+	if cfg.Header != "" {
+		switch strings.ToLower(r.Header.Get(cfg.Header)) {
+		case armCanary, "true":
+			useCanary, forced = true, true
+		case armBaseline, "false":
+			forced = true
+		}
+	}
+	// Rolled back canaries only get explicitly forced traffic
+	if !forced && status == canaryRunning {
+		useCanary = int(ringHash("canary:"+key)%100) < cfg.Weight
+	}
+	if !useCanary || draining.contains(cfg.Canary) {
+		return target, armBaseline
+	}
+
+	canaryTarget := shardTarget{ID: cfg.Canary, Address: cfg.CanaryAddress}
+	if canaryTarget.Address == "" {
+		t, ok := ring.get(cfg.Canary)
+		if !ok {
+			return target, armBaseline
+		}
+		canaryTarget = t
+	}
+	return canaryTarget, armCanary
+}
+
+func (cc *canaryController) record(arm string, latency time.Duration, failed bool) {
+	if arm == "" {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state == nil {
+		return
+	}
+	cc.samples[arm] = append(cc.samples[arm], canarySample{at: time.Now(), latency: latency, failed: failed})
+}
+
+func (cc *canaryController) snapshot() *canaryState {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state == nil {
+		return nil
+	}
+	state := *cc.state
+	return &state
+}
+
+// analyse compares the arms over the window and raises the rollback signal on a breach
+func (cc *canaryController) analyse() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state == nil {
+		return
+	}
+	cfg := cc.state.Config
+	cutoff := time.Now().Add(-time.Duration(cfg.WindowSeconds) * time.Second)
+
+	slis := make(map[string]armSLIs)
+	for arm, samples := range cc.samples {
+		kept := samples[:0]
+		for _, s := range samples {
+			if s.at.After(cutoff) {
+				kept = append(kept, s)
+			}
+		}
+		cc.samples[arm] = kept
+		slis[arm] = computeSLIs(kept)
+	}
+
+	analysis := canaryAnalysis{Baseline: slis[armBaseline], Canary: slis[armCanary], Verdict: "pass"}
+	if analysis.Baseline.Requests < cfg.MinRequests || analysis.Canary.Requests < cfg.MinRequests {
+		analysis.Verdict = "insufficient_data"
+	} else {
+		if delta := analysis.Canary.ErrorRate - analysis.Baseline.ErrorRate; delta > cfg.MaxErrorRateDelta {
+			analysis.Breaches = append(analysis.Breaches, fmt.Sprintf(
+				"error rate %.2f%% vs baseline %.2f%% exceeds +%.2f%%",
+				analysis.Canary.ErrorRate*100, analysis.Baseline.ErrorRate*100, cfg.MaxErrorRateDelta*100))
+		}
+		if analysis.Baseline.LatencyP95Ms > 0 && analysis.Canary.LatencyP95Ms > analysis.Baseline.LatencyP95Ms*cfg.MaxLatencyRatio {
+			analysis.Breaches = append(analysis.Breaches, fmt.Sprintf(
+				"p95 latency %.0fms vs baseline %.0fms exceeds x%.2f",
+				analysis.Canary.LatencyP95Ms, analysis.Baseline.LatencyP95Ms, cfg.MaxLatencyRatio))
+		}
+		if len(analysis.Breaches) > 0 {
+			analysis.Verdict = "fail"
+		}
+	}
+	cc.state.LastAnalysis = analysis
+
+	for arm, s := range slis {
+		tags := []pipeline.MetricTag{pipeline.Tag("arm", arm), pipeline.Tag("baseline", cfg.Baseline), pipeline.Tag("canary", cfg.Canary)}
+		pipeline.Metrics.Gauge(pipeline.MetricCanaryErrorRate, s.ErrorRate, tags...)
+		pipeline.Metrics.Gauge(pipeline.MetricCanaryLatencyP95, s.LatencyP95Ms, tags...)
+		pipeline.Metrics.Gauge(pipeline.MetricCanaryRequests, float64(s.Requests), tags...)
+	}
+	pipeline.Metrics.Gauge(pipeline.MetricCanaryWeight, float64(cfg.Weight),
+		pipeline.Tag("baseline", cfg.Baseline), pipeline.Tag("canary", cfg.Canary))
+
+	if analysis.Verdict != "fail" || cc.state.Rollback {
+		return
+	}
+	now := time.Now().UTC()
+	cc.state.Rollback = true
+	cc.state.RollbackAt = &now
+	cc.state.RollbackWhy = analysis.Breaches
+	if cfg.AutoRollback {
+		cc.state.Status = canaryRolledBack
+	}
+	pipeline.Metrics.Incr(pipeline.MetricCanaryRollback,
+		pipeline.Tag("baseline", cfg.Baseline),
+		pipeline.Tag("canary", cfg.Canary),
+		pipeline.Tag("auto", strconv.FormatBool(cfg.AutoRollback)))
+	pipeline.Logger.Error("Canary breached thresholds, rollback signalled",
+		"baseline", cfg.Baseline,
+		"canary", cfg.Canary,
+		"weight", cfg.Weight,
+		"auto_rollback", cfg.AutoRollback,
+		"breaches", analysis.Breaches)
+}
+
+func computeSLIs(samples []canarySample) armSLIs {
+	s := armSLIs{Requests: len(samples)}
+	if len(samples) == 0 {
+		return s
+	}
+	latencies := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		if sample.failed {
+			s.Errors++
+		}
+		latencies = append(latencies, float64(sample.latency)/float64(time.Millisecond))
+	}
+	sort.Float64s(latencies)
+	s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	s.LatencyP50Ms = percentile(latencies, 0.50)
+	s.LatencyP95Ms = percentile(latencies, 0.95)
+	return s
+}
+
+// percentile uses nearest-rank on already sorted values
+func percentile(sorted []float64, p float64) float64 {
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func canaryAnalysisLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		canary.analyse()
+	}
+}
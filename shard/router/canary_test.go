@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	testBaseline = shardTarget{ID: "shard-1", Address: "http://shard-1"}
+	testCanary   = shardTarget{ID: "shard-2", Address: "http://shard-2"}
+)
+
+func testCanaryController(weight int) *canaryController {
+	cc := &canaryController{}
+	cc.start(canaryConfig{
+		Baseline:      testBaseline.ID,
+		Canary:        testCanary.ID,
+		CanaryAddress: testCanary.Address,
+		Weight:        weight,
+		Header:        "X-Canary",
+	})
+	return cc
+}
+
+// canaryShare routes n keys to the baseline and returns the fraction sent to the canary
+func canaryShare(t *testing.T, cc *canaryController, n int) float64 {
+	t.Helper()
+	toCanary := 0
+	for i := range n {
+		target, arm := cc.route(httptest.NewRequest("GET", "/", nil), fmt.Sprintf("key-%d", i), testBaseline)
+		if arm == armCanary {
+			if target != testCanary {
+				t.Fatalf("canary arm routed to %+v", target)
+			}
+			toCanary++
+		} else if arm != armBaseline || target != testBaseline {
+			t.Fatalf("baseline arm %q routed to %+v", arm, target)
+		}
+	}
+	return float64(toCanary) / float64(n)
+}
+
+func TestCanarySplitFollowsWeight(t *testing.T) {
+	for _, weight := range []int{0, 1, 10, 50, 90, 100} {
+		t.Run(fmt.Sprintf("weight %d", weight), func(t *testing.T) {
+			share := canaryShare(t, testCanaryController(weight), 20000)
+			if want := float64(weight) / 100; math.Abs(share-want) > 0.02 {
+				t.Errorf("%.3f of keys went to the canary, want %.2f", share, want)
+			}
+		})
+	}
+}
+
+func TestCanarySplitIsStickyPerKey(t *testing.T) {
+	cc := testCanaryController(30)
+	for i := range 1000 {
+		key := fmt.Sprintf("key-%d", i)
+		_, first := cc.route(httptest.NewRequest("GET", "/", nil), key, testBaseline)
+		for range 3 {
+			if _, arm := cc.route(httptest.NewRequest("GET", "/", nil), key, testBaseline); arm != first {
+				t.Fatalf("%s routed to %s, then %s", key, first, arm)
+			}
+		}
+	}
+
+	// Raising the weight only moves baseline keys to the canary
+	before := make(map[string]string)
+	for i := range 1000 {
+		key := fmt.Sprintf("key-%d", i)
+		_, before[key] = cc.route(httptest.NewRequest("GET", "/", nil), key, testBaseline)
+	}
+	raised := testCanaryController(60)
+	for key, arm := range before {
+		if _, now := raised.route(httptest.NewRequest("GET", "/", nil), key, testBaseline); arm == armCanary && now != armCanary {
+			t.Fatalf("%s left the canary when the weight went up", key)
+		}
+	}
+}
+
+func TestCanaryRoute(t *testing.T) {
+	other := shardTarget{ID: "shard-3", Address: "http://shard-3"}
+	tests := []struct {
+		name       string
+		weight     int
+		rolledBack bool
+		header     string
+		target     shardTarget
+		wantTarget shardTarget
+		wantArm    string
+	}{
+		{"other shards are not split", 100, false, "", other, other, ""},
+		{"header forces the canary", 0, false, "canary", testBaseline, testCanary, armCanary},
+		{"header forces the canary with true", 0, false, "true", testBaseline, testCanary, armCanary},
+		{"header forces the baseline", 100, false, "baseline", testBaseline, testBaseline, armBaseline},
+		{"unknown header value follows the weight", 100, false, "maybe", testBaseline, testCanary, armCanary},
+		{"rolled back sends nothing unforced", 100, true, "", testBaseline, testBaseline, armBaseline},
+		{"rolled back still honours the header", 0, true, "canary", testBaseline, testCanary, armCanary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := testCanaryController(tt.weight)
+			if tt.rolledBack {
+				cc.state.Status = canaryRolledBack
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Canary", tt.header)
+			}
+			target, arm := cc.route(r, "key-1", tt.target)
+			if target != tt.wantTarget || arm != tt.wantArm {
+				t.Errorf("route = %s, %q, want %s, %q", target.ID, arm, tt.wantTarget.ID, tt.wantArm)
+			}
+		})
+	}
+}
+
+func TestCanaryRouteSkipsDrainingCanary(t *testing.T) {
+	draining.mu.Lock()
+	draining.shards[testCanary.ID] = drainedShard{Target: testCanary, DrainedAt: time.Now()}
+	draining.mu.Unlock()
+	t.Cleanup(func() {
+		draining.mu.Lock()
+		delete(draining.shards, testCanary.ID)
+		draining.mu.Unlock()
+	})
+
+	if share := canaryShare(t, testCanaryController(100), 100); share != 0 {
+		t.Errorf("%.2f of keys went to a draining canary", share)
+	}
+}
+
+func TestCanaryAnalysis(t *testing.T) {
+	useTestTelemetry(t)
+	tests := []struct {
+		name           string
+		baselineErrors int
+		canaryErrors   int
+		canaryLatency  time.Duration
+		requests       int
+		autoRollback   bool
+		wantVerdict    string
+		wantStatus     string
+	}{
+		{"healthy canary", 1, 1, 10 * time.Millisecond, 100, true, "pass", canaryRunning},
+		{"too few requests", 0, 50, 10 * time.Millisecond, 20, true, "insufficient_data", canaryRunning},
+		{"error rate breach", 1, 10, 10 * time.Millisecond, 100, true, "fail", canaryRolledBack},
+		{"latency breach", 0, 0, 20 * time.Millisecond, 100, true, "fail", canaryRolledBack},
+		{"breach without auto rollback", 1, 10, 10 * time.Millisecond, 100, false, "fail", canaryRunning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &canaryController{}
+			cc.start(canaryConfig{Baseline: testBaseline.ID, Canary: testCanary.ID, Weight: 10, AutoRollback: tt.autoRollback})
+			for i := range tt.requests {
+				cc.record(armBaseline, 10*time.Millisecond, i < tt.baselineErrors)
+				cc.record(armCanary, tt.canaryLatency, i < tt.canaryErrors)
+			}
+			cc.analyse()
+
+			state := cc.snapshot()
+			if state.LastAnalysis.Verdict != tt.wantVerdict {
+				t.Errorf("verdict = %s, want %s (breaches %v)", state.LastAnalysis.Verdict, tt.wantVerdict, state.LastAnalysis.Breaches)
+			}
+			if state.Rollback != (tt.wantVerdict == "fail") {
+				t.Errorf("rollback = %v, want it signalled only on a failed analysis", state.Rollback)
+			}
+			if state.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", state.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{0.5, 5},
+		{0.95, 10},
+		{1, 10},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%.2f) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestCanarySkipsEventStreamLatency(t *testing.T) {
+	useTestTelemetry(t)
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pipeline/events" {
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			fmt.Fprint(w, "event: step\ndata: {}\n\n")
+			w.(http.Flusher).Flush()
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer shard.Close()
+
+	r := newHashRing(8)
+	r.add(shardTarget{ID: testBaseline.ID, Address: shard.URL})
+	useTestRing(t, r)
+	previous := canary
+	canary = &canaryController{}
+	canary.start(canaryConfig{Baseline: testBaseline.ID, Canary: testCanary.ID, CanaryAddress: shard.URL, Weight: 50})
+	t.Cleanup(func() { canary = previous })
+
+	for i := range 20 {
+		for _, path := range []string{"/send-message", "/pipeline/events"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("X-Customer-ID", fmt.Sprintf("customer-%d", i))
+			w := httptest.NewRecorder()
+			routeHandler(w, req)
+			if path == "/pipeline/events" && !w.Flushed {
+				t.Fatal("event stream was not flushed through the router")
+			}
+		}
+	}
+
+	canary.mu.Lock()
+	defer canary.mu.Unlock()
+	if n := len(canary.samples[armBaseline]) + len(canary.samples[armCanary]); n != 20 {
+		t.Errorf("%d canary samples, want the 20 /send-message requests only", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// discoverShards keeps the ring in sync with the service1 instances in the shard registry.
+// Only shards that were added by discovery are removed when they leave the registry, so
+// shards added through /admin/shards are left alone.
+func discoverShards(ctx context.Context, registry pipeline.ShardRegistry, interval time.Duration) {
+	discovered := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		instances, err := registry.List(callCtx, "", "service1")
+		cancel()
+		if err != nil {
+			pipeline.Logger.Warn("Failed to list shards from registry, keeping current ring",
+				"operation", "registry_list",
+				"error", err)
+		} else {
+			syncRing(instances, discovered)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func syncRing(instances []pipeline.ServiceInstance, discovered map[string]bool) {
+	// One address per shard; the lowest instance ID wins so the choice is stable
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	current := make(map[string]shardTarget)
+	for _, instance := range instances {
+		if _, seen := current[instance.Shard]; !seen {
+			current[instance.Shard] = shardTarget{ID: instance.Shard, Address: instance.Address}
+		}
+	}
+
+	for id, target := range current {
+		if draining.contains(id) {
+			continue
+		}
+		existing, ok := ring.get(id)
+		if ok && existing.Address == target.Address {
+			discovered[id] = true
+			continue
+		}
+		ring.add(target)
+		discovered[id] = true
+		pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", id), pipeline.Tag("action", "add"))
+		pipeline.Logger.Info("Shard added to ring", "shard", id, "address", target.Address, "source", "registry")
+	}
+
+	for id := range discovered {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		delete(discovered, id)
+		if ring.remove(id) {
+			pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", id), pipeline.Tag("action", "remove"))
+			pipeline.Logger.Info("Shard removed from ring", "shard", id, "source", "registry")
+		}
+	}
+}
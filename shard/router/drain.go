@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// drainedShard is a shard taken out of the ring so it receives no new traffic while its
+// work finishes; the target is kept so the drain can be cancelled
+type drainedShard struct {
+	Target    shardTarget `json:"target"`
+	DrainedAt time.Time   `json:"drained_at"`
+}
+
+type drainSet struct {
+	mu     sync.RWMutex
+	shards map[string]drainedShard
+}
+
+var draining = &drainSet{shards: make(map[string]drainedShard)}
+
+func (d *drainSet) contains(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.shards[id]
+	return ok
+}
+
+func (d *drainSet) list() []drainedShard {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	shards := make([]drainedShard, 0, len(d.shards))
+	for _, shard := range d.shards {
+		shards = append(shards, shard)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Target.ID < shards[j].Target.ID })
+	return shards
+}
+
+// drainHandler lists (GET), starts (POST ?id=) and cancels (DELETE ?id=) shard drains.
+// Draining shards are skipped by registry discovery and by the canary split.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(draining.list())
+
+	case http.MethodPost:
+		id := r.URL.Query().Get("id")
+		target, ok := ring.get(id)
+		if !ok {
+			if draining.contains(id) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			http.Error(w, "Shard not found", http.StatusNotFound)
+			return
+		}
+		draining.mu.Lock()
+		draining.shards[id] = drainedShard{Target: target, DrainedAt: time.Now().UTC()}
+		draining.mu.Unlock()
+		ring.remove(id)
+
+		pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", id), pipeline.Tag("action", "drain"))
+		pipeline.Logger.InfoContext(r.Context(), "Shard draining, removed from ring", "shard", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ring.snapshot())
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		draining.mu.Lock()
+		shard, ok := draining.shards[id]
+		delete(draining.shards, id)
+		draining.mu.Unlock()
+		if !ok {
+			http.Error(w, "Shard is not draining", http.StatusNotFound)
+			return
+		}
+		ring.add(shard.Target)
+
+		pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", id), pipeline.Tag("action", "undrain"))
+		pipeline.Logger.InfoContext(r.Context(), "Shard drain cancelled, added back to ring", "shard", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
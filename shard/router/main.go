@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+var ring *hashRing
+
+// Router configuration
+var (
+	routerPort        string
+	adminAddr         string
+	keyHeaders        []string
+	vnodes            int
+	discoveryInterval = 5 * time.Second
+)
+
+// Default shard layout, matching get_port_base() in manage-services-shard.sh
+const defaultShards = "shard-baseline=http://localhost:8080,shard-1=http://localhost:8090,shard-2=http://localhost:8100"
+
+func init() {
+	pipeline.ServiceVersion = os.Getenv("SERVICE_VERSION")
+	if pipeline.ServiceVersion == "" {
+		pipeline.ServiceVersion = "1.2.0"
+	}
+
+	routerPort = os.Getenv("ROUTER_PORT")
+	if routerPort == "" {
+		routerPort = "8070"
+	}
+
+	// The admin endpoints change the ring, so they are only served on this address,
+	// loopback unless an operator opens it up
+	adminAddr = os.Getenv("ROUTER_ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = "localhost:8071"
+	}
+
+	// Headers checked in order to build the routing key
+	headers := os.Getenv("ROUTER_KEY_HEADERS")
+	if headers == "" {
+		headers = "X-Customer-ID,X-Correlation-ID"
+	}
+	for _, h := range strings.Split(headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			keyHeaders = append(keyHeaders, h)
+		}
+	}
+
+	vnodes = 128
+	if v := os.Getenv("ROUTER_VNODES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			vnodes = n
+		}
+	}
+
+	if v := os.Getenv("ROUTER_DISCOVERY_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			discoveryInterval = d
+		}
+	}
+}
+
+func main() {
+	var closeLogs func()
+	pipeline.Logger, closeLogs = pipeline.NewLogger("router", "router.log")
+	defer closeLogs()
+
+	redactConfigPath := os.Getenv("REDACT_CONFIG")
+	if redactConfigPath == "" {
+		redactConfigPath = "../redaction.json"
+	}
+	var err error
+	pipeline.Redaction, err = pipeline.NewRedactor(redactConfigPath)
+	if err != nil {
+		pipeline.LogFatal("Failed to load redaction rules", "error", err)
+	}
+
+	pipeline.Telemetry, err = pipeline.NewTelemetry(pipeline.TelemetryConfig{
+		Service: "router",
+		Env:     "pipeline",
+		Version: pipeline.ServiceVersion,
+		Tags:    map[string]string{"port": routerPort},
+	})
+	if err != nil {
+		pipeline.LogFatal("Failed to initialize telemetry", "error", err)
+	}
+	defer pipeline.Telemetry.Shutdown()
+	// The router is in front of every shard: shard is a tag of its metrics, not a base tag
+	pipeline.Metrics = pipeline.NewMetrics("router", "", pipeline.ServiceVersion, "pipeline")
+
+	ring = newHashRing(vnodes)
+	registry := pipeline.NewRegistryFromEnv()
+	shards := os.Getenv("ROUTER_SHARDS")
+	if shards == "" && registry == nil {
+		shards = defaultShards
+	}
+	targets, err := parseShardList(shards)
+	if err != nil {
+		pipeline.LogFatal("Invalid ROUTER_SHARDS", "error", err)
+	}
+	for _, target := range targets {
+		ring.add(target)
+	}
+	if registry != nil {
+		go discoverShards(context.Background(), registry, discoveryInterval)
+	}
+	go canaryAnalysisLoop(10 * time.Second)
+
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/admin/ring", ringHandler)
+	adminMux.HandleFunc("/admin/shards", shardsHandler)
+	adminMux.HandleFunc("/admin/canary", canaryHandler)
+	adminMux.HandleFunc("/admin/drain", drainHandler)
+	go func() {
+		if err := http.ListenAndServe(adminAddr, pipeline.Telemetry.InstrumentHandler(adminMux)); err != nil {
+			pipeline.LogFatal("Admin HTTP server failed", "address", adminAddr, "error", err)
+		}
+	}()
+
+	// Neither the router's admin endpoints nor the shards' are reachable through the public port
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.NotFoundHandler())
+	mux.HandleFunc("/", routeHandler)
+
+	fmt.Printf("Router running on :%s, admin on %s (shards: %s)\n", routerPort, adminAddr, strings.Join(ring.ids(), ","))
+	pipeline.Logger.Info("Router started", "port", routerPort, "admin_address", adminAddr, "shards", ring.ids(), "vnodes", vnodes)
+	if err := http.ListenAndServe(":"+routerPort, pipeline.Telemetry.InstrumentHandler(mux)); err != nil {
+		pipeline.Logger.Error("HTTP server failed", "error", err)
+	}
+}
+
+// parseShardList parses "shard-id=http://host:port,..." into shard targets
+func parseShardList(list string) ([]shardTarget, error) {
+	var targets []shardTarget
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, address, found := strings.Cut(entry, "=")
+		if !found || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid shard entry %q, expected <shard-id>=<address>", entry)
+		}
+		if _, err := url.Parse(address); err != nil {
+			return nil, fmt.Errorf("invalid address for shard %s: %w", id, err)
+		}
+		targets = append(targets, shardTarget{ID: id, Address: address})
+	}
+	return targets, nil
+}
+
+// routingKey returns the first non-empty key header and the header it came from
+func routingKey(r *http.Request) (string, string) {
+	for _, h := range keyHeaders {
+		if v := r.Header.Get(h); v != "" {
+			return v, h
+		}
+	}
+	return "", ""
+}
+
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	span, ctx := pipeline.Telemetry.StartSpan(r.Context(), "router.route")
+	defer span.Finish()
+	r = r.WithContext(ctx)
+
+	// Without a key the request gets a correlation ID, which then becomes the key,
+	// so service1 sees the same ID the router hashed on
+	key, source := routingKey(r)
+	if key == "" {
+		key = uuid.New().String()
+		source = "X-Correlation-ID"
+		r.Header.Set("X-Correlation-ID", key)
+	}
+
+	span.SetTag("service", "router")
+	span.SetTag("env", "pipeline")
+	span.SetTag("routing.key_source", source)
+	span.SetTag("correlation.id", r.Header.Get("X-Correlation-ID"))
+
+	target, ok := ring.lookup(key)
+	if !ok {
+		span.SetTag("error", true)
+		span.SetTag("error.msg", "no shards available")
+		pipeline.Metrics.Incr(pipeline.MetricRouterErrors, pipeline.Tag("error_type", "no_shards"))
+		pipeline.Logger.ErrorContext(ctx, "No shards available in ring",
+			"correlation.id", r.Header.Get("X-Correlation-ID"),
+			"path", r.URL.Path)
+		http.Error(w, "No shards available", http.StatusServiceUnavailable)
+		return
+	}
+	target, arm := canary.route(r, key, target)
+	if arm != "" {
+		span.SetTag("canary.arm", arm)
+	}
+	span.SetTag("shard", target.ID)
+	span.SetTag("routing.target", target.Address)
+
+	proxy, err := proxies.get(target)
+	if err != nil {
+		span.SetTag("error", true)
+		span.SetTag("error.msg", err.Error())
+		http.Error(w, "Invalid shard address", http.StatusBadGateway)
+		return
+	}
+
+	// Propagate the router span to service1
+	carrier := make(map[string]string)
+	if err := pipeline.Telemetry.Inject(span, carrier); err != nil {
+		pipeline.Logger.DebugContext(ctx, "Failed to inject trace context, continuing without tracing",
+			"shard", target.ID,
+			"operation", "trace_inject",
+			"error", err)
+	}
+	for k, v := range carrier {
+		r.Header.Set(k, v)
+	}
+
+	w.Header().Set("X-Shard-ID", target.ID)
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	proxy.ServeHTTP(recorder, r)
+	duration := time.Since(start)
+	// An event stream lasts as long as the client listens, its duration is no latency sample
+	if !isEventStream(recorder.Header()) {
+		canary.record(arm, duration, recorder.status >= 500)
+	}
+
+	tags := []pipeline.MetricTag{pipeline.Tag("shard", target.ID)}
+	if arm != "" {
+		tags = append(tags, pipeline.Tag("canary.arm", arm))
+	}
+	pipeline.Metrics.Incr(pipeline.MetricRouterRequests, tags...)
+	pipeline.Metrics.Timing(pipeline.MetricRouterDuration, duration, tags...)
+}
+
+// statusRecorder captures the status code written by the proxy
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing for streamed responses)
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Flush sends what the proxy wrote so far, for writers that check for http.Flusher
+// instead of going through http.ResponseController
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// canaryHandler starts or replaces (PUT), inspects (GET) and stops (DELETE) the canary split
+func canaryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		state := canary.snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		if state == nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "inactive"})
+			return
+		}
+		json.NewEncoder(w).Encode(state)
+
+	case http.MethodPut:
+		var cfg canaryConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid canary config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			http.Error(w, "Invalid canary config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := ring.get(cfg.Canary); !ok && cfg.CanaryAddress == "" {
+			http.Error(w, "Canary shard is not in the ring, canary_address is required", http.StatusBadRequest)
+			return
+		}
+		canary.start(cfg)
+		pipeline.Logger.InfoContext(r.Context(), "Canary traffic split started",
+			"baseline", cfg.Baseline,
+			"canary", cfg.Canary,
+			"weight", cfg.Weight,
+			"header", cfg.Header)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(canary.snapshot())
+
+	case http.MethodDelete:
+		canary.stop()
+		pipeline.Logger.InfoContext(r.Context(), "Canary traffic split stopped")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ringHandler exposes the current ring. With ?key=... it also reports which shard owns the key.
+func ringHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := map[string]interface{}{
+		"ring": ring.snapshot(),
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		if target, ok := ring.lookup(key); ok {
+			response["key"] = key
+			response["shard"] = target.ID
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// shardsHandler adds (POST {"id","address"}) or removes (DELETE ?id=) shards from the ring
+func shardsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ring.snapshot().Shards)
+
+	case http.MethodPost:
+		var target shardTarget
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+			http.Error(w, "Invalid shard: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if target.ID == "" || target.Address == "" {
+			http.Error(w, "Shard id and address are required", http.StatusBadRequest)
+			return
+		}
+		if _, err := url.Parse(target.Address); err != nil {
+			http.Error(w, "Invalid shard address: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ring.add(target)
+		pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", target.ID), pipeline.Tag("action", "add"))
+		pipeline.Logger.InfoContext(r.Context(), "Shard added to ring", "shard", target.ID, "address", target.Address)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(target)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Shard id is required", http.StatusBadRequest)
+			return
+		}
+		if !ring.remove(id) {
+			http.Error(w, "Shard not found", http.StatusNotFound)
+			return
+		}
+		pipeline.Metrics.Incr(pipeline.MetricRouterRingChanges, pipeline.Tag("shard", id), pipeline.Tag("action", "remove"))
+		pipeline.Logger.InfoContext(r.Context(), "Shard removed from ring", "shard", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
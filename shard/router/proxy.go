@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// proxyCache keeps one reverse proxy per shard target instead of building one per request.
+// The proxies are dropped whenever the ring changes, so a shard that moved to another
+// address, or left, does not keep a stale proxy around.
+type proxyCache struct {
+	mu      sync.Mutex
+	version uint64
+	proxies map[shardTarget]*httputil.ReverseProxy
+}
+
+var proxies = &proxyCache{proxies: make(map[shardTarget]*httputil.ReverseProxy)}
+
+func (c *proxyCache) get(target shardTarget) (*httputil.ReverseProxy, error) {
+	version := ring.changes()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != c.version {
+		clear(c.proxies)
+		c.version = version
+	}
+	if proxy, ok := c.proxies[target]; ok {
+		return proxy, nil
+	}
+
+	targetURL, err := url.Parse(target.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address for shard %s: %w", target.ID, err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// The proxy is shared, the request's own router.route span is in its context
+		if span := pipeline.Telemetry.SpanFromContext(r.Context()); span != nil {
+			span.SetTag("error", true)
+			span.SetTag("error.msg", err.Error())
+		}
+		pipeline.Metrics.Incr(pipeline.MetricRouterErrors,
+			pipeline.Tag("shard", target.ID),
+			pipeline.Tag("error_type", "upstream_unavailable"))
+		pipeline.Logger.ErrorContext(r.Context(), "Failed to forward request to shard",
+			"shard", target.ID,
+			"target", target.Address,
+			"correlation.id", r.Header.Get("X-Correlation-ID"),
+			"error", err)
+		http.Error(w, "Shard unavailable", http.StatusBadGateway)
+	}
+	c.proxies[target] = proxy
+	return proxy, nil
+}
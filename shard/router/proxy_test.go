@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+)
+
+// useTestRing installs r as the router's ring, with an empty proxy cache, for the duration of the test
+func useTestRing(t *testing.T, r *hashRing) {
+	t.Helper()
+	previousRing, previousProxies := ring, proxies
+	ring, proxies = r, &proxyCache{proxies: make(map[shardTarget]*httputil.ReverseProxy)}
+	t.Cleanup(func() { ring, proxies = previousRing, previousProxies })
+}
+
+func TestProxyCacheReusesProxiesUntilTheRingChanges(t *testing.T) {
+	useTestRing(t, testRing(8, "shard-1", "shard-2"))
+	shard1, _ := ring.get("shard-1")
+	shard2, _ := ring.get("shard-2")
+
+	first, err := proxies.get(shard1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := proxies.get(shard1); again != first {
+		t.Error("second request to the same shard built a new proxy")
+	}
+	if other, _ := proxies.get(shard2); other == first {
+		t.Error("two shards share a proxy")
+	}
+
+	ring.add(shardTarget{ID: "shard-1", Address: "http://shard-1-moved"})
+	moved, _ := ring.get("shard-1")
+	if rebuilt, _ := proxies.get(moved); rebuilt == first {
+		t.Error("shard that changed address kept its proxy")
+	}
+	if len(proxies.proxies) != 1 {
+		t.Errorf("%d cached proxies, want only the one built since the ring changed", len(proxies.proxies))
+	}
+
+	if _, err := proxies.get(shardTarget{ID: "shard-3", Address: "://bad"}); err == nil {
+		t.Error("invalid address gave a proxy")
+	}
+}
+
+func TestRouteHandlerForwardsToTheOwningShard(t *testing.T) {
+	useTestTelemetry(t)
+	var got *http.Request
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer shard.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name       string
+		address    string
+		wantStatus int
+	}{
+		{"shard up", shard.URL, http.StatusAccepted},
+		{"shard down", down.URL, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newHashRing(8)
+			r.add(shardTarget{ID: "shard-1", Address: tt.address})
+			useTestRing(t, r)
+			got = nil
+
+			req := httptest.NewRequest(http.MethodPost, "/send-message", nil)
+			req.Header.Set("X-Customer-ID", "customer-42")
+			w := httptest.NewRecorder()
+			routeHandler(w, req)
+			if w.Code != tt.wantStatus || w.Header().Get("X-Shard-ID") != "shard-1" {
+				t.Errorf("status %d, shard %q, want %d from shard-1", w.Code, w.Header().Get("X-Shard-ID"), tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusAccepted && (got == nil || got.URL.Path != "/send-message") {
+				t.Errorf("shard received %v, want the request", got)
+			}
+		})
+	}
+}
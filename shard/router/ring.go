@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// shardTarget is a shard known to the router and the service1 address requests are forwarded to
+type shardTarget struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// hashRing is a consistent-hash ring with virtual nodes. Each shard is placed on the ring
+// vnodes times, so adding or removing a shard only remaps the keys owned by that shard.
+type hashRing struct {
+	mu     sync.RWMutex
+	vnodes int
+	hashes []uint32
+	owners map[uint32]string
+	shards map[string]shardTarget
+	// version counts the changes, for what is derived from the ring such as the proxy cache
+	version uint64
+}
+
+type ringShardInfo struct {
+	ID        string  `json:"id"`
+	Address   string  `json:"address"`
+	VNodes    int     `json:"vnodes"`
+	Ownership float64 `json:"ownership"`
+}
+
+type ringSnapshot struct {
+	VNodes int             `json:"vnodes_per_shard"`
+	Points int             `json:"points"`
+	Shards []ringShardInfo `json:"shards"`
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	return &hashRing{
+		vnodes: vnodes,
+		owners: make(map[uint32]string),
+		shards: make(map[string]shardTarget),
+	}
+}
+
+// ringHash takes the first 4 bytes of the MD5 of key (ketama style) so that similar
+// shard IDs such as shard-1#0 and shard-1#1 still spread evenly around the ring
+func ringHash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// add places a shard on the ring, replacing its address if it is already present
+func (r *hashRing) add(target shardTarget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.version++
+	if _, exists := r.shards[target.ID]; exists {
+		r.shards[target.ID] = target
+		return
+	}
+	r.shards[target.ID] = target
+	for i := 0; i < r.vnodes; i++ {
+		h := ringHash(fmt.Sprintf("%s#%d", target.ID, i))
+		// On the (rare) hash collision the first shard keeps the point
+		if _, taken := r.owners[h]; taken {
+			continue
+		}
+		r.owners[h] = target.ID
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// remove takes a shard off the ring. Only keys owned by that shard move to its successors.
+func (r *hashRing) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.shards[id]; !exists {
+		return false
+	}
+	r.version++
+	delete(r.shards, id)
+	kept := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owners[h] == id {
+			delete(r.owners, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	r.hashes = kept
+	return true
+}
+
+// lookup returns the shard owning key: the first virtual node clockwise from the key hash
+func (r *hashRing) lookup(key string) (shardTarget, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return shardTarget{}, false
+	}
+	h := ringHash(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.shards[r.owners[r.hashes[idx]]], true
+}
+
+// changes returns a number that differs after every add or remove
+func (r *hashRing) changes() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+func (r *hashRing) get(id string) (shardTarget, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	target, ok := r.shards[id]
+	return target, ok
+}
+
+func (r *hashRing) ids() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.shards))
+	for id := range r.shards {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// snapshot reports the ring layout and the fraction of the hash space each shard owns
+func (r *hashRing) snapshot() ringSnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	points := make(map[string]int)
+	owned := make(map[string]uint64)
+	for i, h := range r.hashes {
+		id := r.owners[h]
+		points[id]++
+		// A point owns the arc between its predecessor and itself
+		var prev uint32
+		if i == 0 {
+			prev = r.hashes[len(r.hashes)-1]
+		} else {
+			prev = r.hashes[i-1]
+		}
+		owned[id] += uint64(h - prev)
+	}
+	if len(r.hashes) == 1 {
+		owned[r.owners[r.hashes[0]]] = 1 << 32
+	}
+
+	snap := ringSnapshot{VNodes: r.vnodes, Points: len(r.hashes)}
+	for id, target := range r.shards {
+		snap.Shards = append(snap.Shards, ringShardInfo{
+			ID:        id,
+			Address:   target.Address,
+			VNodes:    points[id],
+			Ownership: float64(owned[id]) / float64(uint64(1)<<32),
+		})
+	}
+	sort.Slice(snap.Shards, func(i, j int) bool { return snap.Shards[i].ID < snap.Shards[j].ID })
+	return snap
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func testRing(vnodes int, ids ...string) *hashRing {
+	r := newHashRing(vnodes)
+	for _, id := range ids {
+		r.add(shardTarget{ID: id, Address: "http://" + id})
+	}
+	return r
+}
+
+// owners looks up n keys and returns the shard owning each
+func owners(t *testing.T, r *hashRing, n int) []string {
+	t.Helper()
+	ids := make([]string, n)
+	for i := range ids {
+		target, ok := r.lookup(fmt.Sprintf("key-%d", i))
+		if !ok {
+			t.Fatal("lookup found no shard")
+		}
+		ids[i] = target.ID
+	}
+	return ids
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	for _, shards := range []int{2, 3, 5, 8} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			var ids []string
+			for i := 1; i <= shards; i++ {
+				ids = append(ids, fmt.Sprintf("shard-%d", i))
+			}
+			r := testRing(128, ids...)
+
+			const keys = 20000
+			counts := make(map[string]int)
+			for _, id := range owners(t, r, keys) {
+				counts[id]++
+			}
+			fair := float64(keys) / float64(shards)
+			for _, id := range ids {
+				if got := float64(counts[id]); math.Abs(got-fair) > 0.3*fair {
+					t.Errorf("%s got %d keys, want within 30%% of %.0f", id, counts[id], fair)
+				}
+			}
+
+			var total float64
+			for _, info := range r.snapshot().Shards {
+				total += info.Ownership
+				if info.VNodes != 128 {
+					t.Errorf("%s has %d points, want 128", info.ID, info.VNodes)
+				}
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Errorf("ownership adds up to %f, want 1", total)
+			}
+		})
+	}
+}
+
+func TestHashRingAddMovesKeysOnlyToTheNewShard(t *testing.T) {
+	r := testRing(128, "shard-1", "shard-2", "shard-3")
+	before := owners(t, r, 10000)
+	r.add(shardTarget{ID: "shard-4", Address: "http://shard-4"})
+	after := owners(t, r, 10000)
+
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+		if after[i] != "shard-4" {
+			t.Fatalf("key-%d moved from %s to %s, not to the new shard", i, before[i], after[i])
+		}
+	}
+	// The new shard takes about a quarter of the keys
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("%d of 10000 keys moved, want about 2500", moved)
+	}
+}
+
+func TestHashRingRemoveMovesOnlyTheRemovedShardsKeys(t *testing.T) {
+	r := testRing(128, "shard-1", "shard-2", "shard-3", "shard-4")
+	before := owners(t, r, 10000)
+	if !r.remove("shard-2") {
+		t.Fatal("remove did not find shard-2")
+	}
+	after := owners(t, r, 10000)
+
+	for i := range before {
+		if before[i] == "shard-2" {
+			if after[i] == "shard-2" {
+				t.Fatalf("key-%d still owned by the removed shard", i)
+			}
+		} else if before[i] != after[i] {
+			t.Fatalf("key-%d moved from %s to %s, though its shard stayed", i, before[i], after[i])
+		}
+	}
+	if r.remove("shard-2") {
+		t.Error("removed shard-2 twice")
+	}
+
+	// Adding it back restores the original placement
+	r.add(shardTarget{ID: "shard-2", Address: "http://shard-2"})
+	for i, id := range owners(t, r, 10000) {
+		if id != before[i] {
+			t.Fatalf("key-%d owned by %s after re-adding shard-2, was %s", i, id, before[i])
+		}
+	}
+}
+
+func TestHashRingReplaceAddressKeepsPlacement(t *testing.T) {
+	r := testRing(16, "shard-1", "shard-2")
+	before := owners(t, r, 1000)
+	r.add(shardTarget{ID: "shard-1", Address: "http://moved"})
+
+	if points := r.snapshot().Points; points != 32 {
+		t.Errorf("ring has %d points, want 32", points)
+	}
+	for i := range before {
+		target, _ := r.lookup(fmt.Sprintf("key-%d", i))
+		if target.ID != before[i] {
+			t.Fatalf("key-%d moved from %s to %s", i, before[i], target.ID)
+		}
+		if target.ID == "shard-1" && target.Address != "http://moved" {
+			t.Fatalf("shard-1 address = %s, want the new one", target.Address)
+		}
+	}
+}
+
+func TestHashRingEdges(t *testing.T) {
+	empty := newHashRing(0)
+	if _, ok := empty.lookup("key"); ok {
+		t.Error("lookup on an empty ring found a shard")
+	}
+	if empty.vnodes != 1 {
+		t.Errorf("vnodes = %d, want at least 1", empty.vnodes)
+	}
+
+	single := testRing(1, "shard-1")
+	for _, id := range owners(t, single, 100) {
+		if id != "shard-1" {
+			t.Fatalf("key owned by %s on a single shard ring", id)
+		}
+	}
+	if snap := single.snapshot(); snap.Shards[0].Ownership != 1 {
+		t.Errorf("single point owns %f of the ring, want 1", snap.Shards[0].Ownership)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// testTelemetry starts spans that record nothing and drops metrics
+type testTelemetry struct {
+	pipeline.TelemetryProvider
+}
+
+type testSpan struct{}
+
+// useTestTelemetry installs a testTelemetry for the duration of the test
+func useTestTelemetry(t *testing.T) {
+	t.Helper()
+	previousTelemetry, previousMetrics := pipeline.Telemetry, pipeline.Metrics
+	pipeline.Telemetry, pipeline.Metrics = testTelemetry{}, pipeline.NewMetrics("router", "", "test", "test")
+	t.Cleanup(func() { pipeline.Telemetry, pipeline.Metrics = previousTelemetry, previousMetrics })
+}
+
+func (testTelemetry) StartSpan(ctx context.Context, operationName string) (pipeline.Span, context.Context) {
+	return testSpan{}, ctx
+}
+
+func (testTelemetry) SpanFromContext(context.Context) pipeline.Span { return nil }
+
+func (testTelemetry) Inject(pipeline.Span, map[string]string) error { return nil }
+
+func (testTelemetry) Incr(string, []string)                  {}
+func (testTelemetry) Timing(string, time.Duration, []string) {}
+func (testTelemetry) Gauge(string, float64, []string)        {}
+
+func (testSpan) SetTag(string, interface{})        {}
+func (s testSpan) StartChild(string) pipeline.Span { return s }
+func (testSpan) Finish()                           {}
+func (testSpan) TraceID() string                   { return "" }
+func (testSpan) SpanID() string                    { return "" }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+const (
+	// maxRetryAfter bounds the Retry-After of rejected requests
+	maxRetryAfter = time.Minute
+	// stalledLatency is the estimate while the queue has messages but nothing drains
+	stalledLatency = time.Hour
+	// stalledPolls is how many polls in a row must see nothing drain before the consumers
+	// count as stalled, as their processing rates lag behind
+	stalledPolls = 3
+)
+
+// admissionController rejects pipeline submissions while the step1 queue is saturated, so
+// clients back off instead of filling it. The queue is polled in the background; requests
+// never wait on SQS. A new message's latency is estimated as the time the consumers need to
+// drain the messages ahead of it (pending / drain rate), since the real end-to-end latency
+// is only known once service3 finishes it. The drain rate is the sum of the processing
+// rates the queue's consumers report on /admin/scaling: other service1 instances and shards
+// may feed the same queue, so what this instance sent says nothing about it.
+//
+//	ADMISSION_MAX_QUEUE_DEPTH  visible plus in-flight messages above which requests get 429, 0 disables (default 0)
+//	ADMISSION_MAX_LATENCY      estimated latency above which requests get 429, 0 disables (default 0)
+//	ADMISSION_POLL_INTERVAL    how often the queue is polled (default 5s)
+//	ADMISSION_CONSUMERS        comma-separated addresses of the queue's consumers, used without a shard registry
+//
+// Past twice a threshold the pipeline is saturated rather than busy and requests get 503.
+// Both carry a Retry-After of the estimated time to get back under the threshold. When the
+// queue cannot be polled, requests are admitted.
+type admissionController struct {
+	queue      string
+	queueURL   string
+	maxDepth   int64
+	maxLatency time.Duration
+	interval   time.Duration
+
+	// Where the consumers of the queue are found: the registry, or else the static list
+	registry  pipeline.ShardRegistry
+	consumers []string
+	client    *http.Client
+
+	mu        sync.Mutex
+	idlePolls int // polls in a row with pending messages and nothing drained
+	status    admissionStatus
+}
+
+// admissionStatus is served on /admin/admission
+type admissionStatus struct {
+	Queue                  string    `json:"queue"`
+	Pending                int64     `json:"pending"`
+	Consumers              int       `json:"consumers"`
+	DrainRate              float64   `json:"drain_rate"`
+	EstimatedLatencyMillis int64     `json:"estimated_latency_ms"`
+	MaxQueueDepth          int64     `json:"max_queue_depth"`
+	MaxLatencyMillis       int64     `json:"max_latency_ms"`
+	Status                 int       `json:"status"` // 200, 429 or 503
+	Reason                 string    `json:"reason,omitempty"`
+	RetryAfterSeconds      int       `json:"retry_after_seconds,omitempty"`
+	UpdatedAt              time.Time `json:"updated_at"`
+	Error                  string    `json:"error,omitempty"`
+
+	estimatedLatency time.Duration
+	cause            string // queue_depth or latency, the metric tag of rejections
+}
+
+// admission guards /send-message, nil until main creates it
+var admission *admissionController
+
+func newAdmissionController(queueURL string, registry pipeline.ShardRegistry) *admissionController {
+	a := &admissionController{
+		queue:      path.Base(queueURL),
+		queueURL:   queueURL,
+		maxDepth:   int64(pipeline.EnvInt("ADMISSION_MAX_QUEUE_DEPTH", 0)),
+		maxLatency: pipeline.EnvDuration("ADMISSION_MAX_LATENCY", 0),
+		interval:   pipeline.EnvDuration("ADMISSION_POLL_INTERVAL", 5*time.Second),
+		registry:   registry,
+		client:     &http.Client{Timeout: 2 * time.Second},
+	}
+	for _, address := range strings.Split(os.Getenv("ADMISSION_CONSUMERS"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			a.consumers = append(a.consumers, strings.TrimSuffix(address, "/"))
+		}
+	}
+	if a.interval <= 0 {
+		a.interval = 5 * time.Second
+	}
+	a.status = admissionStatus{Queue: a.queue, Status: http.StatusOK, MaxQueueDepth: a.maxDepth, MaxLatencyMillis: a.maxLatency.Milliseconds()}
+	return a
+}
+
+func (a *admissionController) enabled() bool {
+	return a != nil && (a.maxDepth > 0 || a.maxLatency > 0)
+}
+
+func (a *admissionController) run(ctx context.Context) {
+	if !a.enabled() {
+		return
+	}
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		a.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *admissionController) poll(ctx context.Context) {
+	callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := pipeline.SQSClient.GetQueueAttributes(callCtx, &sqs.GetQueueAttributesInput{
+		QueueUrl: &a.queueURL,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		},
+	})
+	if err != nil {
+		pipeline.Logger.WarnContext(ctx, "Failed to read queue attributes, admitting all requests",
+			"operation", "sqs_get_queue_attributes",
+			"queue.url", a.queueURL,
+			"error", err)
+		a.mu.Lock()
+		a.status.Status, a.status.Reason, a.status.RetryAfterSeconds = http.StatusOK, "", 0
+		a.status.Error = err.Error()
+		a.mu.Unlock()
+		return
+	}
+	attr := func(name types.QueueAttributeName) int64 {
+		n, _ := strconv.ParseInt(out.Attributes[string(name)], 10, 64)
+		return n
+	}
+	drain, err := a.drainRate(ctx)
+	if err != nil {
+		pipeline.Logger.WarnContext(ctx, "Failed to read the drain rate of the queue's consumers",
+			"operation", "admission_drain_rate",
+			"queue", a.queue,
+			"error", err)
+	}
+	status := a.update(
+		attr(types.QueueAttributeNameApproximateNumberOfMessages)+attr(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+		drain,
+		time.Now(),
+	)
+
+	queue := pipeline.Tag("queue", a.queue)
+	pipeline.Metrics.Gauge(pipeline.MetricAdmissionPending, float64(status.Pending), queue)
+	pipeline.Metrics.Timing(pipeline.MetricAdmissionEstimatedLatency, status.estimatedLatency, queue)
+	if status.Status != http.StatusOK {
+		pipeline.Logger.WarnContext(ctx, "Pipeline saturated, rejecting new messages",
+			"queue", a.queue,
+			"status", status.Status,
+			"reason", status.Reason,
+			"pending", status.Pending)
+	}
+}
+
+// consumerDrain is what the consumers of the queue reported on their latest poll
+type consumerDrain struct {
+	consumers int
+	rate      float64 // messages per second, all consumers together
+}
+
+// drainRate sums the processing rates of the queue's consumers. A consumer that cannot be
+// read counts as draining nothing; the error says which.
+func (a *admissionController) drainRate(ctx context.Context) (consumerDrain, error) {
+	addresses := a.consumers
+	if a.registry != nil {
+		instances, err := pipeline.QueueConsumers(ctx, a.registry, "service2", a.queueURL)
+		if err != nil {
+			return consumerDrain{}, err
+		}
+		addresses = nil
+		for _, instance := range instances {
+			addresses = append(addresses, instance.Address)
+		}
+	}
+	var drain consumerDrain
+	var failed []error
+	for _, address := range addresses {
+		rate, err := pipeline.ConsumerRate(ctx, a.client, address)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", address, err))
+			continue
+		}
+		drain.consumers++
+		drain.rate += rate
+	}
+	return drain, errors.Join(failed...)
+}
+
+// update takes a poll of the queue and of its consumers and decides how requests are
+// answered until the next one
+func (a *admissionController) update(pending int64, drain consumerDrain, now time.Time) admissionStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := admissionStatus{
+		Queue:            a.queue,
+		Pending:          pending,
+		Consumers:        drain.consumers,
+		DrainRate:        drain.rate,
+		MaxQueueDepth:    a.maxDepth,
+		MaxLatencyMillis: a.maxLatency.Milliseconds(),
+		Status:           http.StatusOK,
+		UpdatedAt:        now,
+	}
+	switch {
+	case pending == 0:
+		a.idlePolls = 0
+	case s.DrainRate > 0:
+		a.idlePolls = 0
+		s.estimatedLatency = time.Duration(float64(pending) / s.DrainRate * float64(time.Second))
+	default:
+		// Nothing drained for several polls: the consumers are stalled, or there are none
+		if a.idlePolls++; a.idlePolls >= stalledPolls {
+			s.estimatedLatency = stalledLatency
+		}
+	}
+	s.EstimatedLatencyMillis = s.estimatedLatency.Milliseconds()
+
+	// The worse of the two signals decides; retryAfter is how long until it is back under its threshold
+	var ratio float64
+	var retryAfter time.Duration
+	if a.maxDepth > 0 && pending > a.maxDepth {
+		ratio = float64(pending) / float64(a.maxDepth)
+		s.cause = "queue_depth"
+		s.Reason = fmt.Sprintf("queue_depth %d > %d", pending, a.maxDepth)
+		if s.DrainRate > 0 {
+			retryAfter = time.Duration(float64(pending-a.maxDepth) / s.DrainRate * float64(time.Second))
+		} else {
+			retryAfter = maxRetryAfter
+		}
+	}
+	if a.maxLatency > 0 && s.estimatedLatency > a.maxLatency {
+		if r := float64(s.estimatedLatency) / float64(a.maxLatency); r > ratio {
+			ratio = r
+			s.cause = "latency"
+			s.Reason = fmt.Sprintf("estimated_latency %s > %s", s.estimatedLatency.Round(time.Millisecond), a.maxLatency)
+			retryAfter = s.estimatedLatency - a.maxLatency
+		}
+	}
+	switch {
+	case ratio > 2:
+		s.Status = http.StatusServiceUnavailable
+	case ratio > 1:
+		s.Status = http.StatusTooManyRequests
+	}
+	if s.Status != http.StatusOK {
+		retryAfter = min(max(retryAfter, time.Second), maxRetryAfter)
+		s.RetryAfterSeconds = int(math.Ceil(retryAfter.Seconds()))
+	}
+
+	a.status = s
+	return s
+}
+
+// admit wraps a handler, rejecting requests with the status of the last poll
+func (a *admissionController) admit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() {
+			next(w, r)
+			return
+		}
+		a.mu.Lock()
+		status := a.status
+		a.mu.Unlock()
+		if status.Status == http.StatusOK {
+			next(w, r)
+			return
+		}
+
+		pipeline.Metrics.Incr(pipeline.MetricAdmissionRejected, pipeline.Tag("queue", a.queue), pipeline.Tag("reason", status.cause), pipeline.Tag("status", strconv.Itoa(status.Status)))
+		// A saturated pipeline is an availability problem of the pipeline, not a client error
+		pipeline.Classify(r.Context(), pipeline.OutcomeDependencyError, "pipeline_saturated")
+
+		w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfterSeconds))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status.Status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":               "pipeline saturated, retry later",
+			"reason":              status.Reason,
+			"retry_after_seconds": status.RetryAfterSeconds,
+		})
+	}
+}
+
+// handler serves GET /admin/admission
+func (a *admissionController) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.mu.Lock()
+	status := a.status
+	a.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
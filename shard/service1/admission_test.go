@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+type poll struct {
+	pending int64
+	rate    float64
+}
+
+func TestAdmissionUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxDepth    int64
+		maxLatency  time.Duration
+		polls       []poll
+		wantStatus  int
+		wantLatency time.Duration
+		wantRetry   int
+	}{
+		{
+			name:       "empty queue",
+			maxLatency: 30 * time.Second,
+			polls:      []poll{{0, 0}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "latency from the consumers' rate",
+			maxLatency:  30 * time.Second,
+			polls:       []poll{{100, 10}},
+			wantStatus:  http.StatusOK,
+			wantLatency: 10 * time.Second,
+		},
+		{
+			name:        "busy",
+			maxLatency:  30 * time.Second,
+			polls:       []poll{{500, 10}},
+			wantStatus:  http.StatusTooManyRequests,
+			wantLatency: 50 * time.Second,
+			wantRetry:   20,
+		},
+		{
+			name:        "saturated",
+			maxLatency:  30 * time.Second,
+			polls:       []poll{{1000, 10}},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantLatency: 100 * time.Second,
+			wantRetry:   60,
+		},
+		{
+			name:       "idle polls below the stall threshold",
+			maxLatency: 30 * time.Second,
+			polls:      []poll{{100, 0}, {100, 0}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "stalled after consecutive idle polls",
+			maxLatency:  30 * time.Second,
+			polls:       []poll{{100, 0}, {100, 0}, {100, 0}},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantLatency: stalledLatency,
+			wantRetry:   60,
+		},
+		{
+			name:        "draining poll resets the stall count",
+			maxLatency:  30 * time.Second,
+			polls:       []poll{{100, 0}, {100, 0}, {100, 5}, {100, 0}, {100, 0}},
+			wantStatus:  http.StatusOK,
+			wantLatency: 0,
+		},
+		{
+			name:       "queue depth",
+			maxDepth:   100,
+			polls:      []poll{{150, 10}},
+			wantStatus: http.StatusTooManyRequests,
+			// 50 messages over the threshold at 10/s
+			wantLatency: 15 * time.Second,
+			wantRetry:   5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &admissionController{queue: "q", maxDepth: tt.maxDepth, maxLatency: tt.maxLatency}
+			now := time.Unix(0, 0)
+			var s admissionStatus
+			for _, p := range tt.polls {
+				now = now.Add(5 * time.Second)
+				s = a.update(p.pending, consumerDrain{consumers: 1, rate: p.rate}, now)
+			}
+			if s.Status != tt.wantStatus {
+				t.Errorf("status = %d (%s), want %d", s.Status, s.Reason, tt.wantStatus)
+			}
+			if s.estimatedLatency != tt.wantLatency {
+				t.Errorf("estimated latency = %s, want %s", s.estimatedLatency, tt.wantLatency)
+			}
+			if s.RetryAfterSeconds != tt.wantRetry {
+				t.Errorf("retry after = %d, want %d", s.RetryAfterSeconds, tt.wantRetry)
+			}
+		})
+	}
+}
+
+type fakeRegistry struct {
+	instances []pipeline.ServiceInstance
+}
+
+func (r *fakeRegistry) Register(context.Context, pipeline.ServiceInstance) error { return nil }
+func (r *fakeRegistry) Deregister(context.Context, string) error                 { return nil }
+func (r *fakeRegistry) List(_ context.Context, shard, role string) ([]pipeline.ServiceInstance, error) {
+	var out []pipeline.ServiceInstance
+	for _, instance := range r.instances {
+		if (shard == "" || instance.Shard == shard) && (role == "" || instance.Role == role) {
+			out = append(out, instance)
+		}
+	}
+	return out, nil
+}
+
+func consumer(t *testing.T, rate float64) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/scaling" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"processing_rate":%g}`, rate)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestAdmissionDrainRateSumsQueueConsumers(t *testing.T) {
+	const queueURL = "https://sqs/shard-1-step1"
+	registry := &fakeRegistry{instances: []pipeline.ServiceInstance{
+		{Shard: "shard-1", Role: "service2", Address: consumer(t, 4), Queues: map[string]string{"input": queueURL}},
+		{Shard: "shard-2", Role: "service2", Address: consumer(t, 1.5), Queues: map[string]string{"input": queueURL}},
+		{Shard: "shard-3", Role: "service2", Address: consumer(t, 100), Queues: map[string]string{"input": "https://sqs/shard-3-step1"}},
+		{Shard: "shard-1", Role: "service3", Address: consumer(t, 100), Queues: map[string]string{"input": queueURL}},
+	}}
+	a := &admissionController{queueURL: queueURL, registry: registry, client: http.DefaultClient}
+
+	drain, err := a.drainRate(context.Background())
+	if err != nil {
+		t.Fatalf("drainRate: %v", err)
+	}
+	if drain.consumers != 2 || drain.rate != 5.5 {
+		t.Errorf("drain = %+v, want 2 consumers at 5.5/s", drain)
+	}
+}
+
+func TestAdmissionDrainRateStaticConsumers(t *testing.T) {
+	a := &admissionController{
+		consumers: []string{consumer(t, 2), "http://127.0.0.1:1"},
+		client:    &http.Client{Timeout: time.Second},
+	}
+
+	drain, err := a.drainRate(context.Background())
+	if err == nil {
+		t.Error("unreachable consumer not reported")
+	}
+	if drain.consumers != 1 || drain.rate != 2 {
+		t.Errorf("drain = %+v, want 1 consumer at 2/s", drain)
+	}
+}
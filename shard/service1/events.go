@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// eventHub fans pipeline events out to Server-Sent Events streams: one per pipeline on
+// /pipeline/{correlation_id}/events, and the firehose of every pipeline on GET
+// /pipeline/events. Events come from this instance's status changes and from the step
+// transitions service2 and service3 POST to /pipeline/events. Delivery is best effort: a
+// stream that does not keep up loses events rather than slowing the pipeline down.
+//
+// A pipeline's stream is open to whoever knows its correlation ID, like its status. The
+// firehose shows every caller's pipelines, so it needs one of the keys in
+// EVENTS_FIREHOSE_KEYS in X-API-Key, and is off without them. The POSTed transitions must be
+// signed with CALLBACK_SECRET.
+//
+//	EVENTS_MAX_SUBSCRIBERS  open streams allowed at once (default 100)
+//	EVENTS_FIREHOSE_KEYS    comma-separated keys allowed on the firehose (default none)
+type eventHub struct {
+	maxSubscribers int
+	firehoseKeys   [][sha256.Size]byte
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+	seq         uint64
+	closed      chan struct{}
+}
+
+// eventSubscriber is one open stream, of a single pipeline or of all of them
+type eventSubscriber struct {
+	correlationID string
+	events        chan sequencedEvent
+}
+
+type sequencedEvent struct {
+	seq   uint64
+	event pipeline.Event
+}
+
+const (
+	// subscriberBuffer is how many events a stream may fall behind before it loses some
+	subscriberBuffer = 256
+	// eventsKeepAlive is how often an idle stream gets a comment, so proxies keep it open
+	eventsKeepAlive = 15 * time.Second
+	// eventsLinger keeps a pipeline's stream open after its last event for transitions
+	// that arrive out of order, as they are sent in batches
+	eventsLinger = 2 * time.Second
+)
+
+var events = newEventHub()
+
+func newEventHub() *eventHub {
+	h := &eventHub{
+		maxSubscribers: pipeline.EnvInt("EVENTS_MAX_SUBSCRIBERS", 100),
+		subscribers:    make(map[*eventSubscriber]struct{}),
+		closed:         make(chan struct{}),
+	}
+	for _, key := range strings.Split(os.Getenv("EVENTS_FIREHOSE_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			h.firehoseKeys = append(h.firehoseKeys, sha256.Sum256([]byte(key)))
+		}
+	}
+	return h
+}
+
+// firehoseAllowed reports whether r carries a firehose key. The keys are compared as
+// hashes in constant time, so the comparison does not leak them.
+func (h *eventHub) firehoseAllowed(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(key))
+	allowed := 0
+	for _, k := range h.firehoseKeys {
+		allowed |= subtle.ConstantTimeCompare(sum[:], k[:])
+	}
+	return allowed == 1
+}
+
+// publish hands event to every stream it belongs to, without blocking
+func (h *eventHub) publish(event pipeline.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	for sub := range h.subscribers {
+		if sub.correlationID != "" && sub.correlationID != event.CorrelationID {
+			continue
+		}
+		select {
+		case sub.events <- sequencedEvent{seq: h.seq, event: event}:
+		default:
+			pipeline.Metrics.Incr(pipeline.MetricEventsDropped, pipeline.Tag("reason", "slow_subscriber"))
+		}
+	}
+}
+
+func (h *eventHub) subscribe(correlationID string) (*eventSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) >= h.maxSubscribers {
+		return nil, false
+	}
+	sub := &eventSubscriber{correlationID: correlationID, events: make(chan sequencedEvent, subscriberBuffer)}
+	h.subscribers[sub] = struct{}{}
+	h.reportSubscribers()
+	return sub, true
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, sub)
+	h.reportSubscribers()
+}
+
+// reportSubscribers updates the subscribers gauge, called with h.mu held
+func (h *eventHub) reportSubscribers() {
+	var single, firehose int
+	for sub := range h.subscribers {
+		if sub.correlationID == "" {
+			firehose++
+		} else {
+			single++
+		}
+	}
+	pipeline.Metrics.Gauge(pipeline.MetricEventsSubscribers, float64(single), pipeline.Tag("stream", "pipeline"))
+	pipeline.Metrics.Gauge(pipeline.MetricEventsSubscribers, float64(firehose), pipeline.Tag("stream", "firehose"))
+}
+
+// close ends every stream, so they do not hold up the server's shutdown
+func (h *eventHub) close() {
+	close(h.closed)
+}
+
+// handler serves /pipeline/events: GET is the firehose, POST takes a batch of step
+// transitions from service2 and service3
+func (h *eventHub) handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if len(h.firehoseKeys) == 0 {
+			http.Error(w, "Firehose disabled, see EVENTS_FIREHOSE_KEYS", http.StatusForbidden)
+			return
+		}
+		if !h.firehoseAllowed(r) {
+			w.Header().Set("WWW-Authenticate", `ApiKey header="X-API-Key"`)
+			http.Error(w, "Invalid or missing X-API-Key", http.StatusUnauthorized)
+			return
+		}
+		h.stream(w, r, "")
+	case http.MethodPost:
+		h.intakeHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *eventHub) intakeHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read events", http.StatusBadRequest)
+		return
+	}
+	if err := pipeline.VerifySignature(pipeline.CallbackSecret, r.Header, body, time.Now()); err != nil {
+		pipeline.Metrics.Incr(pipeline.MetricStatusReportsRejected, pipeline.Tag("reason", "signature"))
+		pipeline.Logger.WarnContext(r.Context(), "Rejected pipeline events",
+			"operation", "events_intake",
+			"error", err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var batch []pipeline.Event
+	if err := json.Unmarshal(body, &batch); err != nil {
+		pipeline.Metrics.Incr(pipeline.MetricStatusReportsRejected, pipeline.Tag("reason", "malformed"))
+		http.Error(w, "Malformed events", http.StatusBadRequest)
+		return
+	}
+	for _, event := range batch {
+		// The end of a pipeline is reported on its status URL, which publishes it
+		if event.CorrelationID != "" && !event.Terminal() {
+			h.publish(event)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stream writes the events of correlationID, or of every pipeline when it is empty, as
+// Server-Sent Events until the client goes away. A pipeline's stream starts with its
+// current status and ends shortly after the pipeline does.
+func (h *eventHub) stream(w http.ResponseWriter, r *http.Request, correlationID string) {
+	sub, ok := h.subscribe(correlationID)
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many event streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(sub)
+	// Looked up once subscribed, so no event is missed in between
+	var status pipelineStatus
+	if correlationID != "" {
+		var known bool
+		if status, known = statuses.get(correlationID); !known {
+			http.Error(w, "Unknown pipeline", http.StatusNotFound)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Tells nginx not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		pipeline.Logger.ErrorContext(r.Context(), "Event stream not supported by the response writer", "error", err)
+		return
+	}
+
+	if correlationID != "" {
+		writeEvent(w, 0, "status", status)
+		rc.Flush()
+		if status.Status == pipeline.StatusCompleted || status.Status == pipeline.StatusFailed {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	// Stays nil, blocking forever, until the pipeline ends
+	var linger <-chan time.Time
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.closed:
+			return
+		case <-linger:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-sub.events:
+			writeEvent(w, e.seq, e.event.Status, e.event)
+			if correlationID != "" && e.event.Terminal() && linger == nil {
+				linger = time.After(eventsLinger)
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes one Server-Sent Event; id 0 is left out
+func writeEvent(w io.Writer, id uint64, name string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if id > 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+}
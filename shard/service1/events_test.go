@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+func testEventHub(maxSubscribers int, firehoseKeys ...string) *eventHub {
+	h := &eventHub{
+		maxSubscribers: maxSubscribers,
+		subscribers:    make(map[*eventSubscriber]struct{}),
+		closed:         make(chan struct{}),
+	}
+	for _, key := range firehoseKeys {
+		h.firehoseKeys = append(h.firehoseKeys, sha256.Sum256([]byte(key)))
+	}
+	return h
+}
+
+// received drains the events queued for sub
+func received(sub *eventSubscriber) []string {
+	var got []string
+	for {
+		select {
+		case e := <-sub.events:
+			got = append(got, e.event.CorrelationID+"/"+e.event.Status)
+		default:
+			return got
+		}
+	}
+}
+
+func TestEventHubFanOut(t *testing.T) {
+	useTestTelemetry(t)
+	h := testEventHub(10)
+	first, _ := h.subscribe("c-1")
+	second, _ := h.subscribe("c-2")
+	firehose, _ := h.subscribe("")
+	alsoFirst, _ := h.subscribe("c-1")
+
+	h.publish(pipeline.Event{CorrelationID: "c-1", Status: pipeline.StatusStepStarted})
+	h.publish(pipeline.Event{CorrelationID: "c-2", Status: pipeline.StatusStepStarted})
+	h.publish(pipeline.Event{CorrelationID: "c-1", Status: pipeline.StatusCompleted})
+
+	tests := []struct {
+		name string
+		sub  *eventSubscriber
+		want []string
+	}{
+		{"pipeline stream", first, []string{"c-1/step_started", "c-1/completed"}},
+		{"other pipeline stream", second, []string{"c-2/step_started"}},
+		{"second stream of a pipeline", alsoFirst, []string{"c-1/step_started", "c-1/completed"}},
+		{"firehose", firehose, []string{"c-1/step_started", "c-2/step_started", "c-1/completed"}},
+	}
+	for _, tt := range tests {
+		if got := received(tt.sub); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEventHubSequence(t *testing.T) {
+	useTestTelemetry(t)
+	h := testEventHub(10)
+	sub, _ := h.subscribe("")
+	for range 3 {
+		h.publish(pipeline.Event{CorrelationID: "c-1", Status: pipeline.StatusStepStarted})
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if e := <-sub.events; e.seq != want {
+			t.Errorf("seq = %d, want %d", e.seq, want)
+		}
+	}
+}
+
+func TestEventHubDropsForSlowSubscribers(t *testing.T) {
+	useTestTelemetry(t)
+	h := testEventHub(10)
+	slow, _ := h.subscribe("")
+	for range subscriberBuffer + 10 {
+		// Never blocks, however far behind the stream is
+		h.publish(pipeline.Event{CorrelationID: "c-1", Status: pipeline.StatusStepStarted})
+	}
+	if n := len(received(slow)); n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events, want the %d that fit", n, subscriberBuffer)
+	}
+}
+
+func TestEventHubMaxSubscribers(t *testing.T) {
+	useTestTelemetry(t)
+	h := testEventHub(2)
+	first, _ := h.subscribe("c-1")
+	h.subscribe("")
+	if _, ok := h.subscribe("c-2"); ok {
+		t.Fatal("subscribed past the limit")
+	}
+	h.unsubscribe(first)
+	if _, ok := h.subscribe("c-2"); !ok {
+		t.Error("no room after a stream closed")
+	}
+}
+
+func TestEventHubFirehoseAccess(t *testing.T) {
+	useTestTelemetry(t)
+	tests := []struct {
+		name       string
+		keys       []string
+		header     string
+		wantStatus int
+	}{
+		{"disabled without keys", nil, "anything", http.StatusForbidden},
+		{"missing key", []string{"ops-key"}, "", http.StatusUnauthorized},
+		{"wrong key", []string{"ops-key"}, "ops-key-2", http.StatusUnauthorized},
+		{"rate limit key is not enough", []string{"ops-key"}, "load-test-key", http.StatusUnauthorized},
+		{"valid key", []string{"other-key", "ops-key"}, "ops-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testEventHub(10, tt.keys...)
+			server := httptest.NewServer(http.HandlerFunc(h.handler))
+			defer server.Close()
+			defer close(h.closed)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEventHubFirehoseStream(t *testing.T) {
+	useTestTelemetry(t)
+	h := testEventHub(10, "ops-key")
+	server := httptest.NewServer(http.HandlerFunc(h.handler))
+	defer server.Close()
+	defer close(h.closed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	req.Header.Set("X-API-Key", "ops-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	// The headers are flushed once subscribed, so nothing published now is missed
+	h.publish(pipeline.Event{CorrelationID: "c-1", Status: pipeline.StatusStepStarted, Step: 2})
+	h.publish(pipeline.Event{CorrelationID: "c-2", Status: pipeline.StatusStepCompleted, Step: 2})
+
+	reader := bufio.NewReader(resp.Body)
+	for i, want := range []string{"step_started", "step_completed"} {
+		var block []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading event %d: %v", i, err)
+			}
+			if line == "\n" {
+				break
+			}
+			block = append(block, strings.TrimSuffix(line, "\n"))
+		}
+		if len(block) != 3 || block[0] != "id: "+strconv.Itoa(i+1) || block[1] != "event: "+want ||
+			!strings.HasPrefix(block[2], "data: {") {
+			t.Errorf("event %d = %q, want id %d, event %s and its data", i, block, i+1, want)
+		}
+	}
+}
+
+// signBatch signs body for the events intake as service2 and service3 do
+func signBatch(req *http.Request, secret, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.Header.Set("X-Pipeline-Timestamp", timestamp)
+	req.Header.Set("X-Pipeline-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestEventIntakeRequiresSignature(t *testing.T) {
+	useTestTelemetry(t)
+	previous := pipeline.CallbackSecret
+	t.Cleanup(func() { pipeline.CallbackSecret = previous })
+	pipeline.CallbackSecret = []byte("0123456789abcdef-test")
+
+	body := []byte(`[{"correlation_id":"c-1","status":"step_started","step":2}]`)
+	tests := []struct {
+		name          string
+		secret        []byte // nil sends the batch unsigned
+		wantStatus    int
+		wantPublished int
+	}{
+		{"unsigned", nil, http.StatusUnauthorized, 0},
+		{"other secret", []byte("another-secret-0123"), http.StatusUnauthorized, 0},
+		{"signed", pipeline.CallbackSecret, http.StatusNoContent, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testEventHub(10)
+			sub, _ := h.subscribe("")
+			req := httptest.NewRequest(http.MethodPost, "/pipeline/events", bytes.NewReader(body))
+			if tt.secret != nil {
+				signBatch(req, tt.secret, body)
+			}
+			w := httptest.NewRecorder()
+			h.handler(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := received(sub); len(got) != tt.wantPublished {
+				t.Errorf("published %v, want %d events", got, tt.wantPublished)
+			}
+		})
+	}
+}
@@ -3,113 +3,197 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
-	httptrace "github.com/DataDog/dd-trace-go/contrib/net/http/v2"
-	"github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
+
+	"pipeline-shard/internal/pipeline"
 )
 
-var sqsClient *sqs.Client
-var statsdClient *statsd.Client
 var queueURL = "https://sqs.us-east-1.amazonaws.com/025775160945/service-queue-step1"
 
 // Shard configuration
 var (
-	shardID     string
-	servicePort string
+	servicePort    string
+	serviceAddress string
 )
 
-type PipelineMessage struct {
-	CorrelationID string `json:"correlation_id"`
-	Data          string `json:"data"`
-	Pipeline      struct {
-		StartTime     string `json:"start_time"`
-		Step1Complete string `json:"step1_complete,omitempty"`
-		Step2Complete string `json:"step2_complete,omitempty"`
-		CurrentStep   int    `json:"current_step"`
-	} `json:"pipeline"`
-	ErrorType string `json:"error_type,omitempty"`
-}
-
 func init() {
-	shardID = os.Getenv("SHARD_ID")
-	if shardID == "" {
-		shardID = "shard-default"
+	pipeline.ShardID = os.Getenv("SHARD_ID")
+	if pipeline.ShardID == "" {
+		pipeline.ShardID = "shard-default"
 	}
-	
+
 	servicePort = os.Getenv("SERVICE1_PORT")
 	if servicePort == "" {
 		servicePort = "8080"
 	}
+
+	pipeline.ServiceVersion = os.Getenv("SERVICE_VERSION")
+	if pipeline.ServiceVersion == "" {
+		pipeline.ServiceVersion = "1.2.0"
+	}
+
+	// Per-shard queues, so a shard can be drained independently
+	if v := os.Getenv("STEP1_QUEUE_URL"); v != "" {
+		queueURL = v
+	}
+
+	// Address announced to the shard registry
+	serviceAddress = os.Getenv("SERVICE_ADDRESS")
+	if serviceAddress == "" {
+		serviceAddress = "http://localhost:" + servicePort
+	}
 }
 
 func main() {
-	tracer.Start(
-		tracer.WithService("service1"),
-		tracer.WithEnv("pipeline"),
-		tracer.WithServiceVersion("1.2.0"),
-		tracer.WithGlobalTag("shard", shardID),
-		tracer.WithGlobalTag("port", servicePort),
-	)
-	defer tracer.Stop()
-
-	log.SetFormatter(&log.JSONFormatter{})
-	logFileName := fmt.Sprintf("service1-%s.log", shardID)
-	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	var closeLogs func()
+	pipeline.Logger, closeLogs = pipeline.NewLogger("service1", fmt.Sprintf("service1-%s.log", pipeline.ShardID))
+	defer closeLogs()
+
+	redactConfigPath := os.Getenv("REDACT_CONFIG")
+	if redactConfigPath == "" {
+		redactConfigPath = "../redaction.json"
+	}
+	var err error
+	pipeline.Redaction, err = pipeline.NewRedactor(redactConfigPath)
 	if err != nil {
-		log.WithError(err).Warn("Failed to open log file, using stdout")
-	} else {
-		defer func() {
-			if closeErr := logFile.Close(); closeErr != nil {
-				log.WithError(closeErr).Error("Failed to close log file")
-			}
-		}()
-		log.SetOutput(logFile)
+		pipeline.LogFatal("Failed to load redaction rules", "error", err)
 	}
 
-	statsdClient, err = statsd.New("127.0.0.1:8125")
+	pipeline.Telemetry, err = pipeline.NewTelemetry(pipeline.TelemetryConfig{
+		Service: "service1",
+		Env:     "pipeline",
+		Version: pipeline.ServiceVersion,
+		Tags:    map[string]string{"shard": pipeline.ShardID, "port": servicePort},
+	})
 	if err != nil {
-		log.WithError(err).Fatal("Failed to initialize StatsD client")
+		pipeline.LogFatal("Failed to initialize telemetry", "error", err)
+	}
+	defer pipeline.Telemetry.Shutdown()
+
+	// Metrics are also exposed on /metrics for Prometheus scraping
+	promMetrics := pipeline.NewPrometheusMetrics()
+	pipeline.Telemetry = pipeline.WithPrometheus(pipeline.Telemetry, promMetrics)
+	pipeline.Metrics = pipeline.NewMetrics("service1", pipeline.ShardID, pipeline.ServiceVersion, "pipeline")
+
+	sloConfigPath := os.Getenv("SLO_CONFIG")
+	if sloConfigPath == "" {
+		sloConfigPath = "../slo.json"
+	}
+	pipeline.SLOs, err = pipeline.NewSLOEngine("service1", sloConfigPath)
+	if err != nil {
+		pipeline.LogFatal("Failed to load SLO definitions", "error", err)
+	}
+	if err := pipeline.ConfigureCallbacks(); err != nil {
+		pipeline.LogFatal("Failed to configure pipeline events", "error", err)
+	}
+	go pipeline.SLOs.EmitLoop(30 * time.Second)
+
+	rateLimitConfigPath := os.Getenv("RATE_LIMIT_CONFIG")
+	if rateLimitConfigPath == "" {
+		rateLimitConfigPath = "../ratelimits.json"
+	}
+	rateLimits, err = newRateLimiter(rateLimitConfigPath)
+	if err != nil {
+		pipeline.LogFatal("Failed to load rate limits", "error", err)
 	}
-	defer func() {
-		if closeErr := statsdClient.Close(); closeErr != nil {
-			log.WithError(closeErr).Error("Failed to close StatsD client")
-		}
-	}()
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion("us-east-1"),
 		config.WithSharedConfigProfile("controlplane-pcsilva"))
 	if err != nil {
-		log.WithError(err).Fatal("Failed to load AWS configuration")
+		pipeline.LogFatal("Failed to load AWS configuration", "error", err)
+	}
+	// Retries are left to the retry policies, see pipeline.RetryPolicy
+	pipeline.SQSClient = sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.RetryMaxAttempts = 1 })
+	registry := pipeline.NewRegistryFromEnv()
+	admission = newAdmissionController(queueURL, registry)
+
+	if path := os.Getenv("OUTBOX_PATH"); path != "" {
+		outbox, err = openOutbox(path)
+		if err != nil {
+			pipeline.LogFatal("Failed to open the outbox", "error", err)
+		}
+		defer outbox.Close()
 	}
-	sqsClient = sqs.NewFromConfig(cfg)
 
-	mux := httptrace.NewServeMux()
-	mux.HandleFunc("/", homeHandler)
-	mux.HandleFunc("/send-message", sendMessageHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", pipeline.WithOutcome("/", homeHandler))
+	mux.Handle("/metrics", promMetrics.Handler())
+	mux.HandleFunc("/admin/log-level", pipeline.LogLevelHandler)
+	mux.HandleFunc("/admin/admission", admission.handler)
+	mux.HandleFunc("/admin/quotas", rateLimits.adminHandler)
+	mux.HandleFunc("/quota", rateLimits.quotaHandler)
+	mux.HandleFunc("/slo", pipeline.SLOs.Handler)
+	mux.HandleFunc("/pipeline/events", events.handler)
+	mux.HandleFunc("/pipeline/", pipelineHandler)
+	mux.HandleFunc("/send-message", pipeline.WithOutcome("/send-message", admission.admit(rateLimits.limit(sendMessageHandler))))
+
+	fmt.Printf("Service1 running on :%s (shard: %s)\n", servicePort, pipeline.ShardID)
+	pipeline.Logger.Info("Service1 started", "port", servicePort)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go admission.run(ctx)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		if outbox != nil {
+			outbox.relay(ctx)
+		}
+	}()
 
-	fmt.Printf("Service1 running on :%s (shard: %s)\n", servicePort, shardID)
-	log.WithFields(log.Fields{
-		"service": "service1",
-		"shard":   shardID,
-		"port":    servicePort,
-	}).Info("Service1 started")
-	http.ListenAndServe(":"+servicePort, mux)
+	registrationDone := make(chan struct{})
+	if registry != nil {
+		go func() {
+			defer close(registrationDone)
+			pipeline.KeepRegistered(ctx, registry, pipeline.ServiceInstance{
+				ID:         fmt.Sprintf("%s-service1-%s", pipeline.ShardID, servicePort),
+				Shard:      pipeline.ShardID,
+				Role:       "service1",
+				Address:    serviceAddress,
+				Version:    pipeline.ServiceVersion,
+				Queues:     map[string]string{"output": queueURL},
+				TTLSeconds: 15,
+			})
+		}()
+	} else {
+		close(registrationDone)
+	}
+
+	server := &http.Server{Addr: ":" + servicePort, Handler: pipeline.Telemetry.InstrumentHandler(mux)}
+	// Event streams never end on their own
+	server.RegisterOnShutdown(events.close)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		pipeline.Logger.Error("HTTP server failed", "error", err)
+	}
+	stop()
+	<-registrationDone
+	<-relayDone
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	span, _ := tracer.StartSpanFromContext(r.Context(), "http.request")
+	span, _ := pipeline.Telemetry.StartSpan(r.Context(), "http.request")
 	defer span.Finish()
 
 	correlationID := r.Header.Get("X-Correlation-ID")
@@ -117,31 +201,23 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		correlationID = uuid.New().String()
 	}
 
-	span.SetTag("shard", shardID)
+	span.SetTag("shard", pipeline.ShardID)
 	span.SetTag("service", "service1")
 	span.SetTag("service.name", "service1")
 	span.SetTag("service.port", servicePort)
 	span.SetTag("env", "pipeline")
 	span.SetTag("correlation.id", correlationID)
 
-	// SLI Metrics for health endpoint
-	statsdClient.Incr("sli.requests.total", []string{
-		"service:service1",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-	statsdClient.Incr("sli.requests.success", []string{
-		"service:service1",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-
+	circuit := pipeline.SQSSendBreaker.Status()
 	response := map[string]interface{}{
 		"message":        "Service1 - Pipeline Entry Point",
 		"correlation_id": correlationID,
 		"service":        "service1",
+		"status":         "ok",
+		"circuits":       map[string]pipeline.BreakerStatus{"sqs_send": circuit},
+	}
+	if circuit.State != pipeline.BreakerClosed {
+		response["status"] = "degraded"
 	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -153,7 +229,7 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	start := time.Now()
-	pipelineSpan, ctx := tracer.StartSpanFromContext(r.Context(), "pipeline.step1.process")
+	pipelineSpan, ctx := pipeline.Telemetry.StartSpan(r.Context(), "pipeline.step1.process")
 	defer pipelineSpan.Finish()
 
 	correlationID := r.Header.Get("X-Correlation-ID")
@@ -161,8 +237,18 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		correlationID = uuid.New().String()
 	}
 	injectError := r.Header.Get("X-Inject-Error") == "true"
+	ctx = pipeline.WithLogContext(ctx, correlationID, 1)
+
+	callbackURL := r.Header.Get("X-Callback-URL")
+	if callbackURL != "" {
+		if err := validateCallbackURL(r.Context(), callbackURL); err != nil {
+			pipeline.Classify(r.Context(), pipeline.OutcomeClientError, "invalid_callback_url")
+			http.Error(w, "Invalid X-Callback-URL: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	pipelineSpan.SetTag("shard", shardID)
+	pipelineSpan.SetTag("shard", pipeline.ShardID)
 	pipelineSpan.SetTag("service", "service1")
 	pipelineSpan.SetTag("service.name", "service1")
 	pipelineSpan.SetTag("service.port", servicePort)
@@ -173,34 +259,32 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Business logic processing span
 	processingSpan := pipelineSpan.StartChild("pipeline.step1.business_logic")
-	processingSpan.SetTag("shard", shardID)
+	processingSpan.SetTag("shard", pipeline.ShardID)
 	processingSpan.SetTag("correlation.id", correlationID)
 	processingSpan.SetTag("operation", "validate_and_prepare_order")
 
 	// Create pipeline message with start timestamp
-	message := PipelineMessage{
+	message := pipeline.PipelineMessage{
 		CorrelationID: correlationID,
 		Data:          "Initial data from service1",
+		CallbackURL:   callbackURL,
+		StatusURL:     statusURL(correlationID),
+		EventsURL:     serviceAddress + "/pipeline/events",
 	}
 	message.Pipeline.StartTime = time.Now().Format(time.RFC3339Nano)
 	message.Pipeline.CurrentStep = 1
 
 	if injectError {
 		message.ErrorType = "invalid_data"
-		statsdClient.Incr("business.pipeline.errors.step1", []string{"service:service1"}, 1)
+		pipeline.Metrics.Incr(pipeline.MetricErrorsStep1)
 		processingSpan.SetTag("error.injected", true)
 		processingSpan.SetTag("error", true)
 		pipelineSpan.SetTag("error.injected", true)
 		pipelineSpan.SetTag("error", true)
 
-		log.WithFields(log.Fields{
-			"correlation.id": correlationID,
-			"service":        "service1",
-			"shard":          shardID,
-			"pipeline.step":  1,
-			"error.type":     "invalid_data",
-			"error.injected": true,
-		}).Warn("Error injection activated - message marked as invalid_data")
+		pipeline.Logger.WarnContext(ctx, "Error injection activated - message marked as invalid_data",
+			"error.type", "invalid_data",
+			"error.injected", true)
 	}
 
 	// Step1 processing simulation
@@ -209,53 +293,13 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	message.Pipeline.Step1Complete = time.Now().Format(time.RFC3339Nano)
 	processingSpan.Finish()
 
-	// SLI Metrics for SLO tracking
-	statsdClient.Incr("sli.requests.total", []string{
-		"service:service1",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/send-message",
-	}, 1)
-	if !injectError {
-		statsdClient.Incr("sli.requests.success", []string{
-			"service:service1",
-			"shard:" + shardID,
-			"endpoint:/send-message",
-		}, 1)
-	} else {
-		statsdClient.Incr("sli.requests.error", []string{
-			"service:service1",
-			"shard:" + shardID,
-			"endpoint:/send-message",
-			"error_type:invalid_data",
-		}, 1)
-	}
-	if step1Duration <= 50*time.Millisecond {
-		statsdClient.Incr("sli.latency.under_50ms", []string{
-			"service:service1",
-			"shard:" + shardID,
-		}, 1)
-	}
-	statsdClient.Timing("sli.response_time", step1Duration, []string{
-		"service:service1",
-		"shard:" + shardID,
-		"endpoint:/send-message",
-	}, 1)
-
 	// Business Metrics
-	statsdClient.Timing("business.pipeline.step1.duration", step1Duration, []string{
-		"service:service1",
-		"shard:" + shardID,
-	}, 1)
-	statsdClient.Incr("business.pipeline.messages.step1", []string{
-		"service:service1",
-		"shard:" + shardID,
-	}, 1)
-	statsdClient.Timing("sli.pipeline.duration", step1Duration, []string{
-		"service:service1",
-		"shard:" + shardID,
-		"step:1",
-	}, 1)
+	pipeline.Metrics.Timing(pipeline.MetricStep1Duration, step1Duration)
+	pipeline.Metrics.Incr(pipeline.MetricMessagesStep1)
+	pipeline.Metrics.Timing(pipeline.MetricPipelineDuration, step1Duration, pipeline.Tag("step", "1"))
+
+	// Known before it is sent, so the end of the pipeline can never be reported first
+	statuses.accepted(correlationID, time.Now())
 
 	// Send to Service2 via SQS
 	if err := sendToService2(ctx, pipelineSpan, message, correlationID); err != nil {
@@ -266,45 +310,77 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		n := runtime.Stack(buf, false)
 		pipelineSpan.SetTag("error.stack", string(buf[:n]))
 
-		log.WithFields(log.Fields{
-			"dd.trace_id":    pipelineSpan.Context().TraceIDLower(),
-			"correlation.id": correlationID,
-			"service":        "service1",
-			"shard":          shardID,
-			"pipeline.step":  1,
-			"operation":      "send_to_service2",
-			"queue.url":      queueURL,
-		}).WithError(err).Error("Failed to send message to Service2")
-
-		statsdClient.Incr("sli.requests.error", []string{"service:service1", "endpoint:/send-message", "error_type:sqs_send_failure"}, 1)
+		pipeline.Logger.ErrorContext(ctx, "Failed to send message to Service2",
+			"operation", "send_to_service2",
+			"queue.url", queueURL,
+			"error", err)
+
+		if errors.Is(err, pipeline.ErrCircuitOpen) {
+			// Fail fast with a code clients can act on instead of a generic 500
+			pipeline.Classify(r.Context(), pipeline.OutcomeDependencyError, "circuit_open")
+			statuses.failed(correlationID, "circuit_open")
+			breaker := pipeline.SQSSendBreaker.Status()
+			w.Header().Set("Retry-After", strconv.Itoa(breaker.RetryAfterSeconds))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":               "queue unavailable, circuit open",
+				"code":                "CIRCUIT_OPEN",
+				"correlation_id":      correlationID,
+				"retry_after_seconds": breaker.RetryAfterSeconds,
+			})
+			return
+		}
+		if outbox != nil {
+			pipeline.Classify(r.Context(), pipeline.OutcomeServerError, "outbox_write_failure")
+			statuses.failed(correlationID, "outbox_write_failure")
+			http.Error(w, "Internal server error: failed to store pipeline message", http.StatusInternalServerError)
+			return
+		}
+		pipeline.Classify(r.Context(), pipeline.OutcomeDependencyError, "sqs_send_failure")
+		statuses.failed(correlationID, "sqs_send_failure")
 		http.Error(w, "Internal server error: failed to process pipeline message", http.StatusInternalServerError)
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"dd.trace_id":    pipelineSpan.Context().TraceIDLower(),
-		"correlation.id": correlationID,
-		"service":        "service1",
-		"shard":          shardID,
-		"pipeline.step":  1,
-		"step1_duration": step1Duration.Milliseconds(),
-		"error.injected": injectError,
-	}).Info("Step1 completed, message sent to Service2")
+	// Only classified once the message is on the queue, so a failed send is never counted as invalid_data
+	if injectError {
+		pipeline.Classify(r.Context(), pipeline.OutcomeBusinessError, "invalid_data")
+	}
 
 	response := map[string]interface{}{
 		"message":        "Pipeline started - Step1 completed",
 		"correlation_id": correlationID,
 		"step":           1,
 		"duration_ms":    step1Duration.Milliseconds(),
+		"status_url":     message.StatusURL,
+		"events_url":     eventsURL(correlationID),
 	}
+	if outbox != nil {
+		// Stored durably: the relay delivers it at least once from here on
+		pipeline.Logger.InfoContext(ctx, "Step1 completed, message stored in the outbox",
+			"step1_duration", step1Duration.Milliseconds(),
+			"error.injected", injectError)
+		response["message"] = "Pipeline accepted - Step1 completed, message queued for delivery"
+	} else {
+		pipeline.Logger.InfoContext(ctx, "Step1 completed, message sent to Service2",
+			"step1_duration", step1Duration.Milliseconds(),
+			"error.injected", injectError)
+	}
+
+	// The rest of the pipeline runs asynchronously: its end is served on the status URL
+	// and sent to the callback URL
+	w.Header().Set("Location", message.StatusURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
-func sendToService2(ctx context.Context, parentSpan *tracer.Span, message PipelineMessage, correlationID string) error {
+func sendToService2(ctx context.Context, parentSpan pipeline.Span, message pipeline.PipelineMessage, correlationID string) error {
 	sendSpan := parentSpan.StartChild("pipeline.step1.send_to_service2")
 	defer sendSpan.Finish()
 
-	sendSpan.SetTag("shard", shardID)
+	sendSpan.SetTag("shard", pipeline.ShardID)
 	sendSpan.SetTag("service", "service1")
 	sendSpan.SetTag("env", "pipeline")
 	sendSpan.SetTag("correlation.id", correlationID)
@@ -317,35 +393,19 @@ func sendToService2(ctx context.Context, parentSpan *tracer.Span, message Pipeli
 	sqsSpan.SetTag("span.kind", "producer")
 	sqsSpan.SetTag("messaging.system", "sqs")
 	sqsSpan.SetTag("messaging.destination", "service-queue-step1")
-	sqsSpan.SetTag("shard", shardID)
+	sqsSpan.SetTag("shard", pipeline.ShardID)
 	sqsSpan.SetTag("correlation.id", correlationID)
 	sqsSpan.SetTag("aws.service", "sqs")
 	sqsSpan.SetTag("aws.operation", "SendMessage")
 
 	// Inject trace context
 	carrier := make(map[string]string)
-	if err := tracer.Inject(sqsSpan.Context(), tracer.TextMapCarrier(carrier)); err != nil {
-		log.WithFields(log.Fields{
-			"correlation.id": correlationID,
-			"service":        "service1",
-			"shard":          shardID,
-			"operation":      "trace_inject",
-		}).WithError(err).Warn("Failed to inject trace context, continuing without tracing")
-	}
-
-	// Convert carrier to SQS message attributes
-	msgAttrs := map[string]types.MessageAttributeValue{
-		"correlation-id": {
-			DataType:    &[]string{"String"}[0],
-			StringValue: &correlationID,
-		},
-	}
-	for key, value := range carrier {
-		msgAttrs[key] = types.MessageAttributeValue{
-			DataType:    &[]string{"String"}[0],
-			StringValue: &value,
-		}
+	if err := pipeline.Telemetry.Inject(sqsSpan, carrier); err != nil {
+		pipeline.Logger.WarnContext(ctx, "Failed to inject trace context, continuing without tracing",
+			"operation", "trace_inject",
+			"error", err)
 	}
+	attrs := map[string]string{"correlation-id": correlationID}
 
 	// Marshal message body
 	msgBody, err := json.Marshal(message)
@@ -355,14 +415,20 @@ func sendToService2(ctx context.Context, parentSpan *tracer.Span, message Pipeli
 		return fmt.Errorf("failed to marshal pipeline message for service2: %w", err)
 	}
 
-	// Send message to SQS
-	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:          &queueURL,
-		MessageBody:       &[]string{string(msgBody)}[0],
-		MessageAttributes: msgAttrs,
-	})
+	// With an outbox the message is accepted once it is stored; the relay sends it
+	if outbox != nil {
+		if err := outbox.add(correlationID, string(msgBody), attrs, carrier); err != nil {
+			sqsSpan.SetTag("error", true)
+			sqsSpan.SetTag("error.msg", err.Error())
+			return fmt.Errorf("failed to store message in the outbox [correlation_id=%s]: %w", correlationID, err)
+		}
+		sqsSpan.SetTag("message.outbox", true)
+		return nil
+	}
 
-	if err != nil {
+	// Sent as SQS message attributes, with the correlation ID
+	maps.Copy(attrs, carrier)
+	if err := publishToService2(ctx, string(msgBody), attrs); err != nil {
 		sqsSpan.SetTag("error", true)
 		sqsSpan.SetTag("error.msg", err.Error())
 		return fmt.Errorf("failed to send message to service2 queue [correlation_id=%s, queue=%s]: %w",
@@ -371,4 +437,30 @@ func sendToService2(ctx context.Context, parentSpan *tracer.Span, message Pipeli
 
 	sqsSpan.SetTag("message.sent", true)
 	return nil
-}
\ No newline at end of file
+}
+
+// publishToService2 sends body to the step1 queue with attrs, the trace context and
+// correlation ID, as string message attributes. Throttling and transient failures are
+// retried, and it fails fast while the circuit is open.
+func publishToService2(ctx context.Context, body string, attrs map[string]string) error {
+	msgAttrs := make(map[string]types.MessageAttributeValue, len(attrs))
+	for key, value := range attrs {
+		msgAttrs[key] = types.MessageAttributeValue{
+			DataType:    &[]string{"String"}[0],
+			StringValue: &value,
+		}
+	}
+	err := pipeline.SQSSendRetry.Do(ctx, func(ctx context.Context) error {
+		return pipeline.SQSSendBreaker.Do(ctx, func(ctx context.Context) error {
+			attemptCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			_, err := pipeline.SQSClient.SendMessage(attemptCtx, &sqs.SendMessageInput{
+				QueueUrl:          &queueURL,
+				MessageBody:       &body,
+				MessageAttributes: msgAttrs,
+			})
+			return err
+		})
+	})
+	return err
+}
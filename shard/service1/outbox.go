@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+var (
+	outboxBucket = []byte("outbox")
+	// outboxDueBucket indexes the entries by their next attempt, so the relay reads only
+	// those that are due: keys are the attempt time in Unix nanoseconds followed by the
+	// entry's key, both big-endian, and values are empty
+	outboxDueBucket = []byte("outbox_due")
+)
+
+// outboxRelayRetry spaces out the attempts of a message the relay could not publish. It
+// never gives up: a message in the outbox has been accepted and must be delivered.
+var outboxRelayRetry = pipeline.NewRetryPolicy("outbox_relay", 0, time.Second, 5*time.Minute)
+
+// messageOutbox stores accepted messages durably before service1 answers, and a relay
+// publishes them to the step1 queue, so a message is delivered at least once even when SQS
+// is down or the process dies after answering. Messages are published when due and removed
+// once SQS has them; a crash between the two publishes a message again, which the consumers
+// already tolerate as a redelivery. Ordering is not guaranteed: a message whose publish
+// failed waits out its backoff while later ones go ahead, and the queue does not keep order
+// either.
+//
+//	OUTBOX_PATH            BoltDB file of the outbox; unset, messages are sent synchronously
+//	OUTBOX_POLL_INTERVAL   how often the relay looks for messages due for publishing (default 1s)
+type messageOutbox struct {
+	db       *bolt.DB
+	interval time.Duration
+	wake     chan struct{}
+	// send publishes a message, publishToService2 outside of tests
+	send func(ctx context.Context, body string, attrs map[string]string) error
+	// pending counts the stored entries, so the gauge does not need a scan
+	pending atomic.Int64
+}
+
+// outboxEntry is the stored form of one accepted message
+type outboxEntry struct {
+	CorrelationID string            `json:"correlation_id"`
+	Body          string            `json:"body"`
+	Attributes    map[string]string `json:"attributes"`
+	// TraceContext is the accepting request's span context; the relay continues the trace
+	// from it and sends its own span's context with the message
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	AcceptedAt   time.Time         `json:"accepted_at"`
+	Attempts     int               `json:"attempts"`
+	NextAttempt  time.Time         `json:"next_attempt"`
+	LastError    string            `json:"last_error,omitempty"`
+}
+
+// outbox is nil when OUTBOX_PATH is not set
+var outbox *messageOutbox
+
+func openOutbox(path string) (*messageOutbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox %s: %w", path, err)
+	}
+	o := &messageOutbox{
+		db:       db,
+		interval: pipeline.EnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		wake:     make(chan struct{}, 1),
+		send:     publishToService2,
+	}
+	if o.interval <= 0 {
+		o.interval = time.Second
+	}
+	if err := db.Update(o.initialize); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize outbox %s: %w", path, err)
+	}
+	return o, nil
+}
+
+// initialize creates the buckets and counts the stored entries. An outbox written before
+// the due index existed is indexed once here.
+func (o *messageOutbox) initialize(tx *bolt.Tx) error {
+	entries, err := tx.CreateBucketIfNotExists(outboxBucket)
+	if err != nil {
+		return err
+	}
+	due := tx.Bucket(outboxDueBucket)
+	indexed := due != nil
+	if !indexed {
+		if due, err = tx.CreateBucket(outboxDueBucket); err != nil {
+			return err
+		}
+	}
+	var pending int64
+	err = entries.ForEach(func(k, v []byte) error {
+		pending++
+		if indexed {
+			return nil
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("outbox entry %x: %w", k, err)
+		}
+		return due.Put(outboxDueKey(entry.NextAttempt, k), nil)
+	})
+	o.pending.Store(pending)
+	return err
+}
+
+func (o *messageOutbox) Close() error {
+	return o.db.Close()
+}
+
+// add stores a message; it is durable once add returns
+func (o *messageOutbox) add(correlationID, body string, attrs, traceContext map[string]string) error {
+	now := time.Now()
+	value, err := json.Marshal(outboxEntry{
+		CorrelationID: correlationID,
+		Body:          body,
+		Attributes:    attrs,
+		TraceContext:  traceContext,
+		AcceptedAt:    now,
+		NextAttempt:   now,
+	})
+	if err != nil {
+		return err
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := outboxKey(seq)
+		if err := b.Put(key, value); err != nil {
+			return err
+		}
+		return tx.Bucket(outboxDueBucket).Put(outboxDueKey(now, key), nil)
+	})
+	if err != nil {
+		return err
+	}
+	o.pending.Add(1)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// outboxKey orders entries by acceptance
+func outboxKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// outboxDueKey orders entries by next attempt, then by acceptance
+func outboxDueKey(at time.Time, key []byte) []byte {
+	dueKey := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(dueKey, uint64(max(at.UnixNano(), 0)))
+	return append(dueKey, key...)
+}
+
+// relay publishes due messages until ctx is done
+func (o *messageOutbox) relay(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		o.publishDue(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// publishDue publishes every message whose next attempt is due at now, earliest first. Only
+// the due part of the index is read.
+func (o *messageOutbox) publishDue(ctx context.Context, now time.Time) {
+	type dueEntry struct {
+		key   []byte
+		entry outboxEntry
+	}
+	var due []dueEntry
+	limit := outboxDueKey(now, nil)
+	err := o.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(outboxBucket)
+		c := tx.Bucket(outboxDueBucket).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, _ = c.Next() {
+			key := k[8:]
+			v := entries.Get(key)
+			if v == nil {
+				continue
+			}
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("outbox entry %x: %w", key, err)
+			}
+			due = append(due, dueEntry{key: append([]byte(nil), key...), entry: entry})
+		}
+		return nil
+	})
+	pipeline.Metrics.Gauge(pipeline.MetricOutboxPending, float64(o.pending.Load()))
+	if err != nil {
+		pipeline.Logger.ErrorContext(ctx, "Failed to read the outbox", "operation", "outbox_read", "error", err)
+		return
+	}
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		o.publish(ctx, d.key, d.entry)
+	}
+}
+
+func (o *messageOutbox) publish(ctx context.Context, key []byte, entry outboxEntry) {
+	// A child of the accepting request's trace, so the delay before delivery shows in it
+	traceContext, attributes := entry.TraceContext, entry.Attributes
+	if traceContext == nil {
+		// Stored before the trace context had its own field, when the attributes held it
+		traceContext, attributes = entry.Attributes, map[string]string{"correlation-id": entry.CorrelationID}
+	}
+	span, spanCtx, _ := pipeline.Telemetry.StartSpanFromCarrier("pipeline.step1.outbox_relay", traceContext)
+	defer span.Finish()
+	span.SetTag("span.kind", "producer")
+	span.SetTag("shard", pipeline.ShardID)
+	span.SetTag("correlation.id", entry.CorrelationID)
+	span.SetTag("outbox.attempt", entry.Attempts+1)
+	logCtx := pipeline.WithLogContext(spanCtx, entry.CorrelationID, 1)
+
+	// The consumer continues the trace from the relay's span, which did the actual send
+	attrs := maps.Clone(attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	if err := pipeline.Telemetry.Inject(span, attrs); err != nil {
+		pipeline.Logger.WarnContext(logCtx, "Failed to inject trace context, continuing without tracing",
+			"operation", "trace_inject",
+			"error", err)
+	}
+
+	dueKey := outboxDueKey(entry.NextAttempt, key)
+	err := o.send(ctx, entry.Body, attrs)
+	if err == nil {
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(outboxBucket).Delete(key); err != nil {
+				return err
+			}
+			return tx.Bucket(outboxDueBucket).Delete(dueKey)
+		})
+		if err != nil {
+			// Published but still stored: it will be published again
+			pipeline.Logger.ErrorContext(logCtx, "Failed to remove a published message from the outbox",
+				"operation", "outbox_delete",
+				"error", err)
+		} else {
+			o.pending.Add(-1)
+		}
+		pipeline.Metrics.Incr(pipeline.MetricOutboxPublished)
+		pipeline.Metrics.Timing(pipeline.MetricOutboxDelay, time.Since(entry.AcceptedAt))
+		return
+	}
+
+	entry.Attempts++
+	entry.NextAttempt = time.Now().Add(outboxRelayRetry.Backoff(entry.Attempts))
+	entry.LastError = err.Error()
+	span.SetTag("error", true)
+	span.SetTag("error.msg", err.Error())
+	pipeline.Metrics.Incr(pipeline.MetricOutboxPublishFailures, pipeline.Tag("error_code", pipeline.ErrorCode(err)))
+	pipeline.Logger.WarnContext(logCtx, "Failed to publish message from the outbox, will retry",
+		"operation", "outbox_publish",
+		"outbox.attempts", entry.Attempts,
+		"retry.delay_ms", time.Until(entry.NextAttempt).Milliseconds(),
+		"error", err)
+
+	value, err := json.Marshal(entry)
+	if err == nil {
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			due := tx.Bucket(outboxDueBucket)
+			if err := due.Delete(dueKey); err != nil {
+				return err
+			}
+			if err := tx.Bucket(outboxBucket).Put(key, value); err != nil {
+				return err
+			}
+			return due.Put(outboxDueKey(entry.NextAttempt, key), nil)
+		})
+	}
+	if err != nil {
+		pipeline.Logger.ErrorContext(logCtx, "Failed to reschedule outbox message, retrying on the next poll",
+			"operation", "outbox_update",
+			"error", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sentMessage is a message the relay handed to SQS
+type sentMessage struct {
+	body  string
+	attrs map[string]string
+}
+
+type testSender struct {
+	mu   sync.Mutex
+	fail error
+	sent []sentMessage
+}
+
+func (s *testSender) send(_ context.Context, body string, attrs map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	s.sent = append(s.sent, sentMessage{body: body, attrs: attrs})
+	return nil
+}
+
+func testOutbox(t *testing.T, path string) (*messageOutbox, *testSender) {
+	t.Helper()
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatalf("openOutbox: %v", err)
+	}
+	t.Cleanup(func() { o.Close() })
+	sender := &testSender{}
+	o.send = sender.send
+	return o, sender
+}
+
+func TestOutboxRelayPublishesInOrder(t *testing.T) {
+	useTestTelemetry(t)
+	o, sender := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	for _, id := range []string{"c-1", "c-2", "c-3"} {
+		if err := o.add(id, "body "+id, map[string]string{"correlation-id": id}, nil); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	o.publishDue(context.Background(), time.Now())
+	if len(sender.sent) != 3 {
+		t.Fatalf("published %d messages, want 3", len(sender.sent))
+	}
+	for i, id := range []string{"c-1", "c-2", "c-3"} {
+		if got := sender.sent[i].attrs["correlation-id"]; got != id {
+			t.Errorf("message %d: correlation-id = %q, want %q", i, got, id)
+		}
+	}
+	if n := o.pending.Load(); n != 0 {
+		t.Errorf("pending = %d after publishing, want 0", n)
+	}
+
+	// Published messages are gone
+	o.publishDue(context.Background(), time.Now().Add(time.Hour))
+	if len(sender.sent) != 3 {
+		t.Errorf("published %d messages after a second pass, want 3", len(sender.sent))
+	}
+}
+
+func TestOutboxRelayRestoresTraceContext(t *testing.T) {
+	useTestTelemetry(t)
+	o, sender := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	trace := map[string]string{"x-test-trace": "trace-1", "x-test-span": "sqs.send_message.service_queue_step1"}
+	if err := o.add("c-1", "body", map[string]string{"correlation-id": "c-1"}, trace); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	o.publishDue(context.Background(), time.Now())
+	if len(sender.sent) != 1 {
+		t.Fatalf("published %d messages, want 1", len(sender.sent))
+	}
+	attrs := sender.sent[0].attrs
+	// The message continues the accepting request's trace from the relay's span
+	if attrs["x-test-trace"] != "trace-1" || attrs["x-test-span"] != "pipeline.step1.outbox_relay" {
+		t.Errorf("trace attributes = %v, want trace-1 from pipeline.step1.outbox_relay", attrs)
+	}
+	if attrs["correlation-id"] != "c-1" {
+		t.Errorf("correlation-id = %q, want c-1", attrs["correlation-id"])
+	}
+}
+
+func TestOutboxRelayReschedulesFailures(t *testing.T) {
+	useTestTelemetry(t)
+	o, sender := testOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	if err := o.add("c-1", "body", map[string]string{"correlation-id": "c-1"}, nil); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	sender.fail = errors.New("queue unavailable")
+	o.publishDue(context.Background(), time.Now())
+	sender.fail = nil
+	if n := o.pending.Load(); n != 1 {
+		t.Fatalf("pending = %d after a failed publish, want 1", n)
+	}
+
+	// Past the longest backoff the rescheduled message is due again, once
+	o.publishDue(context.Background(), time.Now().Add(outboxRelayRetry.MaxDelay+time.Second))
+	if len(sender.sent) != 1 {
+		t.Fatalf("published %d messages after the backoff, want 1", len(sender.sent))
+	}
+	if n := o.pending.Load(); n != 0 {
+		t.Errorf("pending = %d after publishing, want 0", n)
+	}
+}
+
+func TestOutboxReopenCountsAndIndexes(t *testing.T) {
+	useTestTelemetry(t)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	o, _ := testOutbox(t, path)
+	for _, id := range []string{"c-1", "c-2"} {
+		if err := o.add(id, "body", map[string]string{"correlation-id": id}, nil); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	o.Close()
+
+	reopened, sender := testOutbox(t, path)
+	if n := reopened.pending.Load(); n != 2 {
+		t.Errorf("pending after reopening = %d, want 2", n)
+	}
+	reopened.publishDue(context.Background(), time.Now())
+	if len(sender.sent) != 2 {
+		t.Errorf("published %d messages after reopening, want 2", len(sender.sent))
+	}
+}
+
+func TestOutboxIndexesEntriesStoredWithoutIndex(t *testing.T) {
+	useTestTelemetry(t)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open: %v", err)
+	}
+	// The earlier format: no due index, and the trace context in the attributes
+	value, _ := json.Marshal(outboxEntry{
+		CorrelationID: "c-1",
+		Body:          "body",
+		Attributes:    map[string]string{"correlation-id": "c-1", "x-test-trace": "trace-1", "x-test-span": "send"},
+		NextAttempt:   time.Now(),
+	})
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(outboxBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(outboxKey(1), value)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("writing the old outbox: %v", err)
+	}
+
+	o, sender := testOutbox(t, path)
+	o.publishDue(context.Background(), time.Now())
+	if len(sender.sent) != 1 {
+		t.Fatalf("published %d messages, want 1", len(sender.sent))
+	}
+	if attrs := sender.sent[0].attrs; attrs["x-test-trace"] != "trace-1" || attrs["x-test-span"] != "pipeline.step1.outbox_relay" {
+		t.Errorf("trace attributes = %v, want trace-1 from pipeline.step1.outbox_relay", attrs)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// rateLimitConfig is the format of RATE_LIMIT_CONFIG
+type rateLimitConfig struct {
+	// ClientHeaders identify the caller, the first one present wins
+	ClientHeaders []string `json:"client_headers"`
+	// DefaultTier applies to callers not listed in Clients, who all share one bucket
+	DefaultTier string                   `json:"default_tier"`
+	Tiers       map[string]rateLimitTier `json:"tiers"`
+	Clients     []rateLimitClient        `json:"clients"`
+}
+
+// rateLimitTier is a token bucket refilled with Rate tokens per second up to Burst, plus a
+// number of messages per UTC day. A zero Rate or DailyQuota is unlimited.
+type rateLimitTier struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	DailyQuota int64   `json:"daily_quota"`
+}
+
+type rateLimitClient struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Tier string `json:"tier"`
+}
+
+// rateLimiter applies per-client rate limits and daily quotas to /send-message
+type rateLimiter struct {
+	headers     []string
+	tiers       map[string]rateLimitTier
+	defaultTier string
+	known       map[string]rateLimitClient // by key
+
+	mu      sync.Mutex
+	buckets map[string]*clientBucket // by key, "" for every caller not in known
+}
+
+type clientBucket struct {
+	client   rateLimitClient
+	tokens   float64
+	updated  time.Time
+	day      string
+	used     int64
+	rejected int64
+}
+
+// quotaStatus is served on /quota and /admin/quotas
+type quotaStatus struct {
+	Client         string  `json:"client"`
+	Tier           string  `json:"tier"`
+	Rate           float64 `json:"rate"`
+	Burst          int     `json:"burst"`
+	Tokens         float64 `json:"tokens"`
+	DailyQuota     int64   `json:"daily_quota"`
+	Used           int64   `json:"used"`
+	Remaining      int64   `json:"remaining"`
+	ResetInSeconds int     `json:"reset_in_seconds"`
+	Rejected       int64   `json:"rejected"`
+}
+
+// rateLimits guards /send-message, nil when rate limiting is not configured
+var rateLimits *rateLimiter
+
+// newRateLimiter loads the limits from path. Without the file every caller is unlimited.
+func newRateLimiter(path string) (*rateLimiter, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var cfg rateLimitConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return compileRateLimits(cfg)
+}
+
+func compileRateLimits(cfg rateLimitConfig) (*rateLimiter, error) {
+	if len(cfg.ClientHeaders) == 0 {
+		cfg.ClientHeaders = []string{"X-API-Key"}
+	}
+	if _, ok := cfg.Tiers[cfg.DefaultTier]; !ok {
+		return nil, fmt.Errorf("default_tier %q is not defined", cfg.DefaultTier)
+	}
+	l := &rateLimiter{
+		headers:     cfg.ClientHeaders,
+		tiers:       cfg.Tiers,
+		defaultTier: cfg.DefaultTier,
+		known:       make(map[string]rateLimitClient),
+		buckets:     make(map[string]*clientBucket),
+	}
+	for _, c := range cfg.Clients {
+		if _, ok := cfg.Tiers[c.Tier]; !ok {
+			return nil, fmt.Errorf("client %s: tier %q is not defined", c.Name, c.Tier)
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("client %s has no key", c.Name)
+		}
+		l.known[c.Key] = c
+	}
+	return l, nil
+}
+
+// clientKey identifies the caller of r by the first client header present
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	for _, h := range l.headers {
+		if v := r.Header.Get(h); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// bucketKey is the bucket key charges to. Keys that are not configured, like callers without
+// a client header, share the default tier's bucket: client headers are not authenticated, so a
+// made-up key must not buy a bucket and a daily quota of its own.
+func (l *rateLimiter) bucketKey(key string) string {
+	if _, known := l.known[key]; known {
+		return key
+	}
+	return ""
+}
+
+// bucket returns the bucket of key, refilled up to now. Called with l.mu held.
+func (l *rateLimiter) bucket(key string, now time.Time) (*clientBucket, rateLimitTier) {
+	key = l.bucketKey(key)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = l.newBucket(key, now)
+		l.buckets[key] = b
+	}
+	tier := l.tiers[b.client.Tier]
+	b.refill(tier, now)
+	return b, tier
+}
+
+// peek returns the status of the bucket of key without creating it. Called with l.mu held.
+func (l *rateLimiter) peek(key string, now time.Time) quotaStatus {
+	key = l.bucketKey(key)
+	var b clientBucket
+	if existing, ok := l.buckets[key]; ok {
+		b = *existing
+	} else {
+		b = *l.newBucket(key, now)
+	}
+	tier := l.tiers[b.client.Tier]
+	b.refill(tier, now)
+	return b.status(tier, now)
+}
+
+func (l *rateLimiter) newBucket(key string, now time.Time) *clientBucket {
+	client, known := l.known[key]
+	if !known {
+		// Unconfigured keys are not tagged on metrics or logged, they may be mistyped secrets
+		client = rateLimitClient{Name: "anonymous", Tier: l.defaultTier}
+	}
+	return &clientBucket{client: client, tokens: float64(l.tiers[client.Tier].Burst), updated: now}
+}
+
+// refill adds the tokens earned since the last update and restarts the quota on a new UTC day
+func (b *clientBucket) refill(tier rateLimitTier, now time.Time) {
+	if tier.Rate > 0 {
+		b.tokens = math.Min(float64(tier.Burst), b.tokens+now.Sub(b.updated).Seconds()*tier.Rate)
+	}
+	b.updated = now
+	if day := now.UTC().Format(time.DateOnly); day != b.day {
+		b.day, b.used = day, 0
+	}
+}
+
+// take spends one token and one message of quota of key if both are available.
+// retryAfter is set when the request is rejected, reason says by which limit.
+func (l *rateLimiter) take(key string, now time.Time) (status quotaStatus, reason string, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, tier := l.bucket(key, now)
+
+	switch {
+	case tier.DailyQuota > 0 && b.used >= tier.DailyQuota:
+		reason, retryAfter = "quota", untilMidnightUTC(now)
+	case tier.Rate > 0 && b.tokens < 1:
+		reason, retryAfter = "rate", time.Duration((1-b.tokens)/tier.Rate*float64(time.Second))
+	default:
+		if tier.Rate > 0 {
+			b.tokens--
+		}
+		b.used++
+	}
+	if reason != "" {
+		b.rejected++
+	}
+	return b.status(tier, now), reason, retryAfter
+}
+
+// refund gives back what take spent for a request the service failed, so callers are only
+// charged for messages the pipeline accepted or rejected as invalid. Quota spent on a previous
+// UTC day is not refunded, the day's count has restarted since.
+func (l *rateLimiter) refund(key string, taken, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, tier := l.bucket(key, now)
+	if tier.Rate > 0 {
+		b.tokens = math.Min(float64(tier.Burst), b.tokens+1)
+	}
+	if b.day == taken.UTC().Format(time.DateOnly) && b.used > 0 {
+		b.used--
+	}
+}
+
+func (b *clientBucket) status(tier rateLimitTier, now time.Time) quotaStatus {
+	s := quotaStatus{
+		Client:         b.client.Name,
+		Tier:           b.client.Tier,
+		Rate:           tier.Rate,
+		Burst:          tier.Burst,
+		Tokens:         math.Floor(b.tokens),
+		DailyQuota:     tier.DailyQuota,
+		Used:           b.used,
+		ResetInSeconds: int(math.Ceil(untilMidnightUTC(now).Seconds())),
+		Rejected:       b.rejected,
+	}
+	if tier.DailyQuota > 0 {
+		s.Remaining = max(tier.DailyQuota-b.used, 0)
+	}
+	return s
+}
+
+func untilMidnightUTC(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// limit wraps a handler with the caller's rate limit and quota and sets the X-RateLimit-* headers
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			next(w, r)
+			return
+		}
+		key, taken := l.clientKey(r), time.Now()
+		status, reason, retryAfter := l.take(key, taken)
+		setRateLimitHeaders(w, status)
+		if reason == "" {
+			pipeline.Metrics.Incr(pipeline.MetricRateLimitAdmitted, pipeline.Tag("client", status.Client), pipeline.Tag("tier", status.Tier))
+			rw := &refundWriter{ResponseWriter: w, status: http.StatusOK}
+			next(rw, r)
+			// Server errors and an open circuit (503 CIRCUIT_OPEN) are the service's failures, not the caller's
+			if rw.status >= http.StatusInternalServerError {
+				l.refund(key, taken, time.Now())
+			}
+			return
+		}
+
+		pipeline.Metrics.Incr(pipeline.MetricRateLimited, pipeline.Tag("client", status.Client), pipeline.Tag("tier", status.Tier), pipeline.Tag("reason", reason))
+		pipeline.Classify(r.Context(), pipeline.OutcomeClientError, "rate_limited")
+		pipeline.Logger.InfoContext(r.Context(), "Request rate limited",
+			"client", status.Client,
+			"tier", status.Tier,
+			"reason", reason)
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  "rate limit exceeded",
+			"reason": reason,
+			"quota":  status,
+		})
+	}
+}
+
+// refundWriter records the status of an admitted request, to refund it if the service failed
+type refundWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *refundWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *refundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// setRateLimitHeaders reports the token bucket in X-RateLimit-* and the daily quota in X-Quota-*
+func setRateLimitHeaders(w http.ResponseWriter, s quotaStatus) {
+	if s.Rate > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(s.Tokens)))
+		// Seconds until the bucket is full again
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(s.Burst)-s.Tokens)/s.Rate))))
+	}
+	if s.DailyQuota > 0 {
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(s.DailyQuota, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(s.Remaining, 10))
+		w.Header().Set("X-Quota-Reset", strconv.Itoa(s.ResetInSeconds))
+	}
+}
+
+// quotaHandler serves GET /quota, the limits and usage of the caller
+func (l *rateLimiter) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l == nil {
+		http.Error(w, "Rate limiting is not configured", http.StatusNotFound)
+		return
+	}
+	l.mu.Lock()
+	status := l.peek(l.clientKey(r), time.Now())
+	l.mu.Unlock()
+
+	setRateLimitHeaders(w, status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// adminHandler serves GET /admin/quotas, the usage of every configured client and of the
+// bucket the others share
+func (l *rateLimiter) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l == nil {
+		http.Error(w, "Rate limiting is not configured", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	clients := make([]quotaStatus, 0, len(l.known)+1)
+	clients = append(clients, l.peek("", now))
+	for key := range l.known {
+		clients = append(clients, l.peek(key, now))
+	}
+	l.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Client < clients[j].Client })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clients": clients})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testRateLimiter(t *testing.T, tier rateLimitTier) *rateLimiter {
+	t.Helper()
+	l, err := compileRateLimits(rateLimitConfig{
+		DefaultTier: "test",
+		Tiers:       map[string]rateLimitTier{"test": tier},
+	})
+	if err != nil {
+		t.Fatalf("compileRateLimits: %v", err)
+	}
+	return l
+}
+
+func TestRateLimitTokenBucketRefill(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		tier       rateLimitTier
+		requests   []time.Duration // offsets from start
+		wantReason string          // of the last request
+		wantTokens float64         // after the last request
+	}{
+		{
+			name:       "burst is available at once",
+			tier:       rateLimitTier{Rate: 1, Burst: 3},
+			requests:   []time.Duration{0, 0, 0},
+			wantTokens: 0,
+		},
+		{
+			name:       "empty bucket rejects",
+			tier:       rateLimitTier{Rate: 1, Burst: 2},
+			requests:   []time.Duration{0, 0, 0},
+			wantReason: "rate",
+		},
+		{
+			name:       "refills at rate",
+			tier:       rateLimitTier{Rate: 2, Burst: 2},
+			requests:   []time.Duration{0, 0, 500 * time.Millisecond},
+			wantTokens: 0,
+		},
+		{
+			name:       "partial refill is not a token",
+			tier:       rateLimitTier{Rate: 1, Burst: 1},
+			requests:   []time.Duration{0, 900 * time.Millisecond},
+			wantReason: "rate",
+		},
+		{
+			name:       "refill is capped at burst",
+			tier:       rateLimitTier{Rate: 10, Burst: 3},
+			requests:   []time.Duration{0, time.Hour},
+			wantTokens: 2,
+		},
+		{
+			name:       "zero rate is unlimited",
+			tier:       rateLimitTier{},
+			requests:   []time.Duration{0, 0, 0, 0},
+			wantTokens: 0,
+		},
+		{
+			name:       "daily quota",
+			tier:       rateLimitTier{DailyQuota: 2},
+			requests:   []time.Duration{0, time.Second, 2 * time.Second},
+			wantReason: "quota",
+		},
+		{
+			name:       "daily quota resets at midnight UTC",
+			tier:       rateLimitTier{DailyQuota: 1},
+			requests:   []time.Duration{0, 12 * time.Hour},
+			wantTokens: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := testRateLimiter(t, tt.tier)
+			var status quotaStatus
+			var reason string
+			for _, offset := range tt.requests {
+				status, reason, _ = l.take("key", start.Add(offset))
+			}
+			if reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+			}
+			if tt.wantReason == "" && status.Tokens != tt.wantTokens {
+				t.Errorf("tokens = %v, want %v", status.Tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	l := testRateLimiter(t, rateLimitTier{Rate: 4, Burst: 1})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.take("key", now)
+
+	_, reason, retryAfter := l.take("key", now.Add(100*time.Millisecond))
+	if reason != "rate" {
+		t.Fatalf("reason = %q, want rate", reason)
+	}
+	// 0.4 tokens refilled, the rest takes 150ms at 4/s
+	if retryAfter != 150*time.Millisecond {
+		t.Errorf("retry after = %s, want 150ms", retryAfter)
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := testRateLimiter(t, rateLimitTier{Rate: 1, Burst: 1, DailyQuota: 10})
+
+	l.take("key", now)
+	l.refund("key", now, now)
+	status, reason, _ := l.take("key", now)
+	if reason != "" {
+		t.Fatalf("refunded request still charged: rejected by %s", reason)
+	}
+	if status.Used != 1 {
+		t.Errorf("used = %d, want 1", status.Used)
+	}
+
+	// A refund never fills the bucket past its burst
+	l.refund("key", now, now)
+	l.refund("key", now, now)
+	if status, _, _ = l.take("key", now); status.Tokens != 0 {
+		t.Errorf("tokens after refunds = %v, want 0", status.Tokens)
+	}
+}
+
+func TestRateLimitRefundAfterMidnight(t *testing.T) {
+	taken := time.Date(2026, 3, 1, 23, 59, 59, 0, time.UTC)
+	l := testRateLimiter(t, rateLimitTier{DailyQuota: 10})
+
+	l.take("key", taken)
+	next := taken.Add(2 * time.Second)
+	l.take("key", next)
+	l.refund("key", taken, next)
+	status, _, _ := l.take("key", next)
+	if status.Used != 2 {
+		t.Errorf("used = %d, want 2: the previous day's request was refunded from today", status.Used)
+	}
+}
+
+func TestRateLimitUnconfiguredCallersShareABucket(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l, err := compileRateLimits(rateLimitConfig{
+		DefaultTier: "free",
+		Tiers: map[string]rateLimitTier{
+			"free":     {Rate: 1, Burst: 2, DailyQuota: 3},
+			"standard": {Rate: 10, Burst: 10},
+		},
+		Clients: []rateLimitClient{{Name: "team-orders", Key: "team-orders-key", Tier: "standard"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Made-up keys and no key at all draw on the same bucket, so rotating keys buys nothing
+	for i, key := range []string{"made-up-1", "", "made-up-2"} {
+		status, reason, _ := l.take(key, now.Add(time.Duration(i)*time.Second))
+		if i < 2 && reason != "" {
+			t.Fatalf("request %d with %q rejected by %s", i, key, reason)
+		}
+		if status.Client != "anonymous" || status.Tier != "free" {
+			t.Errorf("%q charged to %s on %s, want anonymous on free", key, status.Client, status.Tier)
+		}
+	}
+	if status, reason, _ := l.take("made-up-3", now.Add(time.Hour)); reason != "quota" || status.Used != 3 {
+		t.Errorf("fourth unconfigured request: %s, used %d, want the shared quota of 3 spent", reason, status.Used)
+	}
+	if status, reason, _ := l.take("team-orders-key", now); reason != "" || status.Client != "team-orders" {
+		t.Errorf("configured key: %q, %s, want its own bucket", reason, status.Client)
+	}
+	if len(l.buckets) != 2 {
+		t.Errorf("%d buckets, want the shared one and team-orders", len(l.buckets))
+	}
+}
+
+func TestRateLimitQuotaHandlerDoesNotCreateBuckets(t *testing.T) {
+	l := testRateLimiter(t, rateLimitTier{Rate: 1, Burst: 5, DailyQuota: 10})
+	for _, key := range []string{"", "someone", "someone-else"} {
+		r := httptest.NewRequest("GET", "/quota", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		l.quotaHandler(w, r)
+		var status quotaStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Tokens != 5 || status.Remaining != 10 {
+			t.Errorf("%q: tokens %v, remaining %d, want a full bucket", key, status.Tokens, status.Remaining)
+		}
+	}
+	if len(l.buckets) != 0 {
+		t.Errorf("/quota created %d buckets", len(l.buckets))
+	}
+
+	// Once there is a bucket, /quota reports its usage without spending any
+	now := time.Now()
+	l.take("someone", now)
+	w := httptest.NewRecorder()
+	l.quotaHandler(w, httptest.NewRequest("GET", "/quota", nil))
+	var status quotaStatus
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.Used != 1 || l.buckets[""].used != 1 {
+		t.Errorf("used = %d, bucket %d, want 1 and 1", status.Used, l.buckets[""].used)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// pipelineStatus is served on GET /pipeline/{correlation_id}/status
+type pipelineStatus struct {
+	CorrelationID string    `json:"correlation_id"`
+	Status        string    `json:"status"`
+	Step          int       `json:"step"`
+	ErrorType     string    `json:"error_type,omitempty"`
+	EndToEndMs    int64     `json:"end_to_end_duration_ms,omitempty"`
+	AcceptedAt    time.Time `json:"accepted_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// statusStore keeps the status of the pipelines this instance accepted, until the oldest are
+// evicted. It lives in memory: a restart forgets them, and only the accepting instance
+// knows a pipeline, which is why the status URL points at its SERVICE_ADDRESS. The step that
+// ends a pipeline reports it with a POST to the same URL. Every change is also published on
+// the event streams.
+//
+//	PIPELINE_STATUS_MAX_ENTRIES  pipelines kept (default 10000)
+//	CALLBACK_ALLOWED_HOSTS       comma-separated hosts X-Callback-URL may point at; unset, any host
+type statusStore struct {
+	maxEntries int
+
+	mu    sync.Mutex
+	byID  map[string]*pipelineStatus
+	order []string // acceptance order, oldest first
+}
+
+var statuses = newStatusStore()
+
+func newStatusStore() *statusStore {
+	s := &statusStore{
+		maxEntries: pipeline.EnvInt("PIPELINE_STATUS_MAX_ENTRIES", 10000),
+		byID:       make(map[string]*pipelineStatus),
+	}
+	if s.maxEntries < 1 {
+		s.maxEntries = 1
+	}
+	return s
+}
+
+// statusURL is where the status of correlationID is served and reported
+func statusURL(correlationID string) string {
+	return serviceAddress + "/pipeline/" + url.PathEscape(correlationID) + "/status"
+}
+
+// eventsURL is the event stream of correlationID
+func eventsURL(correlationID string) string {
+	return serviceAddress + "/pipeline/" + url.PathEscape(correlationID) + "/events"
+}
+
+// accepted records a pipeline handed to the next step
+func (s *statusStore) accepted(correlationID string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events.publish(pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusAccepted,
+		Step:          1,
+		Service:       "service1",
+		Shard:         pipeline.ShardID,
+		Timestamp:     now,
+	})
+	if _, ok := s.byID[correlationID]; !ok {
+		s.order = append(s.order, correlationID)
+	}
+	s.byID[correlationID] = &pipelineStatus{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusAccepted,
+		Step:          1,
+		AcceptedAt:    now,
+		UpdatedAt:     now,
+	}
+	for len(s.byID) > s.maxEntries {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// failed records a pipeline that step1 could not hand to the next step
+func (s *statusStore) failed(correlationID, errorType string) {
+	now := time.Now()
+	s.report(pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusFailed,
+		Step:          1,
+		Service:       "service1",
+		ErrorType:     errorType,
+		Shard:         pipeline.ShardID,
+		Timestamp:     now,
+	}, now)
+}
+
+// report applies the event that ended a pipeline, false when the pipeline is unknown
+func (s *statusStore) report(event pipeline.Event, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.byID[event.CorrelationID]
+	if !ok {
+		return false
+	}
+	events.publish(event)
+	status.Status = event.Status
+	status.Step = event.Step
+	status.ErrorType = event.ErrorType
+	status.EndToEndMs = event.EndToEndMs
+	status.UpdatedAt = now
+	return true
+}
+
+func (s *statusStore) get(correlationID string) (pipelineStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.byID[correlationID]
+	if !ok {
+		return pipelineStatus{}, false
+	}
+	return *status, true
+}
+
+// pipelineHandler serves /pipeline/{correlation_id}/status and /pipeline/{correlation_id}/events
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	// Split on the escaped path: a correlation ID may contain a slash
+	escaped, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/pipeline/"), "/")
+	id, err := url.PathUnescape(escaped)
+	if err != nil || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch resource {
+	case "status":
+		statuses.handler(w, r, id)
+	case "events":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		events.stream(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handler serves the status of pipeline id: GET returns it, POST is the signed report of
+// the step that ended the pipeline
+func (s *statusStore) handler(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		status, ok := s.get(id)
+		if !ok {
+			http.Error(w, "Unknown pipeline", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case http.MethodPost:
+		s.reportHandler(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *statusStore) reportHandler(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Failed to read report", http.StatusBadRequest)
+		return
+	}
+	if err := pipeline.VerifySignature(pipeline.CallbackSecret, r.Header, body, time.Now()); err != nil {
+		pipeline.Metrics.Incr(pipeline.MetricStatusReportsRejected, pipeline.Tag("reason", "signature"))
+		pipeline.Logger.WarnContext(r.Context(), "Rejected status report",
+			"operation", "status_report",
+			"correlation.id", id,
+			"error", err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var event pipeline.Event
+	if err := json.Unmarshal(body, &event); err != nil || event.CorrelationID != id || !event.Terminal() {
+		pipeline.Metrics.Incr(pipeline.MetricStatusReportsRejected, pipeline.Tag("reason", "malformed"))
+		http.Error(w, "Malformed report", http.StatusBadRequest)
+		return
+	}
+	if !s.report(event, time.Now()) {
+		// Evicted or accepted before a restart
+		pipeline.Metrics.Incr(pipeline.MetricStatusReportsRejected, pipeline.Tag("reason", "unknown"))
+		http.Error(w, "Unknown pipeline", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// callbackAllowedHosts restricts X-Callback-URL to a list of hosts; empty allows any host
+// with a public address
+var callbackAllowedHosts = parseHostList(os.Getenv("CALLBACK_ALLOWED_HOSTS"))
+
+func parseHostList(list string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts[strings.ToLower(h)] = true
+		}
+	}
+	return hosts
+}
+
+// validateCallbackURL accepts absolute http(s) URLs to an allowed host, which must resolve to
+// public addresses so callers cannot point the pipeline at internal ones. Deliveries check
+// the address again when they connect.
+func validateCallbackURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https URL")
+	}
+	if len(callbackAllowedHosts) > 0 && !callbackAllowedHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("host %s is not allowed", u.Hostname())
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return pipeline.CheckCallbackHost(resolveCtx, u.Hostname())
+}
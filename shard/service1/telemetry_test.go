@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// testTelemetry propagates a trace as the x-test-trace and x-test-span carrier keys and
+// drops metrics
+type testTelemetry struct {
+	pipeline.TelemetryProvider
+}
+
+type testSpan struct {
+	name    string
+	traceID string
+	parent  string // name of the span it continues
+}
+
+// useTestTelemetry installs a testTelemetry for the duration of the test
+func useTestTelemetry(t *testing.T) {
+	t.Helper()
+	previousTelemetry, previousMetrics := pipeline.Telemetry, pipeline.Metrics
+	pipeline.Telemetry, pipeline.Metrics = testTelemetry{}, pipeline.NewMetrics("service1", "shard-test", "test", "test")
+	t.Cleanup(func() { pipeline.Telemetry, pipeline.Metrics = previousTelemetry, previousMetrics })
+}
+
+func (testTelemetry) StartSpan(ctx context.Context, operationName string) (pipeline.Span, context.Context) {
+	return &testSpan{name: operationName, traceID: "root"}, ctx
+}
+
+func (testTelemetry) StartSpanFromCarrier(operationName string, carrier map[string]string) (pipeline.Span, context.Context, error) {
+	if carrier["x-test-trace"] == "" {
+		return &testSpan{name: operationName, traceID: "root"}, context.Background(), errors.New("no trace context")
+	}
+	span := &testSpan{name: operationName, traceID: carrier["x-test-trace"], parent: carrier["x-test-span"]}
+	return span, context.Background(), nil
+}
+
+func (testTelemetry) SpanFromContext(context.Context) pipeline.Span { return nil }
+
+func (testTelemetry) Inject(span pipeline.Span, carrier map[string]string) error {
+	s := span.(*testSpan)
+	carrier["x-test-trace"], carrier["x-test-span"] = s.traceID, s.name
+	return nil
+}
+
+func (testTelemetry) Incr(string, []string)                  {}
+func (testTelemetry) Timing(string, time.Duration, []string) {}
+func (testTelemetry) Gauge(string, float64, []string)        {}
+
+func (s *testSpan) SetTag(string, interface{}) {}
+func (s *testSpan) StartChild(operationName string) pipeline.Span {
+	return &testSpan{name: operationName, traceID: s.traceID, parent: s.name}
+}
+func (s *testSpan) Finish()         {}
+func (s *testSpan) TraceID() string { return s.traceID }
+func (s *testSpan) SpanID() string  { return s.name }
@@ -6,27 +6,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
-	httptrace "github.com/DataDog/dd-trace-go/contrib/net/http/v2"
-	"github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
+
+	"pipeline-shard/internal/pipeline"
 )
 
-var sqsClient *sqs.Client
-var statsdClient *statsd.Client
 var inputQueueURL = "https://sqs.us-east-1.amazonaws.com/025775160945/service-queue-step1"
 var outputQueueURL = "https://sqs.us-east-1.amazonaws.com/025775160945/service-queue-step2"
 
 // Shard configuration
 var (
-	shardID     string
-	servicePort string
+	servicePort    string
+	serviceAddress string
 )
 
 // Helper function to safely get message ID
@@ -37,90 +35,147 @@ func getMessageID(msg types.Message) string {
 	return "unknown"
 }
 
-type PipelineMessage struct {
-	CorrelationID string `json:"correlation_id"`
-	Data          string `json:"data"`
-	Pipeline      struct {
-		StartTime     string `json:"start_time"`
-		Step1Complete string `json:"step1_complete,omitempty"`
-		Step2Complete string `json:"step2_complete,omitempty"`
-		CurrentStep   int    `json:"current_step"`
-	} `json:"pipeline"`
-	ErrorType string `json:"error_type,omitempty"`
-}
-
 func init() {
-	shardID = os.Getenv("SHARD_ID")
-	if shardID == "" {
-		shardID = "shard-default"
+	pipeline.ShardID = os.Getenv("SHARD_ID")
+	if pipeline.ShardID == "" {
+		pipeline.ShardID = "shard-default"
 	}
 
 	servicePort = os.Getenv("SERVICE2_PORT")
 	if servicePort == "" {
 		servicePort = "8081"
 	}
+
+	pipeline.ServiceVersion = os.Getenv("SERVICE_VERSION")
+	if pipeline.ServiceVersion == "" {
+		pipeline.ServiceVersion = "1.2.0"
+	}
+
+	// Per-shard queues, so a shard can be drained independently
+	if v := os.Getenv("STEP1_QUEUE_URL"); v != "" {
+		inputQueueURL = v
+	}
+	if v := os.Getenv("STEP2_QUEUE_URL"); v != "" {
+		outputQueueURL = v
+	}
+
+	// Address announced to the shard registry
+	serviceAddress = os.Getenv("SERVICE_ADDRESS")
+	if serviceAddress == "" {
+		serviceAddress = "http://localhost:" + servicePort
+	}
 }
 
 func main() {
-	tracer.Start(
-		tracer.WithService("service2"),
-		tracer.WithEnv("pipeline"),
-		tracer.WithServiceVersion("1.2.0"),
-		tracer.WithGlobalTag("shard", shardID),
-		tracer.WithGlobalTag("port", servicePort),
-	)
-	defer tracer.Stop()
-
-	log.SetFormatter(&log.JSONFormatter{})
-	logFileName := fmt.Sprintf("service2-%s.log", shardID)
-	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	var closeLogs func()
+	pipeline.Logger, closeLogs = pipeline.NewLogger("service2", fmt.Sprintf("service2-%s.log", pipeline.ShardID))
+	defer closeLogs()
+
+	redactConfigPath := os.Getenv("REDACT_CONFIG")
+	if redactConfigPath == "" {
+		redactConfigPath = "../redaction.json"
+	}
+	var err error
+	pipeline.Redaction, err = pipeline.NewRedactor(redactConfigPath)
 	if err != nil {
-		log.WithError(err).Warn("Failed to open log file, using stdout")
-	} else {
-		// Use defer for proper resource cleanup
-		defer func() {
-			if closeErr := logFile.Close(); closeErr != nil {
-				log.WithError(closeErr).Error("Failed to close log file")
-			}
-		}()
-		log.SetOutput(logFile)
+		pipeline.LogFatal("Failed to load redaction rules", "error", err)
 	}
 
-	statsdClient, err = statsd.New("127.0.0.1:8125")
+	pipeline.Telemetry, err = pipeline.NewTelemetry(pipeline.TelemetryConfig{
+		Service: "service2",
+		Env:     "pipeline",
+		Version: pipeline.ServiceVersion,
+		Tags:    map[string]string{"shard": pipeline.ShardID, "port": servicePort},
+	})
 	if err != nil {
-		log.WithError(err).Fatal("Failed to initialize StatsD client")
+		pipeline.LogFatal("Failed to initialize telemetry", "error", err)
 	}
-	// Use defer for proper resource cleanup
-	defer func() {
-		if closeErr := statsdClient.Close(); closeErr != nil {
-			log.WithError(closeErr).Error("Failed to close StatsD client")
-		}
-	}()
+	defer pipeline.Telemetry.Shutdown()
+
+	// Metrics are also exposed on /metrics for Prometheus scraping
+	promMetrics := pipeline.NewPrometheusMetrics()
+	pipeline.Telemetry = pipeline.WithPrometheus(pipeline.Telemetry, promMetrics)
+	pipeline.Metrics = pipeline.NewMetrics("service2", pipeline.ShardID, pipeline.ServiceVersion, "pipeline")
+
+	sloConfigPath := os.Getenv("SLO_CONFIG")
+	if sloConfigPath == "" {
+		sloConfigPath = "../slo.json"
+	}
+	pipeline.SLOs, err = pipeline.NewSLOEngine("service2", sloConfigPath)
+	if err != nil {
+		pipeline.LogFatal("Failed to load SLO definitions", "error", err)
+	}
+	if err := pipeline.ConfigureCallbacks(); err != nil {
+		pipeline.LogFatal("Failed to configure pipeline events", "error", err)
+	}
+	go pipeline.SLOs.EmitLoop(30 * time.Second)
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion("us-east-1"),
 		config.WithSharedConfigProfile("controlplane-pcsilva"))
 	if err != nil {
-		log.WithError(err).Fatal("Failed to load AWS configuration")
+		pipeline.LogFatal("Failed to load AWS configuration", "error", err)
 	}
-	sqsClient = sqs.NewFromConfig(cfg)
-
+	// Retries are left to the retry policies, see pipeline.RetryPolicy
+	pipeline.SQSClient = sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.RetryMaxAttempts = 1 })
+
+	pipeline.Limiter = pipeline.NewConcurrencyLimiter(inputQueueURL)
+	registry := pipeline.NewRegistryFromEnv()
+	instance := pipeline.ServiceInstance{
+		ID:         fmt.Sprintf("%s-service2-%s", pipeline.ShardID, servicePort),
+		Shard:      pipeline.ShardID,
+		Role:       "service2",
+		Address:    serviceAddress,
+		Version:    pipeline.ServiceVersion,
+		Queues:     map[string]string{"input": inputQueueURL, "output": outputQueueURL},
+		TTLSeconds: 15,
+	}
+	pipeline.Backlog = pipeline.NewBacklogMonitor(inputQueueURL, pipeline.Limiter.Current, registry, instance)
 	go consumeFromStep1()
 
-	mux := httptrace.NewServeMux()
-	mux.HandleFunc("/", homeHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", pipeline.WithOutcome("/", homeHandler))
+	mux.Handle("/metrics", promMetrics.Handler())
+	mux.HandleFunc("/admin/log-level", pipeline.LogLevelHandler)
+	mux.HandleFunc("/admin/scaling", pipeline.Backlog.Handler)
+	mux.HandleFunc("/admin/consumer", pipeline.ConsumerPauseHandler)
+	mux.HandleFunc("/slo", pipeline.SLOs.Handler)
+
+	fmt.Printf("Service2 running on :%s (shard: %s)\n", servicePort, pipeline.ShardID)
+	pipeline.Logger.Info("Service2 started", "port", servicePort)
 
-	fmt.Printf("Service2 running on :%s (shard: %s)\n", servicePort, shardID)
-	log.WithFields(log.Fields{
-		"service": "service2",
-		"shard":   shardID,
-		"port":    servicePort,
-	}).Info("Service2 started")
-	http.ListenAndServe(":"+servicePort, mux)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go pipeline.Backlog.Run(ctx)
+	go pipeline.Progress.Run(ctx)
+
+	registrationDone := make(chan struct{})
+	if registry != nil {
+		go func() {
+			defer close(registrationDone)
+			pipeline.KeepRegistered(ctx, registry, instance)
+		}()
+	} else {
+		close(registrationDone)
+	}
+
+	server := &http.Server{Addr: ":" + servicePort, Handler: pipeline.Telemetry.InstrumentHandler(mux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		pipeline.Logger.Error("HTTP server failed", "error", err)
+	}
+	stop()
+	<-registrationDone
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	span, _ := tracer.StartSpanFromContext(r.Context(), "http.request")
+	span, _ := pipeline.Telemetry.StartSpan(r.Context(), "http.request")
 	defer span.Finish()
 
 	correlationID := r.Header.Get("X-Correlation-ID")
@@ -128,89 +183,77 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		correlationID = uuid.New().String()
 	}
 
-	span.SetTag("shard", shardID)
+	span.SetTag("shard", pipeline.ShardID)
 	span.SetTag("service", "service2")
 	span.SetTag("service.name", "service2")
 	span.SetTag("service.port", servicePort)
 	span.SetTag("env", "pipeline")
 	span.SetTag("correlation.id", correlationID)
 
-	// SLI Metrics for health endpoint
-	statsdClient.Incr("sli.requests.total", []string{
-		"service:service2",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-	statsdClient.Incr("sli.requests.success", []string{
-		"service:service2",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-
+	circuit := pipeline.SQSSendBreaker.Status()
 	response := map[string]interface{}{
 		"message":        "Service2 - Pipeline Step2 Processor",
 		"correlation_id": correlationID,
 		"service":        "service2",
+		"status":         "ok",
+		"circuits":       map[string]pipeline.BreakerStatus{"sqs_send": circuit},
+	}
+	if circuit.State != pipeline.BreakerClosed {
+		response["status"] = "degraded"
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
 func consumeFromStep1() {
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		result, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-			QueueUrl:              &inputQueueURL,
-			MaxNumberOfMessages:   1,
-			WaitTimeSeconds:       20,
-			MessageAttributeNames: []string{"All"},
-		})
-		cancel() // Always cancel context to free resources
-
+		messages, err := pipeline.ReceiveMessages(inputQueueURL)
 		if err != nil {
-			// Log SQS receive errors with context
-			log.WithFields(log.Fields{
-				"service":   "service2",
-				"operation": "sqs_receive",
-				"shard":     shardID,
-				"queue.url": inputQueueURL,
-			}).WithError(err).Error("Failed to receive messages from SQS, retrying...")
-
-			statsdClient.Incr("business.pipeline.errors.sqs.receive", []string{"service:service2"}, 1)
-			// Brief pause before retry to avoid tight loop
-			time.Sleep(5 * time.Second)
+			// Only errors that are not worth retrying get here, e.g. a missing queue or permission
+			pipeline.Logger.Error("Failed to receive messages from SQS",
+				"operation", "sqs_receive",
+				"queue.url", inputQueueURL,
+				"error", err)
+
+			pipeline.Metrics.Incr(pipeline.MetricErrorsSQSReceive)
+			time.Sleep(pipeline.SQSReceiveRetry.MaxDelay)
 			continue
 		}
 
-		for _, msg := range result.Messages {
-			processStep2Message(msg)
+		if len(messages) == 0 {
+			continue
 		}
+		pipeline.Metrics.Gauge(pipeline.MetricBatchSize, float64(len(messages)))
+		var batchSpan pipeline.Span
+		if len(messages) > 1 {
+			batchSpan = pipeline.StartBatchSpan("sqs.receive_batch", messages)
+			batchSpan.SetTag("messaging.destination", "service-queue-step1")
+		}
+		pipeline.DispatchBatch(messages, batchSpan, func(msg types.Message) pipeline.Outcome {
+			return pipeline.ProcessWithOutcome("message_processing", func(ctx context.Context) {
+				processStep2Message(ctx, msg)
+			})
+		})
 	}
 }
 
-func processStep2Message(msg types.Message) {
+func processStep2Message(ctx context.Context, msg types.Message) {
 	step2Start := time.Now()
-	var message PipelineMessage
+	var message pipeline.PipelineMessage
 
 	// Parse message body with error handling
 	if err := json.Unmarshal([]byte(*msg.Body), &message); err != nil {
-		log.WithFields(log.Fields{
-			"service":    "service2",
-			"operation":  "json_unmarshal",
-			"shard":      shardID,
-			"message.id": getMessageID(msg),
-			"queue.url":  inputQueueURL,
-		}).WithError(err).Error("Failed to unmarshal pipeline message, skipping")
+		pipeline.Logger.ErrorContext(ctx, "Failed to unmarshal pipeline message, skipping",
+			"operation", "json_unmarshal",
+			"message.id", getMessageID(msg),
+			"queue.url", inputQueueURL,
+			"error", err)
 
-		statsdClient.Incr("business.pipeline.errors.json.unmarshal", []string{"service:service2"}, 1)
+		pipeline.Metrics.Incr(pipeline.MetricErrorsJSONUnmarshal)
+		pipeline.Classify(ctx, pipeline.OutcomeClientError, "malformed_message")
 
 		// Delete malformed message to prevent infinite reprocessing
-		if _, delErr := sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-			QueueUrl:      &inputQueueURL,
-			ReceiptHandle: msg.ReceiptHandle,
-		}); delErr != nil {
-			log.WithError(delErr).Error("Failed to delete malformed message")
+		if delErr := pipeline.DeleteMessage(ctx, inputQueueURL, msg); delErr != nil {
+			pipeline.Logger.ErrorContext(ctx, "Failed to delete malformed message", "error", delErr)
 		}
 		return
 	}
@@ -220,28 +263,14 @@ func processStep2Message(msg types.Message) {
 		correlationID = uuid.New().String()
 	}
 
-	// Extract trace context from SQS message attributes
-	carrier := make(map[string]string)
-	for key, attr := range msg.MessageAttributes {
-		if attr.StringValue != nil {
-			carrier[key] = *attr.StringValue
-		}
-	}
-
-	// Extract span context and create child span
-	spanCtx, err := tracer.Extract(tracer.TextMapCarrier(carrier))
-	var span *tracer.Span
-	if err != nil {
-		// Trace extraction failed, start new span
-		span, _ = tracer.StartSpanFromContext(context.Background(), "sqs.receive")
-		log.WithFields(log.Fields{
-			"correlation.id": correlationID,
-			"service":        "service2",
-			"shard":          shardID,
-			"operation":      "trace_extract",
-		}).WithError(err).Debug("Failed to extract trace context, starting new span")
-	} else {
-		span = tracer.StartSpan("sqs.receive", tracer.ChildOf(spanCtx))
+	// Continue the producer's trace from the SQS message attributes
+	span, spanCtx, orphaned := pipeline.StartMessageSpan("sqs.receive", "service-queue-step1", msg)
+	// ctx carries the outcome of the message, logCtx the span and pipeline fields for logging
+	logCtx := pipeline.WithLogContext(spanCtx, correlationID, 2)
+	if orphaned {
+		pipeline.Logger.DebugContext(logCtx, "No trace context in message, started a new trace",
+			"operation", "trace_extract",
+			"message.id", getMessageID(msg))
 	}
 	defer span.Finish()
 
@@ -250,7 +279,7 @@ func processStep2Message(msg types.Message) {
 	span.SetTag("messaging.system", "sqs")
 	span.SetTag("messaging.destination", "service-queue-step1")
 	span.SetTag("messaging.operation", "receive")
-	span.SetTag("shard", shardID)
+	span.SetTag("shard", pipeline.ShardID)
 	span.SetTag("service", "service2")
 	span.SetTag("service.name", "service2")
 	span.SetTag("service.port", servicePort)
@@ -260,50 +289,62 @@ func processStep2Message(msg types.Message) {
 	span.SetTag("aws.service", "sqs")
 	span.SetTag("aws.operation", "ReceiveMessage")
 
+	pipeline.Progress.Publish(message, pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusStepStarted,
+		Step:          2,
+		Service:       "service2",
+		Shard:         pipeline.ShardID,
+		StartTime:     message.Pipeline.StartTime,
+		Timestamp:     step2Start,
+	})
+
 	// Calculate step1 to step2 duration
 	if step1Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step1Complete); err == nil {
 		step1ToStep2Duration := step2Start.Sub(step1Time)
-		statsdClient.Timing("business.pipeline.step1_to_step2.duration", step1ToStep2Duration, []string{"service:service2"}, 1)
+		pipeline.Metrics.Timing(pipeline.MetricStep1ToStep2Duration, step1ToStep2Duration)
 	}
 
 	// Check for errors from step1 or inject new errors
 	processingFailed := message.ErrorType == "invalid_data"
 	if processingFailed {
-		statsdClient.Incr("business.pipeline.errors.step2", []string{"service:service2", "type:inherited"}, 1)
+		pipeline.Metrics.Incr(pipeline.MetricErrorsStep2, pipeline.Tag("type", "inherited"))
 		span.SetTag("error.inherited", true)
 		span.SetTag("error", true)
 		span.SetTag("error.msg", fmt.Sprintf("inherited error from step1: %s", message.ErrorType))
 		span.SetTag("error.type", "BusinessLogicError")
 
 		// Log detailed error information
-		log.WithFields(log.Fields{
-			"dd.trace_id":    span.Context().TraceID(),
-			"correlation.id": correlationID,
-			"service":        "service2",
-			"shard":          shardID,
-			"pipeline.step":  2,
-			"error.type":     message.ErrorType,
-			"error.source":   "step1",
-			"message.data":   message.Data,
-			"action":         "skipping_step2_processing",
-		}).Error("Step2 processing failed - inherited error from step1, message will not be forwarded to step3")
+		pipeline.Logger.ErrorContext(logCtx, "Step2 processing failed - inherited error from step1, forwarding only its result to step3",
+			"error.type", message.ErrorType,
+			"error.source", "step1",
+			"message.data", message.Data,
+			"action", "skipping_step2_processing")
+
+		// service3 records the results of failed pipelines too; until it has this one, the
+		// message stays on the queue
+		message.FailedStep = 2
+		if !sendToStep3(ctx, logCtx, span, message, correlationID) {
+			return
+		}
 
 		// Delete message from queue to prevent reprocessing
-		if _, err := sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-			QueueUrl:      &inputQueueURL,
-			ReceiptHandle: msg.ReceiptHandle,
-		}); err != nil {
-			log.WithFields(log.Fields{
-				"correlation.id": correlationID,
-				"error":          err.Error(),
-			}).Error("Failed to delete failed message from step1 queue")
+		if err := pipeline.DeleteMessage(logCtx, inputQueueURL, msg); err != nil {
+			pipeline.Logger.ErrorContext(logCtx, "Failed to delete failed message from step1 queue", "error", err)
 		}
 
-		// SLI Error Metrics
-		statsdClient.Incr("sli.processing.total", []string{"service:service2", "operation:message_processing"}, 1)
-		statsdClient.Incr("sli.processing.error", []string{"service:service2", "operation:message_processing", "error_type:inherited_error"}, 1)
-
-		statsdClient.Incr("business.pipeline.failed.step2", []string{"service:service2"}, 1)
+		pipeline.Classify(ctx, pipeline.OutcomeBusinessError, "inherited_error")
+		pipeline.Metrics.Incr(pipeline.MetricFailedStep2)
+		pipeline.NotifyEvent(logCtx, message, pipeline.Event{
+			CorrelationID: correlationID,
+			Status:        pipeline.StatusFailed,
+			Step:          2,
+			Service:       "service2",
+			ErrorType:     message.ErrorType,
+			Shard:         pipeline.ShardID,
+			StartTime:     message.Pipeline.StartTime,
+			Timestamp:     time.Now(),
+		})
 		return
 	}
 
@@ -316,31 +357,46 @@ func processStep2Message(msg types.Message) {
 	message.Pipeline.Step2Complete = time.Now().Format(time.RFC3339Nano)
 	message.Pipeline.CurrentStep = 2
 
-	// SLI Metrics for SLO tracking
-	statsdClient.Incr("sli.processing.total", []string{"service:service2", "operation:message_processing"}, 1)
-	statsdClient.Incr("sli.processing.success", []string{"service:service2", "operation:message_processing"}, 1)
-	if step2Duration <= 50*time.Millisecond {
-		statsdClient.Incr("sli.latency.under_50ms", []string{"service:service2"}, 1)
+	// Business Metrics
+	pipeline.Metrics.Timing(pipeline.MetricStep2Duration, step2Duration)
+	pipeline.Metrics.Incr(pipeline.MetricMessagesStep2)
+	pipeline.Metrics.Timing(pipeline.MetricPipelineDuration, step2Duration, pipeline.Tag("step", "2"))
+
+	if !sendToStep3(ctx, logCtx, span, message, correlationID) {
+		return
 	}
-	statsdClient.Timing("sli.processing_time", step2Duration, []string{"service:service2", "operation:message_processing"}, 1)
 
-	// Business Metrics
-	statsdClient.Timing("business.pipeline.step2.duration", step2Duration, []string{"service:service2"}, 1)
-	statsdClient.Incr("business.pipeline.messages.step2", []string{"service:service2"}, 1)
-	statsdClient.Timing("sli.pipeline.duration", step2Duration, []string{
-		"service:service2",
-		"shard:" + shardID,
-		"step:2",
-	}, 1)
+	// Delete from step1 queue
+	if err := pipeline.DeleteMessage(logCtx, inputQueueURL, msg); err != nil {
+		pipeline.Logger.ErrorContext(logCtx, "Failed to delete processed message from step1 queue", "error", err)
+	}
+
+	pipeline.Progress.Publish(message, pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusStepCompleted,
+		Step:          2,
+		Service:       "service2",
+		Shard:         pipeline.ShardID,
+		StartTime:     message.Pipeline.StartTime,
+		DurationMs:    step2Duration.Milliseconds(),
+		Timestamp:     time.Now(),
+	})
 
+	pipeline.Logger.InfoContext(logCtx, "Step2 completed, message sent to step3",
+		"step2_duration", step2Duration.Milliseconds())
+}
+
+// sendToStep3 sends message to the step3 queue, continuing the trace of span. A failure is
+// logged and classified on ctx, and the caller leaves the message to be redelivered.
+func sendToStep3(ctx, logCtx context.Context, span pipeline.Span, message pipeline.PipelineMessage, correlationID string) bool {
 	// Send to step3 queue with proper trace propagation
-	sqsSendSpan := tracer.StartSpan("sqs.send", tracer.ChildOf(span.Context()))
+	sqsSendSpan := span.StartChild("sqs.send")
 	defer sqsSendSpan.Finish()
 
 	sqsSendSpan.SetTag("span.kind", "producer")
 	sqsSendSpan.SetTag("messaging.system", "sqs")
 	sqsSendSpan.SetTag("messaging.destination", "service-queue-step2")
-	sqsSendSpan.SetTag("shard", shardID)
+	sqsSendSpan.SetTag("shard", pipeline.ShardID)
 	sqsSendSpan.SetTag("service.name", "service2")
 	sqsSendSpan.SetTag("service.port", servicePort)
 	sqsSendSpan.SetTag("correlation.id", correlationID)
@@ -349,14 +405,11 @@ func processStep2Message(msg types.Message) {
 
 	// Inject trace context for Service3
 	carrierOut := make(map[string]string)
-	if err := tracer.Inject(sqsSendSpan.Context(), tracer.TextMapCarrier(carrierOut)); err != nil {
+	if err := pipeline.Telemetry.Inject(sqsSendSpan, carrierOut); err != nil {
 		// Tracing injection failure is not critical, log and continue
-		log.WithFields(log.Fields{
-			"correlation.id": correlationID,
-			"service":        "service2",
-			"shard":          shardID,
-			"operation":      "trace_inject",
-		}).WithError(err).Debug("Failed to inject trace context, continuing without tracing")
+		pipeline.Logger.DebugContext(logCtx, "Failed to inject trace context, continuing without tracing",
+			"operation", "trace_inject",
+			"error", err)
 	}
 
 	// Convert carrier to SQS message attributes
@@ -381,25 +434,26 @@ func processStep2Message(msg types.Message) {
 		sqsSendSpan.SetTag("error.type", fmt.Sprintf("%T", err))
 		span.SetTag("error", true)
 		span.SetTag("error.msg", err.Error())
-		log.WithFields(log.Fields{
-			"dd.trace_id":    span.Context().TraceID(),
-			"correlation.id": correlationID,
-			"service":        "service2",
-			"shard":          shardID,
-			"pipeline.step":  2,
-			"operation":      "json_marshal",
-		}).WithError(err).Error("Failed to marshal message for step3")
-		return
+		pipeline.Logger.ErrorContext(logCtx, "Failed to marshal message for step3",
+			"operation", "json_marshal",
+			"error", err)
+		pipeline.Classify(ctx, pipeline.OutcomeServerError, "marshal_failure")
+		return false
 	}
 
-	// Send message to step3 queue
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:          &outputQueueURL,
-		MessageBody:       &[]string{string(msgBody)}[0],
-		MessageAttributes: msgAttrs,
+	// Send message to step3 queue, retrying throttling and transient failures
+	// and failing fast while the circuit is open
+	err = pipeline.SQSSendRetry.Do(logCtx, func(ctx context.Context) error {
+		return pipeline.SQSSendBreaker.Do(ctx, func(ctx context.Context) error {
+			attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			_, err := pipeline.SQSClient.SendMessage(attemptCtx, &sqs.SendMessageInput{
+				QueueUrl:          &outputQueueURL,
+				MessageBody:       &[]string{string(msgBody)}[0],
+				MessageAttributes: msgAttrs,
+			})
+			return err
+		})
 	})
 
 	if err != nil {
@@ -408,41 +462,14 @@ func processStep2Message(msg types.Message) {
 		sqsSendSpan.SetTag("error.type", fmt.Sprintf("%T", err))
 		span.SetTag("error", true)
 		span.SetTag("error.msg", err.Error())
-		log.WithFields(log.Fields{
-			"dd.trace_id":    span.Context().TraceID(),
-			"correlation.id": correlationID,
-			"service":        "service2",
-			"shard":          shardID,
-			"pipeline.step":  2,
-			"operation":      "sqs_send",
-			"queue.url":      outputQueueURL,
-		}).WithError(err).Error("Failed to send message to step3 queue")
-
-		// SLI Error Metrics
-		statsdClient.Incr("sli.processing.total", []string{"service:service2", "operation:message_processing"}, 1)
-		statsdClient.Incr("sli.processing.error", []string{"service:service2", "operation:message_processing", "error_type:sqs_send_failure"}, 1)
-
-		statsdClient.Incr("business.pipeline.errors.sqs.send", []string{"service:service2"}, 1)
-		return
+		pipeline.Logger.ErrorContext(logCtx, "Failed to send message to step3 queue",
+			"operation", "sqs_send",
+			"queue.url", outputQueueURL,
+			"error", err)
+
+		pipeline.Classify(ctx, pipeline.OutcomeDependencyError, "sqs_send_failure")
+		pipeline.Metrics.Incr(pipeline.MetricErrorsSQSSend)
+		return false
 	}
-
-	// Delete from step1 queue
-	if _, err := sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      &inputQueueURL,
-		ReceiptHandle: msg.ReceiptHandle,
-	}); err != nil {
-		log.WithFields(log.Fields{
-			"correlation.id": correlationID,
-			"error":          err.Error(),
-		}).Error("Failed to delete processed message from step1 queue")
-	}
-
-	log.WithFields(log.Fields{
-		"dd.trace_id":    span.Context().TraceID(),
-		"correlation.id": correlationID,
-		"service":        "service2",
-		"shard":          shardID,
-		"pipeline.step":  2,
-		"step2_duration": step2Duration.Milliseconds(),
-	}).Info("Step2 completed, message sent to step3")
+	return true
 }
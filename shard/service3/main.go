@@ -6,76 +6,97 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/DataDog/datadog-go/statsd"
-	httptrace "github.com/DataDog/dd-trace-go/contrib/net/http/v2"
-	"github.com/DataDog/dd-trace-go/v2/ddtrace/tracer"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
+
+	"pipeline-shard/internal/pipeline"
 )
 
-var sqsClient *sqs.Client
-var statsdClient *statsd.Client
 var queueURL = "https://sqs.us-east-1.amazonaws.com/025775160945/service-queue-step2"
 
 // Shard configuration
 var (
-	shardID     string
-	servicePort string
+	servicePort    string
+	serviceAddress string
 )
 
-type PipelineMessage struct {
-	CorrelationID string `json:"correlation_id"`
-	Data          string `json:"data"`
-	Pipeline      struct {
-		StartTime     string `json:"start_time"`
-		Step1Complete string `json:"step1_complete,omitempty"`
-		Step2Complete string `json:"step2_complete,omitempty"`
-		CurrentStep   int    `json:"current_step"`
-	} `json:"pipeline"`
-	ErrorType string `json:"error_type,omitempty"`
-}
-
 func init() {
-	shardID = os.Getenv("SHARD_ID")
-	if shardID == "" {
-		shardID = "shard-default"
+	pipeline.ShardID = os.Getenv("SHARD_ID")
+	if pipeline.ShardID == "" {
+		pipeline.ShardID = "shard-default"
 	}
 
 	servicePort = os.Getenv("SERVICE3_PORT")
 	if servicePort == "" {
 		servicePort = "8082"
 	}
+
+	pipeline.ServiceVersion = os.Getenv("SERVICE_VERSION")
+	if pipeline.ServiceVersion == "" {
+		pipeline.ServiceVersion = "1.2.0"
+	}
+
+	// Per-shard queues, so a shard can be drained independently
+	if v := os.Getenv("STEP2_QUEUE_URL"); v != "" {
+		queueURL = v
+	}
+
+	// Address announced to the shard registry
+	serviceAddress = os.Getenv("SERVICE_ADDRESS")
+	if serviceAddress == "" {
+		serviceAddress = "http://localhost:" + servicePort
+	}
 }
 
 func main() {
-	tracer.Start(
-		tracer.WithService("service3"),
-		tracer.WithEnv("pipeline"),
-		tracer.WithServiceVersion("1.2.0"),
-		tracer.WithGlobalTag("shard", shardID),
-		tracer.WithGlobalTag("port", servicePort),
-	)
-	defer tracer.Stop()
-
-	log.SetFormatter(&log.JSONFormatter{})
-	if logFile, err := os.OpenFile("service3.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err == nil {
-		defer logFile.Close()
-		log.SetOutput(logFile)
-	} else {
-		log.WithError(err).Warn("Failed to open log file, using stdout")
-	}
+	var closeLogs func()
+	pipeline.Logger, closeLogs = pipeline.NewLogger("service3", "service3.log")
+	defer closeLogs()
 
+	redactConfigPath := os.Getenv("REDACT_CONFIG")
+	if redactConfigPath == "" {
+		redactConfigPath = "../redaction.json"
+	}
 	var err error
-	statsdClient, err = statsd.New("127.0.0.1:8125")
+	pipeline.Redaction, err = pipeline.NewRedactor(redactConfigPath)
+	if err != nil {
+		pipeline.LogFatal("Failed to load redaction rules", "error", err)
+	}
+
+	pipeline.Telemetry, err = pipeline.NewTelemetry(pipeline.TelemetryConfig{
+		Service: "service3",
+		Env:     "pipeline",
+		Version: pipeline.ServiceVersion,
+		Tags:    map[string]string{"shard": pipeline.ShardID, "port": servicePort},
+	})
+	if err != nil {
+		pipeline.LogFatal("Failed to initialize telemetry", "error", err)
+	}
+	defer pipeline.Telemetry.Shutdown()
+
+	// Metrics are also exposed on /metrics for Prometheus scraping
+	promMetrics := pipeline.NewPrometheusMetrics()
+	pipeline.Telemetry = pipeline.WithPrometheus(pipeline.Telemetry, promMetrics)
+	pipeline.Metrics = pipeline.NewMetrics("service3", pipeline.ShardID, pipeline.ServiceVersion, "pipeline")
+
+	sloConfigPath := os.Getenv("SLO_CONFIG")
+	if sloConfigPath == "" {
+		sloConfigPath = "../slo.json"
+	}
+	pipeline.SLOs, err = pipeline.NewSLOEngine("service3", sloConfigPath)
 	if err != nil {
-		log.Fatal(err)
+		pipeline.LogFatal("Failed to load SLO definitions", "error", err)
+	}
+	if err := pipeline.ConfigureCallbacks(); err != nil {
+		pipeline.LogFatal("Failed to configure pipeline events", "error", err)
 	}
-	defer statsdClient.Close()
+	go pipeline.SLOs.EmitLoop(30 * time.Second)
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion("us-east-1"),
@@ -83,24 +104,76 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	sqsClient = sqs.NewFromConfig(cfg)
+	// Retries are left to the retry policies, see pipeline.RetryPolicy
+	pipeline.SQSClient = sqs.NewFromConfig(cfg, func(o *sqs.Options) { o.RetryMaxAttempts = 1 })
+
+	results, err = newResultStore()
+	if err != nil {
+		pipeline.LogFatal("Failed to open the results store", "error", err)
+	}
+	if results != nil {
+		defer results.Close()
+	}
 
+	pipeline.Limiter = pipeline.NewConcurrencyLimiter(queueURL)
+	registry := pipeline.NewRegistryFromEnv()
+	instance := pipeline.ServiceInstance{
+		ID:         fmt.Sprintf("%s-service3-%s", pipeline.ShardID, servicePort),
+		Shard:      pipeline.ShardID,
+		Role:       "service3",
+		Address:    serviceAddress,
+		Version:    pipeline.ServiceVersion,
+		Queues:     map[string]string{"input": queueURL},
+		TTLSeconds: 15,
+	}
+	pipeline.Backlog = pipeline.NewBacklogMonitor(queueURL, pipeline.Limiter.Current, registry, instance)
 	go consumeFromStep2()
 
-	mux := httptrace.NewServeMux()
-	mux.HandleFunc("/", homeHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", pipeline.WithOutcome("/", homeHandler))
+	mux.Handle("/metrics", promMetrics.Handler())
+	mux.HandleFunc("/admin/log-level", pipeline.LogLevelHandler)
+	mux.HandleFunc("/admin/scaling", pipeline.Backlog.Handler)
+	mux.HandleFunc("/admin/consumer", pipeline.ConsumerPauseHandler)
+	mux.HandleFunc("/slo", pipeline.SLOs.Handler)
+	mux.HandleFunc("/results", resultsHandler)
+
+	fmt.Printf("Service3 running on :%s (shard: %s)\n", servicePort, pipeline.ShardID)
+	pipeline.Logger.Info("Service3 started", "port", servicePort)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go pipeline.Backlog.Run(ctx)
+	go pipeline.Progress.Run(ctx)
+	go purgeResults(ctx)
+
+	registrationDone := make(chan struct{})
+	if registry != nil {
+		go func() {
+			defer close(registrationDone)
+			pipeline.KeepRegistered(ctx, registry, instance)
+		}()
+	} else {
+		close(registrationDone)
+	}
 
-	fmt.Printf("Service3 running on :%s (shard: %s)\n", servicePort, shardID)
-	log.WithFields(log.Fields{
-		"service": "service3",
-		"shard":   shardID,
-		"port":    servicePort,
-	}).Info("Service3 started")
-	http.ListenAndServe(":"+servicePort, mux)
+	server := &http.Server{Addr: ":" + servicePort, Handler: pipeline.Telemetry.InstrumentHandler(mux)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		pipeline.Logger.Error("HTTP server failed", "error", err)
+	}
+	stop()
+	<-registrationDone
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	span, _ := tracer.StartSpanFromContext(r.Context(), "http.request")
+	span, _ := pipeline.Telemetry.StartSpan(r.Context(), "http.request")
 	defer span.Finish()
 
 	correlationID := r.Header.Get("X-Correlation-ID")
@@ -108,27 +181,13 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		correlationID = uuid.New().String()
 	}
 
-	span.SetTag("shard", shardID)
+	span.SetTag("shard", pipeline.ShardID)
 	span.SetTag("service", "service3")
 	span.SetTag("service.name", "service3")
 	span.SetTag("service.port", servicePort)
 	span.SetTag("env", "pipeline")
 	span.SetTag("correlation.id", correlationID)
 
-	// SLI Metrics for health endpoint
-	statsdClient.Incr("sli.requests.total", []string{
-		"service:service3",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-	statsdClient.Incr("sli.requests.success", []string{
-		"service:service3",
-		"shard:" + shardID,
-		"port:" + servicePort,
-		"endpoint:/",
-	}, 1)
-
 	response := map[string]interface{}{
 		"message":        "Service3 - Pipeline Final Step",
 		"correlation_id": correlationID,
@@ -139,34 +198,46 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 
 func consumeFromStep2() {
 	for {
-		result, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
-			QueueUrl:              &queueURL,
-			MaxNumberOfMessages:   1,
-			WaitTimeSeconds:       20,
-			MessageAttributeNames: []string{"All"},
-		})
-
+		messages, err := pipeline.ReceiveMessages(queueURL)
 		if err != nil {
+			// Only errors that are not worth retrying get here, e.g. a missing queue or permission
+			pipeline.Logger.Error("Failed to receive messages from SQS",
+				"operation", "sqs_receive",
+				"queue.url", queueURL,
+				"error", err)
+
+			pipeline.Metrics.Incr(pipeline.MetricErrorsSQSReceive)
+			time.Sleep(pipeline.SQSReceiveRetry.MaxDelay)
 			continue
 		}
 
-		for _, msg := range result.Messages {
-			processStep3Message(msg)
+		if len(messages) == 0 {
+			continue
 		}
+		pipeline.Metrics.Gauge(pipeline.MetricBatchSize, float64(len(messages)))
+		var batchSpan pipeline.Span
+		if len(messages) > 1 {
+			batchSpan = pipeline.StartBatchSpan("sqs.receive_batch", messages)
+			batchSpan.SetTag("messaging.destination", "service-queue-step2")
+		}
+		pipeline.DispatchBatch(messages, batchSpan, func(msg types.Message) pipeline.Outcome {
+			return pipeline.ProcessWithOutcome("final_processing", func(ctx context.Context) {
+				processStep3Message(ctx, msg)
+			})
+		})
 	}
 }
 
-func processStep3Message(msg types.Message) {
+func processStep3Message(ctx context.Context, msg types.Message) {
 	step3Start := time.Now()
-	var message PipelineMessage
+	var message pipeline.PipelineMessage
 	if err := json.Unmarshal([]byte(*msg.Body), &message); err != nil {
-		log.WithFields(log.Fields{
-			"service":                "service3",
-			"shard":                  shardID,
-			"operation":              "json_unmarshal",
-			"queue.url":              queueURL,
-			"processing_duration_ms": time.Since(step3Start).Milliseconds(),
-		}).WithError(err).Error("Failed to unmarshal pipeline message, skipping")
+		pipeline.Logger.ErrorContext(ctx, "Failed to unmarshal pipeline message, skipping",
+			"operation", "json_unmarshal",
+			"queue.url", queueURL,
+			"processing_duration_ms", time.Since(step3Start).Milliseconds(),
+			"error", err)
+		pipeline.Classify(ctx, pipeline.OutcomeClientError, "malformed_message")
 		return
 	}
 
@@ -175,28 +246,14 @@ func processStep3Message(msg types.Message) {
 		correlationID = uuid.New().String()
 	}
 
-	// Extract trace context from SQS message attributes
-	carrier := make(map[string]string)
-	for key, attr := range msg.MessageAttributes {
-		if attr.StringValue != nil {
-			carrier[key] = *attr.StringValue
-		}
-	}
-
-	// Extract span context and create child span
-	spanCtx, err := tracer.Extract(tracer.TextMapCarrier(carrier))
-	var span *tracer.Span
-	if err != nil {
-		span, _ = tracer.StartSpanFromContext(context.Background(), "sqs.receive")
-		log.WithFields(log.Fields{
-			"correlation.id":         correlationID,
-			"service":                "service3",
-			"shard":                  shardID,
-			"operation":              "trace_extract",
-			"processing_duration_ms": time.Since(step3Start).Milliseconds(),
-		}).WithError(err).Debug("Failed to extract trace context, starting new span")
-	} else {
-		span = tracer.StartSpan("sqs.receive", tracer.ChildOf(spanCtx))
+	// Continue the producer's trace from the SQS message attributes
+	span, spanCtx, orphaned := pipeline.StartMessageSpan("sqs.receive", "service-queue-step2", msg)
+	// ctx carries the outcome of the message, logCtx the span and pipeline fields for logging
+	logCtx := pipeline.WithLogContext(spanCtx, correlationID, 3)
+	if orphaned {
+		pipeline.Logger.DebugContext(logCtx, "No trace context in message, started a new trace",
+			"operation", "trace_extract",
+			"processing_duration_ms", time.Since(step3Start).Milliseconds())
 	}
 	defer span.Finish()
 
@@ -205,7 +262,7 @@ func processStep3Message(msg types.Message) {
 	span.SetTag("messaging.system", "sqs")
 	span.SetTag("messaging.destination", "service-queue-step2")
 	span.SetTag("messaging.operation", "receive")
-	span.SetTag("shard", shardID)
+	span.SetTag("shard", pipeline.ShardID)
 	span.SetTag("service", "service3")
 	span.SetTag("service.name", "service3")
 	span.SetTag("service.port", servicePort)
@@ -215,149 +272,171 @@ func processStep3Message(msg types.Message) {
 	span.SetTag("aws.service", "sqs")
 	span.SetTag("aws.operation", "ReceiveMessage")
 
+	if message.FailedStep != 0 {
+		recordFailedPipeline(ctx, logCtx, span, msg, message, correlationID)
+		return
+	}
+
+	pipeline.Progress.Publish(message, pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusStepStarted,
+		Step:          3,
+		Service:       "service3",
+		Shard:         pipeline.ShardID,
+		StartTime:     message.Pipeline.StartTime,
+		Timestamp:     step3Start,
+	})
+
 	// Calculate step2 to step3 duration
 	if step2Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step2Complete); err == nil {
 		step2ToStep3Duration := step3Start.Sub(step2Time)
-		statsdClient.Timing("business.pipeline.step2_to_step3.duration", step2ToStep3Duration, []string{
-			"service:service3",
-			"shard:" + shardID,
-		}, 1)
+		pipeline.Metrics.Timing(pipeline.MetricStep2ToStep3Duration, step2ToStep3Duration)
 	}
 
 	// Step3 processing simulation
 	time.Sleep(40 * time.Millisecond)
 	step3Duration := time.Since(step3Start)
 
+	// Calculate individual step durations for the result and logging
+	var step1DurationMs, step2DurationMs, endToEndDurationMs int64
+	if startTime, err := time.Parse(time.RFC3339Nano, message.Pipeline.StartTime); err == nil {
+		endToEndDurationMs = time.Since(startTime).Milliseconds()
+		if step1Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step1Complete); err == nil {
+			step1DurationMs = step1Time.Sub(startTime).Milliseconds()
+			if step2Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step2Complete); err == nil {
+				step2DurationMs = step2Time.Sub(step1Time).Milliseconds()
+			}
+		}
+	}
+
+	// The result is stored before anything else: if that fails, the message is left on the
+	// queue and processed again
+	result := pipelineResult{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusCompleted,
+		Data:          message.Data,
+		ErrorType:     message.ErrorType,
+		TraceID:       span.TraceID(),
+		Shard:         pipeline.ShardID,
+		CompletedAt:   time.Now(),
+		Step1Ms:       step1DurationMs,
+		Step2Ms:       step2DurationMs,
+		Step3Ms:       step3Duration.Milliseconds(),
+		EndToEndMs:    endToEndDurationMs,
+	}
+	result.StartTime, _ = time.Parse(time.RFC3339Nano, message.Pipeline.StartTime)
+	if err := saveResult(logCtx, result); err != nil {
+		span.SetTag("error", true)
+		span.SetTag("error.msg", err.Error())
+		pipeline.Logger.ErrorContext(logCtx, "Failed to store pipeline result, message will be redelivered",
+			"operation", "results_save",
+			"error", err)
+		pipeline.Classify(ctx, pipeline.OutcomeServerError, "result_store_failure")
+		return
+	}
+
 	// Calculate end-to-end pipeline duration
 	if startTime, err := time.Parse(time.RFC3339Nano, message.Pipeline.StartTime); err == nil {
 		endToEndDuration := time.Since(startTime)
-		statsdClient.Timing("business.pipeline.end_to_end.duration", endToEndDuration, []string{
-			"service:service3",
-			"shard:" + shardID,
-		}, 1)
+		pipeline.Metrics.Timing(pipeline.MetricEndToEndDuration, endToEndDuration)
 
 		// Calculate individual step durations from timestamps
 		if step1Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step1Complete); err == nil {
 			step1Duration := step1Time.Sub(startTime)
-			statsdClient.Timing("business.pipeline.step1.calculated_duration", step1Duration, []string{
-				"service:service3",
-				"shard:" + shardID,
-			}, 1)
+			pipeline.Metrics.Timing(pipeline.MetricStep1CalculatedDuration, step1Duration)
 
 			if step2Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step2Complete); err == nil {
 				step2Duration := step2Time.Sub(step1Time)
-				statsdClient.Timing("business.pipeline.step2.calculated_duration", step2Duration, []string{
-					"service:service3",
-					"shard:" + shardID,
-				}, 1)
+				pipeline.Metrics.Timing(pipeline.MetricStep2CalculatedDuration, step2Duration)
 			}
 		}
 	}
 
-	// SLI Metrics for SLO tracking
-	statsdClient.Incr("sli.processing.total", []string{
-		"service:service3",
-		"shard:" + shardID,
-		"operation:final_processing",
-	}, 1)
-	statsdClient.Incr("sli.processing.success", []string{
-		"service:service3",
-		"shard:" + shardID,
-		"operation:final_processing",
-	}, 1)
-	if step3Duration <= 60*time.Millisecond {
-		statsdClient.Incr("sli.latency.under_60ms", []string{
-			"service:service3",
-			"shard:" + shardID,
-		}, 1)
-	}
-	statsdClient.Timing("sli.processing_time", step3Duration, []string{
-		"service:service3",
-		"shard:" + shardID,
-		"operation:final_processing",
-	}, 1)
-
 	// End-to-end SLI metrics
 	if startTime, err := time.Parse(time.RFC3339Nano, message.Pipeline.StartTime); err == nil {
 		endToEndDuration := time.Since(startTime)
-		statsdClient.Incr("sli.pipeline.total", []string{
-			"pipeline:multi_service",
-			"shard:" + shardID,
-		}, 1)
-		statsdClient.Incr("sli.pipeline.success", []string{
-			"pipeline:multi_service",
-			"shard:" + shardID,
-		}, 1)
+		pipeline.SLOs.Observe(pipeline.SLOSourcePipeline, "end_to_end", pipeline.OutcomeSuccess, endToEndDuration)
+		pipeline.Metrics.Incr(pipeline.MetricPipelineTotal, pipeline.Tag("pipeline", "multi_service"))
+		pipeline.Metrics.Incr(pipeline.MetricPipelineSuccess, pipeline.Tag("pipeline", "multi_service"))
 		if endToEndDuration <= 300*time.Millisecond {
-			statsdClient.Incr("sli.pipeline.under_300ms", []string{
-				"pipeline:multi_service",
-				"shard:" + shardID,
-			}, 1)
+			pipeline.Metrics.Incr(pipeline.MetricPipelineUnder300ms, pipeline.Tag("pipeline", "multi_service"))
 		}
 		if endToEndDuration <= 1*time.Second {
-			statsdClient.Incr("sli.pipeline.under_1s", []string{
-				"pipeline:multi_service",
-				"shard:" + shardID,
-			}, 1)
+			pipeline.Metrics.Incr(pipeline.MetricPipelineUnder1s, pipeline.Tag("pipeline", "multi_service"))
 		}
-		statsdClient.Timing("sli.pipeline.duration", endToEndDuration, []string{
-			"pipeline:multi_service",
-			"shard:" + shardID,
-		}, 1)
+		pipeline.Metrics.Timing(pipeline.MetricPipelineDuration, endToEndDuration, pipeline.Tag("step", "end_to_end"))
 	}
 
 	// Business Metrics
-	statsdClient.Timing("business.pipeline.step3.duration", step3Duration, []string{
-		"service:service3",
-		"shard:" + shardID,
-	}, 1)
-	statsdClient.Incr("business.pipeline.messages.step3", []string{
-		"service:service3",
-		"shard:" + shardID,
-	}, 1)
-	statsdClient.Incr("business.pipeline.completed", []string{
-		"service:service3",
-		"shard:" + shardID,
-	}, 1)
-	statsdClient.Timing("sli.pipeline.duration", step3Duration, []string{
-		"service:service3",
-		"shard:" + shardID,
-		"step:3",
-	}, 1)
+	pipeline.Metrics.Timing(pipeline.MetricStep3Duration, step3Duration)
+	pipeline.Metrics.Incr(pipeline.MetricMessagesStep3)
+	pipeline.Metrics.Incr(pipeline.MetricPipelineCompleted)
+	pipeline.Metrics.Timing(pipeline.MetricPipelineDuration, step3Duration, pipeline.Tag("step", "3"))
 
 	// Delete message from queue
-	sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      &queueURL,
-		ReceiptHandle: msg.ReceiptHandle,
+	if err := pipeline.DeleteMessage(logCtx, queueURL, msg); err != nil {
+		pipeline.Logger.ErrorContext(logCtx, "Failed to delete processed message from step2 queue", "error", err)
+	}
+
+	pipeline.NotifyEvent(logCtx, message, pipeline.Event{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusCompleted,
+		Step:          3,
+		Service:       "service3",
+		Shard:         pipeline.ShardID,
+		StartTime:     message.Pipeline.StartTime,
+		DurationMs:    step3Duration.Milliseconds(),
+		EndToEndMs:    endToEndDurationMs,
+		Timestamp:     time.Now(),
 	})
 
-	// Calculate individual step durations for logging
-	var step1DurationMs, step2DurationMs, endToEndDurationMs int64
+	pipeline.Logger.InfoContext(logCtx, "Pipeline completed - Step3 finished",
+		"step1_duration_ms", step1DurationMs,
+		"step2_duration_ms", step2DurationMs,
+		"step3_duration_ms", step3Duration.Milliseconds(),
+		"end_to_end_duration_ms", endToEndDurationMs,
+		"pipeline_complete", true,
+		"message.data", message.Data,
+		"error.type", message.ErrorType,
+		"pipeline.start", message.Pipeline.StartTime,
+		"pipeline.step1", message.Pipeline.Step1Complete,
+		"pipeline.step2", message.Pipeline.Step2Complete)
+}
+
+// recordFailedPipeline stores the result of a pipeline an earlier step failed, which
+// reached service3 only for that. The failing step has already reported the failure.
+func recordFailedPipeline(ctx, logCtx context.Context, span pipeline.Span, msg types.Message, message pipeline.PipelineMessage, correlationID string) {
+	span.SetTag("pipeline.failed_step", message.FailedStep)
+	result := pipelineResult{
+		CorrelationID: correlationID,
+		Status:        pipeline.StatusFailed,
+		FailedStep:    message.FailedStep,
+		Data:          message.Data,
+		ErrorType:     message.ErrorType,
+		TraceID:       span.TraceID(),
+		Shard:         pipeline.ShardID,
+		CompletedAt:   time.Now(),
+	}
 	if startTime, err := time.Parse(time.RFC3339Nano, message.Pipeline.StartTime); err == nil {
-		endToEndDurationMs = time.Since(startTime).Milliseconds()
+		result.StartTime = startTime
 		if step1Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step1Complete); err == nil {
-			step1DurationMs = step1Time.Sub(startTime).Milliseconds()
-			if step2Time, err := time.Parse(time.RFC3339Nano, message.Pipeline.Step2Complete); err == nil {
-				step2DurationMs = step2Time.Sub(step1Time).Milliseconds()
-			}
+			result.Step1Ms = step1Time.Sub(startTime).Milliseconds()
 		}
 	}
+	if err := saveResult(logCtx, result); err != nil {
+		span.SetTag("error", true)
+		span.SetTag("error.msg", err.Error())
+		pipeline.Logger.ErrorContext(logCtx, "Failed to store pipeline result, message will be redelivered",
+			"operation", "results_save",
+			"error", err)
+		pipeline.Classify(ctx, pipeline.OutcomeServerError, "result_store_failure")
+		return
+	}
 
-	log.WithFields(log.Fields{
-		"dd.trace_id":            span.Context().TraceID(),
-		"correlation.id":         correlationID,
-		"service":                "service3",
-		"shard":                  shardID,
-		"pipeline.step":          3,
-		"step1_duration_ms":      step1DurationMs,
-		"step2_duration_ms":      step2DurationMs,
-		"step3_duration_ms":      step3Duration.Milliseconds(),
-		"end_to_end_duration_ms": endToEndDurationMs,
-		"pipeline_complete":      true,
-		"message.data":           message.Data,
-		"error.type":             message.ErrorType,
-		"pipeline.start":         message.Pipeline.StartTime,
-		"pipeline.step1":         message.Pipeline.Step1Complete,
-		"pipeline.step2":         message.Pipeline.Step2Complete,
-	}).Info("Pipeline completed - Step3 finished")
+	if err := pipeline.DeleteMessage(logCtx, queueURL, msg); err != nil {
+		pipeline.Logger.ErrorContext(logCtx, "Failed to delete recorded message from step2 queue", "error", err)
+	}
+	pipeline.Logger.InfoContext(logCtx, "Recorded failed pipeline",
+		"pipeline.failed_step", message.FailedStep,
+		"error.type", message.ErrorType)
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+// pipelineResult is the final outcome of a pipeline, saved by service3 and served on /results.
+// A failed pipeline has the step that failed it and the durations up to there; CompletedAt
+// is when service3 recorded it.
+type pipelineResult struct {
+	CorrelationID string    `json:"correlation_id"`
+	Status        string    `json:"status"` // completed or failed
+	FailedStep    int       `json:"failed_step,omitempty"`
+	Data          string    `json:"data"`
+	ErrorType     string    `json:"error_type,omitempty"`
+	TraceID       string    `json:"trace_id,omitempty"`
+	Shard         string    `json:"shard"`
+	StartTime     time.Time `json:"start_time"`
+	CompletedAt   time.Time `json:"completed_at"`
+	Step1Ms       int64     `json:"step1_duration_ms"`
+	Step2Ms       int64     `json:"step2_duration_ms"`
+	Step3Ms       int64     `json:"step3_duration_ms"`
+	EndToEndMs    int64     `json:"end_to_end_duration_ms"`
+}
+
+// resultQuery filters and pages results, newest first
+type resultQuery struct {
+	CorrelationID string
+	Status        string
+	ErrorType     string
+	Since         time.Time // completed at or after
+	Until         time.Time // completed before
+	MinDurationMs int64     // end to end
+	Limit         int
+	After         *resultCursor
+}
+
+// resultCursor is the position after the last result of a page
+type resultCursor struct {
+	CompletedAt   time.Time
+	CorrelationID string
+}
+
+type resultPage struct {
+	Results    []pipelineResult `json:"results"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// resultStore persists pipeline results. A result saved again for the same correlation ID,
+// as a redelivered message is, replaces the previous one.
+type resultStore interface {
+	save(ctx context.Context, result pipelineResult) error
+	query(ctx context.Context, q resultQuery) ([]pipelineResult, error)
+	// purge deletes the results completed before cutoff and returns how many
+	purge(ctx context.Context, cutoff time.Time) (int64, error)
+	Close() error
+}
+
+const (
+	defaultResultsLimit = 50
+	maxResultsLimit     = 500
+)
+
+// results is nil when RESULTS_STORE is none
+var results resultStore
+
+// resultsSaveRetry retries a failed write of a result before its message is left to be redelivered
+var resultsSaveRetry = pipeline.NewRetryPolicy("results_save", 3, 100*time.Millisecond, 2*time.Second)
+
+// newResultStore picks the store from the environment:
+//
+//	RESULTS_STORE        sqlite (default), memory or none
+//	RESULTS_DB_PATH      SQLite file (default service3-<shard>-results.db)
+//	RESULTS_MAX_ENTRIES  results kept by the memory store (default 10000)
+func newResultStore() (resultStore, error) {
+	switch kind := os.Getenv("RESULTS_STORE"); kind {
+	case "", "sqlite":
+		path := os.Getenv("RESULTS_DB_PATH")
+		if path == "" {
+			path = fmt.Sprintf("service3-%s-results.db", pipeline.ShardID)
+		}
+		store, err := openSQLiteResultStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "memory":
+		return newMemoryResultStore(pipeline.EnvInt("RESULTS_MAX_ENTRIES", 10000)), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown RESULTS_STORE %q, expected sqlite, memory or none", kind)
+	}
+}
+
+// saveResult stores the result, retrying failed writes and counting those that still fail
+func saveResult(ctx context.Context, result pipelineResult) error {
+	if results == nil {
+		return nil
+	}
+	err := resultsSaveRetry.Do(ctx, func(ctx context.Context) error {
+		storeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := results.save(storeCtx, result); err != nil {
+			// A busy or locked database clears up; the store has no errors a retry cannot fix
+			return fmt.Errorf("%w: %v", pipeline.ErrTransient, err)
+		}
+		return nil
+	})
+	if err != nil {
+		pipeline.Metrics.Incr(pipeline.MetricResultsStoreErrors, pipeline.Tag("operation", "save"))
+		return err
+	}
+	pipeline.Metrics.Incr(pipeline.MetricResultsStored)
+	return nil
+}
+
+// purgeResults deletes results older than RESULTS_RETENTION (default 168h, 0 keeps them)
+// every hour until ctx is done
+func purgeResults(ctx context.Context) {
+	retention := pipeline.EnvDuration("RESULTS_RETENTION", 7*24*time.Hour)
+	if results == nil || retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		n, err := results.purge(ctx, time.Now().Add(-retention))
+		if err != nil {
+			pipeline.Metrics.Incr(pipeline.MetricResultsStoreErrors, pipeline.Tag("operation", "purge"))
+			pipeline.Logger.ErrorContext(ctx, "Failed to purge old pipeline results", "operation", "results_purge", "error", err)
+		} else if n > 0 {
+			pipeline.Logger.InfoContext(ctx, "Purged old pipeline results", "operation", "results_purge", "results", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resultsHandler serves GET /results. Query parameters, all optional:
+//
+//	correlation_id   one pipeline
+//	status           completed or failed pipelines
+//	error_type       pipelines that carried this error type
+//	since, until     completion time range, RFC 3339
+//	min_duration_ms  pipelines at least this slow end to end
+//	limit            page size (default 50, at most 500)
+//	cursor           next_cursor of the previous page
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if results == nil {
+		http.Error(w, "Results store is not configured", http.StatusNotFound)
+		return
+	}
+	q, err := parseResultQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One more than the page tells whether there is a next page
+	limit := q.Limit
+	q.Limit++
+	found, err := results.query(r.Context(), q)
+	if err != nil {
+		pipeline.Metrics.Incr(pipeline.MetricResultsStoreErrors, pipeline.Tag("operation", "query"))
+		pipeline.Logger.ErrorContext(r.Context(), "Failed to query pipeline results", "operation", "results_query", "error", err)
+		http.Error(w, "Failed to query results", http.StatusInternalServerError)
+		return
+	}
+	page := resultPage{Results: found}
+	if len(found) > limit {
+		page.Results = found[:limit]
+		last := page.Results[limit-1]
+		page.NextCursor = encodeResultCursor(resultCursor{CompletedAt: last.CompletedAt, CorrelationID: last.CorrelationID})
+	}
+	if page.Results == nil {
+		page.Results = []pipelineResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseResultQuery(r *http.Request) (resultQuery, error) {
+	params := r.URL.Query()
+	q := resultQuery{
+		CorrelationID: params.Get("correlation_id"),
+		Status:        params.Get("status"),
+		ErrorType:     params.Get("error_type"),
+		Limit:         defaultResultsLimit,
+	}
+	if q.Status != "" && q.Status != pipeline.StatusCompleted && q.Status != pipeline.StatusFailed {
+		return q, errors.New("status must be completed or failed")
+	}
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return q, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return q, errors.New("until must be an RFC 3339 time")
+		}
+	}
+	if v := params.Get("min_duration_ms"); v != "" {
+		if q.MinDurationMs, err = strconv.ParseInt(v, 10, 64); err != nil || q.MinDurationMs < 0 {
+			return q, errors.New("min_duration_ms must be a non-negative integer")
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxResultsLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxResultsLimit)
+		}
+	}
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := decodeResultCursor(v)
+		if err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		q.After = &cursor
+	}
+	return q, nil
+}
+
+// The cursor is opaque to clients: base64 of "<completed_at unix nanos>:<correlation_id>"
+func encodeResultCursor(c resultCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.CompletedAt.UnixNano(), 10) + ":" + c.CorrelationID))
+}
+
+func decodeResultCursor(s string) (resultCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return resultCursor{}, err
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return resultCursor{}, errors.New("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return resultCursor{}, err
+	}
+	return resultCursor{CompletedAt: time.Unix(0, n), CorrelationID: id}, nil
+}
+
+// before reports whether the cursor comes before r in newest-first order, so r belongs
+// to the following pages
+func (c *resultCursor) before(r pipelineResult) bool {
+	if c == nil {
+		return true
+	}
+	if !r.CompletedAt.Equal(c.CompletedAt) {
+		return r.CompletedAt.Before(c.CompletedAt)
+	}
+	return r.CorrelationID < c.CorrelationID
+}
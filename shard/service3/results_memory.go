@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryResultStore keeps the newest results in memory, lost on restart
+type memoryResultStore struct {
+	maxEntries int
+
+	mu   sync.Mutex
+	byID map[string]pipelineResult
+}
+
+func newMemoryResultStore(maxEntries int) *memoryResultStore {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &memoryResultStore{maxEntries: maxEntries, byID: make(map[string]pipelineResult)}
+}
+
+func (s *memoryResultStore) save(ctx context.Context, result pipelineResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[result.CorrelationID] = result
+	if len(s.byID) > s.maxEntries {
+		// Evicting is a scan, done in bulk to keep it rare
+		sorted := s.sorted()
+		for _, r := range sorted[s.maxEntries*9/10:] {
+			delete(s.byID, r.CorrelationID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryResultStore) query(ctx context.Context, q resultQuery) ([]pipelineResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []pipelineResult
+	for _, r := range s.sorted() {
+		if len(found) == q.Limit {
+			break
+		}
+		if q.After.before(r) && matchesResultQuery(q, r) {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryResultStore) purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, r := range s.byID {
+		if r.CompletedAt.Before(cutoff) {
+			delete(s.byID, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryResultStore) Close() error {
+	return nil
+}
+
+// sorted lists the results newest first, called with s.mu held
+func (s *memoryResultStore) sorted() []pipelineResult {
+	all := make([]pipelineResult, 0, len(s.byID))
+	for _, r := range s.byID {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].CompletedAt.Equal(all[j].CompletedAt) {
+			return all[i].CompletedAt.After(all[j].CompletedAt)
+		}
+		return all[i].CorrelationID > all[j].CorrelationID
+	})
+	return all
+}
+
+func matchesResultQuery(q resultQuery, r pipelineResult) bool {
+	switch {
+	case q.CorrelationID != "" && r.CorrelationID != q.CorrelationID:
+		return false
+	case q.Status != "" && r.Status != q.Status:
+		return false
+	case q.ErrorType != "" && r.ErrorType != q.ErrorType:
+		return false
+	case !q.Since.IsZero() && r.CompletedAt.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !r.CompletedAt.Before(q.Until):
+		return false
+	case r.EndToEndMs < q.MinDurationMs:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteResultStore keeps results in a SQLite file. Times are stored as Unix nanoseconds,
+// so they sort and compare as integers.
+type sqliteResultStore struct {
+	db *sql.DB
+}
+
+const sqliteResultsSchema = `
+CREATE TABLE IF NOT EXISTS pipeline_results (
+	correlation_id  TEXT PRIMARY KEY,
+	status          TEXT NOT NULL DEFAULT 'completed',
+	failed_step     INTEGER NOT NULL DEFAULT 0,
+	data            TEXT NOT NULL,
+	error_type      TEXT NOT NULL DEFAULT '',
+	trace_id        TEXT NOT NULL DEFAULT '',
+	shard           TEXT NOT NULL,
+	start_time      INTEGER NOT NULL,
+	completed_at    INTEGER NOT NULL,
+	step1_ms        INTEGER NOT NULL,
+	step2_ms        INTEGER NOT NULL,
+	step3_ms        INTEGER NOT NULL,
+	end_to_end_ms   INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS pipeline_results_completed ON pipeline_results (completed_at DESC, correlation_id DESC);
+`
+
+func openSQLiteResultStore(path string) (*sqliteResultStore, error) {
+	// WAL lets /results read while the consumer writes; writers wait on each other
+	// instead of failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open results store %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteResultsSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize results store %s: %w", path, err)
+	}
+	return &sqliteResultStore{db: db}, nil
+}
+
+func (s *sqliteResultStore) save(ctx context.Context, r pipelineResult) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO pipeline_results
+			(correlation_id, status, failed_step, data, error_type, trace_id, shard, start_time, completed_at,
+			 step1_ms, step2_ms, step3_ms, end_to_end_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.CorrelationID, r.Status, r.FailedStep, r.Data, r.ErrorType, r.TraceID, r.Shard, r.StartTime.UnixNano(), r.CompletedAt.UnixNano(),
+		r.Step1Ms, r.Step2Ms, r.Step3Ms, r.EndToEndMs)
+	return err
+}
+
+func (s *sqliteResultStore) query(ctx context.Context, q resultQuery) ([]pipelineResult, error) {
+	var where []string
+	var args []interface{}
+	if q.CorrelationID != "" {
+		where, args = append(where, "correlation_id = ?"), append(args, q.CorrelationID)
+	}
+	if q.Status != "" {
+		where, args = append(where, "status = ?"), append(args, q.Status)
+	}
+	if q.ErrorType != "" {
+		where, args = append(where, "error_type = ?"), append(args, q.ErrorType)
+	}
+	if !q.Since.IsZero() {
+		where, args = append(where, "completed_at >= ?"), append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where, args = append(where, "completed_at < ?"), append(args, q.Until.UnixNano())
+	}
+	if q.MinDurationMs > 0 {
+		where, args = append(where, "end_to_end_ms >= ?"), append(args, q.MinDurationMs)
+	}
+	if q.After != nil {
+		where = append(where, "(completed_at < ? OR (completed_at = ? AND correlation_id < ?))")
+		nanos := q.After.CompletedAt.UnixNano()
+		args = append(args, nanos, nanos, q.After.CorrelationID)
+	}
+	query := `SELECT correlation_id, status, failed_step, data, error_type, trace_id, shard, start_time, completed_at,
+		step1_ms, step2_ms, step3_ms, end_to_end_ms FROM pipeline_results`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY completed_at DESC, correlation_id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []pipelineResult
+	for rows.Next() {
+		var r pipelineResult
+		var start, completed int64
+		if err := rows.Scan(&r.CorrelationID, &r.Status, &r.FailedStep, &r.Data, &r.ErrorType, &r.TraceID, &r.Shard, &start, &completed,
+			&r.Step1Ms, &r.Step2Ms, &r.Step3Ms, &r.EndToEndMs); err != nil {
+			return nil, err
+		}
+		r.StartTime, r.CompletedAt = time.Unix(0, start).UTC(), time.Unix(0, completed).UTC()
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
+
+func (s *sqliteResultStore) purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM pipeline_results WHERE completed_at < ?", cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqliteResultStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pipeline-shard/internal/pipeline"
+)
+
+var resultsEpoch = time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC)
+
+func testResult(id string, completedAfter time.Duration) pipelineResult {
+	return pipelineResult{
+		CorrelationID: id,
+		Status:        pipeline.StatusCompleted,
+		Data:          "data " + id,
+		Shard:         "shard-test",
+		StartTime:     resultsEpoch,
+		CompletedAt:   resultsEpoch.Add(completedAfter),
+	}
+}
+
+// testResultStores opens one of each store for a test
+func testResultStores(t *testing.T) map[string]resultStore {
+	t.Helper()
+	sqliteStore, err := openSQLiteResultStore(filepath.Join(t.TempDir(), "results.db"))
+	if err != nil {
+		t.Fatalf("opening the SQLite store: %v", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+	return map[string]resultStore{
+		"memory": newMemoryResultStore(1000),
+		"sqlite": sqliteStore,
+	}
+}
+
+// pageAll follows the cursors of q to the last page and returns the correlation IDs in order
+func pageAll(t *testing.T, store resultStore, q resultQuery) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("paging does not end")
+		}
+		// As resultsHandler does, one more than the page tells whether there is a next one
+		limit := q.Limit
+		q.Limit++
+		found, err := store.query(context.Background(), q)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		q.Limit = limit
+		if len(found) <= limit {
+			for _, r := range found {
+				ids = append(ids, r.CorrelationID)
+			}
+			return ids
+		}
+		for _, r := range found[:limit] {
+			ids = append(ids, r.CorrelationID)
+		}
+		last := found[limit-1]
+		cursor, err := decodeResultCursor(encodeResultCursor(resultCursor{CompletedAt: last.CompletedAt, CorrelationID: last.CorrelationID}))
+		if err != nil {
+			t.Fatalf("decoding a cursor: %v", err)
+		}
+		q.After = &cursor
+	}
+}
+
+func TestResultsPagingAcrossEqualCompletionTimes(t *testing.T) {
+	for name, store := range testResultStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// Five results share one completion time, more than fit on a page
+			for _, r := range []pipelineResult{
+				testResult("a", time.Second),
+				testResult("c", 2*time.Second),
+				testResult("e", 2*time.Second),
+				testResult("b", 2*time.Second),
+				testResult("f", 2*time.Second),
+				testResult("d", 2*time.Second),
+				testResult("g", 3*time.Second),
+			} {
+				if err := store.save(context.Background(), r); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+			}
+			for _, limit := range []int{1, 2, 3, 7, 10} {
+				got := strings.Join(pageAll(t, store, resultQuery{Limit: limit}), "")
+				if got != "gfedcba" {
+					t.Errorf("limit %d: paged %s, want gfedcba", limit, got)
+				}
+			}
+		})
+	}
+}
+
+func TestResultsQueryFilters(t *testing.T) {
+	failed := testResult("failed", 4*time.Second)
+	failed.Status, failed.FailedStep, failed.ErrorType = pipeline.StatusFailed, 2, "invalid_data"
+	slow := testResult("slow", 2*time.Second)
+	slow.EndToEndMs = 900
+	saved := []pipelineResult{testResult("early", time.Second), slow, testResult("late", 3*time.Second), failed}
+
+	tests := []struct {
+		name string
+		q    resultQuery
+		want string
+	}{
+		{"all", resultQuery{}, "failed late slow early"},
+		{"correlation ID", resultQuery{CorrelationID: "slow"}, "slow"},
+		{"failed", resultQuery{Status: pipeline.StatusFailed}, "failed"},
+		{"completed", resultQuery{Status: pipeline.StatusCompleted}, "late slow early"},
+		{"error type", resultQuery{ErrorType: "invalid_data"}, "failed"},
+		{"since is inclusive", resultQuery{Since: resultsEpoch.Add(2 * time.Second)}, "failed late slow"},
+		{"until is exclusive", resultQuery{Until: resultsEpoch.Add(2 * time.Second)}, "early"},
+		{"min duration", resultQuery{MinDurationMs: 500}, "slow"},
+		{"after a cursor", resultQuery{After: &resultCursor{CompletedAt: failed.CompletedAt, CorrelationID: "failed"}}, "late slow early"},
+	}
+	for name, store := range testResultStores(t) {
+		for _, r := range saved {
+			if err := store.save(context.Background(), r); err != nil {
+				t.Fatalf("%s: save: %v", name, err)
+			}
+		}
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				tt.q.Limit = 10
+				found, err := store.query(context.Background(), tt.q)
+				if err != nil {
+					t.Fatalf("query: %v", err)
+				}
+				var ids []string
+				for _, r := range found {
+					ids = append(ids, r.CorrelationID)
+				}
+				if got := strings.Join(ids, " "); got != tt.want {
+					t.Errorf("found %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestResultsRoundTrip(t *testing.T) {
+	want := testResult("c-1", time.Second)
+	want.Status, want.FailedStep, want.ErrorType, want.TraceID = pipeline.StatusFailed, 2, "invalid_data", "trace-1"
+	want.Step1Ms, want.Step2Ms, want.Step3Ms, want.EndToEndMs = 1, 2, 3, 6
+	for name, store := range testResultStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// A redelivered message replaces the earlier result
+			if err := store.save(context.Background(), testResult("c-1", 0)); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			if err := store.save(context.Background(), want); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			found, err := store.query(context.Background(), resultQuery{Limit: 10})
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if len(found) != 1 {
+				t.Fatalf("found %d results, want 1", len(found))
+			}
+			got := found[0]
+			if !got.StartTime.Equal(want.StartTime) || !got.CompletedAt.Equal(want.CompletedAt) {
+				t.Errorf("times = %s, %s, want %s, %s", got.StartTime, got.CompletedAt, want.StartTime, want.CompletedAt)
+			}
+			got.StartTime, got.CompletedAt = want.StartTime, want.CompletedAt
+			if got != want {
+				t.Errorf("result = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestResultsPurge(t *testing.T) {
+	for name, store := range testResultStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, r := range []pipelineResult{testResult("old", 0), testResult("cutoff", time.Hour), testResult("new", 2*time.Hour)} {
+				if err := store.save(context.Background(), r); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+			}
+			n, err := store.purge(context.Background(), resultsEpoch.Add(time.Hour))
+			if err != nil || n != 1 {
+				t.Fatalf("purge = %d, %v, want 1 result", n, err)
+			}
+			if got := strings.Join(pageAll(t, store, resultQuery{Limit: 10}), " "); got != "new cutoff" {
+				t.Errorf("kept %q, want %q", got, "new cutoff")
+			}
+		})
+	}
+}
+
+func TestMemoryResultStoreEviction(t *testing.T) {
+	store := newMemoryResultStore(10)
+	for i := range 11 {
+		store.save(context.Background(), testResult(string(rune('a'+i)), time.Duration(i)*time.Second))
+	}
+	// Past the limit, the oldest are evicted down to 90% of it
+	if got := strings.Join(pageAll(t, store, resultQuery{Limit: 20}), ""); got != "kjihgfedc" {
+		t.Errorf("kept %s, want the 9 newest, kjihgfedc", got)
+	}
+	// Saving again under the limit evicts nothing
+	store.save(context.Background(), testResult("l", 11*time.Second))
+	if n := len(pageAll(t, store, resultQuery{Limit: 20})); n != 10 {
+		t.Errorf("kept %d results, want 10", n)
+	}
+}
+
+func TestResultCursor(t *testing.T) {
+	c := resultCursor{CompletedAt: time.Unix(1_736_935_200, 123456789), CorrelationID: "5f0c:with-colon"}
+	got, err := decodeResultCursor(encodeResultCursor(c))
+	if err != nil || !got.CompletedAt.Equal(c.CompletedAt) || got.CorrelationID != c.CorrelationID {
+		t.Errorf("round trip = %+v, %v, want %+v", got, err, c)
+	}
+
+	for _, invalid := range []string{"not base64!", "bm9jb2xvbg", "eDp4"} { // "nocolon", "x:x"
+		if _, err := decodeResultCursor(invalid); err == nil {
+			t.Errorf("decodeResultCursor(%q) accepted an invalid cursor", invalid)
+		}
+	}
+}
+
+func TestResultCursorBefore(t *testing.T) {
+	at := resultsEpoch.Add(time.Second)
+	c := &resultCursor{CompletedAt: at, CorrelationID: "m"}
+	tests := []struct {
+		name string
+		r    pipelineResult
+		want bool
+	}{
+		{"older", pipelineResult{CompletedAt: at.Add(-time.Nanosecond), CorrelationID: "z"}, true},
+		{"newer", pipelineResult{CompletedAt: at.Add(time.Nanosecond), CorrelationID: "a"}, false},
+		{"same time, lower ID", pipelineResult{CompletedAt: at, CorrelationID: "l"}, true},
+		{"same time, higher ID", pipelineResult{CompletedAt: at, CorrelationID: "n"}, false},
+		{"the cursor's own result", pipelineResult{CompletedAt: at, CorrelationID: "m"}, false},
+	}
+	for _, tt := range tests {
+		if got := c.before(tt.r); got != tt.want {
+			t.Errorf("%s: before = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	var first *resultCursor
+	if !first.before(pipelineResult{CompletedAt: at}) {
+		t.Error("no cursor excludes a result")
+	}
+}
+
+func TestParseResultQuery(t *testing.T) {
+	cursor := encodeResultCursor(resultCursor{CompletedAt: resultsEpoch, CorrelationID: "c-1"})
+	tests := []struct {
+		query     string
+		wantLimit int
+		wantErr   bool
+	}{
+		{"", defaultResultsLimit, false},
+		{"limit=1", 1, false},
+		{"limit=500", 500, false},
+		{"limit=0", 0, true},
+		{"limit=501", 0, true},
+		{"limit=-1", 0, true},
+		{"limit=ten", 0, true},
+		{"cursor=" + cursor, defaultResultsLimit, false},
+		{"cursor=not-a-cursor", 0, true},
+		{"cursor=", defaultResultsLimit, false},
+		{"status=failed", defaultResultsLimit, false},
+		{"status=completed", defaultResultsLimit, false},
+		{"status=dropped", 0, true},
+		{"since=2025-01-15T10:00:00Z&until=2025-01-15T11:00:00.5Z", defaultResultsLimit, false},
+		{"since=yesterday", 0, true},
+		{"min_duration_ms=-5", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseResultQuery(httptest.NewRequest("GET", "/results?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && q.Limit != tt.wantLimit {
+				t.Errorf("limit = %d, want %d", q.Limit, tt.wantLimit)
+			}
+		})
+	}
+
+	q, _ := parseResultQuery(httptest.NewRequest("GET", "/results?cursor="+cursor, nil))
+	if q.After == nil || q.After.CorrelationID != "c-1" || !q.After.CompletedAt.Equal(resultsEpoch) {
+		t.Errorf("cursor = %+v, want the position after c-1", q.After)
+	}
+}